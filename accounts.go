@@ -0,0 +1,716 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Optional user accounts, turned on with ACCOUNTS=local (username and
+// password), ACCOUNTS=oidc (an OpenID Connect provider) or both. Signed-in
+// users own the files they upload and can list, extend and delete them.
+// Sessions are HS256 JWTs, kept in a cookie for the browser or sent as
+// "Authorization: Bearer <token>" by scripts.
+
+const (
+	sessionCookieName   = "bashupload_session"
+	oidcStateCookieName = "bashupload_oidc_state"
+	minPasswordLength   = 8
+)
+
+var (
+	accountsLocal    bool
+	accountsOIDC     bool
+	registrationOpen bool
+	jwtSecret        []byte
+	sessionTTL       time.Duration
+
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+	oidcScopes       string
+)
+
+// User is an account. Local accounts have a password hash, OIDC accounts the
+// provider's subject identifier.
+type User struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	Username     string     `json:"username" gorm:"uniqueIndex;not null"`
+	Email        string     `json:"email,omitempty"`
+	PasswordHash string     `json:"-"`
+	OIDCSubject  string     `json:"-" gorm:"index"`
+	CreatedAt    time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	LastLoginAt  *time.Time `json:"last_login_at,omitempty"`
+}
+
+func accountsEnabled() bool {
+	return accountsLocal || accountsOIDC
+}
+
+// loadAccountsConfig reads ACCOUNTS, REGISTRATION_OPEN, JWT_SECRET, SESSION_TTL
+// and the OIDC_* settings.
+func loadAccountsConfig() {
+	accountsLocal, accountsOIDC = false, false
+	for _, mode := range splitList(strings.ToLower(getEnv("ACCOUNTS", ""))) {
+		switch mode {
+		case "local":
+			accountsLocal = true
+		case "oidc":
+			accountsOIDC = true
+		case "off":
+		default:
+			log.Printf("Unknown ACCOUNTS mode '%s' (expected local, oidc or off)", mode)
+		}
+	}
+	if !accountsEnabled() {
+		return
+	}
+
+	registrationOpen = getEnv("REGISTRATION_OPEN", "false") == "true"
+
+	if secret := getEnv("JWT_SECRET", ""); secret != "" {
+		jwtSecret = []byte(secret)
+	} else {
+		jwtSecret = make([]byte, 32)
+		rand.Read(jwtSecret)
+		log.Printf("JWT_SECRET is not set, sessions will not survive a restart")
+	}
+
+	ttlStr := getEnv("SESSION_TTL", "7D")
+	var err error
+	sessionTTL, err = parseDuration(ttlStr)
+	if err != nil || sessionTTL <= 0 {
+		log.Printf("Invalid SESSION_TTL value '%s', using default 7 days", ttlStr)
+		sessionTTL = 7 * 24 * time.Hour
+	}
+
+	if accountsOIDC {
+		oidcIssuer = strings.TrimRight(getEnv("OIDC_ISSUER", ""), "/")
+		oidcClientID = getEnv("OIDC_CLIENT_ID", "")
+		oidcClientSecret = getEnv("OIDC_CLIENT_SECRET", "")
+		oidcRedirectURL = getEnv("OIDC_REDIRECT_URL", "")
+		oidcScopes = getEnv("OIDC_SCOPES", "openid email profile")
+		if oidcIssuer == "" || oidcClientID == "" {
+			log.Printf("OIDC_ISSUER and OIDC_CLIENT_ID are required for ACCOUNTS=oidc, OIDC login disabled")
+			accountsOIDC = false
+		}
+	}
+
+	var modes []string
+	if accountsLocal {
+		modes = append(modes, "local")
+	}
+	if accountsOIDC {
+		modes = append(modes, "OIDC ("+oidcIssuer+")")
+	}
+	log.Printf("User accounts enabled: %s, registration %s", strings.Join(modes, " and "),
+		map[bool]string{true: "open", false: "closed"}[registrationOpen])
+}
+
+func setupAccountRoutes(api fiber.Router) {
+	if !accountsEnabled() {
+		return
+	}
+
+	auth := api.Group("/auth")
+	auth.Post("/register", handleRegister)
+	auth.Post("/login", handleLogin)
+	auth.Post("/logout", handleLogout)
+	auth.Get("/me", requireUser, handleMe)
+
+	my := api.Group("/my", requireUser)
+	my.Get("/files", handleMyFiles)
+	my.Delete("/files/:id", handleMyDeleteFile)
+	my.Post("/files/:id/extend", handleMyExtendFile)
+}
+
+func setupOIDCRoutes(app *fiber.App) {
+	if !accountsEnabled() {
+		return
+	}
+
+	app.Get("/auth/oidc/login", handleOIDCLogin)
+	app.Get("/auth/oidc/callback", handleOIDCCallback)
+}
+
+// Sessions
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type sessionClaims struct {
+	Subject   string `json:"sub"`
+	Name      string `json:"name"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func signJWT(payload []byte) string {
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSessionToken returns a session token for user and when it expires.
+func newSessionToken(user *User) (string, time.Time) {
+	now := time.Now()
+	expiresAt := now.Add(sessionTTL)
+	payload, _ := json.Marshal(sessionClaims{
+		Subject:   strconv.FormatUint(uint64(user.ID), 10),
+		Name:      user.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	return signJWT(payload), expiresAt
+}
+
+// parseSessionToken checks a session token's signature and expiry and
+// returns the user ID it was issued for. Only our own HS256 header is
+// accepted, so the token can't pick a weaker algorithm.
+func parseSessionToken(token string) (uint, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return 0, errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return 0, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, err
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return 0, errors.New("token expired")
+	}
+	id, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
+
+// currentUser returns the signed-in user of the request, or nil. The result
+// is kept for the rest of the request.
+func currentUser(c *fiber.Ctx) *User {
+	if !accountsEnabled() {
+		return nil
+	}
+	if user, ok := c.Locals("user").(*User); ok {
+		return user
+	}
+	// An upload token issued to a user stands for them
+	if strings.HasPrefix(providedAPIKey(c), uploadTokenPrefix) && requestAPIKey(c) != nil {
+		if user, ok := c.Locals("user").(*User); ok {
+			return user
+		}
+	}
+
+	var user *User
+	token := c.Cookies(sessionCookieName)
+	if bearer := strings.TrimPrefix(c.Get("Authorization"), "Bearer "); strings.Count(bearer, ".") == 2 {
+		token = bearer
+	}
+	if token != "" {
+		if id, err := parseSessionToken(token); err == nil {
+			var found User
+			if result := db.First(&found, id); result.Error == nil {
+				user = &found
+			}
+		}
+	}
+	c.Locals("user", user)
+	return user
+}
+
+// currentUserID is the owner to record on a new upload.
+func currentUserID(c *fiber.Ctx) *uint {
+	if user := currentUser(c); user != nil {
+		return &user.ID
+	}
+	return nil
+}
+
+func requireUser(c *fiber.Ctx) error {
+	if currentUser(c) == nil {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Sign in required",
+		})
+	}
+	return c.Next()
+}
+
+// startSession signs user in: it records the login and sets the session
+// cookie. The token is returned for clients that don't keep cookies.
+func startSession(c *fiber.Ctx, user *User) (string, time.Time) {
+	now := time.Now()
+	db.Model(user).Update("last_login_at", now)
+
+	token, expiresAt := newSessionToken(user)
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		// Lax so the cookie survives the redirect back from the OIDC provider
+		SameSite: fiber.CookieSameSiteLaxMode,
+		Expires:  expiresAt,
+	})
+	return token, expiresAt
+}
+
+// Local accounts
+
+type credentials struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	Email    string `json:"email" form:"email"`
+}
+
+// validateNewUser checks the fields of a new local account.
+func validateNewUser(req *credentials) error {
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+	if len(req.Username) < 3 || len(req.Username) > 64 {
+		return errors.New("Username must be 3 to 64 characters")
+	}
+	for _, r := range req.Username {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-@", r)) {
+			return errors.New("Username may only contain letters, digits and . _ - @")
+		}
+	}
+	if len(req.Password) < minPasswordLength {
+		return fmt.Errorf("Password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+// createLocalUser stores a new local account.
+func createLocalUser(req credentials) (*User, error) {
+	if err := validateNewUser(&req); err != nil {
+		return nil, err
+	}
+	var existing int64
+	db.Model(&User{}).Where("username = ?", req.Username).Count(&existing)
+	if existing > 0 {
+		return nil, errors.New("Username is already taken")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	user := User{Username: req.Username, Email: req.Email, PasswordHash: string(hash)}
+	if result := db.Create(&user); result.Error != nil {
+		return nil, result.Error
+	}
+	return &user, nil
+}
+
+func handleRegister(c *fiber.Ctx) error {
+	if !accountsLocal || !registrationOpen {
+		return c.Status(403).JSON(fiber.Map{
+			"success": false,
+			"message": "Registration is closed",
+		})
+	}
+
+	var req credentials
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"success": false, "message": "Invalid request body"})
+	}
+	user, err := createLocalUser(req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+	log.Printf("User %s registered", user.Username)
+
+	token, expiresAt := startSession(c, user)
+	return c.Status(201).JSON(fiber.Map{
+		"success":    true,
+		"user":       user,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+func handleLogin(c *fiber.Ctx) error {
+	if !accountsLocal {
+		return c.Status(404).JSON(fiber.Map{"success": false, "message": "Password login is disabled"})
+	}
+
+	var req credentials
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"success": false, "message": "Invalid request body"})
+	}
+
+	var user User
+	result := db.Where("username = ?", strings.TrimSpace(req.Username)).First(&user)
+	if result.Error != nil || user.PasswordHash == "" ||
+		bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		audit(c, auditAuthFailure, "", "sign-in as "+strings.TrimSpace(req.Username))
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid username or password",
+		})
+	}
+
+	token, expiresAt := startSession(c, &user)
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"user":       user,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+func handleLogout(c *fiber.Ctx) error {
+	c.ClearCookie(sessionCookieName)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Signed out",
+	})
+}
+
+func handleMe(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success": true,
+		"user":    currentUser(c),
+	})
+}
+
+// Own files
+
+// handleMyFiles lists the signed-in user's files, with the filters, sorting
+// and paging of listFiles.
+func handleMyFiles(c *fiber.Ctx) error {
+	return listFiles(c, db.Model(&FileRecord{}).Where("user_id = ?", currentUser(c).ID), 500)
+}
+
+// ownFile loads one of the signed-in user's files.
+func ownFile(c *fiber.Ctx) (*FileRecord, error) {
+	var fileRecord FileRecord
+	result := db.Where("unique_id = ? AND user_id = ?", c.Params("id"), currentUser(c).ID).First(&fileRecord)
+	if result.Error != nil {
+		return nil, c.Status(404).JSON(fiber.Map{"success": false, "message": "File not found"})
+	}
+	logFileID(c, fileRecord.UniqueID)
+	return &fileRecord, nil
+}
+
+func handleMyDeleteFile(c *fiber.Ctx) error {
+	fileRecord, err := ownFile(c)
+	if fileRecord == nil {
+		return err
+	}
+
+	if err := removeFile(fileRecord, "owner"); err != nil {
+		requestLog(c).Error("Failed to delete file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": "Failed to delete file"})
+	}
+	requestLog(c).Info("File deleted by owner", "file_id", fileRecord.UniqueID)
+	audit(c, auditDelete, fileRecord.UniqueID, "owner")
+	sendWebhook(c, webhookDeleted, fileRecord, "owner")
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "File deleted",
+	})
+}
+
+// handleMyExtendFile sets a new expiry counted from now: {"expires": "7D"},
+// capped like an expiry chosen at upload time.
+func handleMyExtendFile(c *fiber.Ctx) error {
+	var req struct {
+		Expires string `json:"expires" form:"expires"`
+	}
+	c.BodyParser(&req)
+	if req.Expires == "" {
+		return c.Status(400).JSON(fiber.Map{"success": false, "message": "expires is required"})
+	}
+
+	fileRecord, respErr := ownFile(c)
+	if fileRecord == nil {
+		return respErr
+	}
+	expiresAt, err := resolveExpiry(req.Expires, fileRecord.FileSize)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"success": false, "message": fmt.Sprintf("Invalid expiration '%s'", req.Expires)})
+	}
+	db.Model(fileRecord).Update("expires_at", expiresAt)
+	fileRecord.ExpiresAt = expiresAt
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    fileRecord,
+	})
+}
+
+// OpenID Connect
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+var (
+	oidcMu       sync.Mutex
+	oidcEndpoint *oidcProvider
+	oidcClient   = &http.Client{Timeout: 15 * time.Second}
+)
+
+// oidcDiscover fetches the provider's endpoints on first use, so a provider
+// that is down at startup doesn't keep the server from starting.
+func oidcDiscover() (*oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcEndpoint != nil {
+		return oidcEndpoint, nil
+	}
+
+	resp, err := oidcClient.Get(oidcIssuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("discovery answered %s", resp.Status)
+	}
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.UserinfoEndpoint == "" {
+		return nil, errors.New("discovery document lacks the authorization, token or userinfo endpoint")
+	}
+	oidcEndpoint = &provider
+	return oidcEndpoint, nil
+}
+
+func oidcCallbackURL(c *fiber.Ctx) string {
+	if oidcRedirectURL != "" {
+		return oidcRedirectURL
+	}
+	return getBaseURL(c) + "/auth/oidc/callback"
+}
+
+// handleOIDCLogin sends the browser to the provider, remembering a random
+// state in a cookie to check on the way back.
+func handleOIDCLogin(c *fiber.Ctx) error {
+	if !accountsOIDC {
+		return c.SendStatus(404)
+	}
+	provider, err := oidcDiscover()
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		return c.Status(502).SendString("Sign-in provider unavailable")
+	}
+
+	state := generateUniqueID()
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/auth/oidc",
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+		Expires:  time.Now().Add(10 * time.Minute),
+	})
+
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {oidcClientID},
+		"redirect_uri":  {oidcCallbackURL(c)},
+		"scope":         {oidcScopes},
+		"state":         {state},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return c.Redirect(provider.AuthorizationEndpoint+separator+params.Encode(), 302)
+}
+
+// handleOIDCCallback exchanges the authorization code for an access token,
+// reads the user's identity from the userinfo endpoint and signs them in,
+// creating the account on first login.
+func handleOIDCCallback(c *fiber.Ctx) error {
+	if !accountsOIDC {
+		return c.SendStatus(404)
+	}
+	state := c.Cookies(oidcStateCookieName)
+	c.ClearCookie(oidcStateCookieName)
+	if state == "" || c.Query("state") != state {
+		return c.Status(400).SendString("Invalid sign-in state, please try again")
+	}
+	if errParam := c.Query("error"); errParam != "" {
+		audit(c, auditAuthFailure, "", "OIDC sign-in: "+errParam)
+		return c.Status(401).SendString("Sign-in failed: " + errParam)
+	}
+
+	provider, err := oidcDiscover()
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		return c.Status(502).SendString("Sign-in provider unavailable")
+	}
+	info, err := oidcExchange(provider, c.Query("code"), oidcCallbackURL(c))
+	if err != nil {
+		log.Printf("OIDC sign-in failed: %v", err)
+		return c.Status(502).SendString("Sign-in failed")
+	}
+
+	var user User
+	if result := db.Where("oidc_subject = ?", info.Subject).First(&user); result.Error != nil {
+		user = User{
+			Username:    uniqueUsername(info.PreferredUsername, info.Email, info.Subject),
+			Email:       info.Email,
+			OIDCSubject: info.Subject,
+		}
+		if result := db.Create(&user); result.Error != nil {
+			return c.Status(500).SendString("Failed to create account")
+		}
+		log.Printf("User %s created from OIDC login", user.Username)
+	}
+
+	startSession(c, &user)
+	return c.Redirect("/", 303)
+}
+
+type oidcUserinfo struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+func oidcExchange(provider *oidcProvider, code, redirectURL string) (*oidcUserinfo, error) {
+	if code == "" {
+		return nil, errors.New("no authorization code")
+	}
+	resp, err := oidcClient.PostForm(provider.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {oidcClientID},
+		"client_secret": {oidcClientSecret},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || resp.StatusCode != 200 || tokens.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+
+	req, err := http.NewRequest("GET", provider.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	infoResp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer infoResp.Body.Close()
+	var info oidcUserinfo
+	if err := json.NewDecoder(infoResp.Body).Decode(&info); err != nil || infoResp.StatusCode != 200 || info.Subject == "" {
+		return nil, fmt.Errorf("userinfo endpoint answered %s", infoResp.Status)
+	}
+	return &info, nil
+}
+
+// uniqueUsername picks a free username for a new OIDC account.
+func uniqueUsername(candidates ...string) string {
+	base := "user"
+	for _, candidate := range candidates {
+		if candidate = strings.TrimSpace(candidate); candidate != "" {
+			base = candidate
+			break
+		}
+	}
+	name := base
+	for {
+		var taken int64
+		db.Model(&User{}).Where("username = ?", name).Count(&taken)
+		if taken == 0 {
+			return name
+		}
+		suffix := make([]byte, 2)
+		rand.Read(suffix)
+		name = base + "-" + hex.EncodeToString(suffix)
+	}
+}
+
+// Admin user management, for instances with closed registration
+
+func handleAdminListUsers(c *fiber.Ctx) error {
+	var users []User
+	db.Order("created_at desc").Find(&users)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    users,
+	})
+}
+
+func handleAdminCreateUser(c *fiber.Ctx) error {
+	if !accountsLocal {
+		return apiError(c, 400, "Local accounts are disabled (set ACCOUNTS=local)")
+	}
+	var req credentials
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(c, 400, "Invalid request body")
+	}
+	user, err := createLocalUser(req)
+	if err != nil {
+		return apiError(c, 400, err.Error())
+	}
+	log.Printf("Admin created user %s", user.Username)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"data":    user,
+	})
+}
+
+// handleAdminDeleteUser removes an account. Its files stay until they expire
+// but no longer belong to anyone.
+func handleAdminDeleteUser(c *fiber.Ctx) error {
+	var user User
+	if result := db.First(&user, c.Params("id")); result.Error != nil {
+		return apiError(c, 404, "User not found")
+	}
+	db.Model(&FileRecord{}).Where("user_id = ?", user.ID).Update("user_id", nil)
+	db.Delete(&user)
+	log.Printf("Admin deleted user %s", user.Username)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "User deleted",
+	})
+}
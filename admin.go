@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin API, enabled by setting ADMIN_KEY. Requests authenticate with the
+// X-Admin-Key header (or "Authorization: Bearer <key>"), the dashboard's
+// session cookie, or an issued API key with the admin scope; API_KEY grants
+// no admin access.
+
+var adminKey string
+
+// BannedIP blocks an address or CIDR range from the whole instance.
+type BannedIP struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	Address   string     `json:"address" gorm:"uniqueIndex;not null"` // IP or CIDR range
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil bans permanently
+}
+
+// bannedNets caches the active bans so checking a request doesn't hit the
+// database.
+var (
+	bannedMu   sync.RWMutex
+	bannedNets []bannedNet
+)
+
+type bannedNet struct {
+	ipNet     *net.IPNet
+	expiresAt *time.Time
+}
+
+func loadAdminConfig() {
+	adminKey = getEnv("ADMIN_KEY", "")
+	if adminKey != "" {
+		log.Printf("Admin API enabled at /api/v1/admin, dashboard at /admin")
+		recordStorageSample()
+	}
+	reloadBans()
+}
+
+// reloadBans refreshes the ban cache from the database.
+func reloadBans() {
+	var bans []BannedIP
+	db.Where("expires_at IS NULL OR expires_at > ?", time.Now()).Find(&bans)
+
+	nets := make([]bannedNet, 0, len(bans))
+	for _, ban := range bans {
+		ipNet, err := parseIPOrCIDR(ban.Address)
+		if err != nil {
+			continue
+		}
+		nets = append(nets, bannedNet{ipNet: ipNet, expiresAt: ban.ExpiresAt})
+	}
+
+	bannedMu.Lock()
+	bannedNets = nets
+	bannedMu.Unlock()
+}
+
+func isBanned(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	bannedMu.RLock()
+	defer bannedMu.RUnlock()
+	now := time.Now()
+	for _, ban := range bannedNets {
+		if ban.ipNet.Contains(parsed) && (ban.expiresAt == nil || now.Before(*ban.expiresAt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// banMiddleware turns away banned clients. Admins are never locked out.
+func banMiddleware(c *fiber.Ctx) error {
+	if isBanned(c.IP()) && !hasValidAdminKey(c) {
+		return c.Status(403).SendString("Access denied: your IP address has been banned")
+	}
+	return c.Next()
+}
+
+func hasValidAdminKey(c *fiber.Ctx) bool {
+	if adminKey == "" {
+		return false
+	}
+	if hasAdminSession(c) {
+		return true
+	}
+	provided := c.Get("X-Admin-Key")
+	if provided == "" {
+		provided = strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+	}
+	if isAdminCredential(provided) {
+		return true
+	}
+
+	// API keys with the admin scope work in any of the key headers
+	key := requestAPIKey(c)
+	return key != nil && key.hasScope(scopeAdmin)
+}
+
+// isAdminCredential reports whether provided is ADMIN_KEY or an API key
+// with the admin scope.
+func isAdminCredential(provided string) bool {
+	if adminKey == "" || provided == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(adminKey)) == 1 {
+		return true
+	}
+	key := lookupAPIKey(provided)
+	return key != nil && key.hasScope(scopeAdmin)
+}
+
+func adminMiddleware(c *fiber.Ctx) error {
+	if adminKey == "" {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Admin API is disabled",
+		})
+	}
+	if !hasValidAdminKey(c) {
+		audit(c, auditAuthFailure, "", "admin key")
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid or missing admin key",
+		})
+	}
+	return c.Next()
+}
+
+// setupAdminRoutes registers the admin API, which takes the admin key rather
+// than an API key.
+func setupAdminRoutes(api fiber.Router) {
+	admin := api.Group("/admin", adminMiddleware, auditAdminAction)
+	admin.Get("/files", handleAdminListFiles)
+	admin.Delete("/files/:id", handleAdminDeleteFile)
+	admin.Post("/files/:id/extend", handleAdminExtendFile)
+	admin.Get("/trash", handleAdminListTrash)
+	admin.Post("/trash/:id/restore", handleAdminRestoreFile)
+	admin.Delete("/trash/:id", handleAdminPurgeFile)
+	admin.Get("/reconcile", handleAdminReconcileReport)
+	admin.Post("/reconcile", handleAdminReconcile)
+	admin.Get("/mirror", handleAdminMirrorStatus)
+	admin.Post("/mirror/sync", handleAdminMirrorSync)
+	admin.Get("/export", handleAdminExport)
+	admin.Post("/import", handleAdminImport)
+	admin.Get("/backups", handleAdminListBackups)
+	admin.Post("/backups", handleAdminCreateBackup)
+	admin.Get("/backups/:id", handleAdminDownloadBackup)
+	admin.Get("/bans", handleAdminListBans)
+	admin.Post("/bans", handleAdminBan)
+	admin.Delete("/bans/:id", handleAdminUnban)
+	admin.Get("/reports", handleAdminListReports)
+	admin.Post("/reports/:id/resolve", handleAdminResolveReport)
+	admin.Get("/quarantine", handleAdminListHeld)
+	admin.Post("/quarantine/:id/approve", handleAdminApproveFile)
+	admin.Post("/quarantine/:id/reject", handleAdminRejectFile)
+	admin.Get("/stats", handleAdminStats)
+	admin.Get("/audit", handleAdminListAudit)
+	admin.Get("/audit/export", handleAdminExportAudit)
+	admin.Get("/keys", handleAdminListKeys)
+	admin.Post("/keys", handleAdminCreateKey)
+	admin.Patch("/keys/:id", handleAdminUpdateKey)
+	admin.Delete("/keys/:id", handleAdminDeleteKey)
+	admin.Get("/users", handleAdminListUsers)
+	admin.Post("/users", handleAdminCreateUser)
+	admin.Delete("/users/:id", handleAdminDeleteUser)
+}
+
+// handleAdminListFiles lists every file, with the filters, sorting and
+// paging of listFiles plus ip.
+func handleAdminListFiles(c *fiber.Ctx) error {
+	query := db.Model(&FileRecord{})
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip_address = ?", storedIP(ip))
+	}
+	return listFiles(c, query, 500)
+}
+
+func handleAdminDeleteFile(c *fiber.Ctx) error {
+	var fileRecord FileRecord
+	if result := db.Where("unique_id = ?", c.Params("id")).First(&fileRecord); result.Error != nil {
+		return apiError(c, 404, "File not found")
+	}
+
+	// ?purge=true skips the trash
+	var err error
+	if c.QueryBool("purge") {
+		if err = purgeFile(&fileRecord); err == nil {
+			recordFileRemoved(&fileRecord)
+		}
+	} else {
+		err = removeFile(&fileRecord, "admin")
+	}
+	if err != nil {
+		log.Printf("Failed to delete %s: %v", fileRecord.FilePath, err)
+		return apiError(c, 500, "Failed to delete file")
+	}
+
+	log.Printf("Admin deleted file %s (%s)", fileRecord.UniqueID, fileRecord.OriginalName)
+	audit(c, auditDelete, fileRecord.UniqueID, "admin")
+	sendWebhook(c, webhookDeleted, &fileRecord, "admin")
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "File deleted",
+	})
+}
+
+// handleAdminExtendFile sets a new expiry, counted from now: {"expires": "7D"}
+// or ?expires=7D. "never" removes the expiry. FILE_EXPIRE_MAX doesn't apply.
+func handleAdminExtendFile(c *fiber.Ctx) error {
+	var req struct {
+		Expires string `json:"expires" form:"expires"`
+	}
+	c.BodyParser(&req)
+	if req.Expires == "" {
+		req.Expires = c.Query("expires")
+	}
+
+	duration, err := parseDuration(req.Expires)
+	if req.Expires == "" || err != nil || duration < 0 {
+		return apiError(c, 400, fmt.Sprintf("Invalid expiration '%s'", req.Expires))
+	}
+
+	var fileRecord FileRecord
+	if result := db.Where("unique_id = ?", c.Params("id")).First(&fileRecord); result.Error != nil {
+		return apiError(c, 404, "File not found")
+	}
+
+	var expiresAt *time.Time
+	if duration > 0 {
+		t := time.Now().Add(duration)
+		expiresAt = &t
+	}
+	db.Model(&fileRecord).Update("expires_at", expiresAt)
+	fileRecord.ExpiresAt = expiresAt
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    fileRecord,
+	})
+}
+
+func handleAdminListBans(c *fiber.Ctx) error {
+	var bans []BannedIP
+	db.Order("created_at desc").Find(&bans)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    bans,
+	})
+}
+
+// handleAdminBan bans an IP or CIDR range: {"address": "203.0.113.7",
+// "reason": "...", "duration": "7D", "delete_files": true}. Without a
+// duration the ban is permanent; delete_files removes the files uploaded from
+// a single banned IP.
+func handleAdminBan(c *fiber.Ctx) error {
+	var req struct {
+		Address     string `json:"address" form:"address"`
+		Reason      string `json:"reason" form:"reason"`
+		Duration    string `json:"duration" form:"duration"`
+		DeleteFiles bool   `json:"delete_files" form:"delete_files"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(c, 400, "Invalid request body")
+	}
+
+	req.Address = strings.TrimSpace(req.Address)
+	if _, err := parseIPOrCIDR(req.Address); err != nil || req.Address == "" {
+		return apiError(c, 400, fmt.Sprintf("Invalid IP address or CIDR range '%s'", req.Address))
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		var err error
+		duration, err = parseDuration(req.Duration)
+		if err != nil || duration < 0 {
+			return apiError(c, 400, fmt.Sprintf("Invalid duration '%s'", req.Duration))
+		}
+	}
+
+	ban, err := banAddress(c, req.Address, req.Reason, duration)
+	if err != nil {
+		return apiError(c, 500, "Failed to save ban")
+	}
+
+	deleted := 0
+	if req.DeleteFiles {
+		var files []FileRecord
+		db.Where("ip_address = ?", storedIP(ban.Address)).Find(&files)
+		for _, file := range files {
+			if err := removeFile(&file, "banned"); err != nil {
+				log.Printf("Failed to delete %s: %v", file.FilePath, err)
+				continue
+			}
+			audit(c, auditDelete, file.UniqueID, "banned")
+			sendWebhook(c, webhookDeleted, &file, "banned")
+			deleted++
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success":       true,
+		"data":          ban,
+		"files_deleted": deleted,
+	})
+}
+
+// banAddress bans an IP or CIDR range for duration, or for good if it is
+// zero, on behalf of the request c. Banning an address again replaces the
+// previous ban.
+func banAddress(c *fiber.Ctx, address, reason string, duration time.Duration) (*BannedIP, error) {
+	ban := BannedIP{Address: address, Reason: reason}
+	if duration > 0 {
+		expiresAt := time.Now().Add(duration)
+		ban.ExpiresAt = &expiresAt
+	}
+
+	db.Where("address = ?", ban.Address).Delete(&BannedIP{})
+	if err := db.Create(&ban).Error; err != nil {
+		return nil, err
+	}
+	reloadBans()
+	log.Printf("Admin banned %s (%s)", ban.Address, ban.Reason)
+	audit(c, auditBan, "", strings.TrimSpace(ban.Address+" "+ban.Reason))
+	return &ban, nil
+}
+
+func handleAdminUnban(c *fiber.Ctx) error {
+	var ban BannedIP
+	if err := db.First(&ban, c.Params("id")).Error; err != nil {
+		return apiError(c, 404, "Ban not found")
+	}
+	result := db.Delete(&ban)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return apiError(c, 404, "Ban not found")
+	}
+	reloadBans()
+	audit(c, auditUnban, "", ban.Address)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Ban removed",
+	})
+}
+
+// adminIPUsage is one row of the top uploaders table.
+type adminIPUsage struct {
+	IPAddress string `json:"ip_address"`
+	Files     int64  `json:"files"`
+	TotalSize int64  `json:"total_size"`
+}
+
+// adminStats are the instance totals shown by the admin API and dashboard.
+type adminStats struct {
+	TotalFiles     int64
+	TotalSize      int64
+	StoredSize     int64 // deduplicated blobs are only stored once
+	TotalDownloads int64
+	UploadsToday   int64
+	ActiveBans     int64
+	OpenReports    int64
+	HeldFiles      int64
+	TopIPs         []adminIPUsage
+}
+
+func collectAdminStats() adminStats {
+	var stats adminStats
+	db.Model(&FileRecord{}).Count(&stats.TotalFiles)
+	db.Model(&FileRecord{}).Select("COALESCE(SUM(file_size), 0)").Row().Scan(&stats.TotalSize)
+	db.Model(&FileRecord{}).Select("COALESCE(SUM(downloads), 0)").Row().Scan(&stats.TotalDownloads)
+	db.Model(&Blob{}).Select("COALESCE(SUM(file_size), 0)").Row().Scan(&stats.StoredSize)
+	db.Model(&FileRecord{}).Where("uploaded_at > ?", time.Now().Add(-24*time.Hour)).Count(&stats.UploadsToday)
+	db.Model(&BannedIP{}).Where("expires_at IS NULL OR expires_at > ?", time.Now()).Count(&stats.ActiveBans)
+	db.Model(&AbuseReport{}).Where("status = ?", reportOpen).Count(&stats.OpenReports)
+	db.Model(&FileRecord{}).Where("moderation = ?", moderationHeld).Count(&stats.HeldFiles)
+
+	db.Model(&FileRecord{}).
+		Select("ip_address, COUNT(*) AS files, COALESCE(SUM(file_size), 0) AS total_size").
+		Where("ip_address <> ''").
+		Group("ip_address").
+		Order("total_size desc").
+		Limit(10).
+		Scan(&stats.TopIPs)
+	return stats
+}
+
+func handleAdminStats(c *fiber.Ctx) error {
+	stats := collectAdminStats()
+	return c.JSON(fiber.Map{
+		"success":               true,
+		"total_files":           stats.TotalFiles,
+		"total_size":            stats.TotalSize,
+		"total_size_formatted":  formatBytes(stats.TotalSize),
+		"stored_size":           stats.StoredSize,
+		"stored_size_formatted": formatBytes(stats.StoredSize),
+		"total_downloads":       stats.TotalDownloads,
+		"uploads_last_24h":      stats.UploadsToday,
+		"active_bans":           stats.ActiveBans,
+		"open_reports":          stats.OpenReports,
+		"held_files":            stats.HeldFiles,
+		"top_ips":               stats.TopIPs,
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Short links for reading aloud or typing: a file's uploader can make
+// aliases such as /x/Ab3k that redirect to its download link. Codes are
+// drawn from letters and digits that can't be mistaken for one another (no
+// 0/O, 1/l/I) and are SHORT_LINK_LENGTH long, growing when that runs out.
+// SHORT_URL sets where short links point: a path on this server (default
+// BASE_URL/x) or a short domain of its own routed here, e.g. https://bu.sh,
+// whose /Ab3k then redirects too. With SIGNED_URLS_REQUIRED on, an alias
+// leads to a freshly signed link, so it's as good as one: such aliases must
+// expire, and the links they lead to never outlast them. Aliases go with
+// their file.
+
+// aliasAlphabet leaves out characters that read or look alike
+const aliasAlphabet = "23456789abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// maxAliasesPerFile keeps a file from collecting aliases without end
+const maxAliasesPerFile = 20
+
+// Alias is a short code redirecting to a file.
+type Alias struct {
+	ID        uint       `json:"-" gorm:"primaryKey"`
+	Code      string     `json:"code" gorm:"size:32;uniqueIndex;not null"`
+	FileID    uint       `json:"-" gorm:"not null;index"`
+	Hits      int64      `json:"hits"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// customAliasPattern is what a code asked for must look like
+var customAliasPattern = regexp.MustCompile(`^[A-Za-z0-9]{3,32}$`)
+
+var (
+	shortLinksEnabled bool
+	shortLinkLength   int
+	shortURL          string // empty to derive it from each request
+	shortHost         string // host of a short domain serving codes at its root
+)
+
+// loadAliasConfig reads SHORT_LINKS, SHORT_LINK_LENGTH and SHORT_URL.
+func loadAliasConfig() {
+	shortLinksEnabled = getEnv("SHORT_LINKS", "false") == "true"
+	if !shortLinksEnabled {
+		return
+	}
+
+	lengthStr := getEnv("SHORT_LINK_LENGTH", "6")
+	var err error
+	shortLinkLength, err = strconv.Atoi(lengthStr)
+	if err != nil || shortLinkLength < 3 || shortLinkLength > 16 {
+		log.Printf("Invalid SHORT_LINK_LENGTH value '%s', using default 6", lengthStr)
+		shortLinkLength = 6
+	}
+
+	shortURL = strings.TrimRight(getEnv("SHORT_URL", ""), "/")
+	if shortURL != "" {
+		u, err := url.Parse(shortURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid SHORT_URL '%s': expected e.g. https://bu.sh or https://example.com/x", shortURL)
+		}
+		if u.Path == "" {
+			shortHost = strings.ToLower(u.Hostname())
+		} else if u.Path != "/x" {
+			log.Fatalf("SHORT_URL must be a domain of its own or end in /x, not '%s'", u.Path)
+		}
+	}
+}
+
+func setupAliasRoutes(app *fiber.App) {
+	if !shortLinksEnabled {
+		return
+	}
+	if shortHost != "" {
+		// The short domain answers /<code> before anything else
+		app.Use(func(c *fiber.Ctx) error {
+			code := strings.TrimPrefix(c.Path(), "/")
+			if strings.EqualFold(c.Hostname(), shortHost) && customAliasPattern.MatchString(code) {
+				return redirectAlias(c, code)
+			}
+			return c.Next()
+		})
+	}
+	app.Get("/x/:code", func(c *fiber.Ctx) error {
+		return redirectAlias(c, c.Params("code"))
+	})
+}
+
+func setupAliasAPIRoutes(api fiber.Router, upload, read fiber.Handler) {
+	api.Get("/files/:id/aliases", read, handleListAliases)
+	api.Post("/files/:id/aliases", upload, handleCreateAlias)
+	api.Delete("/files/:id/aliases/:code", upload, handleDeleteAlias)
+}
+
+// aliasBaseURL is what short links start with.
+func aliasBaseURL(c *fiber.Ctx) string {
+	if shortURL != "" {
+		return shortURL
+	}
+	return getBaseURL(c) + "/x"
+}
+
+// redirectAlias sends the client on to the download link of the file code
+// points to.
+func redirectAlias(c *fiber.Ctx, code string) error {
+	var alias Alias
+	if err := db.Where("code = ?", code).First(&alias).Error; err != nil {
+		return c.Status(404).SendString("Short link not found")
+	}
+	if alias.ExpiresAt != nil && time.Now().After(*alias.ExpiresAt) {
+		db.Delete(&alias)
+		return c.Status(404).SendString("Short link has expired")
+	}
+	var fileRecord FileRecord
+	if err := db.First(&fileRecord, alias.FileID).Error; err != nil {
+		return c.Status(404).SendString("File not found")
+	}
+	if fileRecord.ExpiresAt != nil && time.Now().After(*fileRecord.ExpiresAt) {
+		return c.Status(404).SendString("File has expired")
+	}
+	if fileRecord.usedUp() && !resumable(fileRecord.ID, c.IP()) {
+		return c.Status(410).SendString(usedUpMessage(fileRecord.downloadLimit()))
+	}
+	if refused, err := refuseUnreleased(c, &fileRecord); refused {
+		return err
+	}
+
+	// Without BASE_URL a short domain redirects to itself, served here too
+	link := getBaseURL(c) + fileRecord.downloadPath()
+	if signedURLsRequired {
+		// An alias made before signatures were required may not expire
+		if alias.ExpiresAt == nil {
+			return c.Status(403).SendString("This short link has no expiry, so it can't lead to a signed link")
+		}
+		exp := time.Now().Add(signedURLTTL)
+		if exp.After(*alias.ExpiresAt) {
+			exp = *alias.ExpiresAt
+		}
+		link, _ = signLinkUntil(link, &fileRecord, exp)
+	}
+	db.Model(&alias).UpdateColumn("hits", gorm.Expr("hits + 1"))
+	c.Set("Cache-Control", "no-store")
+	return c.Redirect(link, 302)
+}
+
+// managedFile loads the file of an alias request, refusing callers that
+// have neither its delete token (X-Delete-Token or ?token=) nor own it.
+func managedFile(c *fiber.Ctx) (*FileRecord, error) {
+	if !shortLinksEnabled {
+		return nil, apiError(c, 404, "Short links are not enabled on this server")
+	}
+	var fileRecord FileRecord
+	if err := findFile(c.Params("id"), &fileRecord); err != nil {
+		return nil, apiError(c, 404, "File not found")
+	}
+	logFileID(c, fileRecord.UniqueID)
+
+	token := c.Get("X-Delete-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	if !tokenMatches(token, fileRecord.DeleteToken) && !ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+		return nil, apiError(c, 403, "Managing short links takes the file's delete token or owning it")
+	}
+	return &fileRecord, nil
+}
+
+// aliasEntry is an alias as the API shows it.
+type aliasEntry struct {
+	Alias
+	URL string `json:"url"`
+}
+
+func aliasEntries(c *fiber.Ctx, aliases []Alias) []aliasEntry {
+	entries := make([]aliasEntry, 0, len(aliases))
+	for _, alias := range aliases {
+		entries = append(entries, aliasEntry{Alias: alias, URL: aliasBaseURL(c) + "/" + alias.Code})
+	}
+	return entries
+}
+
+// handleListAliases is GET /api/files/:id/aliases.
+func handleListAliases(c *fiber.Ctx) error {
+	fileRecord, err := managedFile(c)
+	if fileRecord == nil {
+		return err
+	}
+	var aliases []Alias
+	db.Where("file_id = ?", fileRecord.ID).Order("id").Find(&aliases)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    aliasEntries(c, aliases),
+	})
+}
+
+// handleCreateAlias is POST /api/files/:id/aliases, with an optional
+// {"code": "Report5"} to pick the code and {"expires_in": "7D"} to have the
+// alias stop working before the file does.
+func handleCreateAlias(c *fiber.Ctx) error {
+	fileRecord, err := managedFile(c)
+	if fileRecord == nil {
+		return err
+	}
+	var req struct {
+		Code      string `json:"code" form:"code"`
+		ExpiresIn string `json:"expires_in" form:"expires_in"`
+	}
+	c.BodyParser(&req)
+	if req.Code == "" {
+		req.Code = c.Query("code")
+	}
+	if req.ExpiresIn == "" {
+		req.ExpiresIn = c.Query("expires_in")
+	}
+
+	var count int64
+	db.Model(&Alias{}).Where("file_id = ?", fileRecord.ID).Count(&count)
+	if count >= maxAliasesPerFile {
+		return apiError(c, 409, fmt.Sprintf("A file can have at most %d short links", maxAliasesPerFile))
+	}
+
+	alias := Alias{FileID: fileRecord.ID}
+	if req.ExpiresIn != "" {
+		ttl, err := parseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			return apiError(c, 400, fmt.Sprintf("Invalid expires_in '%s'", req.ExpiresIn))
+		}
+		expiresAt := time.Now().Add(ttl)
+		alias.ExpiresAt = &expiresAt
+	} else if signedURLsRequired {
+		// An alias that never expires would hand out signed links for as
+		// long as the file lives
+		return apiError(c, 400, "With signed links required, a short link needs expires_in")
+	}
+
+	if req.Code != "" {
+		if !customAliasPattern.MatchString(req.Code) {
+			return apiError(c, 400, fmt.Sprintf("Invalid code '%s': use 3-32 letters and digits", req.Code))
+		}
+		alias.Code = req.Code
+		if err := db.Create(&alias).Error; err != nil {
+			return apiError(c, 409, fmt.Sprintf("The code '%s' is already taken", req.Code))
+		}
+	} else if err := createRandomAlias(&alias); err != nil {
+		requestLog(c).Error("Failed to create short link", "file_id", fileRecord.UniqueID, "error", err)
+		return apiError(c, 500, "Failed to create short link")
+	}
+
+	requestLog(c).Info("Short link created", "file_id", fileRecord.UniqueID, "code", alias.Code)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"data":    aliasEntries(c, []Alias{alias})[0],
+	})
+}
+
+// createRandomAlias stores alias under a fresh code, one character longer
+// every few collisions.
+func createRandomAlias(alias *Alias) error {
+	length := shortLinkLength
+	var err error
+	for attempt := 0; attempt < 12; attempt++ {
+		if attempt > 0 && attempt%3 == 0 {
+			length++
+		}
+		alias.Code = randomAliasCode(length)
+		if err = db.Create(alias).Error; err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func randomAliasCode(length int) string {
+	code := make([]byte, length)
+	base := big.NewInt(int64(len(aliasAlphabet)))
+	for i := range code {
+		n, _ := rand.Int(rand.Reader, base)
+		code[i] = aliasAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// handleDeleteAlias is DELETE /api/files/:id/aliases/:code.
+func handleDeleteAlias(c *fiber.Ctx) error {
+	fileRecord, err := managedFile(c)
+	if fileRecord == nil {
+		return err
+	}
+	result := db.Where("file_id = ? AND code = ?", fileRecord.ID, c.Params("code")).Delete(&Alias{})
+	if result.Error != nil {
+		return apiError(c, 500, "Failed to delete short link")
+	}
+	if result.RowsAffected == 0 {
+		return apiError(c, 404, "Short link not found")
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Short link deleted",
+	})
+}
+
+// pruneExpiredAliases drops aliases past their expiry.
+func pruneExpiredAliases() {
+	db.Where("expires_at IS NOT NULL AND expires_at < ?", time.Now()).Delete(&Alias{})
+}
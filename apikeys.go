@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// API keys. Keys are issued and revoked at runtime through /api/admin/keys
+// and stored hashed; each carries scopes that decide which routes it opens,
+// and optionally its own rate limit and expiry. The legacy API_KEY still
+// works as a key with the upload and read scopes.
+
+const (
+	scopeUpload = "upload" // upload files and delete them with their token
+	scopeRead   = "read"   // file info and stats
+	scopeAdmin  = "admin"  // the admin API, like ADMIN_KEY
+
+	apiKeyPrefix = "bu_"
+)
+
+var allScopes = []string{scopeUpload, scopeRead, scopeAdmin}
+
+// apiKeyRequired is set by REQUIRE_API_KEY. Without it, keys only raise the
+// rate limit and grant their scopes on an otherwise public instance.
+var apiKeyRequired bool
+
+// APIKey is an API key issued through the admin API.
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	Label      string     `json:"label"`
+	Prefix     string     `json:"prefix"`                        // first characters, to recognise the key
+	KeyHash    string     `json:"-" gorm:"uniqueIndex;not null"` // SHA-256 of the key
+	Scopes     string     `json:"scopes"`                        // comma-separated
+	RateLimit  int        `json:"rate_limit"`                    // requests per window, 0 uses RATE_LIMIT_AUTH_MAX
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`          // nil never expires
+	Revoked    bool       `json:"revoked" gorm:"default:false"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// legacyAPIKey stands for a request carrying API_KEY.
+var legacyAPIKey = APIKey{Label: "API_KEY", Scopes: scopeUpload + "," + scopeRead}
+
+func (k *APIKey) hasScope(scope string) bool {
+	return containsString(strings.Split(k.Scopes, ","), scope)
+}
+
+func (k *APIKey) active() bool {
+	return !k.Revoked && (k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt))
+}
+
+// loadAPIKeyConfig reads API_KEY and REQUIRE_API_KEY. Requiring a key is the
+// default whenever API_KEY is set, as it was before keys could be issued.
+func loadAPIKeyConfig() {
+	apiKey = getEnv("API_KEY", "")
+	requiredStr := getEnv("REQUIRE_API_KEY", strconv.FormatBool(apiKey != ""))
+	var err error
+	apiKeyRequired, err = strconv.ParseBool(requiredStr)
+	if err != nil {
+		log.Printf("Invalid REQUIRE_API_KEY value '%s', using default %t", requiredStr, apiKey != "")
+		apiKeyRequired = apiKey != ""
+	}
+
+	if apiKeyRequired {
+		log.Printf("API Key authentication enabled")
+	} else {
+		log.Printf("API Key authentication disabled - public access")
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey returns the active key matching provided, or nil.
+func lookupAPIKey(provided string) *APIKey {
+	if provided == "" {
+		return nil
+	}
+	if apiKey != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) == 1 {
+		return &legacyAPIKey
+	}
+	if !strings.HasPrefix(provided, apiKeyPrefix) {
+		return nil
+	}
+
+	var key APIKey
+	if result := db.Where("key_hash = ?", hashAPIKey(provided)).First(&key); result.Error != nil {
+		return nil
+	}
+	if !key.active() {
+		return nil
+	}
+
+	// Recording every use would mean a write per request
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+		now := time.Now()
+		db.Model(&key).Update("last_used_at", now)
+	}
+	return &key
+}
+
+// requestAPIKey returns the valid API key sent with the request, if any. The
+// result is kept for the rest of the request, which asks several times.
+func requestAPIKey(c *fiber.Ctx) *APIKey {
+	if key, ok := c.Locals("api_key").(*APIKey); ok {
+		return key
+	}
+	var key *APIKey
+	if provided := providedAPIKey(c); strings.HasPrefix(provided, uploadTokenPrefix) {
+		key = uploadTokenKey(c, provided)
+	} else {
+		key = lookupAPIKey(provided)
+	}
+	c.Locals("api_key", key)
+	return key
+}
+
+// currentAPIKeyID is the issued key to record on a new upload. Uploads with
+// API_KEY, a user's upload token or no key aren't attributed to a key.
+func currentAPIKeyID(c *fiber.Ctx) *uint {
+	if key := requestAPIKey(c); key != nil && key.ID != 0 {
+		return &key.ID
+	}
+	return nil
+}
+
+// requireAPIKey guards a route with scope. Without REQUIRE_API_KEY anyone
+// may use it, signed-in users may upload and read without a key, and admins
+// may read.
+func requireAPIKey(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !apiKeyRequired {
+			return c.Next()
+		}
+		if scope != scopeAdmin && requestAPIKey(c) == nil && currentUser(c) != nil {
+			return c.Next()
+		}
+		if scope == scopeRead && hasValidAdminKey(c) {
+			return c.Next()
+		}
+
+		key := requestAPIKey(c)
+		if key == nil {
+			if providedAPIKey(c) != "" {
+				audit(c, auditAuthFailure, "", "invalid API key")
+			}
+			return c.Status(401).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid or missing API key",
+			})
+		}
+		if !key.hasScope(scope) {
+			audit(c, auditAuthFailure, "", "API key lacks the "+scope+" scope")
+			return c.Status(403).JSON(fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("API key lacks the '%s' scope", scope),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// parseScopes validates a list of scopes and returns it in stored form.
+func parseScopes(scopes []string) (string, error) {
+	var valid []string
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !containsString(allScopes, scope) {
+			return "", fmt.Errorf("Unknown scope '%s' (expected %s)", scope, strings.Join(allScopes, ", "))
+		}
+		if !containsString(valid, scope) {
+			valid = append(valid, scope)
+		}
+	}
+	if len(valid) == 0 {
+		return "", fmt.Errorf("At least one scope is required")
+	}
+	return strings.Join(valid, ","), nil
+}
+
+// parseKeyExpiry turns an "expires" duration such as "90D" into a time;
+// empty or "never" means no expiry.
+func parseKeyExpiry(expires string) (*time.Time, error) {
+	if expires == "" {
+		return nil, nil
+	}
+	duration, err := parseDuration(expires)
+	if err != nil || duration < 0 {
+		return nil, fmt.Errorf("Invalid expires '%s'", expires)
+	}
+	if duration == 0 {
+		return nil, nil
+	}
+	expiresAt := time.Now().Add(duration)
+	return &expiresAt, nil
+}
+
+func handleAdminListKeys(c *fiber.Ctx) error {
+	var keys []APIKey
+	db.Order("created_at desc").Find(&keys)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    keys,
+	})
+}
+
+// handleAdminCreateKey issues a key: {"label": "ci", "scopes": ["upload"],
+// "rate_limit": 500, "expires": "90D"}. Scopes default to upload and read.
+// The key itself is only ever shown in this response.
+func handleAdminCreateKey(c *fiber.Ctx) error {
+	var req struct {
+		Label     string   `json:"label"`
+		Scopes    []string `json:"scopes"`
+		RateLimit int      `json:"rate_limit"`
+		Expires   string   `json:"expires"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(c, 400, "Invalid request body")
+	}
+	if req.Scopes == nil {
+		req.Scopes = []string{scopeUpload, scopeRead}
+	}
+	scopes, err := parseScopes(req.Scopes)
+	if err != nil {
+		return apiError(c, 400, err.Error())
+	}
+	if req.RateLimit < 0 {
+		return apiError(c, 400, "Invalid rate_limit")
+	}
+	expiresAt, err := parseKeyExpiry(req.Expires)
+	if err != nil {
+		return apiError(c, 400, err.Error())
+	}
+
+	secret := apiKeyPrefix + generateUniqueID() + generateUniqueID()[:16]
+	key := APIKey{
+		Label:     strings.TrimSpace(req.Label),
+		Prefix:    secret[:len(apiKeyPrefix)+8],
+		KeyHash:   hashAPIKey(secret),
+		Scopes:    scopes,
+		RateLimit: req.RateLimit,
+		ExpiresAt: expiresAt,
+	}
+	if result := db.Create(&key); result.Error != nil {
+		return apiError(c, 500, "Failed to save API key")
+	}
+	log.Printf("Admin created API key %d (%s, scopes %s)", key.ID, key.Label, key.Scopes)
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"data":    key,
+		"key":     secret,
+	})
+}
+
+// handleAdminUpdateKey changes any of label, scopes, rate_limit, expires and
+// revoked. Revoking takes effect on the key's next request.
+func handleAdminUpdateKey(c *fiber.Ctx) error {
+	var key APIKey
+	if result := db.First(&key, c.Params("id")); result.Error != nil {
+		return apiError(c, 404, "API key not found")
+	}
+
+	var req struct {
+		Label     *string  `json:"label"`
+		Scopes    []string `json:"scopes"`
+		RateLimit *int     `json:"rate_limit"`
+		Expires   *string  `json:"expires"`
+		Revoked   *bool    `json:"revoked"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(c, 400, "Invalid request body")
+	}
+
+	updates := map[string]interface{}{}
+	if req.Label != nil {
+		updates["label"] = strings.TrimSpace(*req.Label)
+	}
+	if req.Scopes != nil {
+		scopes, err := parseScopes(req.Scopes)
+		if err != nil {
+			return apiError(c, 400, err.Error())
+		}
+		updates["scopes"] = scopes
+	}
+	if req.RateLimit != nil {
+		if *req.RateLimit < 0 {
+			return apiError(c, 400, "Invalid rate_limit")
+		}
+		updates["rate_limit"] = *req.RateLimit
+	}
+	if req.Expires != nil {
+		expiresAt, err := parseKeyExpiry(*req.Expires)
+		if err != nil {
+			return apiError(c, 400, err.Error())
+		}
+		updates["expires_at"] = expiresAt
+	}
+	if req.Revoked != nil {
+		updates["revoked"] = *req.Revoked
+	}
+
+	if len(updates) > 0 {
+		if result := db.Model(&key).Updates(updates); result.Error != nil {
+			return apiError(c, 500, "Failed to update API key")
+		}
+	}
+	db.First(&key, key.ID)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    key,
+	})
+}
+
+func handleAdminDeleteKey(c *fiber.Ctx) error {
+	result := db.Delete(&APIKey{}, c.Params("id"))
+	if result.Error != nil || result.RowsAffected == 0 {
+		return apiError(c, 404, "API key not found")
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "API key deleted",
+	})
+}
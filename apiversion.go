@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// API versioning. /api/v1 is the canonical prefix; the unversioned /api
+// serves the same routes so curl scripts and CLI releases from before
+// versioning keep working. A breaking change (to pagination or error shapes,
+// say) goes under /api/v2 next to v1 instead of changing v1 in place.
+//
+// The v1 envelope: every JSON response has a boolean "success". Failures
+// add a human-readable "message". A single resource comes back in "data",
+// and lists come back in "data" with "page", "per_page" and "total". Within a
+// version, fields may be added to responses but are never renamed, removed or
+// given a different type.
+
+// apiPrefixes are the prefixes the API is served under, most specific first.
+var apiPrefixes = []string{"/api/v1", "/api"}
+
+// splitAPIPath splits a request path into the API prefix it was made under
+// and the route below it, e.g. "/api/v1/upload" into "/api/v1" and "/upload".
+// ok is false for paths outside the API.
+func splitAPIPath(path string) (prefix, route string, ok bool) {
+	for _, prefix := range apiPrefixes {
+		if path == prefix {
+			return prefix, "/", true
+		}
+		if strings.HasPrefix(path, prefix+"/") {
+			return prefix, path[len(prefix):], true
+		}
+	}
+	return "", "", false
+}
+
+// isAPIVersion reports whether a path segment names an API version, like
+// "v1" or "v2".
+func isAPIVersion(segment string) bool {
+	if len(segment) < 2 || segment[0] != 'v' {
+		return false
+	}
+	for _, r := range segment[1:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// apiError answers with the failure half of the envelope.
+func apiError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{
+		"success": false,
+		"message": message,
+	})
+}
+
+// handleAPINotFound answers API requests no route matched, telling a client
+// asking for a version this server doesn't have apart from a mistyped path.
+func handleAPINotFound(c *fiber.Ctx) error {
+	_, route, _ := splitAPIPath(c.Path())
+	segment, _, _ := strings.Cut(strings.TrimPrefix(route, "/"), "/")
+	if isAPIVersion(segment) {
+		return apiError(c, 404, "Unsupported API version "+segment)
+	}
+	return apiError(c, 404, "Not found")
+}
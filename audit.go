@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Audit log. Security-relevant events are appended to the audit_logs table
+// as they happen: uploads, downloads, deletions, failed authentication,
+// admin actions and bans. Entries are never changed; AUDIT_RETENTION is the
+// only thing that removes them. Admins query them at /api/admin/audit and
+// export them as CSV or JSON Lines from /api/admin/audit/export.
+
+const (
+	auditUpload      = "upload"
+	auditDownload    = "download"
+	auditDelete      = "delete"
+	auditAuthFailure = "auth_failure"
+	auditAdmin       = "admin"
+	auditBan         = "ban"
+	auditUnban       = "unban"
+)
+
+var auditEvents = []string{auditUpload, auditDownload, auditDelete, auditAuthFailure, auditAdmin, auditBan, auditUnban}
+
+// AuditLog is one audited event.
+type AuditLog struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime;index"`
+	Event     string    `json:"event" gorm:"index;not null"`
+	Actor     string    `json:"actor" gorm:"index"` // admin, user:<id>, key:<id>, api_key, anonymous or system
+	IP        string    `json:"ip,omitempty" gorm:"index"`
+	FileID    string    `json:"file_id,omitempty" gorm:"index"`
+	Detail    string    `json:"detail,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+var (
+	auditEnabled   bool
+	auditRetention time.Duration // 0 keeps entries forever
+)
+
+// loadAuditConfig reads AUDIT_LOG and AUDIT_RETENTION.
+func loadAuditConfig() {
+	auditEnabled = getEnv("AUDIT_LOG", "true") == "true"
+	if !auditEnabled {
+		return
+	}
+	retentionStr := getEnv("AUDIT_RETENTION", "never")
+	var err error
+	auditRetention, err = parseDuration(retentionStr)
+	if err != nil || auditRetention < 0 {
+		log.Printf("Invalid AUDIT_RETENTION value '%s', keeping audit entries forever", retentionStr)
+		auditRetention = 0
+	}
+}
+
+// audit records event for the request c, or for the server itself when c is
+// nil. fileID and detail may be empty.
+func audit(c *fiber.Ctx, event, fileID, detail string) {
+	if !auditEnabled {
+		return
+	}
+	entry := AuditLog{Event: event, Actor: "system", FileID: fileID, Detail: detail}
+	if c != nil {
+		entry.Actor = auditActor(c)
+		entry.IP = storedIP(c.IP())
+		entry.RequestID, _ = c.Locals("request_id").(string)
+	}
+	writeAudit(entry)
+}
+
+// auditAs records event for a caller outside HTTP, such as a gRPC or SFTP
+// client.
+func auditAs(actor, ip, event, fileID, detail string) {
+	if !auditEnabled {
+		return
+	}
+	writeAudit(AuditLog{Event: event, Actor: actor, IP: storedIP(ip), FileID: fileID, Detail: detail})
+}
+
+func writeAudit(entry AuditLog) {
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("Failed to write audit entry %s: %v", entry.Event, err)
+	}
+}
+
+// auditActor names who made the request: the admin, a signed-in user or the
+// API key used.
+func auditActor(c *fiber.Ctx) string {
+	if admin, _ := c.Locals("admin").(bool); admin {
+		return "admin"
+	}
+	if user := currentUser(c); user != nil {
+		return "user:" + strconv.FormatUint(uint64(user.ID), 10)
+	}
+	return keyActor(requestAPIKey(c))
+}
+
+// keyActor names the caller using key, which may be nil.
+func keyActor(key *APIKey) string {
+	switch {
+	case key == nil:
+		return "anonymous"
+	case key == &legacyAPIKey:
+		return "api_key"
+	case key.ID == 0:
+		return "upload_token"
+	}
+	return "key:" + strconv.FormatUint(uint64(key.ID), 10)
+}
+
+// auditAdminAction records every admin API request that changed something,
+// once it has succeeded.
+func auditAdminAction(c *fiber.Ctx) error {
+	c.Locals("admin", true)
+	err := c.Next()
+	if c.Method() != fiber.MethodGet && c.Response().StatusCode() < 400 {
+		audit(c, auditAdmin, "", c.Method()+" "+c.Path())
+	}
+	return err
+}
+
+// pruneAudit drops entries older than AUDIT_RETENTION.
+func pruneAudit() {
+	if auditRetention <= 0 {
+		return
+	}
+	if result := db.Where("created_at < ?", time.Now().Add(-auditRetention)).Delete(&AuditLog{}); result.RowsAffected > 0 {
+		log.Printf("Pruned %d audit entries older than %s", result.RowsAffected, formatDuration(auditRetention))
+	}
+}
+
+// filterAudit applies the audit filters: event, actor, ip, file_id and
+// since/until (dates or RFC 3339).
+func filterAudit(c *fiber.Ctx) (*gorm.DB, error) {
+	query := db.Model(&AuditLog{})
+	if event := c.Query("event"); event != "" {
+		if !containsString(auditEvents, event) {
+			return nil, fmt.Errorf("Invalid event '%s'", event)
+		}
+		query = query.Where("event = ?", event)
+	}
+	if actor := c.Query("actor"); actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip = ?", storedIP(ip))
+	}
+	if fileID := c.Query("file_id"); fileID != "" {
+		query = query.Where("file_id = ?", fileID)
+	}
+	for _, filter := range []struct{ param, clause string }{
+		{"since", "created_at >= ?"},
+		{"until", "created_at < ?"},
+	} {
+		if value := c.Query(filter.param); value != "" {
+			t, err := parseListTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s '%s'", filter.param, value)
+			}
+			query = query.Where(filter.clause, t)
+		}
+	}
+	return query, nil
+}
+
+// handleAdminListAudit lists audit entries, newest first, 100 per page (up
+// to 1000).
+func handleAdminListAudit(c *fiber.Ctx) error {
+	query, err := filterAudit(c)
+	if err != nil {
+		return apiError(c, 400, err.Error())
+	}
+
+	var total int64
+	query.Count(&total)
+
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	perPage := c.QueryInt("per_page", 100)
+	if perPage < 1 || perPage > 1000 {
+		perPage = 100
+	}
+
+	var entries []AuditLog
+	query.Order("id desc").Offset((page - 1) * perPage).Limit(perPage).Find(&entries)
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"data":     entries,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// handleAdminExportAudit streams every matching entry, oldest first, as
+// JSON Lines or, with ?format=csv, CSV.
+func handleAdminExportAudit(c *fiber.Ctx) error {
+	query, err := filterAudit(c)
+	if err != nil {
+		return apiError(c, 400, err.Error())
+	}
+	format := c.Query("format", "jsonl")
+	if format != "jsonl" && format != "csv" {
+		return apiError(c, 400, fmt.Sprintf("Invalid format '%s'", format))
+	}
+
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405") + "." + format
+	if format == "csv" {
+		c.Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Set("Content-Type", "application/x-ndjson")
+	}
+	c.Set("Content-Disposition", contentDisposition("attachment", filename))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		var write func(entry *AuditLog) error
+		if format == "csv" {
+			out := csv.NewWriter(w)
+			out.Write([]string{"id", "created_at", "event", "actor", "ip", "file_id", "detail", "request_id"})
+			write = func(entry *AuditLog) error {
+				out.Write([]string{
+					strconv.FormatUint(uint64(entry.ID), 10),
+					entry.CreatedAt.UTC().Format(time.RFC3339),
+					entry.Event, entry.Actor, entry.IP, entry.FileID, entry.Detail, entry.RequestID,
+				})
+				out.Flush()
+				return out.Error()
+			}
+		} else {
+			encoder := json.NewEncoder(w)
+			write = func(entry *AuditLog) error { return encoder.Encode(entry) }
+		}
+
+		var batch []AuditLog
+		result := query.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				if err := write(&batch[i]); err != nil {
+					return err
+				}
+			}
+			// Stop early once the client has gone away
+			return w.Flush()
+		})
+		if result.Error != nil {
+			log.Printf("Audit export stopped: %v", result.Error)
+		}
+		w.Flush()
+	})
+	return nil
+}
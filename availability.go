@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Release windows: an upload can be staged now and only served later, for
+// embargoed artifacts and the like. available_from (a date or RFC 3339
+// timestamp) is when downloads open; until then they answer 403 with the
+// time in X-Available-From, except to the file's owner and admins.
+// available_until is when the file expires, as a point in time instead of a
+// TTL from upload, and is capped like expires is.
+
+// releaseWindow is the window an upload asked for; either end may be open.
+type releaseWindow struct {
+	from  *time.Time
+	until *time.Time
+}
+
+// requestedWindow reads available_from and available_until from the query
+// string, the X-Available-From and X-Available-Until headers, or through
+// field (form or JSON fields; nil when the upload has none).
+func requestedWindow(c *fiber.Ctx, field func(string) string) (releaseWindow, error) {
+	value := func(name, header string) string {
+		if v := c.Query(name); v != "" {
+			return v
+		}
+		if v := c.Get(header); v != "" {
+			return v
+		}
+		if field != nil {
+			return field(name)
+		}
+		return ""
+	}
+	return parseReleaseWindow(value("available_from", "X-Available-From"), value("available_until", "X-Available-Until"))
+}
+
+// parseReleaseWindow checks the ends of a window, which must not be over
+// before it opens.
+func parseReleaseWindow(fromValue, untilValue string) (releaseWindow, error) {
+	var window releaseWindow
+	if fromValue != "" {
+		from, err := parseListTime(fromValue)
+		if err != nil {
+			return window, fmt.Errorf("Invalid available_from '%s': use a date or RFC 3339 timestamp", fromValue)
+		}
+		window.from = &from
+	}
+	if untilValue != "" {
+		until, err := parseListTime(untilValue)
+		if err != nil {
+			return window, fmt.Errorf("Invalid available_until '%s': use a date or RFC 3339 timestamp", untilValue)
+		}
+		if !until.After(time.Now()) {
+			return window, fmt.Errorf("available_until '%s' has already passed", untilValue)
+		}
+		if window.from != nil && !until.After(*window.from) {
+			return window, fmt.Errorf("available_until must be after available_from")
+		}
+		window.until = &until
+	}
+	return window, nil
+}
+
+// expiry works out when an upload of size bytes in the window expires:
+// at available_until, capped like expires, or as expiresValue says. Giving
+// both is refused, as is a file that would expire before it opens.
+func (w releaseWindow) expiry(expiresValue string, size int64) (*time.Time, error) {
+	if w.until == nil {
+		expiresAt, err := resolveExpiry(expiresValue, size)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expiration '%s'", expiresValue)
+		}
+		if w.from != nil && expiresAt != nil && !expiresAt.After(*w.from) {
+			return nil, fmt.Errorf("The file would expire before available_from; ask for a longer expiration")
+		}
+		return expiresAt, nil
+	}
+	if expiresValue != "" {
+		return nil, fmt.Errorf("Give expires or available_until, not both")
+	}
+
+	until := *w.until
+	if _, limit := retentionFor(size); limit > 0 && time.Until(until) > limit {
+		until = time.Now().Add(limit)
+		if w.from != nil && !until.After(*w.from) {
+			return nil, fmt.Errorf("available_from is further off than this server keeps files (%s)", formatDuration(limit))
+		}
+	}
+	return &until, nil
+}
+
+// refuseUnreleased stops files from being served before their window opens,
+// except to their owner and admins. It reports whether a response was sent.
+func refuseUnreleased(c *fiber.Ctx, fileRecord *FileRecord) (bool, error) {
+	if !fileRecord.unreleased() || ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+		return false, nil
+	}
+	c.Set("X-Available-From", fileRecord.AvailableFrom.UTC().Format(http.TimeFormat))
+	return true, c.Status(403).SendString(fmt.Sprintf("File is not available until %s",
+		fileRecord.AvailableFrom.UTC().Format(time.RFC3339)))
+}
+
+// unreleased reports whether the file's release window hasn't opened yet.
+func (f *FileRecord) unreleased() bool {
+	return f.AvailableFrom != nil && time.Now().Before(*f.AvailableFrom)
+}
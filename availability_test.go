@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReleaseWindow(t *testing.T) {
+	future := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+	later := time.Now().Add(72 * time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		from    string
+		until   string
+		wantErr bool
+	}{
+		{"open", "", "", false},
+		{"from only", future, "", false},
+		{"until only", "", future, false},
+		{"from then until", future, later, false},
+		{"until before from", later, future, true},
+		{"until equal to from", future, future, true},
+		{"until passed", "", past, true},
+		{"bad from", "soon", "", true},
+		{"bad until", "", "soon", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseReleaseWindow(tt.from, tt.until)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseReleaseWindow(%q, %q) error = %v, want error %v", tt.from, tt.until, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReleaseWindowExpiry(t *testing.T) {
+	savedPolicy := retentionPolicy
+	defer func() { retentionPolicy = savedPolicy }()
+	// Small files are kept for 30 days, bigger ones for a day
+	retentionPolicy = []retentionTier{
+		{maxSize: 1 << 20, lifetime: 30 * 24 * time.Hour},
+		{maxSize: 1 << 30, lifetime: 24 * time.Hour},
+	}
+
+	at := func(d time.Duration) *time.Time {
+		t := time.Now().Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name    string
+		window  releaseWindow
+		expires string
+		size    int64
+		want    time.Duration // from now; 0 when an error is expected
+		wantErr bool
+	}{
+		{"tier default", releaseWindow{}, "", 1 << 10, 30 * 24 * time.Hour, false},
+		{"expires capped by tier", releaseWindow{}, "7d", 10 << 20, 24 * time.Hour, false},
+		{"expires within tier", releaseWindow{}, "2h", 10 << 20, 2 * time.Hour, false},
+		{"bad expires", releaseWindow{}, "soon", 1 << 10, 0, true},
+		{"until within tier", releaseWindow{until: at(12 * time.Hour)}, "", 10 << 20, 12 * time.Hour, false},
+		{"until capped by tier", releaseWindow{until: at(72 * time.Hour)}, "", 10 << 20, 24 * time.Hour, false},
+		{"until and expires", releaseWindow{until: at(12 * time.Hour)}, "2h", 1 << 10, 0, true},
+		{"from before expiry", releaseWindow{from: at(time.Hour)}, "", 10 << 20, 24 * time.Hour, false},
+		{"from after tier expiry", releaseWindow{from: at(48 * time.Hour)}, "", 10 << 20, 0, true},
+		{"from after requested expiry", releaseWindow{from: at(3 * time.Hour)}, "2h", 1 << 10, 0, true},
+		{"from after capped until", releaseWindow{from: at(48 * time.Hour), until: at(72 * time.Hour)}, "", 10 << 20, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.window.expiry(tt.expires, tt.size)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expiry() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expiry() error = %v", err)
+			}
+			if got == nil {
+				t.Fatal("expiry() = nil, want a time")
+			}
+			if diff := time.Until(*got) - tt.want; diff < -time.Minute || diff > time.Minute {
+				t.Errorf("expiry() is %v from now, want %v", time.Until(*got).Round(time.Second), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Upload backpressure, so a burst of large uploads can't wedge the host.
+// MAX_CONCURRENT_UPLOADS caps how many uploads are being received at once
+// and MAX_INFLIGHT_UPLOAD_BYTES the bytes they announce between them; an
+// upload over either cap is turned away with 503 and Retry-After rather
+// than queued, so clients back off instead of holding connections open.
+// Uploads are also refused with 507 while the uploads directory's free space
+// is below MIN_FREE_DISK_SPACE, or would fall below it once the uploads in
+// flight and this one are written.
+
+const uploadRetryAfter = 5 // seconds
+
+var (
+	maxConcurrentUploads   int   // 0 means unlimited
+	maxInflightUploadBytes int64 // 0 means unlimited
+
+	uploadsMu           sync.Mutex
+	uploadsInFlight     int
+	uploadBytesInFlight int64
+)
+
+// loadBackpressureConfig reads MAX_CONCURRENT_UPLOADS and
+// MAX_INFLIGHT_UPLOAD_BYTES.
+func loadBackpressureConfig() {
+	concurrentStr := getEnv("MAX_CONCURRENT_UPLOADS", "0")
+	var err error
+	maxConcurrentUploads, err = strconv.Atoi(concurrentStr)
+	if err != nil || maxConcurrentUploads < 0 {
+		log.Printf("Invalid MAX_CONCURRENT_UPLOADS value '%s', using default unlimited", concurrentStr)
+		maxConcurrentUploads = 0
+	}
+	if maxConcurrentUploads > 0 {
+		log.Printf("Maximum concurrent uploads: %d", maxConcurrentUploads)
+	}
+
+	bytesStr := getEnv("MAX_INFLIGHT_UPLOAD_BYTES", "0")
+	maxInflightUploadBytes, err = parseSize(bytesStr)
+	if err != nil || maxInflightUploadBytes < 0 {
+		log.Printf("Invalid MAX_INFLIGHT_UPLOAD_BYTES value '%s', using default unlimited", bytesStr)
+		maxInflightUploadBytes = 0
+	}
+	if maxInflightUploadBytes > 0 {
+		log.Printf("Maximum bytes of uploads in flight: %s", formatBytes(maxInflightUploadBytes))
+	}
+}
+
+// uploadTicket is an upload's place among those in flight. It must be
+// released once the upload has been written, whatever the outcome.
+type uploadTicket struct {
+	size int64
+	once sync.Once
+}
+
+// admitUpload lets an upload of size bytes (0 when not known yet) start, or
+// reports why it can't: the server is busy with other uploads, or the disk
+// is too full.
+func admitUpload(size int64) (*uploadTicket, *quotaError) {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+
+	if maxConcurrentUploads > 0 && uploadsInFlight >= maxConcurrentUploads {
+		return nil, &quotaError{503, fmt.Sprintf("Server is busy with other uploads (%d in progress). Try again shortly", uploadsInFlight)}
+	}
+	// A lone upload bigger than the cap is still let through when nothing
+	// else is in flight, or it could never be made
+	if maxInflightUploadBytes > 0 && uploadsInFlight > 0 && uploadBytesInFlight+size > maxInflightUploadBytes {
+		return nil, &quotaError{503, fmt.Sprintf("Server is busy receiving %s of uploads. Try again shortly", formatBytes(uploadBytesInFlight))}
+	}
+	if free, err := freeDiskSpace(uploadDir); err == nil && free-uploadBytesInFlight-size < minFreeDisk {
+		return nil, &quotaError{507, fmt.Sprintf("Not enough disk space: %s free. Try again later", formatBytes(free))}
+	}
+
+	uploadsInFlight++
+	uploadBytesInFlight += size
+	return &uploadTicket{size: size}, nil
+}
+
+// release gives the ticket's place back. It is safe to call on nil and more
+// than once.
+func (t *uploadTicket) release() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		uploadsMu.Lock()
+		uploadsInFlight--
+		uploadBytesInFlight -= t.size
+		uploadsMu.Unlock()
+	})
+}
+
+// setUploadRetryAfter tells a client turned away by admitUpload when to try
+// again, if waiting will help.
+func setUploadRetryAfter(c *fiber.Ctx, refusal *quotaError) {
+	if refusal.status == 503 {
+		c.Set("Retry-After", strconv.Itoa(uploadRetryAfter))
+	}
+}
+
+// refuseUpload answers a plain-text upload request admitUpload turned away.
+func refuseUpload(c *fiber.Ctx, refusal *quotaError) error {
+	setUploadRetryAfter(c, refusal)
+	return c.Status(refusal.status).SendString(refusal.message)
+}
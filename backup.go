@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Metadata backups, so moving an instance doesn't mean copying the SQLite
+// file from under a running server. GET /api/admin/export streams the
+// database as JSON Lines: a header, then one {"table": ..., "row": {...}}
+// line per row with every column. POST /api/admin/import loads such a dump,
+// gzipped or not, into an instance that has no files yet (or, with
+// ?replace=true, in place of what it has), whatever its database engine.
+// File contents aren't in the dump; they stay in the storage backend.
+//
+// With BACKUP_INTERVAL set the maintenance replica also writes a gzipped
+// dump to the storage backend under .backups/ on that schedule, keeping the
+// last BACKUP_KEEP.
+
+const (
+	backupFormat    = "bashupload-backup"
+	backupVersion   = 1
+	backupBatchSize = 500
+	backupKeyPrefix = ".backups/"
+)
+
+// backupModels are the tables a backup holds, leaving out uploads still in
+// progress and the server's own queues and leases.
+var backupModels = []interface{}{
+	&FileRecord{}, &Blob{}, &FileTag{}, &FileMetadata{}, &DownloadEvent{}, &Alias{}, &Bundle{}, &APIKey{}, &User{},
+	&BannedIP{}, &AbuseReport{}, &AuditLog{}, &UsageStat{}, &StorageSample{}, &DailyStat{},
+}
+
+// appendedModels are the tables the server writes to on its own, e.g. the
+// audit entry of the import itself. Their rows are added with new IDs, and
+// rows clashing with ones already there are skipped.
+var appendedModels = []interface{}{&AuditLog{}, &UsageStat{}, &StorageSample{}, &DailyStat{}}
+
+// errImportNotEmpty refuses an import into an instance that has data.
+var errImportNotEmpty = errors.New("instance already has files, keys or users")
+
+var (
+	backupInterval time.Duration
+	backupKeep     int
+)
+
+// MetadataBackup is a scheduled backup written to the storage backend.
+type MetadataBackup struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Key       string    `json:"key" gorm:"not null"`
+	Size      int64     `json:"size"`
+	Rows      int64     `json:"rows"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// backupHeader is the first line of a dump.
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type backupRow struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+type backupLine struct {
+	Table string                     `json:"table"`
+	Row   map[string]json.RawMessage `json:"row"`
+}
+
+// loadBackupConfig reads BACKUP_INTERVAL and BACKUP_KEEP.
+func loadBackupConfig() {
+	intervalStr := getEnv("BACKUP_INTERVAL", "0")
+	var err error
+	backupInterval, err = parseDuration(intervalStr)
+	if err != nil || backupInterval < 0 {
+		log.Printf("Invalid BACKUP_INTERVAL value '%s', not taking backups", intervalStr)
+		backupInterval = 0
+	}
+
+	keepStr := getEnv("BACKUP_KEEP", "7")
+	backupKeep, err = strconv.Atoi(keepStr)
+	if err != nil || backupKeep < 1 {
+		log.Printf("Invalid BACKUP_KEEP value '%s', using default 7", keepStr)
+		backupKeep = 7
+	}
+	if backupInterval > 0 {
+		log.Printf("Backing up the database every %s, keeping %d", formatDuration(backupInterval), backupKeep)
+	}
+}
+
+// backupSchema is the parsed schema of a backed up model.
+func backupSchema(model interface{}) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+// writeBackup writes a dump of the database to w, read in one transaction
+// so it's consistent, and returns how many rows it holds.
+func writeBackup(w io.Writer) (int64, error) {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(backupHeader{Format: backupFormat, Version: backupVersion, CreatedAt: time.Now()}); err != nil {
+		return 0, err
+	}
+
+	// SQLite and MySQL transactions see a snapshot already; Postgres needs
+	// asking
+	var options *sql.TxOptions
+	if db.Dialector.Name() == "postgres" {
+		options = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	}
+	var rows int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range backupModels {
+			sch, err := backupSchema(model)
+			if err != nil {
+				return err
+			}
+			batch := reflect.New(reflect.SliceOf(sch.ModelType))
+			result := tx.Unscoped().Model(model).FindInBatches(batch.Interface(), backupBatchSize, func(*gorm.DB, int) error {
+				records := batch.Elem()
+				for i := 0; i < records.Len(); i++ {
+					record := records.Index(i)
+					row := make(map[string]interface{}, len(sch.DBNames))
+					for _, name := range sch.DBNames {
+						row[name], _ = sch.FieldsByDBName[name].ValueOf(context.Background(), record)
+					}
+					if err := encoder.Encode(backupRow{Table: sch.Table, Row: row}); err != nil {
+						return err
+					}
+					rows++
+				}
+				return nil
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	}, options)
+	return rows, err
+}
+
+// importBackup loads a dump, gzipped or not, and returns how many rows it
+// held. Without replace the instance must have no files, keys or users.
+func importBackup(r io.Reader, replace bool) (int64, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+	decoder := json.NewDecoder(reader)
+
+	var header backupHeader
+	if err := decoder.Decode(&header); err != nil || header.Format != backupFormat {
+		return 0, errors.New("not a bashupload backup")
+	}
+	if header.Version > backupVersion {
+		return 0, fmt.Errorf("backup version %d is newer than this server understands", header.Version)
+	}
+
+	schemas := make(map[string]*schema.Schema)
+	appended := make(map[string]bool)
+	for _, model := range backupModels {
+		sch, err := backupSchema(model)
+		if err != nil {
+			return 0, err
+		}
+		schemas[sch.Table] = sch
+	}
+	for _, model := range appendedModels {
+		sch, _ := backupSchema(model)
+		appended[sch.Table] = true
+	}
+
+	var rows int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if replace {
+			for _, model := range backupModels {
+				if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(model).Error; err != nil {
+					return err
+				}
+			}
+		} else {
+			for _, model := range []interface{}{&FileRecord{}, &Blob{}, &APIKey{}, &User{}, &Bundle{}} {
+				var count int64
+				tx.Unscoped().Model(model).Count(&count)
+				if count > 0 {
+					return errImportNotEmpty
+				}
+			}
+		}
+
+		for {
+			var line backupLine
+			if err := decoder.Decode(&line); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("invalid backup line %d: %w", rows+2, err)
+			}
+			sch, ok := schemas[line.Table]
+			if !ok {
+				return fmt.Errorf("unknown table '%s' in the backup", line.Table)
+			}
+
+			row := make(map[string]interface{}, len(line.Row))
+			for name, raw := range line.Row {
+				field, ok := sch.FieldsByDBName[name]
+				// Columns this version doesn't have are left behind
+				if !ok || (appended[line.Table] && field.PrimaryKey) {
+					continue
+				}
+				value := reflect.New(field.FieldType)
+				if err := json.Unmarshal(raw, value.Interface()); err != nil {
+					return fmt.Errorf("invalid %s.%s in the backup: %w", line.Table, name, err)
+				}
+				row[name] = value.Elem().Interface()
+			}
+			// Files and blobs are served from their file_path, which must
+			// not point anywhere but at a blob
+			if key, ok := row["file_path"].(string); ok && !validStorageKey(key) {
+				return fmt.Errorf("invalid file_path '%s' in a %s row of the backup", key, line.Table)
+			}
+			insert := tx.Table(line.Table)
+			if appended[line.Table] {
+				insert = insert.Clauses(clause.OnConflict{DoNothing: true})
+			}
+			if err := insert.Create(row).Error; err != nil {
+				return fmt.Errorf("failed to import a %s row: %w", line.Table, err)
+			}
+			rows++
+		}
+		return resetSequences(tx, schemas)
+	})
+	return rows, err
+}
+
+// resetSequences moves Postgres ID sequences past the imported IDs; the
+// other databases follow explicit IDs on their own.
+func resetSequences(tx *gorm.DB, schemas map[string]*schema.Schema) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	for table, sch := range schemas {
+		if sch.PrioritizedPrimaryField == nil || sch.PrioritizedPrimaryField.DBName != "id" {
+			continue
+		}
+		err := tx.Exec(fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %[1]s`, table)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupLoop takes a backup every BACKUP_INTERVAL.
+func backupLoop() {
+	if backupInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(backupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		if _, err := takeBackup(); err != nil {
+			log.Printf("Backup failed: %v", err)
+		}
+	}
+}
+
+// takeBackup writes a gzipped dump to the storage backend and drops the
+// backups past BACKUP_KEEP.
+func takeBackup() (*MetadataBackup, error) {
+	stagedPath := newStagingPath()
+	file, err := os.Create(stagedPath)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(file)
+	rows, err := writeBackup(gz)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	info, statErr := os.Stat(stagedPath)
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		os.Remove(stagedPath)
+		return nil, err
+	}
+
+	createdAt := time.Now().UTC()
+	key := backupKeyPrefix + "metadata-" + createdAt.Format("20060102T150405Z") + ".jsonl.gz"
+	if err := persistStaged(key, stagedPath, info.Size()); err != nil {
+		return nil, err
+	}
+	backup := MetadataBackup{Key: key, Size: info.Size(), Rows: rows, CreatedAt: createdAt}
+	if err := db.Create(&backup).Error; err != nil {
+		return nil, err
+	}
+	enqueueMirror(key, mirrorCopy)
+	log.Printf("Backed up %d rows to %s (%s)", rows, key, formatBytes(info.Size()))
+
+	var old []MetadataBackup
+	db.Order("id DESC").Offset(backupKeep).Find(&old)
+	for i := range old {
+		if err := fileStorage.Delete(old[i].Key); err != nil {
+			log.Printf("Failed to delete old backup %s: %v", old[i].Key, err)
+			continue
+		}
+		enqueueMirror(old[i].Key, mirrorDelete)
+		db.Delete(&old[i])
+	}
+	return &backup, nil
+}
+
+// handleAdminExport is GET /api/admin/export, a dump of the database.
+func handleAdminExport(c *fiber.Ctx) error {
+	c.Set("Content-Type", "application/x-ndjson")
+	c.Set("Content-Disposition", contentDisposition("attachment", "bashupload-"+time.Now().UTC().Format("20060102T150405Z")+".jsonl"))
+	logger := requestLog(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if _, err := writeBackup(w); err != nil {
+			// The status is long sent; a truncated dump won't import
+			logger.Error("Export failed", "error", err)
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+// handleAdminImport is POST /api/admin/import, which loads a dump sent as
+// the request body.
+func handleAdminImport(c *fiber.Ctx) error {
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	rows, err := importBackup(body, c.QueryBool("replace"))
+	if errors.Is(err, errImportNotEmpty) {
+		return apiError(c, 409, "This instance already has files, keys or users; import with ?replace=true to replace them")
+	}
+	if err != nil {
+		return apiError(c, 400, "Failed to import the backup: "+err.Error())
+	}
+	reloadBans()
+	requestLog(c).Info("Imported a backup", "rows", rows, "replace", c.QueryBool("replace"))
+	return c.JSON(fiber.Map{
+		"success": true,
+		"rows":    rows,
+	})
+}
+
+// handleAdminListBackups is GET /api/admin/backups, newest first.
+func handleAdminListBackups(c *fiber.Ctx) error {
+	var backups []MetadataBackup
+	db.Order("id DESC").Find(&backups)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    backups,
+	})
+}
+
+// handleAdminCreateBackup is POST /api/admin/backups, a backup taken now.
+func handleAdminCreateBackup(c *fiber.Ctx) error {
+	backup, err := takeBackup()
+	if err != nil {
+		requestLog(c).Error("Backup failed", "error", err)
+		return apiError(c, 500, "Backup failed")
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    backup,
+	})
+}
+
+// handleAdminDownloadBackup is GET /api/admin/backups/:id, the gzipped dump.
+func handleAdminDownloadBackup(c *fiber.Ctx) error {
+	var backup MetadataBackup
+	if err := db.First(&backup, c.Params("id")).Error; err != nil {
+		return apiError(c, 404, "Backup not found")
+	}
+	reader, err := openBlob(backup.Key)
+	if err != nil {
+		return apiError(c, 404, "Backup not found in storage")
+	}
+	c.Set("Content-Type", "application/gzip")
+	c.Set("Content-Disposition", contentDisposition("attachment", path.Base(backup.Key)))
+	return c.SendStream(reader, int(backup.Size))
+}
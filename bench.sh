@@ -0,0 +1,82 @@
+#!/bin/bash
+
+# bashupload download benchmark
+#
+# Uploads test files to a running server and downloads them many times in
+# parallel with curl, reporting the aggregate throughput of each scenario.
+# Run it from a machine other than the server's when measuring the NIC, and
+# start the server with MAX_DOWNLOADS=0 so the files outlive the run and a
+# RATE_LIMIT_MAX above the number of requests made.
+#
+#   BENCH_URL=http://server:3000 BENCH_CONCURRENCY=32 ./bench.sh
+#
+# Settings (environment):
+#   BENCH_URL          server to test (default http://localhost:3000)
+#   BENCH_API_KEY      API key for servers with REQUIRE_API_KEY
+#   BENCH_SIZE_MB      size of the large file in MB (default 1024)
+#   BENCH_CONCURRENCY  downloads in flight at once (default 8)
+#   BENCH_REQUESTS     downloads per scenario (default 32)
+
+set -euo pipefail
+
+URL="${BENCH_URL:-http://localhost:3000}"
+URL="${URL%/}"
+SIZE_MB="${BENCH_SIZE_MB:-1024}"
+CONCURRENCY="${BENCH_CONCURRENCY:-8}"
+REQUESTS="${BENCH_REQUESTS:-32}"
+
+WORK=$(mktemp -d)
+trap 'rm -rf "$WORK"' EXIT
+
+AUTH=()
+if [ -n "${BENCH_API_KEY:-}" ]; then
+    AUTH=(-H "X-API-Key: $BENCH_API_KEY")
+fi
+
+# upload NAME FILE prints the download path and delete token of FILE, kept
+# for an hour
+upload() {
+    local response
+    response=$(curl -sf "${AUTH[@]}" --data-binary @"$2" -X PUT "$URL/?filename=$1&downloads=0&expires=1h") || return 0
+    echo "$(grep -o '/d/[^[:space:]]*' <<< "$response" | head -1) $(grep -o 'delete token: [0-9a-f]*' <<< "$response" | cut -d' ' -f3)"
+}
+
+# run NAME LINK [CURL ARGS...] downloads LINK $REQUESTS times and reports
+# the bytes per second across all of them, and how many failed
+run() {
+    local name=$1 link=$2
+    shift 2
+    local start end results
+    start=$(date +%s.%N)
+    results=$(seq "$REQUESTS" | xargs -P "$CONCURRENCY" -I{} \
+        curl -s -o /dev/null -w '%{http_code} %{size_download}\n' "$@" "$link" || true)
+    end=$(date +%s.%N)
+    awk -v name="$name" -v start="$start" -v end="$end" '
+        $1 ~ /^2/ { ok++; bytes += $2; next }
+        { failed++ }
+        END {
+            secs = end - start
+            printf "%-22s %6d ok  %6d failed  %10.1f req/s  %8.2f Gbit/s\n", name, ok, failed, ok / secs, bytes * 8 / secs / 1e9
+        }' <<< "$results"
+}
+
+echo "bashupload benchmark against $URL ($REQUESTS downloads, $CONCURRENCY at once)"
+
+echo "Creating a ${SIZE_MB} MB test file..."
+head -c "$((SIZE_MB * 1024 * 1024))" /dev/urandom > "$WORK/large.bin"
+head -c 4096 /dev/urandom > "$WORK/small.bin"
+
+read -r LARGE LARGE_TOKEN <<< "$(upload large.bin "$WORK/large.bin")"
+read -r SMALL SMALL_TOKEN <<< "$(upload small.bin "$WORK/small.bin")"
+if [ -z "$LARGE" ] || [ -z "$SMALL" ]; then
+    echo "Upload failed; is the server running at $URL?" >&2
+    exit 1
+fi
+
+run "large file" "$URL$LARGE"
+run "large file, 2nd half" "$URL$LARGE" -H "Range: bytes=$((SIZE_MB * 512 * 1024))-"
+run "4 KB file" "$URL$SMALL"
+
+# Leave nothing behind
+curl -sf -X DELETE -H "X-Delete-Token: $LARGE_TOKEN" "$URL$LARGE" > /dev/null || true
+curl -sf -X DELETE -H "X-Delete-Token: $SMALL_TOKEN" "$URL$SMALL" > /dev/null || true
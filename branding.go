@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Branding, so an instance can carry its own name, logo, colour and terms
+// without forking the templates. BRAND_* settings reach every page as
+// .Brand; TEMPLATES_DIR holds templates that replace the built-in ones of
+// the same name, so a single page (or notify.txt) can be changed while the
+// rest keep tracking upstream.
+
+// brandConfig is what the pages show of the instance.
+type brandConfig struct {
+	Name        string // shown as the title and heading
+	LogoURL     string // shown before the name when set
+	AccentColor string // replaces the green; empty keeps it
+	Footer      string // plain text shown at the foot of every page
+	TermsURL    string // linked from the footer when set
+}
+
+const builtinTemplatesDir = "./templates"
+
+var (
+	brand        brandConfig
+	templatesDir string // custom templates, empty when there are none
+
+	accentColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+)
+
+// loadBrandConfig reads BRAND_NAME, BRAND_LOGO_URL, BRAND_ACCENT_COLOR,
+// BRAND_FOOTER, BRAND_TERMS_URL and TEMPLATES_DIR.
+func loadBrandConfig() {
+	brand = brandConfig{
+		Name:     getEnv("BRAND_NAME", "bashupload"),
+		LogoURL:  getEnv("BRAND_LOGO_URL", ""),
+		Footer:   getEnv("BRAND_FOOTER", ""),
+		TermsURL: getEnv("BRAND_TERMS_URL", ""),
+	}
+
+	if color := getEnv("BRAND_ACCENT_COLOR", ""); color != "" {
+		if accentColorPattern.MatchString(color) {
+			brand.AccentColor = color
+		} else {
+			log.Printf("Invalid BRAND_ACCENT_COLOR value '%s', use a hex colour like #ff6600; keeping the default", color)
+		}
+	}
+	if brand.Name != "bashupload" {
+		log.Printf("Branded as %s", brand.Name)
+	}
+
+	templatesDir = getEnv("TEMPLATES_DIR", "")
+	if templatesDir != "" {
+		if info, err := os.Stat(templatesDir); err != nil || !info.IsDir() {
+			log.Printf("TEMPLATES_DIR %s is not a directory, using the built-in templates", templatesDir)
+			templatesDir = ""
+		} else {
+			log.Printf("Templates in %s override the built-in ones", templatesDir)
+		}
+	}
+}
+
+// templateFiles is the templates the pages are rendered from: the built-in
+// ones with those in TEMPLATES_DIR in place of their namesakes.
+func templateFiles() fs.FS {
+	builtin := os.DirFS(builtinTemplatesDir)
+	if templatesDir == "" {
+		return builtin
+	}
+	return overlayFS{top: os.DirFS(templatesDir), base: builtin}
+}
+
+// templatePath is where the template name is read from.
+func templatePath(name string) string {
+	if templatesDir != "" {
+		custom := filepath.Join(templatesDir, name)
+		if _, err := os.Stat(custom); err == nil {
+			return custom
+		}
+	}
+	return filepath.Join(builtinTemplatesDir, name)
+}
+
+// overlayFS serves files from top where it has them and from base
+// otherwise. A directory both have lists the entries of both.
+type overlayFS struct {
+	top, base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if err != nil {
+		return o.base.Open(name)
+	}
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		return f, nil
+	}
+
+	entries, err := o.ReadDir(name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &overlayDir{File: f, entries: entries}, nil
+}
+
+// ReadDir lists a directory of either, top's entry winning a name both have.
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	byName := make(map[string]fs.DirEntry)
+	baseEntries, baseErr := fs.ReadDir(o.base, name)
+	for _, entry := range baseEntries {
+		byName[entry.Name()] = entry
+	}
+	topEntries, topErr := fs.ReadDir(o.top, name)
+	if topErr != nil && baseErr != nil {
+		return nil, topErr
+	}
+	for _, entry := range topEntries {
+		byName[entry.Name()] = entry
+	}
+
+	entries := make([]fs.DirEntry, 0, len(byName))
+	for _, entry := range byName {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// overlayDir is a directory of an overlayFS, read as the merged listing.
+type overlayDir struct {
+	fs.File
+	entries []fs.DirEntry
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Bundles group uploads under one link: /b/:id downloads every file in the
+// bundle as a zip, written to the response as it is read from storage so no
+// archive is ever built on disk. A bundle has its own expiry and download
+// limit; each bundle download also counts as a download of every file in it,
+// and files that are gone, exhausted or blocked by the scanner are left out.
+
+const bundleMaxFiles = 1000
+
+// Bundle is a named group of uploads.
+type Bundle struct {
+	ID           uint       `json:"-" gorm:"primaryKey"`
+	BundleID     string     `json:"bundle_id" gorm:"uniqueIndex;not null"`
+	Name         string     `json:"name"`
+	Downloads    int        `json:"downloads" gorm:"default:0"`
+	MaxDownloads int        `json:"max_downloads"` // 0 is unlimited
+	DeleteToken  string     `json:"-"`             // SHA-256 of the management token
+	IPAddress    string     `json:"ip_address"`
+	UserID       *uint      `json:"user_id,omitempty" gorm:"index"`
+	APIKeyID     *uint      `json:"api_key_id,omitempty" gorm:"index"`
+	CreatedAt    time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty" gorm:"index"`
+}
+
+func (b *Bundle) expired() bool {
+	return b.ExpiresAt != nil && time.Now().After(*b.ExpiresAt)
+}
+
+func setupBundleRoutes(api fiber.Router, upload, read fiber.Handler) {
+	api.Post("/bundles", upload, handleCreateBundle)
+	api.Get("/bundles/:id", read, handleBundleInfo)
+	api.Post("/bundles/:id/files", upload, handleAddBundleFiles)
+	api.Delete("/bundles/:id", upload, handleDeleteBundle)
+}
+
+// bundleFileRef names a file to add to a bundle. The delete token proves the
+// caller uploaded it; files uploaded while signed in or with an issued key
+// can be added by their owner without it.
+type bundleFileRef struct {
+	ID          string `json:"id"`
+	DeleteToken string `json:"delete_token"`
+}
+
+type bundleRequest struct {
+	Name      string          `json:"name"`
+	Expires   string          `json:"expires"`
+	Downloads string          `json:"downloads"`
+	Files     []bundleFileRef `json:"files"`
+}
+
+func bundleError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{
+		"success": false,
+		"message": message,
+	})
+}
+
+// resolveBundleFiles loads the files refs point to, checking the caller may
+// bundle each of them. bundle is the bundle they're added to, nil while it's
+// being created.
+func resolveBundleFiles(c *fiber.Ctx, refs []bundleFileRef, bundle *Bundle) ([]FileRecord, int, string) {
+	files := make([]FileRecord, 0, len(refs))
+	seen := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		if seen[ref.ID] {
+			continue
+		}
+		seen[ref.ID] = true
+
+		var fileRecord FileRecord
+		if result := db.Where("unique_id = ?", ref.ID).First(&fileRecord); result.Error != nil {
+			return nil, 404, fmt.Sprintf("File %s not found", ref.ID)
+		}
+		if !tokenMatches(ref.DeleteToken, fileRecord.DeleteToken) && !ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+			return nil, 403, fmt.Sprintf("File %s: delete token required to bundle it", ref.ID)
+		}
+		// A zip of the bundle would hand it out without asking
+		if fileRecord.PasswordHash != "" {
+			return nil, 400, fmt.Sprintf("File %s is password-protected and can't be bundled", ref.ID)
+		}
+		if fileRecord.BundleID != nil && (bundle == nil || *fileRecord.BundleID != bundle.ID) {
+			return nil, 409, fmt.Sprintf("File %s is already in another bundle", ref.ID)
+		}
+		files = append(files, fileRecord)
+	}
+	return files, 0, ""
+}
+
+// addToBundle attaches files to bundle, refusing to grow it past
+// bundleMaxFiles.
+func addToBundle(bundle *Bundle, files []FileRecord) (int, string) {
+	ids := make([]uint, 0, len(files))
+	for _, fileRecord := range files {
+		ids = append(ids, fileRecord.ID)
+	}
+
+	status, message := 0, ""
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		tx.Model(&FileRecord{}).Where("bundle_id = ? AND id NOT IN ?", bundle.ID, ids).Count(&count)
+		if count+int64(len(ids)) > bundleMaxFiles {
+			status, message = 400, fmt.Sprintf("A bundle holds at most %d files", bundleMaxFiles)
+			return gorm.ErrInvalidData
+		}
+		return tx.Model(&FileRecord{}).Where("id IN ?", ids).Update("bundle_id", bundle.ID).Error
+	})
+	if err != nil && status == 0 {
+		status, message = 500, "Failed to update bundle"
+	}
+	return status, message
+}
+
+// bundleInfo describes a bundle and the files in it.
+func bundleInfo(c *fiber.Ctx, bundle *Bundle) fiber.Map {
+	var records []FileRecord
+	db.Where("bundle_id = ?", bundle.ID).Order("original_name").Find(&records)
+
+	baseURL := getBaseURL(c)
+	files := make([]fileListEntry, 0, len(records))
+	var totalSize int64
+	for _, rec := range records {
+		files = append(files, fileListEntry{
+			FileRecord:  rec,
+			DownloadURL: signLink(baseURL+rec.downloadPath(), &rec),
+		})
+		totalSize += rec.FileSize
+	}
+
+	return fiber.Map{
+		"bundle":       bundle,
+		"download_url": fmt.Sprintf("%s/b/%s", baseURL, bundle.BundleID),
+		"file_count":   len(files),
+		"total_size":   totalSize,
+		"files":        files,
+	}
+}
+
+// handleCreateBundle is POST /api/bundles: {"name", "expires", "downloads",
+// "files": [{"id", "delete_token"}]}, all optional. The response carries the
+// bundle's delete token, needed to add files to it or delete it later.
+func handleCreateBundle(c *fiber.Ctx) error {
+	var req bundleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return bundleError(c, 400, "Invalid request body")
+	}
+	if len(req.Files) > bundleMaxFiles {
+		return bundleError(c, 400, fmt.Sprintf("A bundle holds at most %d files", bundleMaxFiles))
+	}
+
+	expiresAt, err := resolveExpiry(req.Expires, 0)
+	if err != nil {
+		return bundleError(c, 400, fmt.Sprintf("Invalid expiration '%s'", req.Expires))
+	}
+	bundleMaxDownloads, err := resolveMaxDownloads(req.Downloads)
+	if err != nil {
+		return bundleError(c, 400, fmt.Sprintf("Invalid download limit '%s'", req.Downloads))
+	}
+
+	files, status, message := resolveBundleFiles(c, req.Files, nil)
+	if status != 0 {
+		return bundleError(c, status, message)
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+	bundle := Bundle{
+		BundleID:    newBundleID(),
+		Name:        strings.TrimSpace(req.Name),
+		DeleteToken: deleteTokenHash,
+		IPAddress:   storedIP(c.IP()),
+		UserID:      currentUserID(c),
+		APIKeyID:    currentAPIKeyID(c),
+		ExpiresAt:   expiresAt,
+	}
+	if bundleMaxDownloads != nil {
+		bundle.MaxDownloads = *bundleMaxDownloads
+	} else {
+		bundle.MaxDownloads = maxDownloads
+	}
+	if bundle.Name != "" {
+		bundle.Name = sanitizeFilename(bundle.Name)
+	}
+
+	if result := db.Create(&bundle); result.Error != nil {
+		return bundleError(c, 500, "Failed to create bundle")
+	}
+	if len(files) > 0 {
+		if status, message := addToBundle(&bundle, files); status != 0 {
+			db.Delete(&bundle)
+			return bundleError(c, status, message)
+		}
+	}
+	requestLog(c).Info("Bundle created", "bundle_id", bundle.BundleID, "files", len(files))
+
+	info := bundleInfo(c, &bundle)
+	info["success"] = true
+	info["delete_token"] = deleteToken
+	return c.JSON(info)
+}
+
+// loadBundle finds the bundle named in the URL, removing it if it has
+// expired.
+func loadBundle(c *fiber.Ctx) *Bundle {
+	var bundle Bundle
+	if result := db.Where("bundle_id = ?", c.Params("id")).First(&bundle); result.Error != nil {
+		return nil
+	}
+	if bundle.expired() {
+		deleteBundle(&bundle)
+		requestLog(c).Info("Removed expired bundle", "bundle_id", bundle.BundleID)
+		return nil
+	}
+	return &bundle
+}
+
+// managesBundle reports whether the request may change bundle: it carries
+// the bundle's delete token (X-Delete-Token or ?token=) or comes from its
+// owner.
+func managesBundle(c *fiber.Ctx, bundle *Bundle) bool {
+	token := c.Get("X-Delete-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	return tokenMatches(token, bundle.DeleteToken) || ownsUpload(c, bundle.UserID, bundle.APIKeyID)
+}
+
+func handleBundleInfo(c *fiber.Ctx) error {
+	bundle := loadBundle(c)
+	if bundle == nil {
+		return bundleError(c, 404, "Bundle not found")
+	}
+	info := bundleInfo(c, bundle)
+	info["success"] = true
+	return c.JSON(info)
+}
+
+// handleAddBundleFiles is POST /api/bundles/:id/files: {"files": [{"id",
+// "delete_token"}]}.
+func handleAddBundleFiles(c *fiber.Ctx) error {
+	bundle := loadBundle(c)
+	if bundle == nil {
+		return bundleError(c, 404, "Bundle not found")
+	}
+	if !managesBundle(c, bundle) {
+		audit(c, auditAuthFailure, "", "bundle token for "+bundle.BundleID)
+		return bundleError(c, 403, "Invalid deletion token")
+	}
+
+	var req bundleRequest
+	if err := c.BodyParser(&req); err != nil || len(req.Files) == 0 {
+		return bundleError(c, 400, "files is required")
+	}
+	if len(req.Files) > bundleMaxFiles {
+		return bundleError(c, 400, fmt.Sprintf("A bundle holds at most %d files", bundleMaxFiles))
+	}
+	files, status, message := resolveBundleFiles(c, req.Files, bundle)
+	if status != 0 {
+		return bundleError(c, status, message)
+	}
+	if status, message := addToBundle(bundle, files); status != 0 {
+		return bundleError(c, status, message)
+	}
+
+	info := bundleInfo(c, bundle)
+	info["success"] = true
+	return c.JSON(info)
+}
+
+// handleDeleteBundle removes a bundle. The files in it stay, with their own
+// expiry and download limits.
+func handleDeleteBundle(c *fiber.Ctx) error {
+	bundle := loadBundle(c)
+	if bundle == nil {
+		return bundleError(c, 404, "Bundle not found")
+	}
+	if !managesBundle(c, bundle) {
+		audit(c, auditAuthFailure, "", "bundle token for "+bundle.BundleID)
+		return bundleError(c, 403, "Invalid deletion token")
+	}
+	deleteBundle(bundle)
+	requestLog(c).Info("Bundle deleted", "bundle_id", bundle.BundleID)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Bundle deleted",
+	})
+}
+
+// deleteBundle removes a bundle, releasing its files.
+func deleteBundle(bundle *Bundle) {
+	db.Model(&FileRecord{}).Where("bundle_id = ?", bundle.ID).Update("bundle_id", nil)
+	db.Delete(bundle)
+}
+
+// bundleEntryNames gives each file a distinct name inside the zip, numbering
+// repeated names like "report (2).pdf".
+func bundleEntryNames(files []FileRecord) []string {
+	names := make([]string, len(files))
+	used := make(map[string]bool, len(files))
+	for i, fileRecord := range files {
+		name := fileRecord.OriginalName
+		if name == "" {
+			name = fileRecord.UniqueID + fileRecord.Extension
+		}
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// handleBundleDownload is GET /b/:id: every servable file in the bundle as
+// one zip. Unlike /zip it asks for no signatures, even with
+// SIGNED_URLS_REQUIRED: only a file's uploader can bundle it, so the bundle
+// link is a share they chose to make, as a signed link is, and it ends with
+// the bundle's own expiry and download limit.
+func handleBundleDownload(c *fiber.Ctx) error {
+	bundle := loadBundle(c)
+	if bundle == nil {
+		return c.Status(404).SendString("Bundle not found")
+	}
+	if bundle.MaxDownloads > 0 && bundle.Downloads >= bundle.MaxDownloads {
+		deleteBundle(bundle)
+		requestLog(c).Info("Removed bundle at its download limit", "bundle_id", bundle.BundleID, "downloads", bundle.Downloads)
+		return c.Status(410).SendString(fmt.Sprintf("Bundle has reached maximum download limit (%d) and was removed", bundle.MaxDownloads))
+	}
+
+	var candidates []FileRecord
+	db.Where("bundle_id = ?", bundle.ID).Order("original_name").Find(&candidates)
+	files := make([]FileRecord, 0, len(candidates))
+	claims := make([]*downloadClaim, 0, len(candidates))
+	for _, fileRecord := range candidates {
+		if fileRecord.ScanStatus == scanInfected || fileRecord.ScanStatus == scanPending ||
+			fileRecord.Moderation == moderationHeld || fileRecord.unreleased() {
+			continue
+		}
+		if _, err := statBlob(fileRecord.FilePath); err != nil {
+			continue
+		}
+		// Leaves out files that have expired or have no downloads left
+		claim := claimDownload(&fileRecord, c.IP())
+		if claim == nil {
+			continue
+		}
+		claim.by(c.IP(), c.Get("User-Agent"))
+		files = append(files, fileRecord)
+		claims = append(claims, claim)
+	}
+	if len(files) == 0 {
+		return c.Status(404).SendString("Bundle has no files available")
+	}
+
+	// The bundle's own limit is claimed the same way
+	query := db.Model(&Bundle{}).Where("id = ?", bundle.ID)
+	if bundle.MaxDownloads > 0 {
+		query = query.Where("downloads < ?", bundle.MaxDownloads)
+	}
+	if query.UpdateColumn("downloads", gorm.Expr("downloads + 1")).RowsAffected == 0 {
+		refundClaims(claims)
+		return c.Status(410).SendString(fmt.Sprintf("Bundle has reached maximum download limit (%d)", bundle.MaxDownloads))
+	}
+	for i := range files {
+		recordDownloadUsage(&files[i], files[i].FileSize, true)
+		audit(c, auditDownload, files[i].UniqueID, "bundle "+bundle.BundleID)
+	}
+	requestLog(c).Info("Bundle downloaded", "bundle_id", bundle.BundleID, "files", len(files), "downloads", bundle.Downloads+1)
+
+	archiveName := bundle.Name
+	if archiveName == "" {
+		archiveName = "bundle-" + bundle.BundleID[:min(8, len(bundle.BundleID))]
+	}
+	if !strings.EqualFold(filepath.Ext(archiveName), ".zip") {
+		archiveName += ".zip"
+	}
+	streamZip(c, archiveName, files, claims, "Bundle "+bundle.BundleID)
+	return nil
+}
+
+// streamZip sends files as a zip named archiveName, finishing claims (one
+// per file) with how much of each was written. label names the download in
+// logs.
+func streamZip(c *fiber.Ctx, archiveName string, files []FileRecord, claims []*downloadClaim, label string) {
+	names := bundleEntryNames(files)
+
+	c.Set("Content-Type", "application/zip")
+	c.Set("Content-Disposition", contentDisposition("attachment", archiveName))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		archive := zip.NewWriter(downloadThrottle().writer(w))
+		sent := make([]int64, len(files))
+		for i := range files {
+			var err error
+			if sent[i], err = writeBundleEntry(archive, &files[i], names[i]); err != nil {
+				// Too late for an error status; the client sees a truncated zip
+				log.Printf("%s: failed to add %s: %v", label, files[i].UniqueID, err)
+				w.Flush()
+				finishClaims(claims, files, sent)
+				return
+			}
+		}
+		err := archive.Close()
+		if err != nil {
+			log.Printf("%s: failed to finish zip: %v", label, err)
+		}
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+		finishClaims(claims, files, sent)
+	})
+}
+
+// writeBundleEntry copies one file into the zip, returning how many of its
+// bytes were written. Entries are stored rather than deflated: most uploads
+// are compressed already, and it keeps the server's CPU out of the
+// download's way.
+func writeBundleEntry(archive *zip.Writer, fileRecord *FileRecord, name string) (int64, error) {
+	reader, err := openFileRecord(fileRecord)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: fileRecord.UploadedAt,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(entry, reader)
+}
+
+// cleanupExpiredBundles removes bundles past their expiry or download limit.
+func cleanupExpiredBundles() {
+	var bundles []Bundle
+	db.Where("expires_at IS NOT NULL AND expires_at < ?", time.Now()).
+		Or("max_downloads > 0 AND downloads >= max_downloads").
+		Find(&bundles)
+	for i := range bundles {
+		deleteBundle(&bundles[i])
+	}
+	if len(bundles) > 0 {
+		log.Printf("Cleaned up %d expired bundles", len(bundles))
+	}
+}
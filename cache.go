@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HTTP caching of downloads. Downloads carry an ETag made from the file's
+// SHA-256 and a Last-Modified of its upload time, and a request whose
+// If-None-Match or If-Modified-Since shows the client already has the file
+// gets 304 Not Modified: no transfer, and no download counted. Files anyone
+// may fetch are cacheable for DOWNLOAD_CACHE_MAX_AGE, never past their
+// expiry; files with a download limit or a password, or behind signed links,
+// are private and revalidated on every use, so each real download is still
+// seen and counted.
+
+var downloadCacheMaxAge time.Duration
+
+// loadCacheConfig reads DOWNLOAD_CACHE_MAX_AGE.
+func loadCacheConfig() {
+	maxAgeStr := getEnv("DOWNLOAD_CACHE_MAX_AGE", "1h")
+	var err error
+	downloadCacheMaxAge, err = parseDuration(maxAgeStr)
+	if err != nil || downloadCacheMaxAge < 0 {
+		log.Printf("Invalid DOWNLOAD_CACHE_MAX_AGE value '%s', using default 1h", maxAgeStr)
+		downloadCacheMaxAge = time.Hour
+	}
+}
+
+// downloadETag is the entity tag of a file: its SHA-256, or for files
+// uploaded before checksums were kept a weak tag from its ID and size. The
+// compressed bytes sent with Content-Encoding are tagged apart by encoding.
+func downloadETag(fileRecord *FileRecord, encoding string) string {
+	if encoding != "" {
+		encoding = "-" + encoding
+	}
+	if fileRecord.SHA256 != "" {
+		return `"` + fileRecord.SHA256 + encoding + `"`
+	}
+	return fmt.Sprintf(`W/"%s-%d%s"`, fileRecord.UniqueID, fileRecord.FileSize, encoding)
+}
+
+// setCacheHeaders sets ETag, Last-Modified and Cache-Control for a download
+// of fileRecord.
+func setCacheHeaders(c *fiber.Ctx, fileRecord *FileRecord) {
+	if fileRecord.Compression != "" {
+		c.Vary("Accept-Encoding")
+	}
+	if servesEncoded(c, fileRecord) {
+		c.Set("ETag", downloadETag(fileRecord, fileRecord.Compression))
+	} else {
+		c.Set("ETag", downloadETag(fileRecord, ""))
+	}
+	c.Set("Last-Modified", fileRecord.UploadedAt.UTC().Format(http.TimeFormat))
+
+	if fileRecord.downloadLimit() > 0 || fileRecord.PasswordHash != "" || signedURLsRequired {
+		c.Set("Cache-Control", "private, no-cache")
+		return
+	}
+	maxAge := downloadCacheMaxAge
+	if fileRecord.ExpiresAt != nil {
+		maxAge = min(maxAge, time.Until(*fileRecord.ExpiresAt))
+	}
+	if maxAge < time.Second {
+		c.Set("Cache-Control", "no-cache")
+		return
+	}
+	value := fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+	// The bytes behind a content address can't change
+	if strings.HasPrefix(c.Path(), "/c/") {
+		value += ", immutable"
+	}
+	c.Set("Cache-Control", value)
+}
+
+// notModified reports whether the request's validators show the client
+// already has fileRecord: If-None-Match when it's sent, else
+// If-Modified-Since. etags are the tags the client's copy may carry, by
+// default the file's own. A used-up file is reported gone rather than
+// unchanged. The caller checks a protected file's password first, so only
+// someone who may read the file learns whether their copy matches it.
+func notModified(c *fiber.Ctx, fileRecord *FileRecord, etags ...string) bool {
+	ifNoneMatch := c.Get("If-None-Match")
+	ifModifiedSince := c.Get("If-Modified-Since")
+	if ifNoneMatch == "" && ifModifiedSince == "" {
+		return false
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 && fileRecord.Downloads >= limit {
+		return false
+	}
+
+	if ifNoneMatch != "" {
+		if len(etags) == 0 {
+			etags = []string{downloadETag(fileRecord, "")}
+			if fileRecord.Compression != "" {
+				etags = append(etags, downloadETag(fileRecord, fileRecord.Compression))
+			}
+		}
+		for _, etag := range etags {
+			if etagListMatches(ifNoneMatch, etag, true) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	return err == nil && !fileRecord.UploadedAt.Truncate(time.Second).After(since)
+}
+
+// ifRangeMatches reports whether a Range request may be answered with a
+// range: If-Range, when sent, must name the current file by strong ETag or
+// by date.
+func ifRangeMatches(c *fiber.Ctx, fileRecord *FileRecord) bool {
+	ifRange := c.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagListMatches(ifRange, downloadETag(fileRecord, ""), false)
+	}
+	since, err := http.ParseTime(ifRange)
+	return err == nil && fileRecord.UploadedAt.Truncate(time.Second).Equal(since)
+}
+
+// etagListMatches reports whether a comma-separated list of entity tags (or
+// "*") names etag. The weak comparison ignores W/ prefixes; the strong one
+// never matches a weak tag.
+func etagListMatches(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if !weak && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
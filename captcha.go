@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CAPTCHA for anonymous web uploads. On an open instance (no
+// REQUIRE_API_KEY) CAPTCHA_PROVIDER puts an hCaptcha or Turnstile widget on
+// the upload page, and POST /api/upload and POST /api/upload/init want a
+// solved token from anyone without an API key or an account session. The
+// token comes as X-Captcha-Token, a captcha_token field (or the widget's own
+// h-captcha-response / cf-turnstile-response) and is checked with the
+// provider. A solved token earns a pass cookie good for captchaPassTTL, so a
+// batch of files needs one challenge. PUT / is left alone for curl; gate it
+// with keys if it's abused.
+
+const (
+	captchaPassTTL    = 10 * time.Minute
+	captchaCookieName = "captcha_pass"
+	captchaTimeout    = 10 * time.Second
+)
+
+var captchaVerifyURLs = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+var (
+	captchaProvider  string // hcaptcha or turnstile; empty when off
+	captchaSiteKey   string
+	captchaSecret    string
+	captchaVerifyURL string
+
+	captchaClient = &http.Client{Timeout: captchaTimeout}
+)
+
+// errCaptchaUnavailable means the provider couldn't be asked.
+var errCaptchaUnavailable = errors.New("CAPTCHA provider unavailable")
+
+// loadCaptchaConfig reads CAPTCHA_PROVIDER, CAPTCHA_SITE_KEY, CAPTCHA_SECRET
+// and CAPTCHA_VERIFY_URL. It runs after loadAPIKeyConfig.
+func loadCaptchaConfig() {
+	provider := strings.ToLower(getEnv("CAPTCHA_PROVIDER", ""))
+	if provider == "" {
+		return
+	}
+	defaultURL, ok := captchaVerifyURLs[provider]
+	if !ok {
+		log.Fatalf("Invalid CAPTCHA_PROVIDER value '%s' (expected hcaptcha or turnstile)", provider)
+	}
+	captchaSiteKey = getEnv("CAPTCHA_SITE_KEY", "")
+	captchaSecret = getEnv("CAPTCHA_SECRET", "")
+	if captchaSiteKey == "" || captchaSecret == "" {
+		log.Fatalf("CAPTCHA_PROVIDER=%s needs CAPTCHA_SITE_KEY and CAPTCHA_SECRET", provider)
+	}
+	if apiKeyRequired {
+		log.Printf("CAPTCHA_PROVIDER is ignored, uploads already need an API key")
+		return
+	}
+	captchaProvider = provider
+	captchaVerifyURL = getEnv("CAPTCHA_VERIFY_URL", defaultURL)
+	log.Printf("Anonymous web uploads need a %s CAPTCHA", captchaProvider)
+}
+
+// captchaRequired reports whether the request has to prove it's from a
+// person: it's anonymous, with neither an API key nor an account session.
+func captchaRequired(c *fiber.Ctx) bool {
+	return captchaProvider != "" && requestAPIKey(c) == nil && currentUser(c) == nil
+}
+
+// captchaToken is the token sent with the request, looking in form fields
+// through field when the body has them.
+func captchaToken(c *fiber.Ctx, field func(name string) string) string {
+	if token := c.Get("X-Captcha-Token"); token != "" {
+		return token
+	}
+	if field == nil {
+		return ""
+	}
+	for _, name := range []string{"captcha_token", "h-captcha-response", "cf-turnstile-response"} {
+		if token := field(name); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// checkCaptcha lets a request through that needs no CAPTCHA, holds a pass
+// or carries a token the provider accepts, in which case it's given a pass.
+// Otherwise it says why not.
+func checkCaptcha(c *fiber.Ctx, token string) *quotaError {
+	if !captchaRequired(c) || validCaptchaPass(c.Cookies(captchaCookieName)) {
+		return nil
+	}
+	if token == "" {
+		return &quotaError{403, "Complete the CAPTCHA to upload"}
+	}
+	return passCaptcha(c, token)
+}
+
+// passCaptcha gives the client a pass if the provider accepts token.
+func passCaptcha(c *fiber.Ctx, token string) *quotaError {
+	if err := verifyCaptcha(token, c.IP()); err != nil {
+		if errors.Is(err, errCaptchaUnavailable) {
+			requestLog(c).Warn("CAPTCHA verification failed", "error", err)
+			return &quotaError{503, "Could not check the CAPTCHA. Try again shortly"}
+		}
+		return &quotaError{403, "CAPTCHA verification failed. Solve it again"}
+	}
+	setCaptchaPass(c)
+	return nil
+}
+
+// verifyCaptcha asks the provider whether token was solved, by the client
+// at ip.
+func verifyCaptcha(token, ip string) error {
+	resp, err := captchaClient.PostForm(captchaVerifyURL, url.Values{
+		"secret":   {captchaSecret},
+		"response": {token},
+		"remoteip": {ip},
+		"sitekey":  {captchaSiteKey},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCaptchaUnavailable, err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != 200 {
+		return fmt.Errorf("%w: siteverify answered %s", errCaptchaUnavailable, resp.Status)
+	}
+	if !result.Success {
+		return fmt.Errorf("token rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// captchaPassSignature signs a pass expiring at expires. The key is derived
+// from CAPTCHA_SECRET, so every instance honours the others' passes.
+func captchaPassSignature(expires string) string {
+	mac := hmac.New(sha256.New, []byte(captchaSecret))
+	mac.Write([]byte("bashupload captcha pass " + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func setCaptchaPass(c *fiber.Ctx) {
+	expiresAt := time.Now().Add(captchaPassTTL)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	c.Cookie(&fiber.Cookie{
+		Name:     captchaCookieName,
+		Value:    expires + "." + captchaPassSignature(expires),
+		Path:     "/",
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteStrictMode,
+		Expires:  expiresAt,
+	})
+}
+
+func validCaptchaPass(cookie string) bool {
+	expires, signature, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(signature), []byte(captchaPassSignature(expires))) == 1
+}
+
+// handleCaptcha is POST /api/captcha: it trades a solved token for a pass,
+// ahead of uploads that then need no token of their own.
+func handleCaptcha(c *fiber.Ctx) error {
+	if captchaProvider == "" {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "CAPTCHA is not enabled on this server",
+		})
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	c.BodyParser(&req)
+	token := req.Token
+	if token == "" {
+		token = captchaToken(c, nil)
+	}
+	if token == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "token is required",
+		})
+	}
+	if refusal := passCaptcha(c, token); refusal != nil {
+		return c.Status(refusal.status).JSON(fiber.Map{
+			"success": false,
+			"message": refusal.message,
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"expires_at": time.Now().Add(captchaPassTTL),
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Chat notifications. SLACK_WEBHOOK_URL and DISCORD_WEBHOOK_URL take the
+// incoming webhook URLs of a Slack or Discord channel, which then gets a
+// short message for every new upload and every file that expires: its name,
+// size, link, expiry and the uploader's address. Handy when a team shares an
+// instance as a drop box.
+
+const (
+	chatQueueSize  = 256
+	chatMaxRetries = 3
+)
+
+var (
+	slackWebhookURL   string
+	discordWebhookURL string
+	chatQueue         chan chatMessage
+)
+
+type chatMessage struct {
+	service string // "slack" or "discord"
+	url     string
+	body    []byte
+}
+
+// chatEvent is what a chat message says about a file.
+type chatEvent struct {
+	event  string
+	reason string
+	link   string // empty when the file is gone or there's no base URL to build it from
+	file   *FileRecord
+}
+
+// loadChatConfig reads SLACK_WEBHOOK_URL and DISCORD_WEBHOOK_URL.
+func loadChatConfig() {
+	for _, setting := range []struct {
+		name string
+		url  *string
+	}{
+		{"SLACK_WEBHOOK_URL", &slackWebhookURL},
+		{"DISCORD_WEBHOOK_URL", &discordWebhookURL},
+	} {
+		value := getEnv(setting.name, "")
+		if value != "" && !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "http://") {
+			log.Printf("Invalid %s value '%s', ignoring it", setting.name, value)
+			value = ""
+		}
+		*setting.url = value
+	}
+	if slackWebhookURL == "" && discordWebhookURL == "" {
+		return
+	}
+
+	chatQueue = make(chan chatMessage, chatQueueSize)
+	go deliverChat()
+	if slackWebhookURL != "" {
+		log.Printf("Posting uploads and expirations to Slack")
+	}
+	if discordWebhookURL != "" {
+		log.Printf("Posting uploads and expirations to Discord")
+	}
+}
+
+// notifyChat posts event for fileRecord to the configured channels. Only
+// uploads and expirations are posted. c is the request that caused the
+// event, or nil for background ones.
+func notifyChat(c *fiber.Ctx, event string, fileRecord *FileRecord, reason string) {
+	if chatQueue == nil || (event != webhookUploaded && event != webhookExpired) {
+		return
+	}
+
+	ev := chatEvent{event: event, reason: reason, file: fileRecord}
+	if event == webhookUploaded {
+		baseURL := publicBaseURL
+		if c != nil {
+			baseURL = getBaseURL(c)
+		}
+		if baseURL != "" {
+			ev.link = signLink(baseURL+fileRecord.downloadPath(), fileRecord)
+		}
+	}
+
+	if slackWebhookURL != "" {
+		queueChat("slack", slackWebhookURL, slackMessage(ev), fileRecord)
+	}
+	if discordWebhookURL != "" {
+		queueChat("discord", discordWebhookURL, discordMessage(ev), fileRecord)
+	}
+}
+
+func queueChat(service, url string, payload interface{}, fileRecord *FileRecord) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode %s message: %v", service, err)
+		return
+	}
+	select {
+	case chatQueue <- chatMessage{service: service, url: url, body: body}:
+	default:
+		slog.Warn("Chat queue full, dropping message", "service", service, "file_id", fileRecord.UniqueID)
+	}
+}
+
+// chatTitle is the headline of a message, e.g. "New upload: report.pdf".
+func (ev chatEvent) chatTitle() string {
+	if ev.event == webhookExpired {
+		if ev.reason == "download_limit" {
+			return "Download limit reached: " + ev.file.OriginalName
+		}
+		return "Expired: " + ev.file.OriginalName
+	}
+	return "New upload: " + ev.file.OriginalName
+}
+
+// chatFields are the facts listed under the title, in order.
+func (ev chatEvent) chatFields() [][2]string {
+	fields := [][2]string{{"Size", formatBytes(ev.file.FileSize)}}
+	if ev.event == webhookUploaded {
+		expiry := "never"
+		if ev.file.ExpiresAt != nil {
+			expiry = ev.file.ExpiresAt.UTC().Format("2 Jan 2006 15:04 MST")
+		}
+		fields = append(fields, [2]string{"Expires", expiry})
+		if ev.file.PasswordHash != "" {
+			fields = append(fields, [2]string{"Password", "required"})
+		}
+	}
+	if ev.file.IPAddress != "" {
+		fields = append(fields, [2]string{"Uploader", ev.file.IPAddress})
+	}
+	return fields
+}
+
+// slackMessage formats ev for a Slack incoming webhook.
+func slackMessage(ev chatEvent) interface{} {
+	title := slackEscape(ev.chatTitle())
+	if ev.link != "" {
+		title = fmt.Sprintf("<%s|%s>", ev.link, title)
+	}
+	lines := []string{"*" + title + "*"}
+	for _, field := range ev.chatFields() {
+		lines = append(lines, fmt.Sprintf("%s: %s", field[0], slackEscape(field[1])))
+	}
+	return map[string]interface{}{
+		"text": strings.Join(lines, "\n"),
+	}
+}
+
+// slackEscape escapes the characters Slack treats as markup.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// discordMessage formats ev as a Discord embed.
+func discordMessage(ev chatEvent) interface{} {
+	color := 0x2ecc71 // green for uploads
+	if ev.event == webhookExpired {
+		color = 0x95a5a6
+	}
+	fields := make([]map[string]interface{}, 0, 4)
+	for _, field := range ev.chatFields() {
+		fields = append(fields, map[string]interface{}{"name": field[0], "value": field[1], "inline": true})
+	}
+	embed := map[string]interface{}{
+		"title":     truncateString(ev.chatTitle(), 256),
+		"color":     color,
+		"fields":    fields,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	if ev.link != "" {
+		embed["url"] = ev.link
+	}
+	return map[string]interface{}{
+		"username":         "bashupload",
+		"embeds":           []interface{}{embed},
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	}
+}
+
+// truncateString shortens s to at most n runes.
+func truncateString(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func deliverChat() {
+	for msg := range chatQueue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			retry, err := postChat(msg)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= chatMaxRetries {
+				slog.Error("Chat notification failed", "service", msg.service, "attempts", attempt+1, "error", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// postChat makes one delivery attempt, reporting like postWebhook whether a
+// failure is worth retrying.
+func postChat(msg chatMessage) (bool, error) {
+	resp, err := webhookClient.Post(msg.url, "application/json", bytes.NewReader(msg.body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("%s answered %s", msg.service, resp.Status)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// computeMD5 enables MD5 digests next to SHA-256 (CHECKSUM_MD5=true), for
+// clients and tools that only understand MD5.
+var computeMD5 bool
+
+// fileDigest holds the hex-encoded digests of an uploaded file. MD5 is empty
+// unless computeMD5 is set.
+type fileDigest struct {
+	SHA256 string
+	MD5    string
+}
+
+// digester hashes everything written to it.
+type digester struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+	writer io.Writer
+}
+
+func newDigester() *digester {
+	d := &digester{sha256: sha256.New()}
+	if computeMD5 {
+		d.md5 = md5.New()
+		d.writer = io.MultiWriter(d.sha256, d.md5)
+	} else {
+		d.writer = d.sha256
+	}
+	return d
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	return d.writer.Write(p)
+}
+
+func (d *digester) digest() fileDigest {
+	digest := fileDigest{SHA256: hex.EncodeToString(d.sha256.Sum(nil))}
+	if d.md5 != nil {
+		digest.MD5 = hex.EncodeToString(d.md5.Sum(nil))
+	}
+	return digest
+}
+
+// stagedFile describes an upload received into the staging area.
+type stagedFile struct {
+	Path           string
+	Size           int64 // plaintext bytes received
+	Digest         fileDigest
+	MimeType       string // detected from the contents
+	Nonce          string // per-file encryption nonce, empty when stored in plain
+	Compression    string // zstd or gzip when stored compressed
+	CompressedSize int64  // compressed bytes, before any encryption
+}
+
+// storedSize returns the size of the staged file on disk.
+func (s *stagedFile) storedSize() int64 {
+	return blobSize(s.Size, s.Compression, s.CompressedSize, s.Nonce)
+}
+
+// blobSize is the size in storage of a file of the given plaintext size,
+// compressed and encrypted as described.
+func blobSize(size int64, compression string, compressedSize int64, nonce string) int64 {
+	if compression != "" {
+		size = compressedSize
+	}
+	if nonce != "" {
+		return encryptedSize(size)
+	}
+	return size
+}
+
+// saveStream writes r to a new file at path, hashing it and sniffing its
+// content type on the way, and compressing and encrypting it when those are
+// enabled.
+func saveStream(path string, r io.Reader) (*stagedFile, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	staged := &stagedFile{Path: path, Nonce: newEncryptionNonce()}
+
+	var dest io.Writer = out
+	var sealer *encryptWriter
+	if staged.Nonce != "" {
+		if sealer, err = newEncryptWriter(out, staged.Nonce); err != nil {
+			return nil, err
+		}
+		dest = sealer
+	}
+
+	// Compression comes first: encrypted bytes don't compress
+	packer := newCompressWriter(dest)
+
+	hasher := newDigester()
+	sniff := &sniffer{}
+	staged.Size, err = io.Copy(io.MultiWriter(packer, hasher, sniff), r)
+	if err != nil {
+		return nil, err
+	}
+	if err := packer.Close(); err != nil {
+		return nil, err
+	}
+	if packer.encoding != "" {
+		staged.Compression = packer.encoding
+		staged.CompressedSize = packer.stored()
+	}
+	if sealer != nil {
+		if err := sealer.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	staged.Digest = hasher.digest()
+	staged.MimeType = sniff.mimeType()
+	return staged, nil
+}
+
+// clientChecksumMatches compares the upload against the SHA-256 the client
+// sent in X-Content-SHA256, if any.
+func clientChecksumMatches(c *fiber.Ctx, digest fileDigest) bool {
+	expected := strings.ToLower(strings.TrimSpace(c.Get("X-Content-SHA256")))
+	return expected == "" || expected == digest.SHA256
+}
+
+// setChecksumHeaders advertises a file's digests on a download response, both
+// as an RFC 3230 Digest header and as plain hex X-Checksum-* headers.
+func setChecksumHeaders(c *fiber.Ctx, fileRecord *FileRecord) {
+	var digests []string
+	if raw, err := hex.DecodeString(fileRecord.SHA256); err == nil && fileRecord.SHA256 != "" {
+		digests = append(digests, "sha-256="+base64.StdEncoding.EncodeToString(raw))
+		c.Set("X-Checksum-SHA256", fileRecord.SHA256)
+	}
+	if raw, err := hex.DecodeString(fileRecord.MD5); err == nil && fileRecord.MD5 != "" {
+		digests = append(digests, "md5="+base64.StdEncoding.EncodeToString(raw))
+		c.Set("X-Checksum-MD5", fileRecord.MD5)
+	}
+	if len(digests) > 0 {
+		c.Set("Digest", strings.Join(digests, ","))
+	}
+}
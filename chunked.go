@@ -0,0 +1,695 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// UploadSession tracks a chunked upload whose parts are sent as separate
+// requests (possibly in parallel) and assembled on completion.
+type UploadSession struct {
+	ID          uint      `json:"-" gorm:"primaryKey"`
+	SessionID   string    `json:"session_id" gorm:"unique;not null"`
+	Filename    string    `json:"filename" gorm:"not null"`
+	MimeType    string    `json:"mime_type"`
+	TotalSize   int64     `json:"total_size" gorm:"not null"`
+	ChunkSize   int64     `json:"chunk_size" gorm:"not null"`
+	TotalChunks int       `json:"total_chunks" gorm:"not null"`
+	IPAddress   string    `json:"-"`
+	UserID      *uint     `json:"-"`
+	APIKeyID    *uint     `json:"-"`
+	CreatedAt   time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt   time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// uploadSessionTTL is how long a chunked or tus upload may sit idle before it
+// is considered abandoned and its parts are removed.
+var uploadSessionTTL time.Duration
+
+// loadUploadSessionConfig reads UPLOAD_SESSION_TTL (default 24 hours).
+func loadUploadSessionConfig() {
+	ttlStr := getEnv("UPLOAD_SESSION_TTL", "24h")
+	var err error
+	uploadSessionTTL, err = parseDuration(ttlStr)
+	if err != nil || uploadSessionTTL <= 0 {
+		log.Printf("Invalid UPLOAD_SESSION_TTL value '%s', using default 24 hours", ttlStr)
+		uploadSessionTTL = 24 * time.Hour
+	}
+	log.Printf("Unfinished uploads expire after %s of inactivity", formatDuration(uploadSessionTTL))
+}
+
+// expiresAt returns when the session will be dropped if no further chunk
+// arrives.
+func (s *UploadSession) expiresAt() time.Time {
+	return s.UpdatedAt.Add(uploadSessionTTL)
+}
+
+func (s *UploadSession) expired() bool {
+	return time.Now().After(s.expiresAt())
+}
+
+// removeUploadSession deletes a session together with its stored chunks.
+func removeUploadSession(session *UploadSession) {
+	for i := 0; i < session.TotalChunks; i++ {
+		fileStorage.Delete(chunkKey(session.SessionID, i))
+	}
+	// The emptied directory, with local storage
+	os.RemoveAll(chunkDir(session.SessionID))
+	db.Delete(session)
+}
+
+// cleanupAbandonedUploads drops chunked and tus uploads that have been idle
+// for longer than uploadSessionTTL, plus local chunk directories whose
+// session no longer exists.
+func cleanupAbandonedUploads() {
+	cutoff := time.Now().Add(-uploadSessionTTL)
+
+	var sessions []UploadSession
+	db.Where("updated_at < ? OR updated_at IS NULL", cutoff).Find(&sessions)
+	for i := range sessions {
+		removeUploadSession(&sessions[i])
+	}
+
+	var tusUploads []TusUpload
+	db.Where("updated_at < ? OR updated_at IS NULL", cutoff).Find(&tusUploads)
+	for i := range tusUploads {
+		removeTusUpload(&tusUploads[i])
+	}
+
+	orphans := 0
+	entries, _ := os.ReadDir(filepath.Join(uploadDir, ".chunks"))
+	for _, entry := range entries {
+		var count int64
+		db.Model(&UploadSession{}).Where("session_id = ?", entry.Name()).Count(&count)
+		if count == 0 {
+			os.RemoveAll(chunkDir(entry.Name()))
+			orphans++
+		}
+	}
+
+	if total := len(sessions) + len(tusUploads) + orphans; total > 0 {
+		log.Printf("Cleaned up %d abandoned uploads", total)
+	}
+}
+
+const (
+	defaultChunkSize = 8 * 1024 * 1024
+	// minChunkSize keeps a session from being split into a chunk per byte;
+	// only the last chunk may be smaller
+	minChunkSize = 64 * 1024
+	// maxTotalChunks bounds the chunks one session can have to store and
+	// clean up
+	maxTotalChunks = 10000
+)
+
+type chunkInitRequest struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ChunkSize   int64  `json:"chunk_size"`
+	TotalChunks int    `json:"total_chunks"`
+	MimeType    string `json:"mime_type"`
+	// A solved CAPTCHA, when anonymous uploads need one
+	CaptchaToken string `json:"captcha_token"`
+}
+
+// chunkCompleteRequest finishes a session. The options are those other
+// uploads take; query parameters and headers win over them.
+type chunkCompleteRequest struct {
+	SessionID      string `json:"session_id"`
+	Expires        string `json:"expires"`
+	AvailableFrom  string `json:"available_from"`
+	AvailableUntil string `json:"available_until"`
+	Downloads      *int   `json:"downloads"`
+	Password       string `json:"password"`
+	Notify         string `json:"notify"`
+	Slug           string `json:"slug"`
+	Tags           string `json:"tags"`
+	// Metadata entries, by name
+	Metadata map[string]string `json:"metadata"`
+}
+
+// chunkKey is the storage key a chunk is kept under until completion. Chunks
+// live in the storage backend rather than on local disk so that, with
+// several instances, any of them can take the next chunk or complete the
+// upload.
+func chunkKey(sessionID string, index int) string {
+	return ".chunks/" + sessionID + "/" + strconv.Itoa(index)
+}
+
+// chunkDir is where local storage keeps a session's chunks.
+func chunkDir(sessionID string) string {
+	return filepath.Join(uploadDir, ".chunks", sessionID)
+}
+
+// expectedChunkSize returns the exact byte length chunk index must have.
+func (s *UploadSession) expectedChunkSize(index int) int64 {
+	if index == s.TotalChunks-1 {
+		return s.TotalSize - s.ChunkSize*int64(s.TotalChunks-1)
+	}
+	return s.ChunkSize
+}
+
+func handleChunkInit(c *fiber.Ctx) error {
+	var req chunkInitRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+
+	// Anonymous web uploads need a solved CAPTCHA when it's on
+	token := captchaToken(c, nil)
+	if token == "" {
+		token = req.CaptchaToken
+	}
+	if refusal := checkCaptcha(c, token); refusal != nil {
+		return c.Status(refusal.status).JSON(fiber.Map{
+			"success": false,
+			"message": refusal.message,
+		})
+	}
+
+	if req.Size <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "File size must be greater than zero",
+		})
+	}
+
+	if req.Size > maxUpload {
+		return c.Status(413).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)),
+		})
+	}
+
+	if quotaErr := checkUploadQuota(c.IP(), req.Size); quotaErr != nil {
+		return c.Status(quotaErr.status).JSON(fiber.Map{
+			"success": false,
+			"message": quotaErr.message,
+		})
+	}
+
+	if err := checkFileType(sanitizeFilename(req.Filename), req.MimeType); err != nil {
+		return c.Status(415).JSON(fiber.Map{
+			"success": false,
+			"message": err.Error(),
+		})
+	}
+
+	// Derive chunk size from the requested chunk count if only that was given,
+	// in chunks no smaller than minChunkSize and no more than maxTotalChunks
+	chunkSize := req.ChunkSize
+	if chunkSize > 0 && chunkSize < minChunkSize && chunkSize < req.Size {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Chunk size must be at least %s", formatBytes(minChunkSize)),
+		})
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+		if req.TotalChunks > 0 {
+			chunkSize = max((req.Size+int64(req.TotalChunks)-1)/int64(req.TotalChunks), minChunkSize)
+		}
+		chunkSize = max(chunkSize, (req.Size+maxTotalChunks-1)/maxTotalChunks)
+	}
+	if chunkSize > req.Size {
+		chunkSize = req.Size
+	}
+	totalChunks := int((req.Size + chunkSize - 1) / chunkSize)
+	if totalChunks > maxTotalChunks {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("A session can have at most %d chunks; use chunks of at least %s",
+				maxTotalChunks, formatBytes((req.Size+maxTotalChunks-1)/maxTotalChunks)),
+		})
+	}
+
+	session := UploadSession{
+		SessionID:   generateUniqueID(),
+		Filename:    sanitizeFilename(req.Filename),
+		MimeType:    req.MimeType,
+		TotalSize:   req.Size,
+		ChunkSize:   chunkSize,
+		TotalChunks: totalChunks,
+		IPAddress:   storedIP(c.IP()),
+		UserID:      currentUserID(c),
+		APIKeyID:    currentAPIKeyID(c),
+	}
+
+	if result := db.Create(&session); result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to create upload session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success":      true,
+		"session_id":   session.SessionID,
+		"chunk_size":   session.ChunkSize,
+		"total_chunks": session.TotalChunks,
+		"expires_at":   session.expiresAt(),
+	})
+}
+
+func handleChunkUpload(c *fiber.Ctx) error {
+	var session UploadSession
+	if result := db.Where("session_id = ?", c.Params("session")).First(&session); result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Upload session not found",
+		})
+	}
+	if session.expired() {
+		removeUploadSession(&session)
+		return c.Status(410).JSON(fiber.Map{
+			"success": false,
+			"message": "Upload session has expired",
+		})
+	}
+
+	index, err := strconv.Atoi(c.Params("index"))
+	if err != nil || index < 0 || index >= session.TotalChunks {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Chunk index must be between 0 and %d", session.TotalChunks-1),
+		})
+	}
+
+	expected := session.expectedChunkSize(index)
+
+	// Hold off while too many uploads are in flight or the disk is full
+	ticket, refusal := admitUpload(expected)
+	if refusal != nil {
+		setUploadRetryAfter(c, refusal)
+		return c.Status(refusal.status).JSON(fiber.Map{
+			"success": false,
+			"message": refusal.message,
+		})
+	}
+	defer ticket.release()
+
+	// Stage the chunk first so a retried or interrupted chunk never leaves a
+	// truncated part behind
+	tmpPath := newStagingPath()
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to store chunk",
+		})
+	}
+
+	written, err := io.Copy(tmpFile, io.LimitReader(uploadThrottle().reader(c.Context().RequestBodyStream()), expected+1))
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to store chunk",
+		})
+	}
+
+	if written != expected {
+		os.Remove(tmpPath)
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Chunk %d must be exactly %d bytes, got %d", index, expected, written),
+		})
+	}
+
+	if err := persistStaged(chunkKey(session.SessionID, index), tmpPath, written); err != nil {
+		log.Printf("Failed to store chunk %d of %s: %v", index, session.SessionID, err)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to store chunk",
+		})
+	}
+
+	// Each chunk keeps the session alive
+	session.UpdatedAt = time.Now()
+	db.Model(&session).Update("updated_at", session.UpdatedAt)
+
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"index":      index,
+		"size":       written,
+		"expires_at": session.expiresAt(),
+	})
+}
+
+// handleChunkStatus reports which chunks of a session have arrived, so a
+// client that lost track of an upload (a reloaded page, say) can send just
+// the rest.
+func handleChunkStatus(c *fiber.Ctx) error {
+	var session UploadSession
+	if result := db.Where("session_id = ?", c.Params("session")).First(&session); result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Upload session not found",
+		})
+	}
+	if session.expired() {
+		removeUploadSession(&session)
+		return c.Status(410).JSON(fiber.Map{
+			"success": false,
+			"message": "Upload session has expired",
+		})
+	}
+
+	received := []int{}
+	var receivedBytes int64
+	for i := 0; i < session.TotalChunks; i++ {
+		size, err := fileStorage.Stat(chunkKey(session.SessionID, i))
+		if err == nil && size == session.expectedChunkSize(i) {
+			received = append(received, i)
+			receivedBytes += size
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success":        true,
+		"session_id":     session.SessionID,
+		"filename":       session.Filename,
+		"size":           session.TotalSize,
+		"chunk_size":     session.ChunkSize,
+		"total_chunks":   session.TotalChunks,
+		"received":       received,
+		"received_bytes": receivedBytes,
+		"expires_at":     session.expiresAt(),
+	})
+}
+
+// handleChunkCancel abandons a session, removing the chunks sent so far.
+func handleChunkCancel(c *fiber.Ctx) error {
+	var session UploadSession
+	if result := db.Where("session_id = ?", c.Params("session")).First(&session); result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Upload session not found",
+		})
+	}
+	removeUploadSession(&session)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Upload cancelled",
+	})
+}
+
+func handleChunkComplete(c *fiber.Ctx) error {
+	var req chunkCompleteRequest
+	if err := c.BodyParser(&req); err != nil || req.SessionID == "" {
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: "session_id is required",
+		})
+	}
+
+	var session UploadSession
+	if result := db.Where("session_id = ?", req.SessionID).First(&session); result.Error != nil {
+		return c.Status(404).JSON(UploadResponse{
+			Success: false,
+			Message: "Upload session not found",
+		})
+	}
+	if session.expired() {
+		removeUploadSession(&session)
+		return c.Status(410).JSON(UploadResponse{
+			Success: false,
+			Message: "Upload session has expired",
+		})
+	}
+
+	// Make sure every chunk arrived with the right size before assembling
+	var missing []int
+	for i := 0; i < session.TotalChunks; i++ {
+		size, err := fileStorage.Stat(chunkKey(session.SessionID, i))
+		if err != nil || size != session.expectedChunkSize(i) {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%d chunk(s) missing", len(missing)),
+			"missing": missing,
+		})
+	}
+
+	// Per-upload expiration from ?expires=, the X-Expire-After header or the
+	// "expires" field
+	expiresValue := c.Query("expires")
+	if expiresValue == "" {
+		expiresValue = c.Get("X-Expire-After")
+	}
+	if expiresValue == "" {
+		expiresValue = req.Expires
+	}
+	// and the release window from available_from and available_until
+	window, err := requestedWindow(c, func(name string) string {
+		if name == "available_from" {
+			return req.AvailableFrom
+		}
+		return req.AvailableUntil
+	})
+	var expiresAt *time.Time
+	if err == nil {
+		expiresAt, err = window.expiry(expiresValue, session.TotalSize)
+	}
+	if err != nil {
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+	}
+
+	// Per-upload download limit from ?downloads=, the X-Max-Downloads header
+	// or the "downloads" field
+	downloadsValue := c.Query("downloads")
+	if downloadsValue == "" {
+		downloadsValue = c.Get("X-Max-Downloads")
+	}
+	if downloadsValue == "" && req.Downloads != nil {
+		downloadsValue = strconv.Itoa(*req.Downloads)
+	}
+	fileMaxDownloads, err := resolveMaxDownloads(downloadsValue)
+	if err != nil {
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid download limit '%s'", downloadsValue),
+		})
+	}
+
+	// Optional download password from the X-File-Password header or the
+	// "password" field
+	password := c.Get("X-File-Password")
+	if password == "" {
+		password = req.Password
+	}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+	}
+
+	// Who to email the link to, from ?notify=, the X-Notify header or the
+	// "notify" field
+	notifyValue := c.Query("notify")
+	if notifyValue == "" {
+		notifyValue = c.Get("X-Notify")
+	}
+	if notifyValue == "" {
+		notifyValue = req.Notify
+	}
+	recipients, err := parseNotify(notifyValue)
+	if err != nil {
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+	}
+
+	// Optional vanity alias from ?slug=, the X-Slug header or the "slug" field
+	slugValue := requestedSlug(c)
+	if slugValue == "" {
+		slugValue = req.Slug
+	}
+	slug, err := resolveSlug(slugValue)
+	if err != nil {
+		return c.Status(slugStatus(err)).JSON(UploadResponse{
+			Success: false,
+			Message: slugErrorMessage(slugValue, err),
+		})
+	}
+
+	// Optional tags and metadata from ?tags=, X-Tags and X-Meta-* headers or
+	// the "tags" and "metadata" fields
+	fields := map[string]string{"tags": req.Tags}
+	for name, value := range req.Metadata {
+		fields["meta["+name+"]"] = value
+	}
+	labels, err := requestLabels(c, fields)
+	if err != nil {
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+	}
+
+	// Assembling writes the whole file once more
+	ticket, refusal := admitUpload(session.TotalSize)
+	if refusal != nil {
+		setUploadRetryAfter(c, refusal)
+		return c.Status(refusal.status).JSON(UploadResponse{
+			Success: false,
+			Message: refusal.message,
+		})
+	}
+	defer ticket.release()
+
+	uniqueID := newFileID()
+	ext := filepath.Ext(session.Filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+	storageKey := newStorageKey(ext)
+
+	stagedPath := newStagingPath()
+	staged, err := assembleChunks(&session, stagedPath)
+	if err != nil {
+		os.Remove(stagedPath)
+		return c.Status(500).JSON(UploadResponse{
+			Success: false,
+			Message: "Failed to assemble file",
+		})
+	}
+
+	// Reject assemblies that don't match the checksum the client sent; the
+	// chunks are kept so the client can resend the bad ones
+	if !clientChecksumMatches(c, staged.Digest) {
+		os.Remove(stagedPath)
+		return c.Status(422).JSON(UploadResponse{
+			Success: false,
+			Message: fmt.Sprintf("Checksum mismatch: assembled file has SHA-256 %s", staged.Digest.SHA256),
+			SHA256:  staged.Digest.SHA256,
+		})
+	}
+
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return c.Status(415).JSON(UploadResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+	}
+
+	storageKey, nonce, err := storeBlob(storageKey, staged)
+	if err != nil {
+		log.Printf("Failed to store %s: %v", storageKey, err)
+		return c.Status(500).JSON(UploadResponse{
+			Success: false,
+			Message: "Failed to save file",
+		})
+	}
+
+	// One-time token that lets the uploader delete the file early
+	deleteToken, deleteTokenHash := newDeleteToken()
+
+	// Save to database with configurable expiration
+	fileRecord := FileRecord{
+		UniqueID:         uniqueID,
+		OriginalName:     session.Filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         session.TotalSize,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: session.MimeType,
+		Extension:        ext,
+		MaxDownloads:     fileMaxDownloads,
+		PasswordHash:     passwordHash,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        storedIP(c.IP()),
+		UserID:           session.UserID,
+		APIKeyID:         session.APIKeyID,
+		Slug:             slug,
+		ExpiresAt:        expiresAt,
+		AvailableFrom:    window.from,
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := createFileRecord(tx, &fileRecord); err != nil {
+			return err
+		}
+		return saveFileLabels(tx, &fileRecord, labels)
+	})
+	if err != nil {
+		// Clean up file if database save fails
+		releaseBlob(storageKey)
+		if isSlugConflict(err, &fileRecord) {
+			return c.Status(409).JSON(UploadResponse{
+				Success: false,
+				Message: slugErrorMessage(slugValue, errSlugTaken),
+			})
+		}
+		return c.Status(500).JSON(UploadResponse{
+			Success: false,
+			Message: "Failed to save file metadata",
+		})
+	}
+	queueScan(fileRecord)
+	logUpload(c, &fileRecord)
+	sendWebhook(c, webhookUploaded, &fileRecord, "")
+
+	// The session is finished; drop its staged chunks
+	removeUploadSession(&session)
+
+	baseURL := getBaseURL(c)
+	downloadURL := signLink(baseURL+fileRecord.downloadPath(), &fileRecord)
+	notifyUpload(recipients, baseURL, []*FileRecord{&fileRecord}, []string{downloadURL})
+
+	return c.JSON(UploadResponse{
+		Success:       true,
+		Message:       uploadMessage("File uploaded successfully"),
+		UniqueID:      fileRecord.UniqueID,
+		DownloadURL:   downloadURL,
+		FileSize:      session.TotalSize,
+		ExpiresAt:     fileRecord.ExpiresAt,
+		AvailableFrom: fileRecord.AvailableFrom,
+		DeleteToken:   deleteToken,
+		ViewURL:       viewURL(baseURL, &fileRecord),
+		SHA256:        staged.Digest.SHA256,
+		MD5:           staged.Digest.MD5,
+	})
+}
+
+// assembleChunks concatenates the session's chunks in order into dest and
+// returns the staged result.
+func assembleChunks(session *UploadSession, dest string) (*stagedFile, error) {
+	keys := make([]string, 0, session.TotalChunks)
+	for i := 0; i < session.TotalChunks; i++ {
+		keys = append(keys, chunkKey(session.SessionID, i))
+	}
+	chunks := &blobSequence{keys: keys}
+	defer chunks.Close()
+	return saveStream(dest, chunks)
+}
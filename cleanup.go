@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// Periodic maintenance. Every CLEANUP_INTERVAL, and once at startup, the
+// maintenance replica removes expired and used-up files and runs the other
+// chores. Files are read in batches of CLEANUP_BATCH_SIZE by ID, so a big
+// table is never loaded at once, and a pass stops after CLEANUP_MAX_PER_PASS
+// removals, leaving the rest for the next one.
+
+// Directories left empty are kept this long, in case an upload is about to
+// write into one
+const emptyDirGrace = time.Minute
+
+var (
+	cleanupInterval   time.Duration
+	cleanupBatchSize  int
+	cleanupMaxPerPass int // 0 means no cap
+)
+
+// loadCleanupConfig reads CLEANUP_INTERVAL, CLEANUP_BATCH_SIZE and
+// CLEANUP_MAX_PER_PASS.
+func loadCleanupConfig() {
+	intervalStr := getEnv("CLEANUP_INTERVAL", "1h")
+	var err error
+	cleanupInterval, err = parseDuration(intervalStr)
+	if err != nil || cleanupInterval <= 0 {
+		log.Printf("Invalid CLEANUP_INTERVAL value '%s', using default 1 hour", intervalStr)
+		cleanupInterval = time.Hour
+	}
+
+	batchStr := getEnv("CLEANUP_BATCH_SIZE", "500")
+	cleanupBatchSize, err = strconv.Atoi(batchStr)
+	if err != nil || cleanupBatchSize <= 0 {
+		log.Printf("Invalid CLEANUP_BATCH_SIZE value '%s', using default 500", batchStr)
+		cleanupBatchSize = 500
+	}
+
+	maxStr := getEnv("CLEANUP_MAX_PER_PASS", "10000")
+	cleanupMaxPerPass, err = strconv.Atoi(maxStr)
+	if err != nil || cleanupMaxPerPass < 0 {
+		log.Printf("Invalid CLEANUP_MAX_PER_PASS value '%s', using default 10000", maxStr)
+		cleanupMaxPerPass = 10000
+	}
+}
+
+// cleanupLoop runs a maintenance pass now and every CLEANUP_INTERVAL.
+func cleanupLoop() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		if isLeader() {
+			maintenancePass()
+		}
+		<-ticker.C
+	}
+}
+
+func maintenancePass() {
+	if removed := cleanupExpiredFiles(); removed > 0 {
+		log.Printf("Cleaned up %d expired files", removed)
+	}
+
+	cleanupAbandonedUploads()
+
+	// Retry scans that failed, e.g. while clamd was down
+	rescanFiles(scanFailed)
+
+	// Keep the dashboard's storage history up to date
+	recordStorageSample()
+
+	// Drop hourly usage counters past USAGE_RETENTION
+	pruneUsage()
+	pruneExpiredAliases()
+	pruneTransfers()
+	pruneRevokedAdminSessions()
+
+	// Drop audit entries past AUDIT_RETENTION
+	pruneAudit()
+
+	cleanupExpiredBundles()
+
+	// Clear uploader IPs and names past METADATA_RETENTION
+	scrubMetadata()
+
+	// Purge files that have been in the trash past TRASH_RETENTION
+	purgeTrash()
+
+	// Drop the directories removed blobs and chunks leave behind
+	if pruner, ok := fileStorage.(dirPruner); ok {
+		pruner.PruneEmptyDirs(emptyDirGrace)
+	}
+	if pruner, ok := mirrorStorage.(dirPruner); ok {
+		pruner.PruneEmptyDirs(emptyDirGrace)
+	}
+}
+
+// cleanupExpiredFiles removes files past their expiry or their download
+// limit, a batch at a time, and returns how many went.
+func cleanupExpiredFiles() int {
+	now := time.Now()
+	removed := 0
+	var lastID uint
+	for cleanupMaxPerPass == 0 || removed < cleanupMaxPerPass {
+		var batch []FileRecord
+		query := db.Where("expires_at IS NOT NULL AND expires_at < ?", now)
+		query = query.Or("max_downloads > 0 AND downloads >= max_downloads")
+		if maxDownloads > 0 {
+			// Files without a limit of their own use the server's
+			query = query.Or("max_downloads IS NULL AND downloads >= ?", maxDownloads)
+		}
+		db.Where("id > ?", lastID).Where(query).Order("id").Limit(cleanupBatchSize).Find(&batch)
+
+		for i := range batch {
+			file := &batch[i]
+			lastID = file.ID
+			if cleanupMaxPerPass > 0 && removed >= cleanupMaxPerPass {
+				break
+			}
+			// Files being downloaded go once the transfer ends, or next time
+			if transferInFlight(file.ID) {
+				continue
+			}
+
+			reason := "download_limit"
+			if file.ExpiresAt != nil && file.ExpiresAt.Before(now) {
+				reason = "expired"
+			} else if resumePending(file.ID) {
+				// Kept until the download that used it up can't be resumed
+				continue
+			}
+			if err := removeFile(file, reason); err != nil {
+				log.Printf("Failed to remove %s: %v", file.UniqueID, err)
+				continue
+			}
+			removed++
+			slog.Info("Removed expired file", "file_id", file.UniqueID, "name", file.OriginalName, "reason", reason)
+			sendWebhook(nil, webhookExpired, file, reason)
+		}
+
+		if len(batch) < cleanupBatchSize {
+			return removed
+		}
+	}
+	log.Printf("Stopped cleaning up at CLEANUP_MAX_PER_PASS (%d); the rest go next pass", cleanupMaxPerPass)
+	return removed
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Multi-instance mode (MULTI_INSTANCE=true) runs several replicas against
+// one database and one storage backend. Requests can land on any replica, so
+// everything that outlives a request lives in the database or in storage,
+// and the periodic maintenance (expiry, trash purges, reconciliation) runs on
+// one replica at a time: whichever holds the maintenance lease.
+
+const (
+	maintenanceLease = "maintenance"
+	leaseTTL         = 90 * time.Second
+	leaseRenewEvery  = 30 * time.Second
+	banRefreshEvery  = time.Minute
+)
+
+// Lease names a job only one replica may run, and which replica runs it
+// until ExpiresAt. The holder renews it well before then; a replica that
+// stops renewing loses it to the next one that asks.
+type Lease struct {
+	Name      string    `gorm:"primaryKey"`
+	Holder    string    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+var (
+	multiInstance bool
+	instanceID    string
+	leader        atomic.Bool
+)
+
+// loadClusterConfig reads MULTI_INSTANCE and refuses settings that only work
+// with a single replica. Runs after storage and the secrets are set up.
+func loadClusterConfig() {
+	multiInstance = getEnv("MULTI_INSTANCE", "false") == "true"
+	if !multiInstance {
+		leader.Store(true)
+		return
+	}
+
+	if db.Dialector.Name() == "sqlite" {
+		log.Fatal("MULTI_INSTANCE needs a database the replicas share: set DB_DRIVER to postgres or mysql")
+	}
+	if getEnv("SIGNED_URL_SECRET", "") == "" {
+		log.Fatal("MULTI_INSTANCE needs SIGNED_URL_SECRET, so links signed by one replica are accepted by the others")
+	}
+	if accountsEnabled() && getEnv("JWT_SECRET", "") == "" {
+		log.Fatal("MULTI_INSTANCE needs JWT_SECRET, so sign-ins are accepted by every replica")
+	}
+	if anonymizeIPs == anonymizeHash && !ipHashSecretIsSet {
+		log.Fatal("MULTI_INSTANCE with ANONYMIZE_IPS=hash needs IP_HASH_SECRET, so every replica hashes addresses alike")
+	}
+	if anonymizeIPs == anonymizeTruncate && !ipHashSecretIsSet {
+		log.Printf("Warning: MULTI_INSTANCE with ANONYMIZE_IPS=truncate and no IP_HASH_SECRET only lets a download be resumed on the replica it started on")
+	}
+	if _, local := fileStorage.(*LocalStorage); local {
+		log.Printf("Warning: MULTI_INSTANCE with local storage needs UPLOAD_DIR on a volume every replica mounts")
+	}
+
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	instanceID = host + "-" + hex.EncodeToString(suffix)
+	log.Printf("Multi-instance mode: this is instance %s", instanceID)
+}
+
+// isLeader reports whether this replica runs the periodic maintenance. With
+// a single instance it always does.
+func isLeader() bool {
+	return leader.Load()
+}
+
+// holdMaintenanceLease keeps trying to take the maintenance lease, and keeps
+// renewing it once held.
+func holdMaintenanceLease() {
+	if !multiInstance {
+		return
+	}
+	for {
+		held := acquireLease(maintenanceLease)
+		if held != leader.Swap(held) {
+			if held {
+				log.Printf("Took over periodic maintenance")
+			} else {
+				log.Printf("Handed periodic maintenance to another instance")
+			}
+		}
+		time.Sleep(leaseRenewEvery)
+	}
+}
+
+// acquireLease takes or renews the named lease, reporting whether this
+// instance holds it. The conditional update makes it safe for every replica
+// to ask at once: only one of them matches the row.
+func acquireLease(name string) bool {
+	now := time.Now()
+	result := db.Model(&Lease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", name, instanceID, now).
+		Updates(map[string]interface{}{"holder": instanceID, "expires_at": now.Add(leaseTTL)})
+	if result.Error != nil {
+		log.Printf("Failed to renew the %s lease: %v", name, result.Error)
+		return false
+	}
+	if result.RowsAffected > 0 {
+		return true
+	}
+
+	// Another replica holds it, or nobody has asked for it yet. Of replicas
+	// racing to create the row, the primary key lets one succeed.
+	var existing int64
+	db.Model(&Lease{}).Where("name = ?", name).Count(&existing)
+	if existing > 0 {
+		return false
+	}
+	return db.Create(&Lease{Name: name, Holder: instanceID, ExpiresAt: now.Add(leaseTTL)}).Error == nil
+}
+
+// refreshBansLoop reloads the ban cache now and then, so a ban made through
+// another replica takes effect here too.
+func refreshBansLoop() {
+	if !multiInstance {
+		return
+	}
+	for {
+		time.Sleep(banRefreshEvery)
+		reloadBans()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Directories are uploaded as an archive (--archive tar.gz or zip) built on
+// the fly: the archive is written into a pipe as the upload reads it, so
+// nothing is staged on disk and the upload is sent without a length.
+
+// archiveExtensions maps each --archive format to its file extension.
+var archiveExtensions = map[string]string{
+	"tar.gz": ".tar.gz",
+	"tgz":    ".tar.gz",
+	"zip":    ".zip",
+}
+
+// archiveBase is the directory's own name, which the archive is named after
+// and unpacks into.
+func archiveBase(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return filepath.Base(dir)
+}
+
+// archiveName is the name a directory is uploaded under.
+func archiveName(dir, format string) string {
+	return archiveBase(dir) + archiveExtensions[format]
+}
+
+// directorySize adds up the regular files under dir.
+func directorySize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// streamArchive returns a reader of dir packed as format. A failure part way
+// through surfaces as a read error; closing the reader early stops packing.
+func streamArchive(dir, format string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, dir, format))
+	}()
+	return pr
+}
+
+// writeArchive packs dir into w. Entries are named under the directory's own
+// name, so the archive unpacks into a single folder. Files other than
+// regular files, directories and (in tar) symlinks are skipped.
+func writeArchive(w io.Writer, dir, format string) error {
+	root := filepath.Clean(dir)
+	base := archiveBase(dir)
+
+	var add func(name string, info fs.FileInfo, path string) error
+	var finish func() error
+	switch format {
+	case "tar.gz", "tgz":
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		add = func(name string, info fs.FileInfo, path string) error {
+			var link string
+			if info.Mode()&fs.ModeSymlink != 0 {
+				var err error
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if info.IsDir() {
+				header.Name += "/"
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				return copyFileInto(tw, path)
+			}
+			return nil
+		}
+		finish = func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+	case "zip":
+		zw := zip.NewWriter(w)
+		add = func(name string, info fs.FileInfo, path string) error {
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if info.IsDir() {
+				header.Name += "/"
+			} else {
+				header.Method = zip.Deflate
+			}
+			entry, err := zw.CreateHeader(header)
+			if err != nil || info.IsDir() {
+				return err
+			}
+			return copyFileInto(entry, path)
+		}
+		finish = zw.Close
+	default:
+		return fmt.Errorf("unknown archive format '%s' (expected tar.gz or zip)", format)
+	}
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := base
+		if rel != "." {
+			name = base + "/" + filepath.ToSlash(rel)
+		}
+		if info.Mode()&(fs.ModeNamedPipe|fs.ModeSocket|fs.ModeDevice) != 0 {
+			return nil
+		}
+		return add(name, info, path)
+	})
+	if err != nil {
+		return err
+	}
+	return finish()
+}
+
+// copyFileInto copies the file at path into w.
+func copyFileInto(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
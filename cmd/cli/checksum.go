@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// responseSHA256 returns the SHA-256 a download response advertises, from
+// X-Checksum-SHA256 or an RFC 3230 Digest header, as lower-case hex.
+func responseSHA256(header http.Header) string {
+	if sum := strings.ToLower(strings.TrimSpace(header.Get("X-Checksum-SHA256"))); len(sum) == 64 {
+		if _, err := hex.DecodeString(sum); err == nil {
+			return sum
+		}
+	}
+	for _, digest := range strings.Split(header.Get("Digest"), ",") {
+		algorithm, value, found := strings.Cut(strings.TrimSpace(digest), "=")
+		if !found || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+		if raw, err := base64.StdEncoding.DecodeString(value); err == nil && len(raw) == 32 {
+			return hex.EncodeToString(raw)
+		}
+	}
+	return ""
+}
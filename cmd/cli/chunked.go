@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+type chunkInitResponse struct {
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	SessionID   string `json:"session_id"`
+	ChunkSize   int64  `json:"chunk_size"`
+	TotalChunks int    `json:"total_chunks"`
+}
+
+// uploadParallel splits file into parts ranges and uploads them concurrently
+// through the chunked upload API. Each range is read straight from disk with
+// an io.SectionReader and retried independently on failure.
+func uploadParallel(file *os.File, filePath string, size int64, parts int, bar *progressbar.ProgressBar) (*UploadResponse, error) {
+	base := strings.TrimRight(serverURL, "/")
+
+	// Expiry and download limit go with the request that finishes the upload
+	completeFields := map[string]interface{}{}
+	if expiresValue != "" {
+		completeFields["expires"] = expiresValue
+	}
+	if downloadsValue != "" {
+		downloads, err := strconv.Atoi(downloadsValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid download limit '%s'", downloadsValue)
+		}
+		completeFields["downloads"] = downloads
+	}
+
+	initBody, _ := json.Marshal(map[string]interface{}{
+		"filename":     filepath.Base(filePath),
+		"size":         size,
+		"total_chunks": parts,
+	})
+
+	var session chunkInitResponse
+	if err := postJSON(base+"/api/upload/init", initBody, &session); err != nil {
+		return nil, fmt.Errorf("starting upload session: %w", err)
+	}
+	if !session.Success {
+		return nil, fmt.Errorf("starting upload session: %s", session.Message)
+	}
+
+	if verbose {
+		statusf("Session %s: %d chunk(s) of %s\n", session.SessionID, session.TotalChunks, formatBytes(session.ChunkSize))
+	}
+
+	// Track bytes per chunk so a retried chunk can take back its progress
+	// without disturbing the other goroutines.
+	var uploaded int64
+	sent := make([]int64, session.TotalChunks)
+
+	jobs := make(chan int)
+	errs := make(chan error, session.TotalChunks)
+	var wg sync.WaitGroup
+
+	for w := 0; w < parts && w < session.TotalChunks; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				offset := int64(index) * session.ChunkSize
+				length := session.ChunkSize
+				if offset+length > size {
+					length = size - offset
+				}
+
+				var err error
+				for attempt := 1; ; attempt++ {
+					section := io.NewSectionReader(file, offset, length)
+					reader := &chunkProgressReader{
+						Reader: section,
+						onRead: func(n int) {
+							atomic.AddInt64(&sent[index], int64(n))
+							bar.Set64(atomic.AddInt64(&uploaded, int64(n)))
+						},
+					}
+
+					err = putChunk(fmt.Sprintf("%s/api/upload/chunk/%s/%d", base, session.SessionID, index), reader, length)
+					if err == nil {
+						break
+					}
+
+					// Roll back this chunk's progress before retrying it
+					bar.Set64(atomic.AddInt64(&uploaded, -atomic.SwapInt64(&sent[index], 0)))
+					if !retryable(err) || attempt > maxRetries {
+						break
+					}
+					wait := retryWait(attempt, 0)
+					noteRetry(fmt.Sprintf("Chunk %d", index), err, attempt, wait)
+					time.Sleep(wait)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("chunk %d: %w", index, err)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < session.TotalChunks; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	bar.Finish()
+	statusf("\n🔗 Assembling file on server...\n")
+
+	completeFields["session_id"] = session.SessionID
+	completeBody, _ := json.Marshal(completeFields)
+	var uploadResp UploadResponse
+	if err := postJSON(base+"/api/upload/complete", completeBody, &uploadResp); err != nil {
+		return nil, fmt.Errorf("completing upload: %w", err)
+	}
+
+	return &uploadResp, nil
+}
+
+// putChunk sends a single chunk body of the given length.
+func putChunk(url string, body io.Reader, length int64) error {
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Minute,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return &statusError{status: resp.StatusCode, message: result.Message}
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// postJSON posts a JSON body and decodes the JSON response into out.
+func postJSON(url string, body []byte, out interface{}) error {
+	client := &http.Client{
+		Timeout: 30 * time.Minute,
+	}
+	resp, err := doRequest("POST "+url, client, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 401 {
+		return fmt.Errorf("authentication required, use --api-key flag")
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Raw response: %s\n", string(respBody))
+		}
+		return fmt.Errorf("parsing response: %w", err)
+	}
+
+	return nil
+}
+
+// chunkProgressReader reports every read to onRead.
+type chunkProgressReader struct {
+	Reader io.Reader
+	onRead func(n int)
+}
+
+func (r *chunkProgressReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		r.onRead(n)
+	}
+	return
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings can be kept in ~/.config/bashupload/config.yaml (under
+// $XDG_CONFIG_HOME when set) as named profiles, picked with --profile:
+//
+//	default_profile: work
+//	profiles:
+//	  work:
+//	    server: https://files.example.com
+//	    api_key: sk_...
+//	    expires: 7d
+//	    downloads: 10
+//	    copy: true
+//
+// A flag given on the command line still wins over the profile.
+
+// cliProfile is one named set of settings.
+type cliProfile struct {
+	Server    string `yaml:"server"`
+	APIKey    string `yaml:"api_key"`
+	Expires   string `yaml:"expires"`
+	Downloads string `yaml:"downloads"`
+	// Copy upload links to the clipboard, as with --copy
+	Copy bool `yaml:"copy"`
+}
+
+type cliConfig struct {
+	DefaultProfile string                `yaml:"default_profile"`
+	Profiles       map[string]cliProfile `yaml:"profiles"`
+}
+
+var profileName string
+
+// configPath returns where the config file lives.
+func configPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "bashupload", "config.yaml"), nil
+}
+
+// loadCLIConfig reads the config file; a missing one is an empty config.
+func loadCLIConfig() (*cliConfig, string, error) {
+	path, err := configPath()
+	if err != nil {
+		return &cliConfig{}, "", nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &cliConfig{}, path, nil
+	}
+	if err != nil {
+		return nil, path, err
+	}
+	var config cliConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, path, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &config, path, nil
+}
+
+// profileNames lists the profiles in the config file.
+func profileNames() []string {
+	config, _, err := loadCLIConfig()
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile fills in the settings not given as flags from the selected
+// profile: --profile, else default_profile, else one named "default".
+func applyProfile(cmd *cobra.Command) error {
+	// Completion doesn't need it, and shouldn't fail over it
+	if cmd.Name() == cobra.ShellCompRequestCmd {
+		return nil
+	}
+	config, path, err := loadCLIConfig()
+	if err != nil {
+		return err
+	}
+
+	name := profileName
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	if name == "" {
+		name = "default"
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		if cmd.Flags().Changed("profile") || config.DefaultProfile != "" {
+			return fmt.Errorf("profile '%s' not found in %s", name, path)
+		}
+		return nil
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Using profile '%s' from %s\n", name, path)
+	}
+
+	setDefault := func(flag string, target *string, value string) {
+		if value != "" && cmd.Flags().Lookup(flag) != nil && !cmd.Flags().Changed(flag) {
+			*target = value
+		}
+	}
+	setDefault("server", &serverURL, profile.Server)
+	setDefault("api-key", &apiKey, profile.APIKey)
+	setDefault("expires", &expiresValue, profile.Expires)
+	setDefault("downloads", &downloadsValue, profile.Downloads)
+	if profile.Copy && cmd.Flags().Lookup("copy") != nil && !cmd.Flags().Changed("copy") {
+		copyLink = true
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var deleteToken string
+
+// deleteFile removes an upload from the server before it expires, with the
+// deletion token from --token or the upload history.
+func deleteFile(cmd *cobra.Command, args []string) {
+	fileID := args[0]
+	if hash := strings.Index(fileID, "#"); hash != -1 {
+		fileID = fileID[:hash]
+	}
+	if strings.HasPrefix(fileID, "http://") || strings.HasPrefix(fileID, "https://") {
+		link, err := url.Parse(fileID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid download link - %v\n", err)
+			os.Exit(1)
+		}
+		if !cmd.Flags().Changed("server") {
+			serverURL = link.Scheme + "://" + link.Host
+		}
+		fileID = path.Base(link.Path)
+	}
+	if dot := strings.Index(fileID, "."); dot != -1 {
+		fileID = fileID[:dot]
+	}
+
+	token := deleteToken
+	if entry := findUpload(fileID); entry != nil {
+		if token == "" {
+			token = entry.DeleteToken
+		}
+		// The file lives where it was uploaded to
+		if !cmd.Flags().Changed("server") && entry.Server != "" {
+			serverURL = entry.Server
+		}
+	}
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "Error: No deletion token for %s in the upload history, pass it with --token\n", fileID)
+		os.Exit(1)
+	}
+
+	deleteURL := strings.TrimRight(serverURL, "/") + "/api/files/" + fileID
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Deleting: %s\n", deleteURL)
+	}
+	resp, err := doRequest("Deleting", http.DefaultClient, func() (*http.Request, error) {
+		req, err := http.NewRequest("DELETE", deleteURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Delete-Token", token)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		return req, nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error deleting file: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(body, &reply) != nil {
+		reply.Message = strings.TrimSpace(string(body))
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// Already gone, so it needn't linger in the history either
+		forgetUpload(fileID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Error: %s (HTTP %d)\n", reply.Message, resp.StatusCode)
+		os.Exit(1)
+	}
+
+	if err := forgetUpload(fileID); err != nil && verbose {
+		fmt.Fprintf(os.Stderr, "Couldn't update upload history: %v\n", err)
+	}
+	switch {
+	case jsonOutput:
+		printJSON(map[string]interface{}{"id": fileID, "deleted": true})
+	case quiet:
+	default:
+		fmt.Printf("🗑️  Deleted %s\n", fileID)
+	}
+}
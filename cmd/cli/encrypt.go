@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// End-to-end encryption. With --encrypt the file is sealed locally before it
+// is uploaded, and the key only ever travels in the URL fragment
+// (/d/<id>#<key>), which browsers and HTTP clients never send to the server.
+//
+// The ciphertext starts with a header of
+//
+//	"BUE1" || nonce prefix (7 bytes)
+//
+// followed by AES-256-GCM sealed segments of e2eSegmentSize plaintext bytes.
+// Segment i uses the nonce prefix || i (4 bytes, big endian) || final flag,
+// so segments cannot be reordered, dropped or truncated. The plaintext begins
+// with the original filename (2-byte length + name) so it never reaches the
+// server either.
+
+const (
+	e2eMagic       = "BUE1"
+	e2eSegmentSize = 64 * 1024
+	e2eNoncePrefix = 7
+	e2eTagSize     = 16
+	e2eKeySize     = 32
+	e2eUploadName  = "encrypted.bin"
+)
+
+func newE2EAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func e2eNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, e2eNoncePrefix+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[e2eNoncePrefix:], index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encodeE2EKey and decodeE2EKey convert a key to and from its URL fragment form.
+func encodeE2EKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func decodeE2EKey(fragment string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(fragment)
+	if err != nil || len(key) != e2eKeySize {
+		return nil, errors.New("invalid decryption key in link")
+	}
+	return key, nil
+}
+
+// encryptToTemp seals src into a temporary file under a fresh random key.
+// The caller removes the file once the upload is done.
+func encryptToTemp(src io.Reader, name string) (*os.File, []byte, error) {
+	key := make([]byte, e2eKeySize)
+	prefix := make([]byte, e2eNoncePrefix)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newE2EAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "bashupload-*.enc")
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (*os.File, []byte, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+
+	out := bufio.NewWriter(tmp)
+	out.WriteString(e2eMagic)
+	out.Write(prefix)
+
+	if len(name) > 0xFFFF {
+		name = name[:0xFFFF]
+	}
+	header := make([]byte, 2, 2+len(name))
+	binary.BigEndian.PutUint16(header, uint16(len(name)))
+	header = append(header, name...)
+	plain := io.MultiReader(bytes.NewReader(header), src)
+
+	// Read one segment ahead so the last one can be marked final
+	current := make([]byte, e2eSegmentSize)
+	next := make([]byte, e2eSegmentSize)
+	n, err := io.ReadFull(plain, current)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fail(err)
+	}
+	for index := uint32(0); ; index++ {
+		m, err := io.ReadFull(plain, next)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fail(err)
+		}
+		final := m == 0
+		if _, err := out.Write(aead.Seal(nil, e2eNonce(prefix, index, final), current[:n], nil)); err != nil {
+			return fail(err)
+		}
+		if final {
+			break
+		}
+		current, next = next, current
+		n = m
+	}
+
+	if err := out.Flush(); err != nil {
+		return fail(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return tmp, key, nil
+}
+
+// e2eReader decrypts a stream written by encryptToTemp.
+type e2eReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	sealed []byte
+	plain  []byte
+	done   bool
+}
+
+// openE2E starts decrypting r with key and returns the plaintext reader
+// along with the original filename stored inside the ciphertext.
+func openE2E(r io.Reader, key []byte) (io.Reader, string, error) {
+	src := bufio.NewReaderSize(r, e2eSegmentSize+e2eTagSize+1)
+
+	header := make([]byte, len(e2eMagic)+e2eNoncePrefix)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(e2eMagic)]) != e2eMagic {
+		return nil, "", errors.New("file is not end-to-end encrypted")
+	}
+	aead, err := newE2EAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	d := &e2eReader{
+		src:    src,
+		aead:   aead,
+		prefix: header[len(e2eMagic):],
+		sealed: make([]byte, e2eSegmentSize+e2eTagSize),
+	}
+
+	var nameLen [2]byte
+	if _, err := io.ReadFull(d, nameLen[:]); err != nil {
+		return nil, "", fmt.Errorf("reading encrypted header: %w", err)
+	}
+	name := make([]byte, binary.BigEndian.Uint16(nameLen[:]))
+	if _, err := io.ReadFull(d, name); err != nil {
+		return nil, "", fmt.Errorf("reading encrypted header: %w", err)
+	}
+	return d, string(name), nil
+}
+
+func (d *e2eReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the following segment.
+func (d *e2eReader) next() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("encrypted file is truncated")
+		}
+		return err
+	}
+
+	final := n < len(d.sealed)
+	if !final {
+		if _, err := d.src.Peek(1); err == io.EOF {
+			final = true
+		}
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0], e2eNonce(d.prefix, d.index, final), d.sealed[:n], nil)
+	if err != nil {
+		return errors.New("decryption failed: wrong key or corrupted file")
+	}
+	d.plain = plain
+	d.index++
+	d.done = final
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Every successful upload is appended to a history file in the user's cache
+// directory, one JSON object per line, so its ID and link can be found again
+// later: by `list`, shell completion and `delete`.
+
+// historyCompletions caps how many recent IDs completion offers.
+const historyCompletions = 50
+
+type historyEntry struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	Server     string    `json:"server"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	// Nil when the file doesn't expire, or the server didn't say
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Lets the file be deleted before it expires
+	DeleteToken string `json:"delete_token,omitempty"`
+}
+
+// historyPath returns where the upload history is kept.
+func historyPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bashupload", "history.jsonl"), nil
+}
+
+// recordUploads appends the successful uploads to the history. Failing to
+// write it doesn't fail the upload.
+func recordUploads(results []uploadResult) {
+	path, err := historyPath()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	// Links to encrypted files carry their key, so only the user reads it
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		if verbose {
+			statusf("Couldn't write upload history: %v\n", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for i := range results {
+		result := &results[i]
+		if result.Err != nil {
+			continue
+		}
+		encoder.Encode(historyEntry{
+			ID:          result.Response.UniqueID,
+			Name:        filepath.Base(result.Path),
+			URL:         result.downloadLink(),
+			Server:      strings.TrimRight(serverURL, "/"),
+			Size:        result.Response.FileSize,
+			UploadedAt:  time.Now(),
+			ExpiresAt:   result.Response.ExpiresAt,
+			DeleteToken: result.Response.DeleteToken,
+		})
+	}
+}
+
+// readHistory returns the recorded uploads, oldest first. Lines that don't
+// parse are skipped.
+func readHistory() []historyEntry {
+	path, err := historyPath()
+	if err != nil {
+		return nil
+	}
+	return readHistoryFile(path)
+}
+
+func readHistoryFile(path string) []historyEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry historyEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.ID != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// expired reports whether the file has passed its expiry time.
+func (e *historyEntry) expired() bool {
+	return e.ExpiresAt != nil && time.Now().After(*e.ExpiresAt)
+}
+
+// findUpload returns the latest recorded upload of id, or nil.
+func findUpload(id string) *historyEntry {
+	entries := readHistory()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ID == id {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// forgetUpload drops id from the history, once it's gone from the server.
+func forgetUpload(id string) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	entries := readHistoryFile(path)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.ID != id {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+	return writeHistory(path, kept)
+}
+
+// writeHistory replaces the history with entries, through a temporary file
+// so it's never left half written.
+func writeHistory(path string, entries []historyEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	encoder := json.NewEncoder(tmp)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// completeFileIDs offers the most recently uploaded IDs, newest first, with
+// the file's name as the description.
+func completeFileIDs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	entries := readHistory()
+	seen := make(map[string]bool)
+	var ids []string
+	for i := len(entries) - 1; i >= 0 && len(ids) < historyCompletions; i-- {
+		entry := entries[i]
+		if seen[entry.ID] || !strings.HasPrefix(entry.ID, toComplete) {
+			continue
+		}
+		seen[entry.ID] = true
+		ids = append(ids, entry.ID+"\t"+entry.Name)
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeProfiles offers the profiles in the config file.
+func completeProfiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return profileNames(), cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	listName    string
+	listSince   string
+	listActive  bool
+	listLimit   int
+	pruneOlder  string
+	pruneAll    bool
+	pruneDryRun bool
+)
+
+// parseAge reads a duration like 12h, 7d or 2w.
+func parseAge(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			n, err := strconv.Atoi(number)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid duration '%s'", value)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", value)
+	}
+	return age, nil
+}
+
+// matchesName reports whether name matches the --name filter: a glob
+// pattern, or otherwise any part of the name regardless of case.
+func matchesName(name, pattern string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, _ := filepath.Match(pattern, name)
+		return matched
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(pattern))
+}
+
+// listUploads prints the upload history, newest first.
+func listUploads(cmd *cobra.Command, args []string) {
+	var since time.Time
+	if listSince != "" {
+		age, err := parseAge(listSince)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		since = time.Now().Add(-age)
+	}
+	server := ""
+	if cmd.Flags().Changed("server") {
+		server = strings.TrimRight(serverURL, "/")
+	}
+
+	entries := readHistory()
+	matched := []historyEntry{}
+	for i := len(entries) - 1; i >= 0 && (listLimit <= 0 || len(matched) < listLimit); i-- {
+		entry := entries[i]
+		if (listName != "" && !matchesName(entry.Name, listName)) || entry.UploadedAt.Before(since) ||
+			(listActive && entry.expired()) || (server != "" && entry.Server != server) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+
+	switch {
+	case jsonOutput:
+		printJSON(matched)
+		return
+	case quiet:
+		for _, entry := range matched {
+			fmt.Println(entry.URL)
+		}
+		return
+	}
+	if len(matched) == 0 {
+		fmt.Println("No uploads found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSIZE\tUPLOADED\tEXPIRES\tDOWNLOAD URL")
+	for _, entry := range matched {
+		expires := "-"
+		if entry.ExpiresAt != nil {
+			expires = entry.ExpiresAt.Local().Format("2006-01-02 15:04")
+			if entry.expired() {
+				expires = "expired"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.ID, entry.Name, formatBytes(entry.Size),
+			entry.UploadedAt.Local().Format("2006-01-02 15:04"), expires, entry.URL)
+	}
+	w.Flush()
+}
+
+// pruneHistory drops entries from the upload history: expired ones, those
+// older than --older-than, or all of them.
+func pruneHistory(cmd *cobra.Command, args []string) {
+	var cutoff time.Time
+	if pruneOlder != "" {
+		age, err := parseAge(pruneOlder)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	entries := readHistoryFile(path)
+	var kept []historyEntry
+	for _, entry := range entries {
+		drop := pruneAll || entry.expired() || (!cutoff.IsZero() && entry.UploadedAt.Before(cutoff))
+		if !drop {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(entries) - len(kept)
+
+	if removed > 0 && !pruneDryRun {
+		if err := writeHistory(path, kept); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	switch {
+	case jsonOutput:
+		printJSON(map[string]interface{}{"removed": removed, "kept": len(kept), "dry_run": pruneDryRun})
+	case quiet:
+	case pruneDryRun:
+		fmt.Printf("Would remove %d of %d entries\n", removed, len(entries))
+	default:
+		fmt.Printf("Removed %d of %d entries\n", removed, len(entries))
+	}
+}
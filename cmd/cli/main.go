@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,11 +22,13 @@ import (
 )
 
 type UploadResponse struct {
-	Success     bool   `json:"success"`
-	Message     string `json:"message"`
-	UniqueID    string `json:"unique_id,omitempty"`
-	DownloadURL string `json:"download_url,omitempty"`
-	FileSize    int64  `json:"file_size,omitempty"`
+	Success     bool       `json:"success"`
+	Message     string     `json:"message"`
+	UniqueID    string     `json:"unique_id,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	FileSize    int64      `json:"file_size,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	DeleteToken string     `json:"delete_token,omitempty"`
 }
 
 type FileInfo struct {
@@ -36,55 +42,207 @@ type FileInfo struct {
 		Extension    string    `json:"extension"`
 		UploadedAt   time.Time `json:"uploaded_at"`
 		Downloads    int       `json:"downloads"`
+		SHA256       string    `json:"sha256"`
+		// Filled in by the CLI
+		DownloadURL string `json:"download_url"`
 	} `json:"data"`
 }
 
+// downloadJSON is the --json output of a download.
+type downloadJSON struct {
+	File      string `json:"file"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256,omitempty"`
+	Verified  bool   `json:"verified"`
+	Decrypted bool   `json:"decrypted"`
+}
+
 var (
-	serverURL string
-	verbose   bool
-	apiKey    string
+	serverURL     string
+	verbose       bool
+	apiKey        string
+	parallel      int
+	noVerify      bool
+	encrypt       bool
+	resumable     bool
+	concurrency   int
+	jsonOutput    bool
+	quiet         bool
+	showQR        bool
+	copyLink      bool
+	archiveFormat string
+	// Sent with the upload; empty leaves them to the server
+	expiresValue   string
+	downloadsValue string
 )
 
 func main() {
 	var rootCmd = &cobra.Command{
 		Use:   "bashupload",
 		Short: "bashupload - High-performance file uploader CLI",
-		Long:  `A CLI tool to upload files up to 50GB and generate secure download links - just like bashupload.com`,
+		Long: `A CLI tool to upload files up to 50GB and generate secure download links - just like bashupload.com
+
+The server, API key and upload defaults can be kept as named profiles in
+~/.config/bashupload/config.yaml and picked with --profile.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := applyProfile(cmd); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
 	}
 
 	var uploadCmd = &cobra.Command{
-		Use:   "upload [file]",
-		Short: "Upload a file",
-		Long:  `Upload a file to the server and get a download link`,
-		Args:  cobra.ExactArgs(1),
-		Run:   uploadFile,
+		Use:   "upload [file|pattern]...",
+		Short: "Upload files",
+		Long: `Upload files to the server and get their download links.
+
+Several files or glob patterns ('*.log') can be given at once; they are
+uploaded one after another, or --concurrency at a time, and listed in a
+summary at the end.
+
+With --encrypt the file is encrypted locally and the key is appended to the
+link after '#', so the server only ever stores ciphertext.
+
+With --resumable an interrupted upload (Ctrl-C, a dropped connection) picks up
+where it stopped when the same command is run again.
+
+With --archive tar.gz or --archive zip a directory is packed on the fly and
+uploaded as a single archive.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  uploadFile,
 	}
 
 	var infoCmd = &cobra.Command{
-		Use:   "info [file-id]",
-		Short: "Get file information",
-		Long:  `Get information about an uploaded file using its unique ID`,
-		Args:  cobra.ExactArgs(1),
-		Run:   getFileInfo,
+		Use:               "info [file-id]",
+		Short:             "Get file information",
+		Long:              `Get information about an uploaded file using its unique ID`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFileIDs,
+		Run:               getFileInfo,
 	}
 
 	var downloadCmd = &cobra.Command{
-		Use:   "download [file-id] [output-path]",
+		Use:   "download [file-id|url] [output-path]",
 		Short: "Download a file",
-		Long:  `Download a file using its unique ID`,
-		Args:  cobra.RangeArgs(1, 2),
-		Run:   downloadFile,
+		Long: `Download a file using its unique ID or download link.
+
+Links carrying a key after '#' (from upload --encrypt) are decrypted locally.`,
+		Args:              cobra.RangeArgs(1, 2),
+		ValidArgsFunction: completeFileIDs,
+		Run:               downloadFile,
+	}
+
+	var deleteCmd = &cobra.Command{
+		Use:   "delete [file-id|url]",
+		Short: "Delete an uploaded file",
+		Long: `Delete a file from the server before it expires.
+
+The deletion token handed out at upload time is taken from the local upload
+history, so files uploaded with this CLI need nothing more; for others pass
+it with --token.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFileIDs,
+		Run:               deleteFile,
+	}
+
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List your uploads",
+		Long: `List the files uploaded with this CLI, newest first, from the local upload
+history. --server narrows it to one server.`,
+		Args: cobra.NoArgs,
+		Run:  listUploads,
+	}
+
+	var historyCmd = &cobra.Command{
+		Use:   "history",
+		Short: "Manage the local upload history",
+	}
+
+	var pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old entries from the upload history",
+		Long: `Remove expired uploads from the local history, and with --older-than
+those uploaded before then. The files on the server are left alone.`,
+		Args: cobra.NoArgs,
+		Run:  pruneHistory,
+	}
+
+	var statsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Show server statistics",
+		Long: `Show how many files the server holds and their total size. With an API key
+it also shows your usage: uploads, downloads and stored files for your key
+and IP. --window limits the traffic counted to a recent period, e.g. 24h or
+7d.`,
+		Args: cobra.NoArgs,
+		Run:  showStats,
+	}
+
+	var watchCmd = &cobra.Command{
+		Use:   "watch [directory]",
+		Short: "Upload new files in a directory as they appear",
+		Long: `Watch a directory and upload files as they are created or changed, printing
+each link, until interrupted. A file is uploaded once it has gone --settle
+without being written to. Hidden and temporary files (.part, .tmp, ~) are
+left alone.
+
+--pattern limits the uploads to matching names ('*.png'), and --webhook posts
+each result as JSON to a URL.`,
+		Args: cobra.ExactArgs(1),
+		Run:  watchDirectory,
 	}
 
 	// Add flags
+	deleteCmd.Flags().StringVarP(&deleteToken, "token", "t", "", "Deletion token, if the upload isn't in the local history")
+	listCmd.Flags().StringVarP(&listName, "name", "n", "", "Only files whose name contains this, or matches this glob pattern")
+	listCmd.Flags().StringVar(&listSince, "since", "", "Only files uploaded within this long, e.g. 24h or 7d")
+	listCmd.Flags().BoolVar(&listActive, "active", false, "Hide files that have expired")
+	listCmd.Flags().IntVarP(&listLimit, "limit", "l", 0, "Show at most N files")
+	pruneCmd.Flags().StringVar(&pruneOlder, "older-than", "", "Also remove uploads older than this, e.g. 30d")
+	pruneCmd.Flags().BoolVar(&pruneAll, "all", false, "Remove every entry")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Only report how many entries would be removed")
+	statsCmd.Flags().StringVarP(&statsWindow, "window", "w", "", "Only count traffic within this long, e.g. 24h or 7d (default all time)")
+	watchCmd.Flags().StringArrayVarP(&watchPatterns, "pattern", "m", nil, "Only upload files whose name matches this glob pattern; can be repeated")
+	watchCmd.Flags().BoolVarP(&watchRecursive, "recursive", "R", false, "Also watch the directories below it")
+	watchCmd.Flags().DurationVar(&watchSettle, "settle", 2*time.Second, "How long a file must go unchanged before it's uploaded")
+	watchCmd.Flags().StringVar(&watchWebhook, "webhook", "", "POST each upload's result as JSON to this URL")
+	watchCmd.Flags().BoolVarP(&encrypt, "encrypt", "e", false, "Encrypt files locally; the key is only part of the printed link")
+	watchCmd.Flags().StringVar(&expiresValue, "expires", "", "Delete files after this long, e.g. 12h or 7d (capped by the server)")
+	watchCmd.Flags().StringVar(&downloadsValue, "downloads", "", "Delete files after this many downloads (capped by the server)")
+	downloadCmd.Flags().BoolVar(&noVerify, "no-verify", false, "Skip SHA-256 verification of the downloaded file")
+	uploadCmd.Flags().IntVarP(&parallel, "parallel", "p", 1, "Upload the file as N concurrent chunks")
+	uploadCmd.Flags().BoolVarP(&encrypt, "encrypt", "e", false, "Encrypt the file locally; the key is only part of the printed link")
+	uploadCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 1, "Upload up to N files at the same time")
+	uploadCmd.Flags().BoolVarP(&resumable, "resumable", "r", false, "Upload in pieces that survive interruptions; run the same command again to continue")
+	uploadCmd.Flags().StringVarP(&archiveFormat, "archive", "a", "", "Upload directories as an archive: tar.gz or zip")
+	uploadCmd.Flags().BoolVar(&showQR, "qr", false, "Also show the download link as a QR code")
+	uploadCmd.Flags().BoolVar(&copyLink, "copy", false, "Copy the download link to the clipboard")
+	uploadCmd.Flags().StringVar(&expiresValue, "expires", "", "Delete the file after this long, e.g. 12h or 7d (capped by the server)")
+	uploadCmd.Flags().StringVar(&downloadsValue, "downloads", "", "Delete the file after this many downloads (capped by the server)")
 	rootCmd.PersistentFlags().StringVarP(&serverURL, "server", "s", "http://localhost:3000", "Server URL")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Verbose output")
 	rootCmd.PersistentFlags().StringVarP(&apiKey, "api-key", "k", "", "API key for authentication")
+	rootCmd.PersistentFlags().IntVar(&maxRetries, "retries", 4, "Try a request that failed for a passing reason (dropped connection, 5xx, 429) this many more times")
+	rootCmd.PersistentFlags().DurationVar(&retryMaxWait, "retry-max-wait", 30*time.Second, "Longest to wait between two attempts")
+	rootCmd.PersistentFlags().StringVarP(&profileName, "profile", "P", "", "Profile from the config file to use")
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Print the result as JSON, progress goes to stderr")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Print only the result: the download link for uploads, the saved path for downloads")
+	rootCmd.MarkFlagsMutuallyExclusive("json", "quiet")
+	rootCmd.RegisterFlagCompletionFunc("profile", completeProfiles)
+	uploadCmd.RegisterFlagCompletionFunc("archive", cobra.FixedCompletions([]string{"tar.gz", "zip"}, cobra.ShellCompDirectiveNoFileComp))
 
 	// Add commands
 	rootCmd.AddCommand(uploadCmd)
 	rootCmd.AddCommand(infoCmd)
 	rootCmd.AddCommand(downloadCmd)
+	rootCmd.AddCommand(deleteCmd)
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(watchCmd)
+	rootCmd.AddCommand(statsCmd)
+	historyCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(historyCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -93,92 +251,248 @@ func main() {
 }
 
 func uploadFile(cmd *cobra.Command, args []string) {
-	filePath := args[0]
-
-	// Check if file exists
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: File not found - %v\n", err)
+	// A resumable upload sends the file through tus by itself, and has to
+	// find the same bytes on every run, which a fresh encryption key wouldn't
+	// give
+	if resumable && (encrypt || parallel > 1) {
+		fmt.Fprintf(os.Stderr, "Error: --resumable can't be combined with --encrypt or --parallel\n")
 		os.Exit(1)
 	}
-
-	if fileInfo.IsDir() {
-		fmt.Fprintf(os.Stderr, "Error: Path is a directory, not a file\n")
+	if _, ok := archiveExtensions[archiveFormat]; archiveFormat != "" && !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown archive format '%s', expected tar.gz or zip\n", archiveFormat)
 		os.Exit(1)
 	}
 
-	// Check file size (50GB limit)
-	if fileInfo.Size() > 50*1024*1024*1024 {
-		fmt.Fprintf(os.Stderr, "Error: File too large. Maximum size is 50GB\n")
-		os.Exit(1)
+	// tus has nowhere to carry these; resumable uploads get the server's
+	if (expiresValue != "" || downloadsValue != "") && resumable {
+		statusf("⚠️  --expires and --downloads don't apply to --resumable uploads, the server defaults do\n")
 	}
 
-	file, err := os.Open(filePath)
+	paths, err := expandUploadArgs(args)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	defer file.Close()
 
-	fmt.Printf("📁 Uploading: %s (%s)\n", filepath.Base(filePath), formatBytes(fileInfo.Size()))
+	// A single file keeps the detailed output
+	if len(paths) == 1 && !jsonOutput && !quiet {
+		result := uploadPath(paths[0], true)
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %v\n", result.Err)
+			os.Exit(1)
+		}
+		recordUploads([]uploadResult{result})
+		printUploadResult(result.Path, result.Response, result.Key)
+		if showQR {
+			printQR("", result.downloadLink())
+		}
+		if copyLink {
+			copyLinks([]uploadResult{result})
+		}
+		return
+	}
+
+	results := uploadAll(paths, concurrency)
+	recordUploads(results)
+	switch {
+	case jsonOutput:
+		printUploadJSON(results)
+	case quiet:
+		printUploadLinks(results)
+	default:
+		printUploadSummary(results)
+	}
+	if showQR {
+		for i := range results {
+			if results[i].Err == nil {
+				printQR(results[i].Path, results[i].downloadLink())
+			}
+		}
+	}
+	if copyLink {
+		copyLinks(results)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			os.Exit(1)
+		}
+	}
+}
 
-	// Create progress bar
-	bar := progressbar.NewOptions64(fileInfo.Size(),
-		progressbar.OptionSetDescription("Uploading..."),
-		progressbar.OptionSetWriter(os.Stderr),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWidth(50),
-		progressbar.OptionThrottle(100*time.Millisecond),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSpinnerType(14),
-		progressbar.OptionFullWidth(),
-		progressbar.OptionSetRenderBlankState(true),
-	)
-
-	// Create multipart form
-	var requestBody bytes.Buffer
-	writer := multipart.NewWriter(&requestBody)
-
-	// Create progress reader
-	progressReader := &ProgressReader{
-		Reader: file,
-		bar:    bar,
-	}
-
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating form file: %v\n", err)
-		os.Exit(1)
+// uploadResult is the outcome of uploading one file.
+type uploadResult struct {
+	Path     string
+	Response *UploadResponse
+	Key      []byte // end-to-end encryption key, nil when not encrypted
+	Err      error
+}
+
+// uploadPath uploads one file. With showProgress off it prints nothing, for
+// uploads running alongside others.
+func uploadPath(filePath string, showProgress bool) uploadResult {
+	result := uploadResult{Path: filePath}
+	showProgress = showProgress && !quiet
+	fail := func(format string, args ...interface{}) uploadResult {
+		result.Err = fmt.Errorf(format, args...)
+		return result
 	}
 
-	_, err = io.Copy(part, progressReader)
+	// Check if file exists
+	fileInfo, err := os.Stat(filePath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error copying file: %v\n", err)
-		os.Exit(1)
+		return fail("File not found - %v", err)
 	}
 
-	err = writer.Close()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error closing writer: %v\n", err)
-		os.Exit(1)
+	// Seekable, for resumable and parallel uploads; nil while streaming an
+	// archive
+	var file *os.File
+	var source io.Reader
+	uploadName := filepath.Base(filePath)
+	uploadSize := fileInfo.Size()
+
+	if fileInfo.IsDir() {
+		if archiveFormat == "" {
+			return fail("Path is a directory, use --archive tar.gz or --archive zip to upload it")
+		}
+		// The archive is packed while it's sent, so its size isn't known
+		// up front and it can only be read once
+		if resumable || (parallel > 1 && !encrypt) {
+			return fail("Directories are uploaded as a stream, which can't be combined with --resumable or --parallel")
+		}
+		if showProgress {
+			statusf("📦 Packing: %s (%s) as %s\n", filePath, formatBytes(directorySize(filePath)), archiveName(filePath, archiveFormat))
+		}
+		archive := streamArchive(filePath, archiveFormat)
+		defer archive.Close()
+		source = archive
+		uploadName = archiveName(filePath, archiveFormat)
+		uploadSize = -1
+	} else {
+		// Check file size (50GB limit)
+		if fileInfo.Size() > 50*1024*1024*1024 {
+			return fail("File too large. Maximum size is 50GB")
+		}
+
+		file, err = os.Open(filePath)
+		if err != nil {
+			return fail("Error opening file: %v", err)
+		}
+		defer file.Close()
+		source = file
 	}
 
-	bar.Finish()
-	fmt.Println("\n🚀 Uploading to server...")
+	// Encrypt to a temporary file and upload that instead; neither the
+	// contents nor the original name are sent to the server
+	if encrypt {
+		if showProgress {
+			statusf("🔐 Encrypting: %s\n", uploadName)
+		}
+		encrypted, key, err := encryptToTemp(source, uploadName)
+		if err != nil {
+			return fail("Error encrypting file: %v", err)
+		}
+		defer os.Remove(encrypted.Name())
+		defer encrypted.Close()
 
-	// Create HTTP request
-	uploadURL := strings.TrimRight(serverURL, "/") + "/api/upload"
-	req, err := http.NewRequest("POST", uploadURL, &requestBody)
+		stat, err := encrypted.Stat()
+		if err != nil {
+			return fail("Error encrypting file: %v", err)
+		}
+		file = encrypted
+		source = encrypted
+		result.Key = key
+		uploadName = e2eUploadName
+		uploadSize = stat.Size()
+	}
+
+	// Create progress bar
+	var bar *progressbar.ProgressBar
+	if showProgress {
+		if uploadSize >= 0 {
+			statusf("📁 Uploading: %s (%s)\n", filepath.Base(filePath), formatBytes(uploadSize))
+		}
+		bar = progressbar.NewOptions64(uploadSize,
+			progressbar.OptionSetDescription("Uploading..."),
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetWidth(50),
+			progressbar.OptionThrottle(100*time.Millisecond),
+			progressbar.OptionShowCount(),
+			progressbar.OptionSpinnerType(14),
+			progressbar.OptionFullWidth(),
+			progressbar.OptionSetRenderBlankState(true),
+		)
+	} else {
+		bar = progressbar.DefaultBytesSilent(uploadSize)
+	}
+
+	var uploadResp *UploadResponse
+	switch {
+	// Upload through tus, keeping state to continue from if interrupted
+	case resumable:
+		uploadResp, err = uploadResumable(file, filePath, uploadName, fileInfo, bar)
+	// Split large uploads into concurrently uploaded chunks when requested
+	case parallel > 1 && uploadSize > 0:
+		uploadResp, err = uploadParallel(file, uploadName, uploadSize, parallel, bar)
+	default:
+		uploadResp, err = uploadStream(source, uploadName, uploadSize, bar)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating request: %v\n", err)
-		os.Exit(1)
+		return fail("Error uploading file: %v", err)
 	}
+	if !uploadResp.Success {
+		return fail("Upload failed: %s", uploadResp.Message)
+	}
+	result.Response = uploadResp
+	return result
+}
+
+// uploadStream sends a file as a single multipart part: the part's header
+// and the closing boundary are written up front, so the body is sent
+// straight from disk with a known Content-Length. An uploadSize of -1 sends
+// it chunked instead, for archives packed on the fly.
+func uploadStream(file io.Reader, uploadName string, uploadSize int64, bar *progressbar.ProgressBar) (*UploadResponse, error) {
+	var head bytes.Buffer
+	writer := multipart.NewWriter(&head)
+	if _, err := writer.CreateFormFile("file", uploadName); err != nil {
+		return nil, fmt.Errorf("creating form file: %w", err)
+	}
+	partHeader := head.Len()
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("closing writer: %w", err)
+	}
+	prefix, suffix := head.Bytes()[:partHeader], head.Bytes()[partHeader:]
+
+	uploadURL := strings.TrimRight(serverURL, "/") + "/api/upload"
+	newRequest := func() (*http.Request, error) {
+		// The bar moves as the HTTP client reads the file off disk to send it
+		progressReader := &ProgressReader{
+			Reader: file,
+			bar:    bar,
+		}
+		body := io.MultiReader(bytes.NewReader(prefix), progressReader, bytes.NewReader(suffix))
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+		req, err := http.NewRequest("POST", uploadURL, body)
+		if err != nil {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		req.ContentLength = -1
+		if uploadSize >= 0 {
+			req.ContentLength = int64(len(prefix)) + uploadSize + int64(len(suffix))
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	// Add API key if provided
-	if apiKey != "" {
-		req.Header.Set("X-API-Key", apiKey)
+		// Add API key if provided
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		if expiresValue != "" {
+			req.Header.Set("X-Expire-After", expiresValue)
+		}
+		if downloadsValue != "" {
+			req.Header.Set("X-Max-Downloads", downloadsValue)
+		}
+		return req, nil
 	}
 
 	// Send request
@@ -186,112 +500,182 @@ func uploadFile(cmd *cobra.Command, args []string) {
 		Timeout: 30 * time.Minute,
 	}
 
-	resp, err := client.Do(req)
+	// A file can be sent again from the start; an archive packed on the fly
+	// only once
+	var resp *http.Response
+	var err error
+	if seeker, ok := file.(io.Seeker); ok {
+		first := true
+		resp, err = doRequest("Upload", client, func() (*http.Request, error) {
+			if !first {
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return nil, err
+				}
+				bar.Reset()
+			}
+			first = false
+			return newRequest()
+		})
+	} else {
+		var req *http.Request
+		if req, err = newRequest(); err == nil {
+			resp, err = client.Do(req)
+		}
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error uploading file: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	bar.Finish()
 
 	// Read response
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading response: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("reading response: %w", err)
 	}
 
 	var uploadResp UploadResponse
-	err = json.Unmarshal(respBody, &uploadResp)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing response: %v\n", err)
+	if err := json.Unmarshal(respBody, &uploadResp); err != nil {
 		if verbose {
 			fmt.Fprintf(os.Stderr, "Raw response: %s\n", string(respBody))
 		}
-		os.Exit(1)
+		return nil, fmt.Errorf("parsing response: %w", err)
 	}
+	return &uploadResp, nil
+}
 
-	if !uploadResp.Success {
-		fmt.Fprintf(os.Stderr, "Upload failed: %s\n", uploadResp.Message)
-		os.Exit(1)
+// printUploadResult displays the success message for a finished upload. For
+// encrypted uploads the key is appended to the link as a URL fragment.
+func printUploadResult(filePath string, uploadResp *UploadResponse, encryptionKey []byte) {
+	downloadURL := uploadResp.DownloadURL
+	if encryptionKey != nil {
+		downloadURL += "#" + encodeE2EKey(encryptionKey)
 	}
 
-	// Display success message
 	fmt.Println("\n✅ Upload successful!")
 	fmt.Printf("📄 File: %s\n", filepath.Base(filePath))
 	fmt.Printf("📏 Size: %s\n", formatBytes(uploadResp.FileSize))
 	fmt.Printf("🆔 ID: %s\n", uploadResp.UniqueID)
-	fmt.Printf("🔗 Download URL: %s\n", uploadResp.DownloadURL)
+	fmt.Printf("🔗 Download URL: %s\n", downloadURL)
 	fmt.Println("\n📋 Share this link to allow others to download your file:")
-	fmt.Printf("   %s\n", uploadResp.DownloadURL)
+	fmt.Printf("   %s\n", downloadURL)
+	if encryptionKey != nil {
+		fmt.Println("\n🔐 The file is end-to-end encrypted. Anyone without the part after '#' only gets ciphertext;")
+		fmt.Println("   decrypt it with: bashupload download '<link>'")
+	}
 }
 
 func getFileInfo(cmd *cobra.Command, args []string) {
-	fileID := args[0]
+	fileInfo, err := fetchFileInfo(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fileInfo.Data.DownloadURL = fmt.Sprintf("%s/d/%s%s", strings.TrimRight(serverURL, "/"), fileInfo.Data.UniqueID, fileInfo.Data.Extension)
 
-	infoURL := strings.TrimRight(serverURL, "/") + "/api/files/" + fileID
+	switch {
+	case jsonOutput:
+		printJSON(fileInfo.Data)
+		return
+	case quiet:
+		fmt.Println(fileInfo.Data.DownloadURL)
+		return
+	}
 
-	if verbose {
-		fmt.Printf("Fetching info from: %s\n", infoURL)
+	// Display file information
+	fmt.Println("📄 File Information")
+	fmt.Println("==================")
+	fmt.Printf("🆔 ID: %s\n", fileInfo.Data.UniqueID)
+	fmt.Printf("📁 Original Name: %s\n", fileInfo.Data.OriginalName)
+	fmt.Printf("📏 Size: %s\n", formatBytes(fileInfo.Data.FileSize))
+	fmt.Printf("📝 MIME Type: %s\n", fileInfo.Data.MimeType)
+	fmt.Printf("📎 Extension: %s\n", fileInfo.Data.Extension)
+	fmt.Printf("📅 Uploaded: %s\n", fileInfo.Data.UploadedAt.Format("2006-01-02 15:04:05"))
+	fmt.Printf("📊 Downloads: %d\n", fileInfo.Data.Downloads)
+	if fileInfo.Data.SHA256 != "" {
+		fmt.Printf("🔒 SHA-256: %s\n", fileInfo.Data.SHA256)
 	}
+	fmt.Printf("🔗 Download URL: %s\n", fileInfo.Data.DownloadURL)
+}
 
-	req, err := http.NewRequest("GET", infoURL, nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating request: %v\n", err)
-		os.Exit(1)
+// fetchFileInfo retrieves metadata for a file ID (with or without extension).
+// Looking up info never consumes a download.
+func fetchFileInfo(fileID string) (*FileInfo, error) {
+	// Accept "id.ext" as printed in download URLs
+	if dot := strings.Index(fileID, "."); dot != -1 {
+		fileID = fileID[:dot]
 	}
 
-	// Add API key if provided
-	if apiKey != "" {
-		req.Header.Set("X-API-Key", apiKey)
+	infoURL := strings.TrimRight(serverURL, "/") + "/api/files/" + fileID
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Fetching info from: %s\n", infoURL)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doRequest("Fetching file info", &http.Client{}, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", infoURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add API key if provided
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		return req, nil
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error fetching file info: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error fetching file info: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 401 {
-		fmt.Fprintf(os.Stderr, "Authentication required. Use --api-key flag.\n")
-		os.Exit(1)
+		return nil, fmt.Errorf("Authentication required. Use --api-key flag.")
 	}
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading response: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error reading response: %v", err)
 	}
 
 	var fileInfo FileInfo
 	err = json.Unmarshal(respBody, &fileInfo)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing response: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error parsing response: %v", err)
 	}
 
 	if !fileInfo.Success {
-		fmt.Fprintf(os.Stderr, "File not found\n")
-		os.Exit(1)
+		return nil, fmt.Errorf("File not found")
 	}
 
-	// Display file information
-	fmt.Println("📄 File Information")
-	fmt.Println("==================")
-	fmt.Printf("🆔 ID: %s\n", fileInfo.Data.UniqueID)
-	fmt.Printf("📁 Original Name: %s\n", fileInfo.Data.OriginalName)
-	fmt.Printf("📏 Size: %s\n", formatBytes(fileInfo.Data.FileSize))
-	fmt.Printf("📝 MIME Type: %s\n", fileInfo.Data.MimeType)
-	fmt.Printf("📎 Extension: %s\n", fileInfo.Data.Extension)
-	fmt.Printf("📅 Uploaded: %s\n", fileInfo.Data.UploadedAt.Format("2006-01-02 15:04:05"))
-	fmt.Printf("📊 Downloads: %d\n", fileInfo.Data.Downloads)
-	fmt.Printf("🔗 Download URL: %s/d/%s%s\n", strings.TrimRight(serverURL, "/"), fileInfo.Data.UniqueID, fileInfo.Data.Extension)
+	return &fileInfo, nil
 }
 
 func downloadFile(cmd *cobra.Command, args []string) {
 	filename := args[0] // This should now include the extension
 
+	// Accept full download links, and pick up the decryption key from the
+	// fragment of links printed by upload --encrypt
+	var decryptionKey []byte
+	if hash := strings.Index(filename, "#"); hash != -1 {
+		key, err := decodeE2EKey(filename[hash+1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		decryptionKey = key
+		filename = filename[:hash]
+	}
+	if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
+		link, err := url.Parse(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid download link - %v\n", err)
+			os.Exit(1)
+		}
+		serverURL = link.Scheme + "://" + link.Host
+		filename = path.Base(link.Path)
+	}
+
 	var outputPath string
 	if len(args) > 1 {
 		outputPath = args[1]
@@ -300,67 +684,59 @@ func downloadFile(cmd *cobra.Command, args []string) {
 	downloadURL := strings.TrimRight(serverURL, "/") + "/d/" + filename
 
 	if verbose {
-		fmt.Printf("Downloading from: %s\n", downloadURL)
+		fmt.Fprintf(os.Stderr, "Downloading from: %s\n", downloadURL)
+	}
+
+	// Fetch the expected digest first; the info endpoint doesn't count as a
+	// download, so this is safe even for single-download files. Failing
+	// that, the download's own checksum headers are used.
+	var expectedSHA256 string
+	var infoErr error
+	if !noVerify {
+		if info, err := fetchFileInfo(filename); err != nil {
+			infoErr = err
+		} else {
+			expectedSHA256 = strings.ToLower(info.Data.SHA256)
+		}
 	}
 
-	fmt.Printf("📥 Starting download...\n")
-
-	// Create HTTP request
-	resp, err := http.Get(downloadURL)
+	// Continue a download interrupted earlier, if there is one
+	partPath := partPathFor(filename, outputPath)
+	partFile, offset, err := openPartFile(partPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error downloading file: %v\n", err)
-		os.Exit(1)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Fprintf(os.Stderr, "Download failed: HTTP %d\n", resp.StatusCode)
+		fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
 		os.Exit(1)
 	}
+	defer partFile.Close()
 
-	// Get filename from Content-Disposition header or use provided filename
-	defaultFilename := filename
-	if contentDisposition := resp.Header.Get("Content-Disposition"); contentDisposition != "" {
-		if idx := strings.Index(contentDisposition, `filename="`); idx != -1 {
-			start := idx + 10
-			if end := strings.Index(contentDisposition[start:], `"`); end != -1 {
-				defaultFilename = contentDisposition[start : start+end]
-			}
-		}
-	}
-
-	// Determine output path
-	if outputPath == "" {
-		outputPath = defaultFilename
-	} else if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
-		outputPath = filepath.Join(outputPath, defaultFilename)
-	}
-
-	// Check if file already exists
-	if _, err := os.Stat(outputPath); err == nil {
-		fmt.Printf("File %s already exists. Overwrite? (y/N): ", outputPath)
-		var response string
-		fmt.Scanln(&response)
-		if strings.ToLower(response) != "y" && strings.ToLower(response) != "yes" {
-			fmt.Println("Download cancelled.")
-			return
-		}
+	if offset > 0 {
+		statusf("📥 Resuming download from %s...\n", formatBytes(offset))
+	} else {
+		statusf("📥 Starting download...\n")
 	}
 
-	// Create output file
-	outFile, err := os.Create(outputPath)
+	resp, offset, fileSize, err := requestDownload(downloadURL, partFile, offset)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Download failed: %v\n", err)
 		os.Exit(1)
 	}
-	defer outFile.Close()
+	// resp is replaced when the download is picked up again
+	defer func() { resp.Body.Close() }()
 
-	// Get file size for progress bar
-	fileSize, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if !noVerify && expectedSHA256 == "" {
+		expectedSHA256 = responseSHA256(resp.Header)
+		if expectedSHA256 == "" && infoErr != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  Cannot verify checksum (%v), continuing without verification\n", infoErr)
+		} else if expectedSHA256 == "" {
+			fmt.Fprintf(os.Stderr, "⚠️  Server did not provide a checksum, continuing without verification\n")
+		}
+	}
 
 	// Create progress bar
 	var bar *progressbar.ProgressBar
-	if fileSize > 0 {
+	if quiet {
+		bar = progressbar.DefaultBytesSilent(fileSize)
+	} else if fileSize > 0 {
 		bar = progressbar.NewOptions64(fileSize,
 			progressbar.OptionSetDescription("Downloading..."),
 			progressbar.OptionSetWriter(os.Stderr),
@@ -372,6 +748,7 @@ func downloadFile(cmd *cobra.Command, args []string) {
 			progressbar.OptionFullWidth(),
 			progressbar.OptionSetRenderBlankState(true),
 		)
+		bar.Set64(offset)
 	} else {
 		bar = progressbar.NewOptions(-1,
 			progressbar.OptionSetDescription("Downloading..."),
@@ -380,15 +757,166 @@ func downloadFile(cmd *cobra.Command, args []string) {
 		)
 	}
 
-	// Copy with progress
-	_, err = io.Copy(io.MultiWriter(outFile, bar), resp.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error downloading file: %v\n", err)
+	// Hash the file as received, starting with what's already on disk: for
+	// encrypted files the server's checksum covers the ciphertext
+	hasher := sha256.New()
+	if offset > 0 {
+		partFile.Seek(0, io.SeekStart)
+		if _, err := io.CopyN(hasher, partFile, offset); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading partial download: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Get filename from Content-Disposition header or use provided filename.
+	// mime.ParseMediaType decodes RFC 5987 filename* values for non-ASCII names.
+	// Encrypted files carry their real name inside the ciphertext instead.
+	if decryptionKey == nil {
+		defaultFilename := filename
+		if contentDisposition := resp.Header.Get("Content-Disposition"); contentDisposition != "" {
+			if _, params, err := mime.ParseMediaType(contentDisposition); err == nil && params["filename"] != "" {
+				defaultFilename = params["filename"]
+			}
+		}
+		outputPath = resolveOutputPath(outputPath, safeFilename(defaultFilename, filename))
+		if !confirmOverwrite(outputPath) {
+			statusf("Download cancelled.\n")
+			return
+		}
+	}
+
+	// Copy with progress, hashing incrementally. When the connection drops
+	// part way, the rest is asked for again, up to --retries times.
+	var written int64
+	for attempt := 1; ; attempt++ {
+		n, err := io.Copy(io.MultiWriter(partFile, hasher, bar), resp.Body)
+		written += n
+		if err == nil {
+			break
+		}
+		if attempt > maxRetries || !retryableError(err) {
+			fmt.Fprintf(os.Stderr, "\nDownload interrupted: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Run the same command again to resume from %s.\n", partPath)
+			os.Exit(1)
+		}
+		resp.Body.Close()
+		wait := retryWait(attempt, 0)
+		noteRetry("Download", err, attempt, wait)
+		time.Sleep(wait)
+
+		var resumed int64
+		resp, resumed, _, err = requestDownload(downloadURL, partFile, offset+written)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nDownload interrupted: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Run the same command again to resume from %s.\n", partPath)
+			os.Exit(1)
+		}
+		// The server sent the whole file again, and the .part was emptied
+		if resumed != offset+written {
+			hasher.Reset()
+			bar.Reset()
+			offset, written = resumed, 0
+		}
+	}
+	if fileSize >= 0 && offset+written != fileSize {
+		fmt.Fprintf(os.Stderr, "\nDownload incomplete: got %s of %s\n", formatBytes(offset+written), formatBytes(fileSize))
+		fmt.Fprintf(os.Stderr, "Run the same command again to resume from %s.\n", partPath)
 		os.Exit(1)
 	}
 
 	bar.Finish()
-	fmt.Printf("\n✅ Download complete: %s\n", outputPath)
+
+	if expectedSHA256 != "" {
+		actual := hex.EncodeToString(hasher.Sum(nil))
+		if actual != expectedSHA256 {
+			partFile.Close()
+			os.Remove(partPath)
+			fmt.Fprintf(os.Stderr, "\n❌ Checksum mismatch! Expected SHA-256 %s, got %s\n", expectedSHA256, actual)
+			fmt.Fprintf(os.Stderr, "The corrupted download has been deleted.\n")
+			os.Exit(1)
+		}
+		statusf("\n🔒 SHA-256 verified: %s", actual)
+	}
+	result := downloadJSON{
+		Size:      offset + written,
+		Verified:  expectedSHA256 != "",
+		Decrypted: decryptionKey != nil,
+	}
+	// For encrypted files that would be the ciphertext's
+	if decryptionKey == nil {
+		result.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	if decryptionKey == nil {
+		partFile.Close()
+		if err := os.Rename(partPath, outputPath); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError saving file: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		outputPath = decryptDownload(partFile, decryptionKey, outputPath, filename)
+		if outputPath == "" {
+			statusf("\nDownload cancelled.\n")
+			return
+		}
+		partFile.Close()
+		os.Remove(partPath)
+		statusf("\n🔐 Decrypted locally")
+	}
+
+	result.File = outputPath
+	switch {
+	case jsonOutput:
+		printJSON(result)
+	case quiet:
+		fmt.Println(outputPath)
+	default:
+		fmt.Printf("\n✅ Download complete: %s\n", outputPath)
+	}
+}
+
+// safeFilename never lets the server choose a path outside the output
+// directory, falling back to fallback.
+func safeFilename(name, fallback string) string {
+	name = filepath.Base(filepath.FromSlash(strings.ReplaceAll(name, `\`, "/")))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return fallback
+	}
+	return name
+}
+
+// decryptDownload decrypts a finished encrypted download into its output
+// file, named after the name inside the ciphertext unless outputPath names a
+// file. It returns the path written, or "" if the user chose not to
+// overwrite it.
+func decryptDownload(partFile *os.File, key []byte, outputPath, fallback string) string {
+	partFile.Seek(0, io.SeekStart)
+	decrypted, name, err := openE2E(partFile, key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError decrypting file: %v\n", err)
+		os.Exit(1)
+	}
+	if name == "" {
+		name = fallback
+	}
+	outputPath = resolveOutputPath(outputPath, safeFilename(name, fallback))
+	if !confirmOverwrite(outputPath) {
+		return ""
+	}
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError creating output file: %v\n", err)
+		os.Exit(1)
+	}
+	defer outFile.Close()
+	if _, err := io.Copy(outFile, decrypted); err != nil {
+		outFile.Close()
+		os.Remove(outputPath)
+		fmt.Fprintf(os.Stderr, "\nError decrypting file: %v\n", err)
+		os.Exit(1)
+	}
+	return outputPath
 }
 
 // ProgressReader wraps an io.Reader and updates a progress bar
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// expandUploadArgs turns the upload arguments into file paths, expanding
+// glob patterns the shell left alone (quoted, or on Windows). A pattern
+// matching nothing is an error, and a file named twice is uploaded once.
+func expandUploadArgs(args []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern '%s': %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match '%s'", arg)
+			}
+		}
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				paths = append(paths, match)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// uploadAll uploads paths, up to concurrency at a time, returning the
+// results in the order given. One at a time each gets its progress bar;
+// side by side only finished files are reported.
+func uploadAll(paths []string, concurrency int) []uploadResult {
+	results := make([]uploadResult, len(paths))
+	if concurrency <= 1 {
+		for i, path := range paths {
+			results[i] = uploadPath(path, true)
+			statusf("\n")
+		}
+		return results
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = uploadPath(paths[i], false)
+				if results[i].Err != nil {
+					statusf("❌ %s: %v\n", paths[i], results[i].Err)
+				} else {
+					statusf("✅ %s\n", paths[i])
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// downloadLink is the link to share for a finished upload, with the
+// decryption key after '#' for encrypted ones.
+func (r *uploadResult) downloadLink() string {
+	if r.Key != nil {
+		return r.Response.DownloadURL + "#" + encodeE2EKey(r.Key)
+	}
+	return r.Response.DownloadURL
+}
+
+// printUploadSummary lists each file with its link or what went wrong.
+func printUploadSummary(results []uploadResult) {
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSIZE\tDOWNLOAD URL")
+	for i := range results {
+		result := &results[i]
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\t-\t❌ %v\n", result.Path, result.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Path, formatBytes(result.Response.FileSize), result.downloadLink())
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Printf("\n%d of %d uploads failed\n", failed, len(results))
+	} else {
+		fmt.Printf("\n✅ %d files uploaded\n", len(results))
+	}
+}
+
+// uploadJSON is one file in the --json output.
+type uploadJSON struct {
+	File        string `json:"file"`
+	Success     bool   `json:"success"`
+	UniqueID    string `json:"unique_id,omitempty"`
+	DownloadURL string `json:"download_url,omitempty"`
+	FileSize    int64  `json:"file_size,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// printUploadJSON prints the results for scripts, one entry per file in the
+// order given.
+func printUploadJSON(results []uploadResult) {
+	entries := make([]uploadJSON, 0, len(results))
+	for i := range results {
+		entries = append(entries, results[i].toJSON())
+	}
+	printJSON(entries)
+}
+
+// toJSON is the result as it appears in the --json output.
+func (r *uploadResult) toJSON() uploadJSON {
+	entry := uploadJSON{File: r.Path, Success: r.Err == nil}
+	if r.Err != nil {
+		entry.Error = r.Err.Error()
+	} else {
+		entry.UniqueID = r.Response.UniqueID
+		entry.DownloadURL = r.downloadLink()
+		entry.FileSize = r.Response.FileSize
+	}
+	return entry
+}
+
+// printUploadLinks prints one link per line for --quiet, and what went wrong
+// with the others on stderr.
+func printUploadLinks(results []uploadResult) {
+	for i := range results {
+		result := &results[i]
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", result.Path, result.Err)
+			continue
+		}
+		fmt.Println(result.downloadLink())
+	}
+}
+
+// copyLinks puts the links of the successful uploads on the clipboard, one
+// per line. Not managing to is only a warning.
+func copyLinks(results []uploadResult) {
+	var links []string
+	for i := range results {
+		if results[i].Err == nil {
+			links = append(links, results[i].downloadLink())
+		}
+	}
+	if len(links) == 0 {
+		return
+	}
+	if err := copyToClipboard(strings.Join(links, "\n")); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️  Couldn't copy to the clipboard: %v\n", err)
+		return
+	}
+	if len(links) == 1 {
+		statusf("📋 Link copied to the clipboard\n")
+	} else {
+		statusf("📋 %d links copied to the clipboard\n", len(links))
+	}
+}
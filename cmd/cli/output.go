@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// With --json each command prints one JSON document on stdout and its
+// progress on stderr; with --quiet it prints only its result (the download
+// link for uploads) and no progress at all. Errors always go to stderr.
+
+// statusf prints a progress message: on stdout normally, on stderr when
+// stdout carries JSON, and nowhere with --quiet.
+func statusf(format string, args ...interface{}) {
+	fmt.Fprintf(statusWriter(), format, args...)
+}
+
+func statusWriter() io.Writer {
+	switch {
+	case quiet:
+		return io.Discard
+	case jsonOutput:
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// userWriter is where what's meant for the user rather than a script goes,
+// like questions and QR codes, kept off stdout when it carries a result.
+func userWriter() io.Writer {
+	if quiet || jsonOutput {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// printJSON prints v as the command's --json output.
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
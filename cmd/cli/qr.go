@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// printQR draws link as a QR code out of half blocks, two rows of modules
+// per line, so a phone can pick it up straight off the terminal. The dark
+// modules are left blank, which suits the usual dark background.
+func printQR(label, link string) {
+	code, err := qrcode.New(link, qrcode.Medium)
+	if err != nil {
+		fmt.Fprintf(userWriter(), "Couldn't draw a QR code: %v\n", err)
+		return
+	}
+	fmt.Fprintf(userWriter(), "\n%s\n%s", label, code.ToSmallString(false))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// Resumable uploads (--resumable) go through the server's tus endpoint. The
+// upload's URL is saved in a state file as soon as it's created, so after
+// Ctrl-C or a dropped connection the same command asks the server how much
+// it already has and sends the rest. Each piece is retried with exponential
+// backoff before giving up.
+
+// tusChunkSize is how much one PATCH sends; a failed one only resends this.
+const tusChunkSize = 8 * 1024 * 1024
+
+// errUploadGone means the server no longer knows the saved upload, e.g. it
+// expired, and it has to start over.
+var errUploadGone = errors.New("upload no longer exists on the server")
+
+var errAuthRequired = errors.New("authentication required, use --api-key flag")
+
+// uploadState is what's kept between runs of a resumable upload.
+type uploadState struct {
+	Server    string    `json:"server"`
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	UploadURL string    `json:"upload_url"`
+}
+
+// uploadStatePath returns the state file for uploading path to the server.
+// A changed file gets a new one, so it's never resumed with the old data.
+func uploadStatePath(absPath string, info os.FileInfo) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%d\n%d", strings.TrimRight(serverURL, "/"), absPath, info.Size(), info.ModTime().UnixNano())))
+	return filepath.Join(dir, "bashupload", "uploads", hex.EncodeToString(key[:16])+".json"), nil
+}
+
+func loadUploadState(statePath string) *uploadState {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+	var state uploadState
+	if json.Unmarshal(data, &state) != nil || state.UploadURL == "" {
+		return nil
+	}
+	return &state
+}
+
+func saveUploadState(statePath string, state *uploadState) error {
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, data, 0600)
+}
+
+// uploadResumable uploads file through tus, continuing an earlier attempt
+// at the same file when there is one.
+func uploadResumable(file *os.File, filePath, uploadName string, info os.FileInfo, bar *progressbar.ProgressBar) (*UploadResponse, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	statePath, err := uploadStatePath(absPath, info)
+	if err != nil {
+		return nil, fmt.Errorf("locating upload state: %w", err)
+	}
+	size := info.Size()
+
+	var offset int64
+	state := loadUploadState(statePath)
+	if state != nil {
+		offset, err = withRetries("checking upload", func() (int64, error) { return tusOffset(state.UploadURL) })
+		if errors.Is(err, errUploadGone) {
+			statusf("⚠️  The earlier upload expired on the server, starting over\n")
+			os.Remove(statePath)
+			state = nil
+		} else if err != nil {
+			return nil, err
+		} else {
+			statusf("⏯  Resuming upload at %s\n", formatBytes(offset))
+		}
+	}
+	if state == nil {
+		uploadURL, err := withRetries("starting upload", func() (string, error) { return tusCreate(uploadName, size) })
+		if err != nil {
+			return nil, err
+		}
+		state = &uploadState{
+			Server:    strings.TrimRight(serverURL, "/"),
+			File:      absPath,
+			Size:      size,
+			ModTime:   info.ModTime(),
+			UploadURL: uploadURL,
+		}
+		if err := saveUploadState(statePath, state); err != nil {
+			return nil, fmt.Errorf("saving upload state: %w", err)
+		}
+		offset = 0
+	}
+
+	if verbose {
+		statusf("Upload %s, state in %s\n", state.UploadURL, statePath)
+	}
+	bar.Set64(offset)
+
+	var downloadURL, deleteToken string
+	for offset < size {
+		length := min(int64(tusChunkSize), size-offset)
+		start := offset
+		var err error
+		for attempt := 1; ; attempt++ {
+			section := io.NewSectionReader(file, start, length)
+			reader := &chunkProgressReader{
+				Reader: section,
+				onRead: func(n int) { bar.Add(n) },
+			}
+			offset, downloadURL, deleteToken, err = tusPatch(state.UploadURL, start, reader, length)
+			if err == nil || !retryable(err) || attempt > maxRetries {
+				break
+			}
+			wait := retryWait(attempt, 0)
+			noteRetry("Upload at "+formatBytes(start), err, attempt, wait)
+			time.Sleep(wait)
+
+			// The server may have kept part of the failed piece
+			if current, headErr := tusOffset(state.UploadURL); headErr == nil {
+				start = current
+				length = min(int64(tusChunkSize), size-start)
+			}
+			bar.Set64(start)
+			if start >= size {
+				err = nil
+				offset = start
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w\nRun the same command again to resume the upload", err)
+		}
+	}
+
+	// The last response may have been lost; the server still has the link,
+	// though not the deletion token
+	if downloadURL == "" {
+		downloadURL, err = withRetries("finishing upload", func() (string, error) { return tusDownloadURL(state.UploadURL) })
+		if err != nil {
+			return nil, err
+		}
+	}
+	os.Remove(statePath)
+	bar.Finish()
+
+	uniqueID := path.Base(downloadURL)
+	if dot := strings.Index(uniqueID, "."); dot != -1 {
+		uniqueID = uniqueID[:dot]
+	}
+	return &UploadResponse{
+		Success:     true,
+		UniqueID:    uniqueID,
+		DownloadURL: downloadURL,
+		DeleteToken: deleteToken,
+		FileSize:    size,
+	}, nil
+}
+
+// tusRequest sends one tus request.
+func tusRequest(method, url string, body io.Reader, length int64, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Minute,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		resp.Body.Close()
+		return nil, errAuthRequired
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, errUploadGone
+	}
+	return resp, nil
+}
+
+// tusError describes a refused tus request.
+func tusError(resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &statusError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+}
+
+// tusCreate starts an upload and returns its URL.
+func tusCreate(name string, size int64) (string, error) {
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+	resp, err := tusRequest("POST", strings.TrimRight(serverURL, "/")+"/api/tus/", nil, 0, map[string]string{
+		"Upload-Length":   strconv.FormatInt(size, 10),
+		"Upload-Metadata": metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", tusError(resp)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("server did not return the upload's location")
+	}
+	return location.String(), nil
+}
+
+// tusOffset asks how much of the upload the server has.
+func tusOffset(uploadURL string) (int64, error) {
+	resp, err := tusRequest("HEAD", uploadURL, nil, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, tusError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// tusDownloadURL fetches the download link of a finished upload.
+func tusDownloadURL(uploadURL string) (string, error) {
+	resp, err := tusRequest("HEAD", uploadURL, nil, 0, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if link := resp.Header.Get("Upload-Download-URL"); link != "" {
+		return link, nil
+	}
+	return "", fmt.Errorf("server did not return a download link")
+}
+
+// tusPatch sends length bytes of body at offset, returning the new offset
+// and, once the upload is complete, its download link and deletion token.
+func tusPatch(uploadURL string, offset int64, body io.Reader, length int64) (int64, string, string, error) {
+	resp, err := tusRequest("PATCH", uploadURL, body, length, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.FormatInt(offset, 10),
+	})
+	if err != nil {
+		return offset, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return offset, "", "", tusError(resp)
+	}
+	newOffset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return offset, "", "", fmt.Errorf("server did not return the new offset")
+	}
+	return newOffset, resp.Header.Get("Upload-Download-URL"), resp.Header.Get("Upload-Delete-Token"), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Downloads are written to <name>.part and only renamed once complete and
+// verified. An interrupted download leaves its .part behind, and running the
+// same command again asks the server for the rest with a Range request.
+
+// partPathFor returns where a download of filename (the ID with its
+// extension) is kept while it's incomplete.
+func partPathFor(filename, outputPath string) string {
+	name := filepath.Base(filename) + ".part"
+	if outputPath == "" {
+		return name
+	}
+	if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
+		return filepath.Join(outputPath, name)
+	}
+	return outputPath + ".part"
+}
+
+// openPartFile opens (or creates) a partial download, returning how much of
+// it is already there.
+func openPartFile(partPath string) (*os.File, int64, error) {
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, offset, nil
+}
+
+// requestDownload fetches downloadURL from offset on. If the server sends
+// the whole file instead, or the partial download doesn't fit the file any
+// more, partFile is emptied and the download starts over. It returns the
+// response, the offset it continues from and the file's total size (-1 when
+// unknown).
+func requestDownload(downloadURL string, partFile *os.File, offset int64) (*http.Response, int64, int64, error) {
+	resp, err := doRequest("Download", http.DefaultClient, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", downloadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if ok && start == offset {
+			return resp, offset, total, nil
+		}
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial download is as long as the file or longer, so it's
+		// not a piece of this one
+	case resp.StatusCode == http.StatusOK:
+		if err := restartPartFile(partFile); err != nil {
+			resp.Body.Close()
+			return nil, 0, 0, err
+		}
+		return resp, 0, resp.ContentLength, nil
+	default:
+		resp.Body.Close()
+		return nil, 0, 0, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	resp.Body.Close()
+	if err := restartPartFile(partFile); err != nil {
+		return nil, 0, 0, err
+	}
+	return requestDownload(downloadURL, partFile, 0)
+}
+
+// restartPartFile empties a partial download.
+func restartPartFile(partFile *os.File) error {
+	if err := partFile.Truncate(0); err != nil {
+		return err
+	}
+	_, err := partFile.Seek(0, io.SeekStart)
+	return err
+}
+
+// parseContentRange reads "bytes <start>-<end>/<total>", with a total of -1
+// for "*".
+func parseContentRange(value string) (start, total int64, ok bool) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	byteRange, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
+
+// resolveOutputPath is where a download named name ends up: outputPath, or
+// name inside it when it's a directory.
+func resolveOutputPath(outputPath, name string) string {
+	if outputPath == "" {
+		return name
+	}
+	if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
+		return filepath.Join(outputPath, name)
+	}
+	return outputPath
+}
+
+// confirmOverwrite asks before replacing an existing file.
+func confirmOverwrite(outputPath string) bool {
+	if _, err := os.Stat(outputPath); err != nil {
+		return true
+	}
+	fmt.Fprintf(userWriter(), "File %s already exists. Overwrite? (y/N): ", outputPath)
+	var response string
+	fmt.Scanln(&response)
+	return strings.ToLower(response) == "y" || strings.ToLower(response) == "yes"
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Requests that fail for reasons that may pass (a dropped connection, a 5xx,
+// 429 Too Many Requests) are tried again up to --retries times, waiting 1s,
+// 2s, 4s, ... between attempts, at most --retry-max-wait, or as long as the
+// server's Retry-After asks within that limit.
+
+var (
+	maxRetries   int
+	retryMaxWait time.Duration
+)
+
+// retryWait is how long to wait before retry number attempt (from 1),
+// honouring the server's Retry-After when it gave one.
+func retryWait(attempt int, retryAfter time.Duration) time.Duration {
+	wait := retryAfter
+	if wait <= 0 {
+		wait = time.Second << uint(min(attempt-1, 16))
+	}
+	return min(wait, retryMaxWait)
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as a date.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// retryableStatus reports whether a response with this status may succeed
+// when tried again.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return status >= 500
+}
+
+// statusError is a request the server refused.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.status, e.message)
+}
+
+// retryable reports whether trying again may help: after a network error, a
+// server error, a conflicting offset or a locked upload, but not after the
+// server refused the upload itself.
+func retryable(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.status {
+		case http.StatusConflict, http.StatusLocked:
+			return true
+		}
+		return retryableStatus(statusErr.status)
+	}
+	return retryableError(err) && !errors.Is(err, errUploadGone) && !errors.Is(err, errAuthRequired)
+}
+
+// withRetries runs fn until it succeeds or trying again won't help, at most
+// --retries more times.
+func withRetries[T any](what string, fn func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := fn()
+		if err == nil || errors.Is(err, errUploadGone) {
+			return result, err
+		}
+		if !retryable(err) || attempt > maxRetries {
+			return result, fmt.Errorf("%s: %w", what, err)
+		}
+		wait := retryWait(attempt, 0)
+		noteRetry(what, err, attempt, wait)
+		time.Sleep(wait)
+	}
+}
+
+// retryableError reports whether a failed request may succeed when tried
+// again: any transport error, unless the request was cancelled.
+func retryableError(err error) bool {
+	return !errors.Is(err, context.Canceled)
+}
+
+// noteRetry tells the user a request is being tried again.
+func noteRetry(what string, reason interface{}, attempt int, wait time.Duration) {
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "\n⚠️  %s failed (%v), retrying in %s (%d/%d)\n", what, reason, wait.Round(time.Second), attempt, maxRetries)
+	}
+}
+
+// doRequest sends a request built by newRequest, which is called again for
+// every attempt as a request body can only be sent once. Out of attempts, it
+// returns the last response or error.
+func doRequest(what string, client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+
+		var reason interface{}
+		var retryAfter time.Duration
+		switch {
+		case err != nil && retryableError(err):
+			reason = err
+		case err == nil && retryableStatus(resp.StatusCode):
+			reason = resp.Status
+			retryAfter = parseRetryAfter(resp)
+		default:
+			return resp, err
+		}
+		if attempt > maxRetries {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		wait := retryWait(attempt, retryAfter)
+		noteRetry(what, reason, attempt, wait)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var statsWindow string
+
+// serverStats is the answer of GET /api/stats. Usage is only filled in for
+// callers with an API key, for that key and their IP.
+type serverStats struct {
+	Success    bool         `json:"success"`
+	Message    string       `json:"message,omitempty"`
+	TotalFiles int64        `json:"total_files"`
+	TotalSize  int64        `json:"total_size"`
+	Window     string       `json:"window,omitempty"`
+	Since      *time.Time   `json:"since,omitempty"`
+	Usage      []usageStats `json:"usage,omitempty"`
+}
+
+// usageStats is one key's, user's or IP's traffic over the window.
+type usageStats struct {
+	SubjectType   string `json:"subject_type"`
+	Subject       string `json:"subject"`
+	Uploads       int64  `json:"uploads"`
+	BytesUploaded int64  `json:"bytes_uploaded"`
+	Downloads     int64  `json:"downloads"`
+	BytesServed   int64  `json:"bytes_served"`
+	FilesAlive    int64  `json:"files_alive"`
+	BytesAlive    int64  `json:"bytes_alive"`
+}
+
+// showStats prints the server's totals and, with an API key, its usage.
+func showStats(cmd *cobra.Command, args []string) {
+	stats, err := fetchStats()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if jsonOutput {
+		printJSON(stats)
+		return
+	}
+
+	fmt.Println("📊 Server Statistics")
+	fmt.Println("====================")
+	fmt.Printf("📁 Files: %d\n", stats.TotalFiles)
+	fmt.Printf("📏 Total size: %s\n", formatBytes(stats.TotalSize))
+	if len(stats.Usage) == 0 {
+		if apiKey == "" {
+			fmt.Println("\nPass --api-key to see your own usage.")
+		}
+		return
+	}
+
+	window := "all time"
+	if stats.Since != nil {
+		window = "since " + stats.Since.Local().Format("2006-01-02 15:04")
+	}
+	fmt.Printf("\n👤 Usage (%s)\n\n", window)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BY\tSUBJECT\tUPLOADS\tUPLOADED\tDOWNLOADS\tSERVED\tFILES\tSTORED")
+	for _, usage := range stats.Usage {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%d\t%s\n",
+			usage.SubjectType, usage.Subject,
+			usage.Uploads, formatBytes(usage.BytesUploaded),
+			usage.Downloads, formatBytes(usage.BytesServed),
+			usage.FilesAlive, formatBytes(usage.BytesAlive))
+	}
+	w.Flush()
+}
+
+// fetchStats asks the server for its statistics over --window.
+func fetchStats() (*serverStats, error) {
+	statsURL := strings.TrimRight(serverURL, "/") + "/api/stats"
+	if statsWindow != "" {
+		statsURL += "?window=" + url.QueryEscape(statsWindow)
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Fetching stats from: %s\n", statsURL)
+	}
+
+	resp, err := doRequest("Fetching stats", &http.Client{}, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", statsURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching stats: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errAuthRequired
+	}
+
+	var stats serverStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("parsing response: %v", err)
+	}
+	if !stats.Success {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, stats.Message)
+	}
+	return &stats, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+var (
+	watchPatterns  []string
+	watchRecursive bool
+	watchSettle    time.Duration
+	watchWebhook   string
+)
+
+// watcher uploads files in a directory as they are created or changed. A
+// file is uploaded once it has gone --settle without being written to, so
+// one still being saved isn't sent half done.
+type watcher struct {
+	fs *fsnotify.Watcher
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+	// Size and modification time last uploaded, to skip events that didn't
+	// change the contents
+	uploaded map[string]fileStamp
+
+	// Uploads run one at a time
+	uploads sync.Mutex
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchDirectory uploads new and changed files under a directory until
+// interrupted.
+func watchDirectory(cmd *cobra.Command, args []string) {
+	root := args[0]
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "Error: '%s' is not a directory\n", root)
+		os.Exit(1)
+	}
+	for _, pattern := range watchPatterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid pattern '%s': %v\n", pattern, err)
+			os.Exit(1)
+		}
+	}
+
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error watching directory: %v\n", err)
+		os.Exit(1)
+	}
+	defer fsWatcher.Close()
+
+	w := &watcher{
+		fs:       fsWatcher,
+		pending:  make(map[string]*time.Timer),
+		uploaded: make(map[string]fileStamp),
+	}
+	if err := w.add(root); err != nil {
+		fmt.Fprintf(os.Stderr, "Error watching directory: %v\n", err)
+		os.Exit(1)
+	}
+	statusf("👀 Watching %s for new files, Ctrl-C to stop\n", root)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	for {
+		select {
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "⚠️  Watch error: %v\n", err)
+		case <-interrupt:
+			// Let an upload already under way finish
+			w.uploads.Lock()
+			statusf("\n👋 Stopped watching\n")
+			return
+		}
+	}
+}
+
+// add watches dir, and with --recursive the directories below it.
+func (w *watcher) add(dir string) error {
+	if !watchRecursive {
+		return w.fs.Add(dir)
+	}
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != dir && hiddenName(entry.Name()) {
+				return filepath.SkipDir
+			}
+			return w.fs.Add(path)
+		}
+		return nil
+	})
+}
+
+// handle reacts to one change: a new directory is watched too, and a file
+// that was written is (re)scheduled for upload.
+func (w *watcher) handle(event fsnotify.Event) {
+	name := filepath.Base(event.Name)
+	if hiddenName(name) {
+		return
+	}
+
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		w.cancel(event.Name)
+		return
+	}
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+
+	info, err := os.Stat(event.Name)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		if watchRecursive && event.Has(fsnotify.Create) {
+			if err := w.add(event.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "⚠️  Can't watch %s: %v\n", event.Name, err)
+			}
+		}
+		return
+	}
+	if !info.Mode().IsRegular() || !matchesWatchPatterns(name) {
+		return
+	}
+	w.schedule(event.Name)
+}
+
+// schedule uploads path once it has settled, pushing the upload back on
+// every further write.
+func (w *watcher) schedule(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timer, ok := w.pending[path]; ok {
+		timer.Reset(watchSettle)
+		return
+	}
+	w.pending[path] = time.AfterFunc(watchSettle, func() {
+		w.mu.Lock()
+		delete(w.pending, path)
+		w.mu.Unlock()
+		w.upload(path)
+	})
+}
+
+// cancel drops a pending upload of a file that went away.
+func (w *watcher) cancel(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timer, ok := w.pending[path]; ok {
+		timer.Stop()
+		delete(w.pending, path)
+	}
+}
+
+// upload sends path, unless it's gone or unchanged since it was last sent,
+// and reports the link.
+func (w *watcher) upload(path string) {
+	w.uploads.Lock()
+	defer w.uploads.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+	w.mu.Lock()
+	unchanged := w.uploaded[path] == stamp
+	w.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	result := uploadPath(path, false)
+	if result.Err == nil {
+		w.mu.Lock()
+		w.uploaded[path] = stamp
+		w.mu.Unlock()
+		recordUploads([]uploadResult{result})
+	}
+	reportWatchUpload(&result)
+	if watchWebhook != "" {
+		if err := notifyWebhook(watchWebhook, result.toJSON()); err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  Webhook for %s failed: %v\n", path, err)
+		}
+	}
+}
+
+// reportWatchUpload prints one upload as it happens: a line per file, the
+// link alone with --quiet, or a JSON object per line with --json.
+func reportWatchUpload(result *uploadResult) {
+	switch {
+	case jsonOutput:
+		json.NewEncoder(os.Stdout).Encode(result.toJSON())
+	case result.Err != nil:
+		fmt.Fprintf(os.Stderr, "❌ %s: %v\n", result.Path, result.Err)
+	case quiet:
+		fmt.Println(result.downloadLink())
+	default:
+		fmt.Printf("✅ %s (%s) %s\n", result.Path, formatBytes(result.Response.FileSize), result.downloadLink())
+	}
+}
+
+// notifyWebhook posts an upload's result to url as JSON.
+func notifyWebhook(url string, entry uploadJSON) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := doRequest("Webhook", client, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// matchesWatchPatterns reports whether a file name matches one of the
+// --pattern globs, or whether there are none.
+func matchesWatchPatterns(name string) bool {
+	if len(watchPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range watchPatterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenName reports whether a file is hidden or, going by its name, a
+// temporary file an editor or download is still writing, like .swp, ~ and
+// .part files.
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") ||
+		strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".tmp")
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Transparent compression. Uploads whose first bytes show a compressible
+// type (text, JSON, logs...) are compressed with zstd or gzip on their way
+// into storage, before encryption at rest when that's on, and the file's
+// record notes how. Reading a file decompresses it again, so thumbnails,
+// previews, zips and Range requests see the original bytes; a download whose
+// client accepts the stored encoding gets the compressed bytes as they are,
+// with Content-Encoding. It's off unless COMPRESSION asks for it, as a
+// compressed blob in storage is no longer the file itself.
+
+const (
+	compressionZstd = "zstd"
+	compressionGzip = "gzip"
+)
+
+var (
+	compressionAlgorithm string // zstd or gzip, empty when compression is off
+	compressionMinSize   int64
+	compressibleTypes    []string
+)
+
+// loadCompressionConfig reads COMPRESSION, COMPRESSION_MIN_SIZE and
+// COMPRESSIBLE_TYPES.
+func loadCompressionConfig() {
+	compressionAlgorithm = strings.ToLower(getEnv("COMPRESSION", "none"))
+	switch compressionAlgorithm {
+	case compressionZstd, compressionGzip:
+	case "off", "false", "none", "":
+		compressionAlgorithm = ""
+		return
+	default:
+		log.Printf("Invalid COMPRESSION value '%s', leaving uploads uncompressed", compressionAlgorithm)
+		compressionAlgorithm = ""
+		return
+	}
+
+	minSizeStr := getEnv("COMPRESSION_MIN_SIZE", "4KB")
+	var err error
+	compressionMinSize, err = parseSize(minSizeStr)
+	if err != nil || compressionMinSize < 0 {
+		log.Printf("Invalid COMPRESSION_MIN_SIZE value '%s', using default 4KB", minSizeStr)
+		compressionMinSize = 4 * 1024
+	}
+	compressibleTypes = normalizeMimeTypes(splitList(getEnv("COMPRESSIBLE_TYPES",
+		"text/*,application/json,application/xml,application/x-ndjson,image/svg+xml")))
+	log.Printf("Compressing %s uploads of %s or more with %s",
+		strings.Join(compressibleTypes, ", "), formatBytes(compressionMinSize), compressionAlgorithm)
+}
+
+// compressWriter compresses what is written to it onto w once the first
+// bytes show the upload is worth it, and passes it through unchanged
+// otherwise. It holds back COMPRESSION_MIN_SIZE bytes (and at least what
+// sniffing needs) before deciding, so small uploads stay plain. Close must
+// be called to flush it.
+type compressWriter struct {
+	out      *countingWriter
+	head     []byte
+	decided  bool
+	encoder  io.WriteCloser // nil when writing plain
+	encoding string         // zstd or gzip once decided to compress
+}
+
+func newCompressWriter(w io.Writer) *compressWriter {
+	return &compressWriter{out: &countingWriter{w: w}, decided: compressionAlgorithm == ""}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		need := int(max(compressionMinSize, sniffLen)) - len(cw.head)
+		if len(p) < need {
+			cw.head = append(cw.head, p...)
+			return len(p), nil
+		}
+		cw.head = append(cw.head, p[:need]...)
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		n, err := cw.dest().Write(p[need:])
+		return need + n, err
+	}
+	return cw.dest().Write(p)
+}
+
+// decide picks plain or compressed storage from the bytes held back, and
+// writes them out. Uploads that end before enough bytes were seen stay plain.
+func (cw *compressWriter) decide(enough bool) error {
+	cw.decided = true
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(cw.head))
+	if enough && matchesMimeType(compressibleTypes, mediaType) {
+		var err error
+		switch compressionAlgorithm {
+		case compressionZstd:
+			cw.encoder, err = zstd.NewWriter(cw.out, zstd.WithEncoderConcurrency(1))
+		case compressionGzip:
+			cw.encoder = gzip.NewWriter(cw.out)
+		}
+		if err != nil {
+			return err
+		}
+		cw.encoding = compressionAlgorithm
+	}
+	_, err := cw.dest().Write(cw.head)
+	cw.head = nil
+	return err
+}
+
+func (cw *compressWriter) dest() io.Writer {
+	if cw.encoder != nil {
+		return cw.encoder
+	}
+	return cw.out
+}
+
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+// stored is how many bytes went into storage.
+func (cw *compressWriter) stored() int64 {
+	return cw.out.n
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// newDecoder returns a reader decompressing r, which is in encoding.
+func newDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case compressionZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case compressionGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", encoding)
+}
+
+// decompressReader is a seekable view of the original bytes of a compressed
+// blob. Compressed streams can only be read forwards, so seeking ahead
+// decompresses and skips the bytes in between, and seeking back starts over.
+type decompressReader struct {
+	src      io.ReadSeekCloser
+	encoding string
+	size     int64 // original size
+	offset   int64 // where the next Read is
+	position int64 // where the decoder is
+	decoder  io.ReadCloser
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	if d.decoder == nil || d.position > d.offset {
+		if err := d.restart(); err != nil {
+			return 0, err
+		}
+	}
+	if d.position < d.offset {
+		skipped, err := io.CopyN(io.Discard, d.decoder, d.offset-d.position)
+		d.position += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := d.decoder.Read(p)
+	d.offset += int64(n)
+	d.position += int64(n)
+	return n, err
+}
+
+func (d *decompressReader) restart() error {
+	if d.decoder != nil {
+		d.decoder.Close()
+		d.decoder = nil
+	}
+	if _, err := d.src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	decoder, err := newDecoder(d.src, d.encoding)
+	if err != nil {
+		return err
+	}
+	d.decoder = decoder
+	d.position = 0
+	return nil
+}
+
+func (d *decompressReader) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = d.offset + offset
+	case io.SeekEnd:
+		target = d.size + offset
+	default:
+		return 0, errors.New("decompress seek: invalid whence")
+	}
+	if target < 0 {
+		return 0, errors.New("decompress seek: negative position")
+	}
+	d.offset = target
+	return target, nil
+}
+
+func (d *decompressReader) Close() error {
+	if d.decoder != nil {
+		d.decoder.Close()
+	}
+	return d.src.Close()
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows
+// encoding, either by name or through "*".
+func acceptsEncoding(header, encoding string) bool {
+	accepted := false
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		// An explicit entry for the encoding wins over the wildcard
+		if name == encoding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// servesEncoded reports whether a download of fileRecord sends the stored,
+// compressed bytes with Content-Encoding: the file is compressed, the
+// client accepts the encoding, and the whole file is asked for, since
+// ranges are of the original bytes.
+func servesEncoded(c *fiber.Ctx, fileRecord *FileRecord) bool {
+	return fileRecord.Compression != "" && c.Get("Range") == "" &&
+		acceptsEncoding(c.Get("Accept-Encoding"), fileRecord.Compression)
+}
+
+// setEncodedHeaders describes the compressed bytes of fileRecord, once the
+// download headers for the original are set.
+func setEncodedHeaders(c *fiber.Ctx, fileRecord *FileRecord) {
+	c.Set("Content-Encoding", fileRecord.Compression)
+	c.Set("Content-Length", strconv.FormatInt(fileRecord.CompressedSize, 10))
+}
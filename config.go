@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Optional YAML configuration file, given with --config or CONFIG_FILE. Its
+// keys are the environment variable names in lower case, either flat
+// (max_upload_size: 5GB) or grouped by prefix (rate_limit: {max: 200}), and
+// they are read through getEnv, so every setting can live in the file and a
+// set environment variable still wins over it.
+
+var configValues map[string]string
+
+// loadConfigFile parses the configuration file, if any, and returns its
+// path. It runs before anything else reads the configuration.
+func loadConfigFile() string {
+	path := os.Getenv("CONFIG_FILE")
+	flag.StringVar(&path, "config", path, "path to a YAML configuration file (env: CONFIG_FILE)")
+	flag.Parse()
+	if path == "" {
+		return ""
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read config file: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		log.Fatalf("Failed to parse config file %s: %v", path, err)
+	}
+
+	configValues = make(map[string]string)
+	if err := flattenConfig("", doc); err != nil {
+		log.Fatalf("Invalid config file %s: %v", path, err)
+	}
+	return path
+}
+
+// flattenConfig stores the settings of a YAML mapping under their
+// environment variable names, joining nested keys with underscores.
+func flattenConfig(prefix string, doc map[string]interface{}) error {
+	for key, value := range doc {
+		name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := flattenConfig(name, value); err != nil {
+				return err
+			}
+		case []interface{}:
+			// Lists become the comma-separated form the env vars use
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				if _, nested := item.(map[string]interface{}); nested {
+					return fmt.Errorf("%s: list items must be plain values", name)
+				}
+				items = append(items, fmt.Sprint(item))
+			}
+			configValues[name] = strings.Join(items, ",")
+		case nil:
+			configValues[name] = ""
+		default:
+			configValues[name] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Content-addressed links. With CONTENT_ADDRESSED_LINKS=true uploads are
+// announced as /c/<digest><ext>, where the digest is the first 32 hex digits
+// of their SHA-256, so a link can only ever stand for exactly those bytes.
+// Uploading the same content again gives the same link, and deduplication
+// keeps a single copy behind it. A /c/ link serves the newest upload of the
+// content that is still available, counting the download against it.
+// Password-protected uploads keep their /d/ links and are never served here.
+
+const (
+	contentDigestLength    = 32
+	contentDigestMaxLength = 64
+)
+
+var contentAddressedLinks bool
+
+// loadContentConfig reads CONTENT_ADDRESSED_LINKS.
+func loadContentConfig() {
+	contentAddressedLinks = getEnv("CONTENT_ADDRESSED_LINKS", "false") == "true"
+	if contentAddressedLinks {
+		log.Printf("Announcing uploads with content-addressed /c/ links")
+	}
+}
+
+// setupContentRoutes serves /c/ links, only when they're on: otherwise
+// anyone knowing a file's checksum could fetch it without its link.
+func setupContentRoutes(app *fiber.App) {
+	if !contentAddressedLinks {
+		return
+	}
+	app.Head("/c/:digest", handleContentHead)
+	app.Get("/c/:digest", handleContentDownload)
+}
+
+// contentPath is the /c/ path of a file, or "" when it isn't announced by
+// its content.
+func (f *FileRecord) contentPath() string {
+	if !contentAddressedLinks || len(f.SHA256) < contentDigestLength || f.PasswordHash != "" {
+		return ""
+	}
+	return "/c/" + f.SHA256[:contentDigestLength] + f.Extension
+}
+
+// validContentDigest reports whether digest can address content: 32 to 64
+// lowercase hex digits.
+func validContentDigest(digest string) bool {
+	if len(digest) < contentDigestLength || len(digest) > contentDigestMaxLength {
+		return false
+	}
+	for _, r := range digest {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// findContent looks up the upload a /c/ link stands for: the newest
+// unprotected, unexpired upload whose SHA-256 starts with digest that still
+// has downloads left, or failing that the newest one at all, whose download
+// then explains why it can't be had. Under signed links, uploads the
+// request's signature is valid for come first.
+func findContent(c *fiber.Ctx, digest string, fileRecord *FileRecord) bool {
+	// A range over the digest rather than LIKE, so the index is used
+	query := db.Where("password_hash = '' OR password_hash IS NULL").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now())
+	if len(digest) == contentDigestMaxLength {
+		query = query.Where("sha256 = ?", digest)
+	} else {
+		query = query.Where("sha256 >= ? AND sha256 < ?", digest, digest+"g")
+	}
+	var candidates []FileRecord
+	query.Order("uploaded_at desc").Limit(50).Find(&candidates)
+	if len(candidates) == 0 {
+		return false
+	}
+
+	for _, candidate := range candidates {
+		if limit := candidate.downloadLimit(); limit > 0 && candidate.Downloads >= limit {
+			continue
+		}
+		if signedURLsRequired && !signatureValid(c, &candidate) {
+			continue
+		}
+		if candidate.unreleased() {
+			continue
+		}
+		*fileRecord = candidate
+		return true
+	}
+	*fileRecord = candidates[0]
+	return true
+}
+
+// handleContentDownload is GET /c/:digest, with or without an extension.
+func handleContentDownload(c *fiber.Ctx) error {
+	digest := c.Params("digest")
+	digest = strings.ToLower(strings.TrimSuffix(digest, filepath.Ext(digest)))
+	if !validContentDigest(digest) {
+		return c.Status(404).SendString("File not found")
+	}
+	var fileRecord FileRecord
+	if !findContent(c, digest, &fileRecord) {
+		return c.Status(404).SendString("File not found")
+	}
+	return serveDownload(c, fileRecord.UniqueID)
+}
+
+// handleContentHead is HEAD /c/:digest.
+func handleContentHead(c *fiber.Ctx) error {
+	digest := c.Params("digest")
+	digest = strings.ToLower(strings.TrimSuffix(digest, filepath.Ext(digest)))
+	var fileRecord FileRecord
+	if !validContentDigest(digest) || !findContent(c, digest, &fileRecord) {
+		return c.SendStatus(404)
+	}
+	return headDownload(c, fileRecord.UniqueID)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+)
+
+// Cross-origin requests. Any origin may call the API and fetch files unless
+// CORS_ORIGINS lists the ones that may: https://app.example.com,
+// https://*.example.com, chrome-extension://<id> and the like. Each kind of
+// route can have a list of its own, falling back to CORS_ORIGINS when empty:
+// CORS_UPLOAD_ORIGINS for uploads (PUT /, /api/upload, /api/fetch, tus and
+// /api/token), CORS_API_ORIGINS for the rest of the API and
+// CORS_DOWNLOAD_ORIGINS for downloads and everything else. Cookies are never
+// sent cross-origin; browser clients authenticate with an API key or an
+// upload token (see uploadtokens.go).
+
+// corsExposeHeaders lets browser clients read the tus protocol and download
+// headers
+const corsExposeHeaders = "Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size,Upload-Offset,Upload-Length,Upload-Download-URL,Upload-Delete-Token,X-Delete-Token,X-View-URL,Content-Disposition,Content-Range,ETag,Digest,X-Checksum-SHA256,X-Checksum-MD5,X-Expires-At,X-Available-From,X-Downloads-Remaining,X-Request-ID,X-Upload-ID"
+
+var (
+	corsUploadOrigins   string
+	corsAPIOrigins      string
+	corsDownloadOrigins string
+)
+
+// loadCORSConfig reads CORS_ORIGINS, CORS_UPLOAD_ORIGINS, CORS_API_ORIGINS
+// and CORS_DOWNLOAD_ORIGINS.
+func loadCORSConfig() {
+	defaults := parseOrigins("CORS_ORIGINS", "*")
+	corsUploadOrigins = parseOrigins("CORS_UPLOAD_ORIGINS", defaults)
+	corsAPIOrigins = parseOrigins("CORS_API_ORIGINS", defaults)
+	corsDownloadOrigins = parseOrigins("CORS_DOWNLOAD_ORIGINS", defaults)
+	if defaults != "*" || corsUploadOrigins != "*" || corsAPIOrigins != "*" || corsDownloadOrigins != "*" {
+		log.Printf("CORS origins: uploads %s, API %s, downloads %s", corsUploadOrigins, corsAPIOrigins, corsDownloadOrigins)
+	}
+}
+
+// parseOrigins reads a comma-separated list of origins from key, in the
+// form fiber's CORS middleware takes.
+func parseOrigins(key, defaultValue string) string {
+	value := getEnv(key, "")
+	if strings.TrimSpace(value) == "" {
+		return defaultValue
+	}
+	var origins []string
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		origin, err := normalizeOrigin(entry)
+		if err != nil {
+			log.Fatalf("Invalid %s entry '%s': expected * or e.g. https://app.example.com", key, entry)
+		}
+		if origin == "*" {
+			return "*"
+		}
+		origins = append(origins, origin)
+	}
+	if len(origins) == 0 {
+		return defaultValue
+	}
+	return strings.Join(origins, ",")
+}
+
+// normalizeOrigin checks an origin is * or a scheme and host, with no path,
+// and drops a trailing slash.
+func normalizeOrigin(origin string) (string, error) {
+	origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+	if origin == "*" {
+		return origin, nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return "", fmt.Errorf("invalid origin %q", origin)
+	}
+	return strings.ToLower(origin), nil
+}
+
+// setupCORS answers preflights and sets the CORS headers of each request by
+// the origins its kind of route allows.
+func setupCORS(app *fiber.App) {
+	handlers := map[string]fiber.Handler{}
+	for group, origins := range map[string]string{
+		"upload":   corsUploadOrigins,
+		"api":      corsAPIOrigins,
+		"download": corsDownloadOrigins,
+	} {
+		handlers[group] = cors.New(cors.Config{
+			AllowOrigins:  origins,
+			ExposeHeaders: corsExposeHeaders,
+		})
+	}
+	app.Use(func(c *fiber.Ctx) error {
+		// WebDAV clients send OPTIONS to discover the drive, not as a preflight
+		if strings.HasPrefix(c.Path(), "/dav") && c.Get(fiber.HeaderAccessControlRequestMethod) == "" {
+			return c.Next()
+		}
+		return handlers[corsRouteGroup(c)](c)
+	})
+}
+
+// corsRouteGroup tells which origins apply to a request: "upload", "api" or
+// "download". Preflights are judged by the method they ask about.
+func corsRouteGroup(c *fiber.Ctx) string {
+	method := c.Method()
+	if method == fiber.MethodOptions {
+		if requested := c.Get(fiber.HeaderAccessControlRequestMethod); requested != "" {
+			method = requested
+		}
+	}
+	path := c.Path()
+	if path == "/" && method == fiber.MethodPut {
+		return "upload"
+	}
+	for _, prefix := range apiPrefixes {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok || (rest != "" && rest[0] != '/') {
+			continue
+		}
+		if routeUnder(rest, "/upload") || routeUnder(rest, "/tus") ||
+			rest == "/fetch" || rest == "/token" {
+			return "upload"
+		}
+		return "api"
+	}
+	return "download"
+}
+
+// routeUnder reports whether route is base or a route below it.
+func routeUnder(route, base string) bool {
+	rest, ok := strings.CutPrefix(route, base)
+	return ok && (rest == "" || rest[0] == '/')
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCORSRouteOrigins(t *testing.T) {
+	saved := [3]string{corsUploadOrigins, corsAPIOrigins, corsDownloadOrigins}
+	corsUploadOrigins = "chrome-extension://abcdefghijklmnop"
+	corsAPIOrigins = "https://dashboard.example.com"
+	corsDownloadOrigins = "*"
+	defer func() { corsUploadOrigins, corsAPIOrigins, corsDownloadOrigins = saved[0], saved[1], saved[2] }()
+
+	app := fiber.New()
+	setupCORS(app)
+	app.All("/*", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	const extension, dashboard = "chrome-extension://abcdefghijklmnop", "https://dashboard.example.com"
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		preflight string // the method a preflight asks about
+		origin    string
+		allowed   bool
+	}{
+		{"upload from the upload origin", "PUT", "/", "", extension, true},
+		{"upload from the API origin", "PUT", "/", "", dashboard, false},
+		{"upload preflight", "OPTIONS", "/api/upload", "POST", extension, true},
+		{"upload preflight from the API origin", "OPTIONS", "/api/upload", "POST", dashboard, false},
+		{"versioned token route", "POST", "/api/v1/token", "", extension, true},
+		{"API from the API origin", "GET", "/api/files", "", dashboard, true},
+		{"API from the upload origin", "GET", "/api/files", "", extension, false},
+		{"API preflight from the upload origin", "OPTIONS", "/api/files/abc", "DELETE", extension, false},
+		{"route that only starts like an upload", "GET", "/api/uploads-stats", "", dashboard, true},
+		{"download from anywhere", "GET", "/d/abc.txt", "", "https://blog.example.org", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.preflight != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.preflight)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := resp.Header.Get("Access-Control-Allow-Origin")
+			if allowed := got == tt.origin || got == "*"; allowed != tt.allowed {
+				t.Errorf("%s %s from %s: Access-Control-Allow-Origin = %q, want allowed %v",
+					tt.method, tt.path, tt.origin, got, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm/clause"
+)
+
+// Admin dashboard at /admin. Browsers sign in once with the admin key and get
+// a session cookie, which the page's calls to the admin API reuse. Sessions
+// last adminSessionTTL and end for good when signed out: the cookie's nonce
+// is recorded as revoked until it would have expired.
+
+const (
+	adminCookieName  = "bashupload_admin"
+	adminSessionTTL  = 12 * time.Hour
+	dashboardHistory = 30 // days of storage usage shown
+)
+
+// RevokedAdminSession is a dashboard session signed out before it expired.
+type RevokedAdminSession struct {
+	Nonce     string    `gorm:"primaryKey;size:32"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// StorageSample is the storage in use on one day, recorded hourly by the
+// cleanup loop so the dashboard can chart usage over time.
+type StorageSample struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	Day        string    `json:"day" gorm:"uniqueIndex;not null"` // YYYY-MM-DD
+	TotalFiles int64     `json:"total_files"`
+	TotalSize  int64     `json:"total_size"`
+	StoredSize int64     `json:"stored_size"`
+	UpdatedAt  time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// recordStorageSample stores today's usage, replacing an earlier sample of
+// the same day.
+func recordStorageSample() {
+	saveStorageSample(collectAdminStats())
+}
+
+func saveStorageSample(stats adminStats) {
+	sample := StorageSample{Day: time.Now().Format("2006-01-02")}
+	db.Where(StorageSample{Day: sample.Day}).FirstOrCreate(&sample)
+	db.Model(&sample).Updates(map[string]interface{}{
+		"total_files": stats.TotalFiles,
+		"total_size":  stats.TotalSize,
+		"stored_size": stats.StoredSize,
+	})
+}
+
+// adminSessionSignature signs a dashboard session with the admin key, so
+// changing the key signs every browser out.
+func adminSessionSignature(nonce string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(adminKey))
+	fmt.Fprintf(mac, "bashupload admin session:%s.%d", nonce, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newAdminSession returns a dashboard cookie value, "nonce.expiry.signature",
+// and when it expires.
+func newAdminSession() (string, time.Time) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	expiresAt := time.Now().Add(adminSessionTTL)
+	encoded := hex.EncodeToString(nonce)
+	return fmt.Sprintf("%s.%d.%s", encoded, expiresAt.Unix(), adminSessionSignature(encoded, expiresAt.Unix())), expiresAt
+}
+
+// parseAdminSession checks a dashboard cookie's signature and expiry and
+// returns its nonce and expiry.
+func parseAdminSession(cookie string) (string, time.Time, bool) {
+	parts := strings.Split(cookie, ".")
+	if adminKey == "" || len(parts) != 3 {
+		return "", time.Time{}, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return "", time.Time{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(parts[2]), []byte(adminSessionSignature(parts[0], expires))) != 1 {
+		return "", time.Time{}, false
+	}
+	return parts[0], time.Unix(expires, 0), true
+}
+
+func hasAdminSession(c *fiber.Ctx) bool {
+	nonce, _, ok := parseAdminSession(c.Cookies(adminCookieName))
+	if !ok {
+		return false
+	}
+	var revoked int64
+	db.Model(&RevokedAdminSession{}).Where("nonce = ?", nonce).Count(&revoked)
+	return revoked == 0
+}
+
+// pruneRevokedAdminSessions forgets signed-out sessions that have expired
+// anyway.
+func pruneRevokedAdminSessions() {
+	db.Where("expires_at < ?", time.Now()).Delete(&RevokedAdminSession{})
+}
+
+func setupDashboardRoutes(app *fiber.App) {
+	app.Get("/admin", handleDashboard)
+	app.Post("/admin/login", handleDashboardLogin)
+	app.Post("/admin/logout", handleDashboardLogout)
+}
+
+func handleDashboardLogin(c *fiber.Ctx) error {
+	if adminKey == "" {
+		return c.SendStatus(404)
+	}
+	if subtle.ConstantTimeCompare([]byte(c.FormValue("key")), []byte(adminKey)) != 1 {
+		audit(c, auditAuthFailure, "", "admin dashboard sign-in")
+		return c.Status(401).Render("admin", fiber.Map{"Brand": brand, "LoginFailed": true})
+	}
+
+	session, expiresAt := newAdminSession()
+	c.Cookie(&fiber.Cookie{
+		Name:     adminCookieName,
+		Value:    session,
+		Path:     "/",
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteStrictMode, // the cookie authorises admin API calls
+		Expires:  expiresAt,
+	})
+	return c.Redirect("/admin", 303)
+}
+
+func handleDashboardLogout(c *fiber.Ctx) error {
+	// A copy of the cookie kept elsewhere stops working too
+	if nonce, expiresAt, ok := parseAdminSession(c.Cookies(adminCookieName)); ok {
+		db.Clauses(clause.OnConflict{DoNothing: true}).Create(&RevokedAdminSession{Nonce: nonce, ExpiresAt: expiresAt})
+	}
+	c.ClearCookie(adminCookieName)
+	return c.Redirect("/admin", 303)
+}
+
+// dashboardFile is a row of the recent uploads table.
+type dashboardFile struct {
+	UniqueID    string
+	Name        string
+	Size        string
+	IPAddress   string
+	UploadedAt  string
+	Downloads   string
+	ExpiresAt   string
+	ScanStatus  string
+	DownloadURL string
+	Thumbnail   string // empty unless the file is an image
+}
+
+// dashboardBar is one day of the storage usage chart.
+type dashboardBar struct {
+	Day     string
+	Size    string
+	Files   int64
+	Percent int
+}
+
+func handleDashboard(c *fiber.Ctx) error {
+	if adminKey == "" {
+		return c.SendStatus(404)
+	}
+	if !hasAdminSession(c) {
+		return c.Render("admin", fiber.Map{"Brand": brand})
+	}
+
+	// Today's bar always reflects the current usage
+	stats := collectAdminStats()
+	saveStorageSample(stats)
+	baseURL := getBaseURL(c)
+
+	var recent []FileRecord
+	db.Order("uploaded_at desc").Limit(50).Find(&recent)
+	files := make([]dashboardFile, 0, len(recent))
+	for _, rec := range recent {
+		downloads := fmt.Sprintf("%d", rec.Downloads)
+		if limit := rec.downloadLimit(); limit > 0 {
+			downloads = fmt.Sprintf("%d/%d", rec.Downloads, limit)
+		}
+		expires := "never"
+		if rec.ExpiresAt != nil {
+			expires = rec.ExpiresAt.Format("2006-01-02 15:04")
+		}
+		thumbnail := ""
+		if thumbnailsEnabled && thumbnailable(&rec) {
+			thumbnail = signLink(fmt.Sprintf("%s/t/%s?w=64", baseURL, rec.UniqueID), &rec)
+		}
+		files = append(files, dashboardFile{
+			UniqueID:    rec.UniqueID,
+			Name:        rec.OriginalName,
+			Size:        formatBytes(rec.FileSize),
+			IPAddress:   rec.IPAddress,
+			UploadedAt:  rec.UploadedAt.Format("2006-01-02 15:04"),
+			Downloads:   downloads,
+			ExpiresAt:   expires,
+			ScanStatus:  rec.ScanStatus,
+			DownloadURL: signLink(baseURL+rec.downloadPath(), &rec),
+			Thumbnail:   thumbnail,
+		})
+	}
+
+	// Storage usage chart, oldest day first
+	var samples []StorageSample
+	db.Order("day desc").Limit(dashboardHistory).Find(&samples)
+	var peak int64
+	for _, sample := range samples {
+		if sample.StoredSize > peak {
+			peak = sample.StoredSize
+		}
+	}
+	usage := make([]dashboardBar, 0, len(samples))
+	for i := len(samples) - 1; i >= 0; i-- {
+		percent := 0
+		if peak > 0 {
+			percent = int(samples[i].StoredSize * 100 / peak)
+		}
+		usage = append(usage, dashboardBar{
+			Day:     samples[i].Day,
+			Size:    formatBytes(samples[i].StoredSize),
+			Files:   samples[i].TotalFiles,
+			Percent: percent,
+		})
+	}
+
+	topIPs := make([]fiber.Map, 0, len(stats.TopIPs))
+	for _, ip := range stats.TopIPs {
+		topIPs = append(topIPs, fiber.Map{
+			"IPAddress": ip.IPAddress,
+			"Files":     ip.Files,
+			"Size":      formatBytes(ip.TotalSize),
+			"Banned":    isBanned(ip.IPAddress),
+		})
+	}
+
+	return c.Render("admin", fiber.Map{
+		"Brand":          brand,
+		"LoggedIn":       true,
+		"TotalFiles":     stats.TotalFiles,
+		"TotalSize":      formatBytes(stats.TotalSize),
+		"StoredSize":     formatBytes(stats.StoredSize),
+		"TotalDownloads": stats.TotalDownloads,
+		"UploadsToday":   stats.UploadsToday,
+		"ActiveBans":     stats.ActiveBans,
+		"OpenReports":    stats.OpenReports,
+		"HeldFiles":      stats.HeldFiles,
+		"Files":          files,
+		"Usage":          usage,
+		"TopIPs":         topIPs,
+	})
+}
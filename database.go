@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// initDB opens the database selected by DB_DRIVER (sqlite, postgres or
+// mysql) using DB_DSN, migrates the schema and configures the connection pool.
+func initDB() {
+	driver := strings.ToLower(getEnv("DB_DRIVER", "sqlite"))
+	dsn := getEnv("DB_DSN", "")
+
+	var dialector gorm.Dialector
+	switch driver {
+	case "sqlite", "sqlite3":
+		if dsn == "" {
+			dsn = "bashupload.db"
+		}
+		dialector = sqlite.Open(sqliteDSN(dsn))
+	case "postgres", "postgresql":
+		if dsn == "" {
+			log.Fatal("DB_DSN is required when DB_DRIVER is postgres")
+		}
+		dialector = postgres.Open(dsn)
+	case "mysql", "mariadb":
+		if dsn == "" {
+			log.Fatal("DB_DSN is required when DB_DRIVER is mysql")
+		}
+		dialector = mysql.Open(dsn)
+	default:
+		log.Fatalf("Unknown DB_DRIVER '%s' (expected sqlite, postgres or mysql)", driver)
+	}
+
+	var err error
+	db, err = gorm.Open(dialector, &gorm.Config{Logger: newGormLogger()})
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+
+	configureConnectionPool(driver, dsn)
+
+	// Migrate the schema
+	err = db.AutoMigrate(&FileRecord{}, &Blob{}, &UploadSession{}, &TusUpload{}, &BannedIP{}, &StorageSample{}, &APIKey{}, &User{}, &UsageStat{}, &Bundle{}, &Lease{}, &AbuseReport{}, &AuditLog{}, &FileTag{}, &FileMetadata{}, &MirrorJob{}, &MetadataBackup{}, &DailyStat{}, &DownloadEvent{}, &Alias{}, &Transfer{}, &ResumeGrant{}, &RevokedAdminSession{})
+	if err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	log.Printf("Database initialized successfully (%s)", driver)
+}
+
+// sqliteDSN adds the connection settings SQLite needs under concurrent load
+// to dsn, unless it sets them itself: WAL so reads don't block on a write, a
+// busy timeout (DB_BUSY_TIMEOUT) so a writer waits for the lock instead of
+// failing with "database is locked", and immediate transactions so two of
+// them can't deadlock upgrading from a read to a write.
+func sqliteDSN(dsn string) string {
+	timeoutStr := getEnv("DB_BUSY_TIMEOUT", "5s")
+	timeout, err := parseDuration(timeoutStr)
+	if err != nil || timeout < 0 {
+		log.Printf("Invalid DB_BUSY_TIMEOUT value '%s', using default 5 seconds", timeoutStr)
+		timeout = 5 * time.Second
+	}
+
+	params := []struct{ name, value string }{
+		{"_journal_mode", "WAL"},
+		{"_synchronous", "NORMAL"},
+		{"_busy_timeout", strconv.FormatInt(timeout.Milliseconds(), 10)},
+		{"_txlock", "immediate"},
+	}
+	for _, param := range params {
+		if strings.Contains(dsn, param.name+"=") {
+			continue
+		}
+		if strings.Contains(dsn, "?") {
+			dsn += "&"
+		} else {
+			dsn += "?"
+		}
+		dsn += param.name + "=" + param.value
+	}
+	return dsn
+}
+
+// configureConnectionPool applies DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and
+// DB_CONN_MAX_LIFETIME to the underlying sql.DB.
+func configureConnectionPool(driver, dsn string) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatal("Failed to access database connection pool:", err)
+	}
+
+	// SQLite in WAL mode takes any number of readers but one writer at a
+	// time, which the busy timeout queues; a few connections let downloads
+	// read while an upload writes. An in-memory database exists per
+	// connection, so it gets exactly one.
+	defaultOpen := "25"
+	if driver == "sqlite" || driver == "sqlite3" {
+		defaultOpen = "4"
+		if strings.Contains(dsn, ":memory:") || strings.Contains(dsn, "mode=memory") {
+			defaultOpen = "1"
+		}
+	}
+
+	maxOpenStr := getEnv("DB_MAX_OPEN_CONNS", defaultOpen)
+	maxOpen, err := strconv.Atoi(maxOpenStr)
+	if err != nil || maxOpen < 0 {
+		log.Printf("Invalid DB_MAX_OPEN_CONNS value '%s', using default %s", maxOpenStr, defaultOpen)
+		maxOpen, _ = strconv.Atoi(defaultOpen)
+	}
+
+	maxIdleStr := getEnv("DB_MAX_IDLE_CONNS", strconv.Itoa(maxOpen))
+	maxIdle, err := strconv.Atoi(maxIdleStr)
+	if err != nil || maxIdle < 0 {
+		log.Printf("Invalid DB_MAX_IDLE_CONNS value '%s', using %d", maxIdleStr, maxOpen)
+		maxIdle = maxOpen
+	}
+
+	lifetimeStr := getEnv("DB_CONN_MAX_LIFETIME", "30m")
+	lifetime, err := parseDuration(lifetimeStr)
+	if err != nil || lifetime < 0 {
+		log.Printf("Invalid DB_CONN_MAX_LIFETIME value '%s', using default 30 minutes", lifetimeStr)
+		lifetime = 30 * time.Minute
+	}
+
+	sqlDB.SetMaxOpenConns(maxOpen)
+	sqlDB.SetMaxIdleConns(maxIdle)
+	sqlDB.SetConnMaxLifetime(lifetime)
+}
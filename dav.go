@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// WebDAV access at /dav/, so the files behind an API key can be mounted as a
+// network drive. The drive is one flat folder of the files the key may list
+// (as GET /api/files): a PUT there is an ordinary upload, GET reads a file
+// without counting as a download, DELETE and MOVE delete and rename. Each
+// file's share link is the download-url property.
+//
+// Clients log in with HTTP Basic auth and the API key as the password (the
+// user name is ignored), or send X-API-Key. Locks are only pretended, enough
+// for Finder and Windows Explorer to mount the drive writable.
+
+// davMethods are the WebDAV methods fiber must accept on top of its own.
+var davMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"}
+
+// davNamespace is the XML namespace of the download-url property.
+const davNamespace = "https://github.com/imnotdev25/bashupload"
+
+// davListLimit caps how many files the drive shows, newest first.
+const davListLimit = 1000
+
+func setupDAVRoutes(app *fiber.App) {
+	dav := app.Group("/dav", davAuth)
+	for _, path := range []string{"", "/", "/:name"} {
+		dav.Options(path, handleDAVOptions)
+		dav.Add("PROPFIND", path, handleDAVPropfind)
+		dav.Add("PROPPATCH", path, handleDAVProppatch)
+		dav.Add("LOCK", path, handleDAVLock)
+		dav.Add("UNLOCK", path, handleDAVUnlock)
+		dav.Add("MKCOL", path, handleDAVForbidden)
+		dav.Add("COPY", path, handleDAVForbidden)
+	}
+	dav.Get("/:name", handleDAVGet)
+	dav.Head("/:name", handleDAVGet)
+	dav.Put("/:name", handleDAVPut)
+	dav.Delete("/:name", handleDAVDelete)
+	dav.Add("MOVE", "/:name", handleDAVMove)
+}
+
+// davAuth takes the API key from Basic auth when no X-API-Key was sent, and
+// requires one whatever REQUIRE_API_KEY says, as the drive shows the key's
+// own files. Reading needs the read scope, anything else the upload scope.
+func davAuth(c *fiber.Ctx) error {
+	key := requestAPIKey(c)
+	if key == nil {
+		if _, password, ok := davBasicAuth(c); ok {
+			key = lookupAPIKey(password)
+			c.Locals("api_key", key)
+		}
+	}
+	if key == nil {
+		if c.Get(fiber.HeaderAuthorization) != "" || providedAPIKey(c) != "" {
+			audit(c, auditAuthFailure, "", "WebDAV API key")
+		}
+		c.Set("WWW-Authenticate", `Basic realm="bashupload", charset="UTF-8"`)
+		return c.Status(401).SendString("Log in with your API key as the password")
+	}
+
+	scope := scopeUpload
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions, "PROPFIND":
+		scope = scopeRead
+	}
+	if !key.hasScope(scope) {
+		audit(c, auditAuthFailure, "", "API key lacks the "+scope+" scope")
+		return c.Status(403).SendString(fmt.Sprintf("API key lacks the '%s' scope", scope))
+	}
+	return c.Next()
+}
+
+// davBasicAuth reads the credentials of an Authorization: Basic header.
+func davBasicAuth(c *fiber.Ctx) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// davName is the file name a request is about, empty for the folder itself.
+func davName(c *fiber.Ctx) string {
+	name, err := url.PathUnescape(c.Params("name"))
+	if err != nil {
+		return c.Params("name")
+	}
+	return name
+}
+
+// davIgnored reports whether a name is one the operating system writes next
+// to files on a network drive (._foo, .DS_Store, desktop.ini, Thumbs.db).
+// Those are accepted and dropped rather than uploaded.
+func davIgnored(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.EqualFold(name, "desktop.ini") || strings.EqualFold(name, "Thumbs.db")
+}
+
+// davFiles narrows a query to the files on the caller's drive: every file
+// for the static API_KEY, else those uploaded with the key. Expired files
+// are left out.
+func davFiles(c *fiber.Ctx) *gorm.DB {
+	query := db.Model(&FileRecord{}).Where("expires_at IS NULL OR expires_at > ?", time.Now())
+	if key := requestAPIKey(c); key != &legacyAPIKey {
+		query = query.Where("api_key_id = ?", key.ID)
+	}
+	return query
+}
+
+// findDAVFile looks a file up on the caller's drive by name. Of several
+// files with the same name the newest is the one shown.
+func findDAVFile(c *fiber.Ctx, name string, fileRecord *FileRecord) error {
+	return davFiles(c).Where("original_name = ?", name).Order("uploaded_at desc").First(fileRecord).Error
+}
+
+func handleDAVOptions(c *fiber.Ctx) error {
+	c.Set("DAV", "1, 2")
+	c.Set("MS-Author-Via", "DAV")
+	c.Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+	return c.SendStatus(200)
+}
+
+func handleDAVForbidden(c *fiber.Ctx) error {
+	return c.Status(403).SendString("The drive is a single folder; files can only be uploaded, renamed and deleted")
+}
+
+// davResponse is one resource in a PROPFIND answer.
+type davResponse struct {
+	XMLName  xml.Name    `xml:"D:response"`
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string           `xml:"D:displayname"`
+	ResourceType  *davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64           `xml:"D:getcontentlength,omitempty"`
+	ContentType   string           `xml:"D:getcontenttype,omitempty"`
+	LastModified  string           `xml:"D:getlastmodified,omitempty"`
+	CreationDate  string           `xml:"D:creationdate,omitempty"`
+	ETag          string           `xml:"D:getetag,omitempty"`
+	DownloadURL   string           `xml:"B:download-url,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// davFileResponse describes a file for PROPFIND.
+func davFileResponse(c *fiber.Ctx, fileRecord *FileRecord) davResponse {
+	size := fileRecord.FileSize
+	prop := davProp{
+		DisplayName:   fileRecord.OriginalName,
+		ResourceType:  &davResourceType{},
+		ContentLength: &size,
+		ContentType:   fileRecord.MimeType,
+		LastModified:  fileRecord.UploadedAt.UTC().Format(http.TimeFormat),
+		CreationDate:  fileRecord.UploadedAt.UTC().Format(time.RFC3339),
+		DownloadURL:   signLink(getBaseURL(c)+fileRecord.downloadPath(), fileRecord),
+	}
+	if fileRecord.SHA256 != "" {
+		prop.ETag = strconv.Quote(fileRecord.SHA256)
+	}
+	return davResponse{
+		Href:     "/dav/" + url.PathEscape(fileRecord.OriginalName),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// handleDAVPropfind lists the drive, or describes one file. Every property
+// is returned whichever were asked for.
+func handleDAVPropfind(c *fiber.Ctx) error {
+	var responses []davResponse
+	if name := davName(c); name != "" {
+		var fileRecord FileRecord
+		if err := findDAVFile(c, name, &fileRecord); err != nil {
+			return c.SendStatus(404)
+		}
+		responses = append(responses, davFileResponse(c, &fileRecord))
+	} else {
+		responses = append(responses, davResponse{
+			Href: "/dav/",
+			Propstat: davPropstat{
+				Prop:   davProp{DisplayName: "bashupload", ResourceType: &davResourceType{Collection: &struct{}{}}},
+				Status: "HTTP/1.1 200 OK",
+			},
+		})
+		if c.Get("Depth", "1") != "0" {
+			var records []FileRecord
+			davFiles(c).Order("uploaded_at desc").Limit(davListLimit).Find(&records)
+			seen := make(map[string]bool)
+			for i := range records {
+				if !seen[records[i].OriginalName] {
+					seen[records[i].OriginalName] = true
+					responses = append(responses, davFileResponse(c, &records[i]))
+				}
+			}
+		}
+	}
+	return sendMultistatus(c, responses)
+}
+
+// sendMultistatus writes a 207 Multi-Status answer.
+func sendMultistatus(c *fiber.Ctx, responses []davResponse) error {
+	body, err := xml.Marshal(struct {
+		XMLName   xml.Name      `xml:"D:multistatus"`
+		DAV       string        `xml:"xmlns:D,attr"`
+		Namespace string        `xml:"xmlns:B,attr"`
+		Responses []davResponse `xml:"D:response"`
+	}{DAV: "DAV:", Namespace: davNamespace, Responses: responses})
+	if err != nil {
+		return c.SendStatus(500)
+	}
+	c.Set(fiber.HeaderContentType, "application/xml; charset=utf-8")
+	return c.Status(207).Send(append([]byte(xml.Header), body...))
+}
+
+// handleDAVProppatch accepts property changes without keeping them, which
+// clients setting modification times expect to succeed.
+func handleDAVProppatch(c *fiber.Ctx) error {
+	href := "/dav/"
+	if name := davName(c); name != "" {
+		href += url.PathEscape(name)
+	}
+	return sendMultistatus(c, []davResponse{{
+		Href:     href,
+		Propstat: davPropstat{Status: "HTTP/1.1 200 OK"},
+	}})
+}
+
+// handleDAVLock hands out a lock token that locks nothing. Files are never
+// changed in place, so writers can't get in each other's way.
+func handleDAVLock(c *fiber.Ctx) error {
+	token := "opaquelocktoken:" + generateUniqueID()
+	c.Set("Lock-Token", "<"+token+">")
+	c.Set(fiber.HeaderContentType, "application/xml; charset=utf-8")
+	return c.Status(200).SendString(xml.Header + `<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>` +
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:depth>0</D:depth><D:timeout>Second-3600</D:timeout>` +
+		`<D:locktoken><D:href>` + token + `</D:href></D:locktoken>` +
+		`</D:activelock></D:lockdiscovery></D:prop>`)
+}
+
+func handleDAVUnlock(c *fiber.Ctx) error {
+	return c.SendStatus(204)
+}
+
+// handleDAVGet serves a file to its owner. It doesn't count as a download,
+// and password protection doesn't apply.
+func handleDAVGet(c *fiber.Ctx) error {
+	var fileRecord FileRecord
+	if err := findDAVFile(c, davName(c), &fileRecord); err != nil {
+		return c.Status(404).SendString("File not found")
+	}
+	logFileID(c, fileRecord.UniqueID)
+	if refused, err := refuseUnscanned(c, &fileRecord); refused {
+		return err
+	}
+	if refused, err := refuseHeld(c, &fileRecord); refused {
+		return err
+	}
+
+	start, end, partial, err := parseByteRange(c.Get("Range"), fileRecord.FileSize)
+	if err != nil {
+		c.Set("Content-Range", fmt.Sprintf("bytes */%d", fileRecord.FileSize))
+		return c.Status(416).SendString("Requested range not satisfiable")
+	}
+	setDownloadHeaders(c, &fileRecord)
+	if c.Method() == fiber.MethodHead {
+		return c.SendStatus(200)
+	}
+
+	served := fileRecord.FileSize
+	if partial {
+		served = end - start + 1
+	}
+	recordDownloadUsage(&fileRecord, served, false)
+	audit(c, auditDownload, fileRecord.UniqueID, "WebDAV")
+	return sendFileRecord(c, &fileRecord, start, end, partial, nil)
+}
+
+// handleDAVPut uploads a file, replacing the one of the same name on the
+// drive. The share link comes back in X-Download-URL and the body.
+func handleDAVPut(c *fiber.Ctx) error {
+	name := davName(c)
+	if davIgnored(name) {
+		io.Copy(io.Discard, c.Context().RequestBodyStream())
+		return c.SendStatus(201)
+	}
+	filename := sanitizeFilename(name)
+
+	if err := checkFileType(filename, c.Get("Content-Type")); err != nil {
+		return c.Status(415).SendString(err.Error())
+	}
+	fileSize, _ := strconv.ParseInt(c.Get("Content-Length"), 10, 64)
+	if fileSize > maxUpload {
+		return c.Status(413).SendString(fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)))
+	}
+	if quotaErr := checkUploadQuota(c.IP(), fileSize); quotaErr != nil {
+		return c.Status(quotaErr.status).SendString(quotaErr.message)
+	}
+	ticket, refusal := admitUpload(fileSize)
+	if refusal != nil {
+		return refuseUpload(c, refusal)
+	}
+	defer ticket.release()
+
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	stagedPath := newStagingPath()
+	staged, err := saveStream(stagedPath, uploadThrottle().reader(body))
+	if err != nil {
+		os.Remove(stagedPath)
+		return c.Status(500).SendString("Failed to save file")
+	}
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return c.Status(415).SendString(err.Error())
+	}
+	if fileSize == 0 {
+		if quotaErr := checkUploadQuota(c.IP(), staged.Size); quotaErr != nil {
+			os.Remove(stagedPath)
+			return c.Status(quotaErr.status).SendString(quotaErr.message)
+		}
+	}
+
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+	storageKey, nonce, err := storeBlob(newStorageKey(ext), staged)
+	if err != nil {
+		requestLog(c).Error("Failed to store file", "key", storageKey, "error", err)
+		return c.Status(500).SendString("Failed to save file")
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+	fileRecord := FileRecord{
+		UniqueID:         newFileID(),
+		OriginalName:     filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         staged.Size,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: c.Get("Content-Type"),
+		Extension:        ext,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        storedIP(c.IP()),
+		APIKeyID:         currentAPIKeyID(c),
+		ExpiresAt:        computeExpiry(staged.Size),
+	}
+
+	// The file it replaces, looked up before the new one shadows it
+	var previous FileRecord
+	replaces := findDAVFile(c, filename, &previous) == nil
+
+	if err := createFileRecord(db, &fileRecord); err != nil {
+		releaseBlob(storageKey)
+		return c.Status(500).SendString("Failed to save file metadata")
+	}
+	queueScan(fileRecord)
+	logUpload(c, &fileRecord)
+	sendWebhook(c, webhookUploaded, &fileRecord, "")
+
+	status := 201
+	if replaces {
+		status = 204
+		if err := removeFile(&previous, "replaced"); err != nil {
+			requestLog(c).Error("Failed to remove replaced file", "file_id", previous.UniqueID, "error", err)
+		} else {
+			audit(c, auditDelete, previous.UniqueID, "replaced")
+			sendWebhook(c, webhookDeleted, &previous, "replaced")
+		}
+	}
+
+	downloadURL := signLink(getBaseURL(c)+fileRecord.downloadPath(), &fileRecord)
+	c.Set("X-Download-URL", downloadURL)
+	c.Set("X-Delete-Token", deleteToken)
+	c.Set("X-Checksum-SHA256", staged.Digest.SHA256)
+	if status == 204 {
+		return c.SendStatus(status)
+	}
+	return c.Status(status).SendString(downloadURL + "\n")
+}
+
+func handleDAVDelete(c *fiber.Ctx) error {
+	name := davName(c)
+	var fileRecord FileRecord
+	if err := findDAVFile(c, name, &fileRecord); err != nil {
+		if davIgnored(name) {
+			return c.SendStatus(204)
+		}
+		return c.Status(404).SendString("File not found")
+	}
+	logFileID(c, fileRecord.UniqueID)
+
+	if err := removeFile(&fileRecord, "uploader"); err != nil {
+		requestLog(c).Error("Failed to delete file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return c.Status(500).SendString("Failed to delete file")
+	}
+	requestLog(c).Info("File deleted over WebDAV", "file_id", fileRecord.UniqueID)
+	audit(c, auditDelete, fileRecord.UniqueID, "uploader")
+	sendWebhook(c, webhookDeleted, &fileRecord, "uploader")
+	return c.SendStatus(204)
+}
+
+// handleDAVMove renames a file. The link keeps working: it's made of the ID
+// and the extension the file was uploaded with.
+func handleDAVMove(c *fiber.Ctx) error {
+	var fileRecord FileRecord
+	if err := findDAVFile(c, davName(c), &fileRecord); err != nil {
+		return c.Status(404).SendString("File not found")
+	}
+
+	destination, err := url.Parse(c.Get("Destination"))
+	if err != nil {
+		return c.Status(400).SendString("Invalid Destination")
+	}
+	target, ok := strings.CutPrefix(destination.Path, "/dav/")
+	if !ok || target == "" || strings.Contains(target, "/") {
+		return c.Status(403).SendString("Files can only be moved within the drive")
+	}
+	target = sanitizeFilename(target)
+	if target == fileRecord.OriginalName {
+		return c.SendStatus(204)
+	}
+
+	status := 201
+	var existing FileRecord
+	if findDAVFile(c, target, &existing) == nil {
+		if c.Get("Overwrite") == "F" {
+			return c.Status(412).SendString("Destination exists")
+		}
+		if err := removeFile(&existing, "replaced"); err != nil {
+			return c.Status(500).SendString("Failed to replace destination")
+		}
+		audit(c, auditDelete, existing.UniqueID, "replaced")
+		sendWebhook(c, webhookDeleted, &existing, "replaced")
+		status = 204
+	}
+
+	if err := db.Model(&fileRecord).Update("original_name", target).Error; err != nil {
+		return c.Status(500).SendString("Failed to rename file")
+	}
+	return c.SendStatus(status)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// Blob is a stored file body shared by every FileRecord with the same
+// SHA-256. Identical uploads point at one blob, which is only removed from
+// storage once RefCount drops to zero.
+type Blob struct {
+	ID       uint   `json:"-" gorm:"primaryKey"`
+	SHA256   string `json:"sha256" gorm:"uniqueIndex;not null"`
+	FilePath string `json:"file_path" gorm:"uniqueIndex;not null"`
+	FileSize int64  `json:"file_size" gorm:"not null"`
+	RefCount int    `json:"ref_count" gorm:"not null;default:1"`
+	Nonce    string `json:"-"`                               // encryption nonce prefix, empty when stored in plain
+	CID      string `json:"cid,omitempty" gorm:"column:cid"` // IPFS content identifier, with the ipfs backend
+	// How the blob is compressed, see compress.go
+	Compression    string `json:"compression,omitempty"`
+	CompressedSize int64  `json:"compressed_size,omitempty"`
+}
+
+// storeBlob stores a fully received staged file and returns the storage key
+// the new FileRecord should use, along with the encryption nonce of the blob
+// behind it. When a blob with the same checksum already exists the staged
+// file is dropped and the existing blob gains a reference, and staged takes
+// on its compression; otherwise the file is stored under key.
+//
+// Reference counts only change through conditional UPDATEs, so replicas
+// sharing the database can't lose a reference to one another: a blob whose
+// count has dropped to zero is on its way out and isn't shared again.
+func storeBlob(key string, staged *stagedFile) (string, string, error) {
+	var existing Blob
+	if result := db.Where("sha256 = ? AND file_size = ?", staged.Digest.SHA256, staged.Size).First(&existing); result.Error == nil {
+		// Make sure the blob is really still there before sharing it
+		if _, err := fileStorage.Stat(existing.FilePath); err == nil {
+			shared := db.Model(&Blob{}).Where("id = ? AND ref_count > 0", existing.ID).
+				UpdateColumn("ref_count", gorm.Expr("ref_count + 1"))
+			if shared.Error == nil && shared.RowsAffected > 0 {
+				os.Remove(staged.Path)
+				staged.Compression, staged.CompressedSize = existing.Compression, existing.CompressedSize
+				return existing.FilePath, existing.Nonce, nil
+			}
+		} else {
+			db.Delete(&existing)
+		}
+	}
+
+	if err := persistStaged(key, staged.Path, staged.storedSize()); err != nil {
+		return key, "", err
+	}
+	enqueueMirror(key, mirrorCopy)
+
+	blob := Blob{SHA256: staged.Digest.SHA256, FilePath: key, FileSize: staged.Size, RefCount: 1, Nonce: staged.Nonce,
+		Compression: staged.Compression, CompressedSize: staged.CompressedSize}
+	if cids, ok := fileStorage.(cidStorage); ok {
+		cid, err := cids.CID(key)
+		if err != nil {
+			log.Printf("Failed to look up the CID of %s: %v", key, err)
+		}
+		blob.CID = cid
+	}
+	if result := db.Create(&blob); result.Error != nil {
+		log.Printf("Failed to record blob %s: %v", key, result.Error)
+	}
+	return key, staged.Nonce, nil
+}
+
+// blobCID returns the CID of the blob stored under key, or "" when the
+// backend doesn't address content by CID.
+func blobCID(key string) string {
+	var blob Blob
+	if db.Select("cid").Where("file_path = ?", key).First(&blob).Error != nil {
+		return ""
+	}
+	return blob.CID
+}
+
+// releaseBlob drops one reference to the blob stored under key and deletes
+// it from storage once nothing refers to it anymore. Blobs stored before
+// deduplication existed have no Blob row and are deleted right away.
+func releaseBlob(key string) error {
+	var blob Blob
+	if result := db.Where("file_path = ?", key).First(&blob); result.Error == nil {
+		// Drop the reference and, when it was the last, the row, in one
+		// transaction: of replicas releasing at once, one sees the count
+		// reach zero
+		last := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&Blob{}).Where("id = ? AND ref_count > 0", blob.ID).
+				UpdateColumn("ref_count", gorm.Expr("ref_count - 1"))
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			result = tx.Where("id = ? AND ref_count <= 0", blob.ID).Delete(&Blob{})
+			last = result.RowsAffected > 0
+			return result.Error
+		})
+		if err != nil || !last {
+			return err
+		}
+	}
+
+	deleteThumbnails(key)
+	deleteTorrentPieces(key)
+	deleteImageTransforms(key)
+	enqueueMirror(key, mirrorDelete)
+	return fileStorage.Delete(key)
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("free disk space check is not supported on Windows")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The download log. Every counted download that completes is recorded with
+// when it happened, the downloader's network (the /24 of an IPv4 address,
+// the /48 of an IPv6 one, or its hash with ANONYMIZE_IPS=hash), their user
+// agent and the bytes sent, so uploaders can see whether and when their link
+// was used. The events go with the file when it's purged, and lose their
+// addresses after METADATA_RETENTION like everything else.
+
+const maxUserAgentLength = 256
+
+// DownloadEvent is one completed download of a file.
+type DownloadEvent struct {
+	ID           uint      `json:"-" gorm:"primaryKey"`
+	FileID       uint      `json:"-" gorm:"not null;index"`
+	DownloadedAt time.Time `json:"downloaded_at" gorm:"not null"`
+	IPAddress    string    `json:"ip_address"` // truncated
+	UserAgent    string    `json:"user_agent"`
+	Bytes        int64     `json:"bytes"`
+}
+
+// by records who the claimed download goes to.
+func (d *downloadClaim) by(ip, userAgent string) {
+	if d == nil {
+		return
+	}
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	d.event.IPAddress = downloaderIP(ip)
+	d.event.UserAgent = userAgent
+}
+
+// serving records how many bytes the claimed download sends, when it isn't
+// the whole file.
+func (d *downloadClaim) serving(bytes int64) {
+	if d != nil {
+		d.event.Bytes = bytes
+	}
+}
+
+// recordDownloadEvent logs a completed download.
+func recordDownloadEvent(event DownloadEvent) {
+	event.DownloadedAt = time.Now()
+	if err := db.Create(&event).Error; err != nil {
+		slog.Error("Failed to record download event", "file_id", event.FileID, "error", err)
+	}
+}
+
+// downloaderIP truncates a downloader's address to its network, or hashes
+// it when ANONYMIZE_IPS=hash.
+func downloaderIP(ip string) string {
+	if anonymizeIPs == anonymizeHash {
+		return storedIP(ip)
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	return truncateIP(parsed)
+}
+
+// handleFileDownloads is GET /api/files/:id/downloads, the file's download
+// log, newest first, with page and per_page. It takes the file's delete
+// token (X-Delete-Token or ?token=), or comes from its owner or an admin.
+func handleFileDownloads(c *fiber.Ctx) error {
+	var fileRecord FileRecord
+	if err := findFile(c.Params("id"), &fileRecord); err != nil {
+		return apiError(c, 404, "File not found")
+	}
+	logFileID(c, fileRecord.UniqueID)
+
+	token := c.Get("X-Delete-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	if !tokenMatches(token, fileRecord.DeleteToken) && !ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+		return apiError(c, 403, "The download log takes the file's delete token or owning it")
+	}
+
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	perPage := c.QueryInt("per_page", 50)
+	if perPage < 1 || perPage > 500 {
+		perPage = 50
+	}
+
+	query := db.Model(&DownloadEvent{}).Where("file_id = ?", fileRecord.ID)
+	var total int64
+	query.Count(&total)
+	events := make([]DownloadEvent, 0)
+	query.Order("downloaded_at desc, id desc").Offset((page - 1) * perPage).Limit(perPage).Find(&events)
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"file_id":   fileRecord.UniqueID,
+		"downloads": fileRecord.Downloads,
+		"data":      events,
+		"page":      page,
+		"per_page":  perPage,
+		"total":     total,
+	})
+}
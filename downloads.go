@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Download accounting. A download is claimed with one conditional UPDATE
+// that only succeeds while the file is unexpired and under its limit, so two
+// requests racing for the last download can't both get it. A claim is
+// finished when the transfer ends. Once a transfer has got going its
+// download stays counted, complete or not, so nobody can take a file for
+// free over and over, whether all but its last byte or a range at a time:
+// only a transfer that aborted before next to nothing was sent gives its
+// download back, never one that sent all it was asked for. The last
+// transfer to finish on a file that has reached its limit removes it.
+// Nothing removes a file while a transfer of it is in flight on any
+// replica: transfers are recorded in the database and renewed while they
+// run, so one whose replica died lapses after leaseTTL.
+//
+// A counted download that broke off can be resumed: for resumeWindow after
+// it was claimed, or last broke off, the client's ranges of the file don't
+// count as downloads of their own, and a file that has reached its limit
+// is kept for them. Sending the file to its end closes the window. Clients
+// are told apart by downloaderKey, never by the network an anonymized
+// address is stored as, so nobody else behind the same NAT or in the same
+// subnet can ride on someone's download.
+
+// Transfer is a download in flight.
+type Transfer struct {
+	ID        uint      `gorm:"primaryKey"`
+	FileID    uint      `gorm:"not null;index"`
+	Client    string    `gorm:"size:64"` // the downloader's downloaderKey
+	Counted   bool      // false for a range joining another transfer
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// ResumeGrant lets a client resume a counted download of a file until
+// ExpiresAt.
+type ResumeGrant struct {
+	ID        uint      `gorm:"primaryKey"`
+	FileID    uint      `gorm:"not null;index"`
+	Client    string    `gorm:"size:64"` // the downloader's downloaderKey
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// resumeWindow is how long a client has to resume a download that broke
+// off.
+const resumeWindow = time.Hour
+
+// refundableBytes is how little of a file an aborted transfer may have sent,
+// if that's also under 1% of it, and still give its download back.
+const refundableBytes = 64 * 1024
+
+// downloadClaim is one counted download of a file, or a range joining one.
+// A nil claim is an uncounted transfer and finishing it does nothing.
+type downloadClaim struct {
+	fileRecord FileRecord
+	transfer   *transferLease
+	client     string        // the downloader's downloaderKey
+	joined     bool          // rides on another transfer's download
+	short      bool          // the range stops before the end of the file
+	event      DownloadEvent // logged once the download completes
+	once       sync.Once
+}
+
+// transferLease keeps a Transfer row alive until the transfer ends.
+type transferLease struct {
+	id   uint
+	done chan struct{}
+}
+
+// beginTransfer records a transfer of the file to client, counted as a
+// download or not.
+func beginTransfer(fileID uint, client string, counted bool) *transferLease {
+	transfer := Transfer{FileID: fileID, Client: downloaderKey(client), Counted: counted, ExpiresAt: time.Now().Add(leaseTTL)}
+	if err := db.Create(&transfer).Error; err != nil {
+		slog.Error("Failed to record transfer", "file_id", fileID, "error", err)
+		return &transferLease{}
+	}
+	lease := &transferLease{id: transfer.ID, done: make(chan struct{})}
+	go lease.renew()
+	return lease
+}
+
+func (l *transferLease) renew() {
+	ticker := time.NewTicker(leaseRenewEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			db.Model(&Transfer{}).Where("id = ?", l.id).UpdateColumn("expires_at", time.Now().Add(leaseTTL))
+		}
+	}
+}
+
+// end drops the transfer and reports whether it was the file's last one in
+// flight.
+func (l *transferLease) end(fileID uint) bool {
+	if l.id != 0 {
+		close(l.done)
+		db.Delete(&Transfer{}, l.id)
+	}
+	return !transferInFlight(fileID)
+}
+
+// claimDownload counts a download of fileRecord by ip, returning nil when it
+// has expired or has no downloads left.
+func claimDownload(fileRecord *FileRecord, ip string) *downloadClaim {
+	// Registered before the UPDATE so a transfer finishing meanwhile can't
+	// remove the file from under this one
+	transfer := beginTransfer(fileRecord.ID, ip, true)
+
+	query := db.Model(&FileRecord{}).
+		Where("id = ?", fileRecord.ID).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now())
+	if limit := fileRecord.downloadLimit(); limit > 0 {
+		query = query.Where("downloads < ?", limit)
+	}
+	result := query.UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil || result.RowsAffected == 0 {
+		transfer.end(fileRecord.ID)
+		return nil
+	}
+	fileRecord.Downloads++
+	client := downloaderKey(ip)
+	grantResume(fileRecord.ID, client)
+	return &downloadClaim{
+		fileRecord: *fileRecord,
+		transfer:   transfer,
+		client:     client,
+		event:      DownloadEvent{FileID: fileRecord.ID, Bytes: fileRecord.FileSize},
+	}
+}
+
+// stopsShort marks a claim whose range ends before the end of the file, so
+// that sending all of it doesn't complete the download.
+func (d *downloadClaim) stopsShort() {
+	if d != nil {
+		d.short = true
+	}
+}
+
+// finish ends the claim's transfer once sent of its length bytes went out.
+// A download sent to the end of the file is logged, unless it was resumed,
+// and can't be resumed again. One that stopped short stays counted and
+// resumable, unless its transfer aborted having sent next to nothing of the
+// file. A range delivered in full always stays counted, however small, so
+// fetching a file in small ranges doesn't get it for free.
+func (d *downloadClaim) finish(sent, length int64) {
+	if d == nil {
+		return
+	}
+	d.once.Do(func() {
+		switch {
+		case sent >= length && !d.short:
+			if !d.joined {
+				recordDownloadEvent(d.event)
+			}
+			dropResumeGrant(d.fileRecord.ID, d.client)
+		case d.joined:
+			// The download is the joined transfer's to count
+			grantResume(d.fileRecord.ID, d.client)
+		case sent < length && sent < refundableBytes && sent*100 < d.fileRecord.FileSize:
+			d.giveBack()
+		default:
+			grantResume(d.fileRecord.ID, d.client)
+		}
+		d.end()
+	})
+}
+
+// joinTransfer lets a later range of a file ride on a counted download the
+// same client has in flight, as download managers fetching a file in
+// parallel segments do, or may resume. It returns nil when there's none to
+// join, and the range has to count as a download of its own.
+func joinTransfer(fileRecord *FileRecord, ip string) *downloadClaim {
+	if !resumable(fileRecord.ID, ip) {
+		return nil
+	}
+	return &downloadClaim{
+		fileRecord: *fileRecord,
+		transfer:   beginTransfer(fileRecord.ID, ip, false),
+		client:     downloaderKey(ip),
+		joined:     true,
+	}
+}
+
+// refund ends the claim's transfer when it failed before anything was sent,
+// giving its download back.
+func (d *downloadClaim) refund() {
+	if d == nil {
+		return
+	}
+	d.once.Do(func() {
+		if !d.joined {
+			d.giveBack()
+		}
+		d.end()
+	})
+}
+
+func (d *downloadClaim) giveBack() {
+	db.Model(&FileRecord{}).Where("id = ? AND downloads > 0", d.fileRecord.ID).
+		UpdateColumn("downloads", gorm.Expr("downloads - 1"))
+	dropResumeGrant(d.fileRecord.ID, d.client)
+}
+
+// end drops the claim's transfer, removing the file if it was the last one
+// in flight and the file has reached its limit.
+func (d *downloadClaim) end() {
+	if d.transfer.end(d.fileRecord.ID) {
+		removeIfUsedUp(d.fileRecord.ID)
+	}
+}
+
+// finishClaims ends the claims of a zip download, claims[i] being of
+// files[i] of which sent[i] bytes went out.
+func finishClaims(claims []*downloadClaim, files []FileRecord, sent []int64) {
+	for i, claim := range claims {
+		claim.finish(sent[i], files[i].FileSize)
+	}
+}
+
+// refundClaims gives back the downloads of a zip that was never sent.
+func refundClaims(claims []*downloadClaim) {
+	for _, claim := range claims {
+		claim.refund()
+	}
+}
+
+// transferInFlight reports whether the file is being sent to anyone.
+func transferInFlight(id uint) bool {
+	var count int64
+	db.Model(&Transfer{}).Where("file_id = ? AND expires_at > ?", id, time.Now()).Count(&count)
+	return count > 0
+}
+
+// countedTransferInFlight reports whether a counted download of the file is
+// being sent to ip.
+func countedTransferInFlight(id uint, ip string) bool {
+	client := downloaderKey(ip)
+	if client == "" {
+		return false
+	}
+	var count int64
+	db.Model(&Transfer{}).
+		Where("file_id = ? AND client = ? AND counted = ? AND expires_at > ?", id, client, true, time.Now()).
+		Count(&count)
+	return count > 0
+}
+
+// grantResume opens, or restarts, client's window to resume the file's
+// download.
+func grantResume(fileID uint, client string) {
+	if client == "" {
+		return
+	}
+	expiresAt := time.Now().Add(resumeWindow)
+	result := db.Model(&ResumeGrant{}).Where("file_id = ? AND client = ?", fileID, client).
+		UpdateColumn("expires_at", expiresAt)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result = db.Create(&ResumeGrant{FileID: fileID, Client: client, ExpiresAt: expiresAt})
+	}
+	if result.Error != nil {
+		slog.Error("Failed to record resume window", "file_id", fileID, "error", result.Error)
+	}
+}
+
+// dropResumeGrant closes client's window to resume the file's download.
+func dropResumeGrant(fileID uint, client string) {
+	if client != "" {
+		db.Where("file_id = ? AND client = ?", fileID, client).Delete(&ResumeGrant{})
+	}
+}
+
+// resumable reports whether ip may fetch ranges of the file without them
+// counting: it has a counted download of it in flight or one to resume.
+func resumable(id uint, ip string) bool {
+	if countedTransferInFlight(id, ip) {
+		return true
+	}
+	client := downloaderKey(ip)
+	if client == "" {
+		return false
+	}
+	var count int64
+	db.Model(&ResumeGrant{}).Where("file_id = ? AND client = ? AND expires_at > ?", id, client, time.Now()).Count(&count)
+	return count > 0
+}
+
+// resumePending reports whether anyone may still resume a download of the
+// file.
+func resumePending(id uint) bool {
+	var count int64
+	db.Model(&ResumeGrant{}).Where("file_id = ? AND expires_at > ?", id, time.Now()).Count(&count)
+	return count > 0
+}
+
+// usedUp reports whether the file has no downloads left.
+func (f *FileRecord) usedUp() bool {
+	limit := f.downloadLimit()
+	return limit > 0 && f.Downloads >= limit
+}
+
+// usedUpMessage tells a downloader the file has no downloads left.
+func usedUpMessage(limit int) string {
+	if limit == 1 {
+		return "File has already been downloaded"
+	}
+	return fmt.Sprintf("File has reached maximum download limit (%d)", limit)
+}
+
+// pruneTransfers drops the records of transfers whose replica stopped
+// renewing them, and of resume windows that have closed.
+func pruneTransfers() {
+	db.Where("expires_at < ?", time.Now()).Delete(&Transfer{})
+	db.Where("expires_at < ?", time.Now()).Delete(&ResumeGrant{})
+}
+
+// removeIfUsedUp removes a file that has reached its download limit, once
+// nobody may resume a download of it.
+func removeIfUsedUp(id uint) {
+	if resumePending(id) {
+		return
+	}
+	var fileRecord FileRecord
+	if err := db.First(&fileRecord, id).Error; err != nil {
+		return
+	}
+	limit := fileRecord.downloadLimit()
+	if limit <= 0 || fileRecord.Downloads < limit {
+		return
+	}
+	if err := removeFile(&fileRecord, "download_limit"); errors.Is(err, gorm.ErrRecordNotFound) {
+		return // another transfer's replica got there first
+	} else if err != nil {
+		slog.Error("Failed to remove file at its download limit", "file_id", fileRecord.UniqueID, "error", err)
+		return
+	}
+	slog.Info("Removed file at its download limit", "file_id", fileRecord.UniqueID, "downloads", fileRecord.Downloads)
+	sendWebhook(nil, webhookExpired, &fileRecord, "download_limit")
+}
+
+// claimedReader finishes a claim when the response body is closed, with
+// how much of it was read.
+type claimedReader struct {
+	io.Reader
+	closer   io.Closer
+	claim    *downloadClaim
+	expected int64
+	read     int64
+}
+
+func (r *claimedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *claimedReader) Close() error {
+	r.claim.finish(r.read, r.expected)
+	return r.closer.Close()
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// newTestFile stores a file of size bytes that may be downloaded limit
+// times.
+func newTestFile(t *testing.T, size int64, limit int) *FileRecord {
+	t.Helper()
+	id := generateUniqueID()
+	fileRecord := &FileRecord{
+		UniqueID:     id,
+		OriginalName: "test.bin",
+		FilePath:     id + ".bin",
+		FileSize:     size,
+		MaxDownloads: &limit,
+	}
+	if err := fileStorage.Save(fileRecord.FilePath, strings.NewReader("test"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(fileRecord).Error; err != nil {
+		t.Fatal(err)
+	}
+	return fileRecord
+}
+
+// downloadsOf reloads the file's download count and how many complete
+// downloads were logged.
+func downloadsOf(t *testing.T, fileRecord *FileRecord) (downloads int, events int64) {
+	t.Helper()
+	var current FileRecord
+	if err := db.First(&current, fileRecord.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&DownloadEvent{}).Where("file_id = ?", fileRecord.ID).Count(&events)
+	return current.Downloads, events
+}
+
+func TestDownloadClaimFinish(t *testing.T) {
+	const length = 1 << 20
+
+	tests := []struct {
+		name          string
+		sent          int64
+		wantDownloads int
+		wantEvents    int64
+	}{
+		{"complete", length, 1, 1},
+		{"nothing sent", 0, 0, 0},
+		{"next to nothing sent", 5000, 0, 0},
+		{"over 1% sent", 20000, 1, 0},
+		{"over refundableBytes sent", refundableBytes, 1, 0},
+		{"all but the last byte", length - 1, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileRecord := newTestFile(t, length, 5)
+			claim := claimDownload(fileRecord, "203.0.113.1")
+			if claim == nil {
+				t.Fatal("claimDownload returned nil for a file with downloads left")
+			}
+			claim.finish(tt.sent, length)
+			claim.finish(length, length) // only the first finish counts
+
+			downloads, events := downloadsOf(t, fileRecord)
+			if downloads != tt.wantDownloads || events != tt.wantEvents {
+				t.Errorf("after sending %d of %d bytes: downloads = %d, events = %d; want %d, %d",
+					tt.sent, length, downloads, events, tt.wantDownloads, tt.wantEvents)
+			}
+			if transferInFlight(fileRecord.ID) {
+				t.Error("transfer still in flight after finish")
+			}
+		})
+	}
+}
+
+func TestShortRangeClaimFinish(t *testing.T) {
+	const length = 8 << 10
+
+	tests := []struct {
+		name          string
+		sent          int64
+		wantDownloads int
+	}{
+		{"aborted", length / 2, 0},
+		{"delivered", length, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileRecord := newTestFile(t, 1<<20, 5)
+			claim := claimDownload(fileRecord, "203.0.113.1")
+			if claim == nil {
+				t.Fatal("claimDownload returned nil for a file with downloads left")
+			}
+			claim.stopsShort()
+			claim.finish(tt.sent, length)
+
+			if downloads, _ := downloadsOf(t, fileRecord); downloads != tt.wantDownloads {
+				t.Errorf("after sending %d of a %d-byte range: downloads = %d, want %d",
+					tt.sent, length, downloads, tt.wantDownloads)
+			}
+		})
+	}
+}
+
+func TestDownloadClaimRefund(t *testing.T) {
+	fileRecord := newTestFile(t, 1<<20, 5)
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	if claim == nil {
+		t.Fatal("claimDownload returned nil for a file with downloads left")
+	}
+	claim.refund()
+	claim.refund()
+
+	if downloads, _ := downloadsOf(t, fileRecord); downloads != 0 {
+		t.Errorf("downloads = %d after refund, want 0", downloads)
+	}
+
+	var nilClaim *downloadClaim
+	nilClaim.refund()
+	nilClaim.finish(0, 1)
+}
+
+func TestClaimDownloadAtLimit(t *testing.T) {
+	fileRecord := newTestFile(t, 1<<20, 1)
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	if claim == nil {
+		t.Fatal("claimDownload returned nil for the first download")
+	}
+	if other := claimDownload(fileRecord, "203.0.113.2"); other != nil {
+		t.Fatal("a second download of a single-download file was claimed")
+	}
+	if !fileRecord.usedUp() {
+		t.Error("usedUp() = false once the only download is claimed")
+	}
+
+	claim.finish(fileRecord.FileSize, fileRecord.FileSize)
+	assertRemoved(t, fileRecord)
+}
+
+func TestResumeAfterBreak(t *testing.T) {
+	const length = 1 << 20
+	fileRecord := newTestFile(t, length, 1)
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	if claim == nil {
+		t.Fatal("claimDownload returned nil for the first download")
+	}
+	claim.finish(200<<10, length)
+
+	// The download stays counted, but the file is kept for its resumption
+	if downloads, _ := downloadsOf(t, fileRecord); downloads != 1 {
+		t.Errorf("downloads = %d after the transfer broke off, want 1", downloads)
+	}
+	if other := joinTransfer(fileRecord, "203.0.113.2"); other != nil {
+		t.Error("another client may resume the download")
+	}
+	resumed := joinTransfer(fileRecord, "203.0.113.1")
+	if resumed == nil {
+		t.Fatal("the client may not resume its download")
+	}
+
+	// Breaking off again keeps it resumable; getting to the end doesn't
+	resumed.finish(100<<10, length-200<<10)
+	if resumed = joinTransfer(fileRecord, "203.0.113.1"); resumed == nil {
+		t.Fatal("the client may not resume its download a second time")
+	}
+	resumed.finish(length-300<<10, length-300<<10)
+	assertRemoved(t, fileRecord)
+	var events int64
+	db.Model(&DownloadEvent{}).Where("file_id = ?", fileRecord.ID).Count(&events)
+	if events != 0 {
+		t.Errorf("a download that broke off logged %d events", events)
+	}
+}
+
+func TestResumeWindowLapses(t *testing.T) {
+	fileRecord := newTestFile(t, 1<<20, 1)
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	if claim == nil {
+		t.Fatal("claimDownload returned nil for the first download")
+	}
+	claim.finish(200<<10, fileRecord.FileSize)
+
+	cleanupExpiredFiles()
+	if err := db.First(&FileRecord{}, fileRecord.ID).Error; err != nil {
+		t.Fatalf("file removed while its download may be resumed (err %v)", err)
+	}
+
+	db.Model(&ResumeGrant{}).Where("file_id = ?", fileRecord.ID).UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+	if joined := joinTransfer(fileRecord, "203.0.113.1"); joined != nil {
+		t.Error("the client may resume its download after the window closed")
+	}
+	cleanupExpiredFiles()
+	assertRemoved(t, fileRecord)
+}
+
+func TestRangeProbeStaysCounted(t *testing.T) {
+	fileRecord := newTestFile(t, 1<<20, 1)
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	if claim == nil {
+		t.Fatal("claimDownload returned nil for the first download")
+	}
+	// Range: bytes=0-0
+	claim.stopsShort()
+	claim.finish(1, 1)
+
+	downloads, events := downloadsOf(t, fileRecord)
+	if downloads != 1 || events != 0 {
+		t.Errorf("after a one-byte probe: downloads = %d, events = %d; want 1, 0", downloads, events)
+	}
+	if other := claimDownload(fileRecord, "203.0.113.1"); other != nil {
+		t.Error("a probe gave its download back")
+	}
+}
+
+func TestSmallRangesCountOnce(t *testing.T) {
+	const length, chunk = 1 << 20, 8 << 10
+	fileRecord := newTestFile(t, length, 1)
+
+	// The whole file, 8 KiB at a time
+	for start := int64(0); start < length; start += chunk {
+		var claim *downloadClaim
+		if start > 0 {
+			claim = joinTransfer(fileRecord, "203.0.113.1")
+		} else {
+			claim = claimDownload(fileRecord, "203.0.113.1")
+		}
+		if claim == nil {
+			t.Fatalf("range at %d was refused", start)
+		}
+		if start+chunk < length {
+			claim.stopsShort()
+		}
+		claim.finish(chunk, chunk)
+		if start+chunk < length {
+			if downloads, _ := downloadsOf(t, fileRecord); downloads != 1 {
+				t.Fatalf("downloads = %d after the range at %d, want 1", downloads, start)
+			}
+		}
+	}
+	assertRemoved(t, fileRecord)
+}
+
+// assertRemoved checks the file and its blob are gone.
+func assertRemoved(t *testing.T, fileRecord *FileRecord) {
+	t.Helper()
+	if err := db.First(&FileRecord{}, fileRecord.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("file still in the database after its last download (err %v)", err)
+	}
+	if _, err := fileStorage.Stat(fileRecord.FilePath); err == nil {
+		t.Error("blob still stored after the file's last download")
+	}
+}
+
+func TestClaimDownloadRefusesExpired(t *testing.T) {
+	fileRecord := newTestFile(t, 1<<20, 5)
+	db.Model(fileRecord).UpdateColumn("expires_at", time.Now().Add(-time.Hour))
+	if claim := claimDownload(fileRecord, "203.0.113.1"); claim != nil {
+		t.Error("claimDownload claimed a download of an expired file")
+	}
+	if transferInFlight(fileRecord.ID) {
+		t.Error("refused claim left a transfer in flight")
+	}
+}
+
+func TestJoinTransfer(t *testing.T) {
+	const length = 1 << 20
+	fileRecord := newTestFile(t, length, 1)
+
+	// A range with nothing to join has to be counted on its own
+	if joined := joinTransfer(fileRecord, "203.0.113.1"); joined != nil {
+		t.Fatal("joinTransfer joined with no transfer in flight")
+	}
+
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	if claim == nil {
+		t.Fatal("claimDownload returned nil for the first download")
+	}
+
+	if other := joinTransfer(fileRecord, "203.0.113.2"); other != nil {
+		t.Error("joinTransfer joined another client's download")
+	}
+	joined := joinTransfer(fileRecord, "203.0.113.1")
+	if joined == nil {
+		t.Fatal("joinTransfer didn't join the client's own download")
+	}
+	if !countedTransferInFlight(fileRecord.ID, "203.0.113.1") {
+		t.Error("countedTransferInFlight = false during the download")
+	}
+
+	// The joined range ends first; it neither counts nor removes the file
+	joined.finish(length/2, length/2)
+	downloads, events := downloadsOf(t, fileRecord)
+	if downloads != 1 || events != 0 {
+		t.Errorf("after the joined range: downloads = %d, events = %d; want 1, 0", downloads, events)
+	}
+
+	claim.finish(length, length)
+	assertRemoved(t, fileRecord)
+	if joined := joinTransfer(fileRecord, "203.0.113.1"); joined != nil {
+		t.Error("joinTransfer joined a download that had finished")
+	}
+}
+
+func TestJoinedRefundKeepsDownload(t *testing.T) {
+	fileRecord := newTestFile(t, 1<<20, 5)
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	joined := joinTransfer(fileRecord, "203.0.113.1")
+	if claim == nil || joined == nil {
+		t.Fatal("claimDownload or joinTransfer returned nil")
+	}
+
+	joined.refund()
+	if downloads, _ := downloadsOf(t, fileRecord); downloads != 1 {
+		t.Errorf("downloads = %d after refunding a joined range, want 1", downloads)
+	}
+	claim.finish(fileRecord.FileSize, fileRecord.FileSize)
+}
+
+func TestUsedUp(t *testing.T) {
+	limit := func(n int) *int { return &n }
+
+	tests := []struct {
+		name         string
+		maxDownloads *int
+		downloads    int
+		want         bool
+	}{
+		{"unlimited", limit(0), 100, false},
+		{"under the limit", limit(3), 2, false},
+		{"at the limit", limit(3), 3, true},
+		{"over the limit", limit(3), 4, true},
+		{"single download taken", limit(1), 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileRecord := FileRecord{MaxDownloads: tt.maxDownloads, Downloads: tt.downloads}
+			if got := fileRecord.usedUp(); got != tt.want {
+				t.Errorf("usedUp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeNeedsSameAddress(t *testing.T) {
+	anonymizeIPs, ipHashSecret = anonymizeTruncate, []byte("test secret")
+	defer func() { anonymizeIPs, ipHashSecret = anonymizeOff, nil }()
+
+	const length = 1 << 20
+	fileRecord := newTestFile(t, length, 1)
+	claim := claimDownload(fileRecord, "203.0.113.1")
+	if claim == nil {
+		t.Fatal("claimDownload returned nil for the first download")
+	}
+
+	// 203.0.113.2 is stored as the same network, but is someone else
+	if storedIP("203.0.113.2") != storedIP("203.0.113.1") {
+		t.Fatal("the addresses aren't stored alike")
+	}
+	if other := joinTransfer(fileRecord, "203.0.113.2"); other != nil {
+		t.Error("another client on the same network joined the download in flight")
+	}
+	claim.finish(200<<10, length)
+	if resumable(fileRecord.ID, "203.0.113.2") {
+		t.Error("another client on the same network may resume the download")
+	}
+	if !resumable(fileRecord.ID, "203.0.113.1") {
+		t.Error("the client may not resume its download")
+	}
+}
+
+func TestHeadAcceptsPreviewToken(t *testing.T) {
+	fileRecord := newTestFile(t, 4, 0)
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(fileRecord).Update("password_hash", hash)
+
+	app := fiber.New()
+	app.Head("/d/:filename", handleFileHead)
+	head := func(query string) int {
+		resp, err := app.Test(httptest.NewRequest("HEAD", "/d/"+fileRecord.UniqueID+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := head(""); status != 401 {
+		t.Errorf("HEAD without the password: got %d, want 401", status)
+	}
+	// A media link's token unlocks the file for GET, so for HEAD too
+	expires := time.Now().Add(time.Hour).Unix()
+	if status := head(fmt.Sprintf("?expires=%d&token=%s", expires, previewToken(fileRecord.UniqueID, expires))); status != 200 {
+		t.Errorf("HEAD with a preview token: got %d, want 200", status)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Encryption at rest. When ENCRYPTION_KEY is set, uploads are written to disk
+// as a sequence of AES-256-GCM sealed segments of encSegmentSize plaintext
+// bytes each. Segment i is sealed with the nonce
+//
+//	prefix (7 bytes) || i (4 bytes, big endian) || final flag (1 byte)
+//
+// where the prefix is random per file and stored in FileRecord. The counter
+// and final flag stop segments from being reordered, dropped or truncated,
+// and fixed-size segments keep downloads seekable for Range requests.
+
+const (
+	encSegmentSize = 64 * 1024
+	encNoncePrefix = 7
+	encTagSize     = 16
+)
+
+var encryptionAEAD cipher.AEAD
+
+// loadEncryptionConfig reads ENCRYPTION_KEY: 32 bytes, hex or base64 encoded.
+func loadEncryptionConfig() {
+	keyStr := strings.TrimSpace(getEnv("ENCRYPTION_KEY", ""))
+	if keyStr == "" {
+		encryptionAEAD = nil
+		return
+	}
+
+	key, err := hex.DecodeString(keyStr)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(keyStr)
+	}
+	if err != nil || len(key) != 32 {
+		log.Fatal("ENCRYPTION_KEY must be 32 bytes, hex or base64 encoded (e.g. `openssl rand -hex 32`)")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatal("Failed to initialise encryption: ", err)
+	}
+	encryptionAEAD, err = cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal("Failed to initialise encryption: ", err)
+	}
+	log.Printf("Encryption at rest enabled (AES-256-GCM)")
+}
+
+// newEncryptionNonce returns a fresh hex-encoded per-file nonce prefix, or an
+// empty string when encryption is disabled.
+func newEncryptionNonce() string {
+	if encryptionAEAD == nil {
+		return ""
+	}
+	prefix := make([]byte, encNoncePrefix)
+	rand.Read(prefix)
+	return hex.EncodeToString(prefix)
+}
+
+func segmentNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, encNoncePrefix+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encNoncePrefix:], index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptedSize returns the on-disk size of a plaintext of the given size.
+func encryptedSize(size int64) int64 {
+	segments := (size + encSegmentSize - 1) / encSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return size + segments*encTagSize
+}
+
+// encryptWriter seals everything written to it onto w. Close must be called
+// to write the final segment.
+type encryptWriter struct {
+	w      io.Writer
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+func newEncryptWriter(w io.Writer, nonceHex string) (*encryptWriter, error) {
+	prefix, err := hex.DecodeString(nonceHex)
+	if err != nil || len(prefix) != encNoncePrefix {
+		return nil, errors.New("invalid encryption nonce")
+	}
+	return &encryptWriter{w: w, prefix: prefix, buf: make([]byte, 0, encSegmentSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so the last
+		// segment can always be marked final on Close
+		if len(e.buf) == encSegmentSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush(final bool) error {
+	sealed := encryptionAEAD.Seal(nil, segmentNonce(e.prefix, e.index, final), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+// decryptReader is a seekable plaintext view of an encrypted blob.
+type decryptReader struct {
+	src     io.ReadSeekCloser
+	prefix  []byte
+	size    int64 // plaintext size
+	offset  int64
+	segment int64 // index of the segment held in plain, -1 if none
+	plain   []byte
+	sealed  []byte
+}
+
+func newDecryptReader(src io.ReadSeekCloser, nonceHex string, size int64) (*decryptReader, error) {
+	if encryptionAEAD == nil {
+		return nil, errors.New("file is encrypted but ENCRYPTION_KEY is not set")
+	}
+	prefix, err := hex.DecodeString(nonceHex)
+	if err != nil || len(prefix) != encNoncePrefix {
+		return nil, errors.New("invalid encryption nonce")
+	}
+	return &decryptReader{
+		src:     src,
+		prefix:  prefix,
+		size:    size,
+		segment: -1,
+		sealed:  make([]byte, encSegmentSize+encTagSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	index := d.offset / encSegmentSize
+	if index != d.segment {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain[d.offset-index*encSegmentSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+// load reads and opens segment index.
+func (d *decryptReader) load(index int64) error {
+	lastIndex := (d.size - 1) / encSegmentSize
+	plainLen := int64(encSegmentSize)
+	if index == lastIndex {
+		plainLen = d.size - index*encSegmentSize
+	}
+
+	if _, err := d.src.Seek(index*(encSegmentSize+encTagSize), io.SeekStart); err != nil {
+		return err
+	}
+	sealed := d.sealed[:plainLen+encTagSize]
+	if _, err := io.ReadFull(d.src, sealed); err != nil {
+		return fmt.Errorf("reading encrypted segment %d: %w", index, err)
+	}
+
+	plain, err := encryptionAEAD.Open(d.plain[:0], segmentNonce(d.prefix, uint32(index), index == lastIndex), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("decrypting segment %d: %w", index, err)
+	}
+	d.plain = plain
+	d.segment = index
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = d.offset + offset
+	case io.SeekEnd:
+		target = d.size + offset
+	default:
+		return 0, errors.New("decrypt seek: invalid whence")
+	}
+	if target < 0 {
+		return 0, errors.New("decrypt seek: negative position")
+	}
+	d.offset = target
+	return target, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+// openFileRecord opens the plaintext contents of a stored file, decrypting
+// and decompressing them as needed.
+func openFileRecord(fileRecord *FileRecord) (io.ReadSeekCloser, error) {
+	reader, err := openStoredFile(fileRecord)
+	if err != nil || fileRecord.Compression == "" {
+		return reader, err
+	}
+	return &decompressReader{src: reader, encoding: fileRecord.Compression, size: fileRecord.FileSize}, nil
+}
+
+// openStoredFile opens a stored file as it was written, decrypted if it was
+// encrypted at rest but still compressed if it was compressed.
+func openStoredFile(fileRecord *FileRecord) (io.ReadSeekCloser, error) {
+	reader, err := openBlob(fileRecord.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	if fileRecord.EncryptionNonce == "" {
+		return reader, nil
+	}
+
+	size := fileRecord.FileSize
+	if fileRecord.Compression != "" {
+		size = fileRecord.CompressedSize
+	}
+	decrypted, err := newDecryptReader(reader, fileRecord.EncryptionNonce, size)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return decrypted, nil
+}
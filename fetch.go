@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Upload by URL: POST /api/fetch makes the server download a file itself, so
+// files can be mirrored between machines without passing through the client.
+// The server refuses to connect to private, loopback, link-local and
+// carrier-grade NAT addresses unless FETCH_ALLOW_PRIVATE is set, so the endpoint can't be used
+// to reach internal services.
+
+const fetchMaxRedirects = 5
+
+// fetchBlockedNets are ranges the net.IP checks miss: "this network"
+// (0.0.0.0 reaches the local host on Linux) and the carrier-grade NAT space
+// cloud providers use internally.
+var fetchBlockedNets = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+var (
+	fetchEnabled      bool
+	fetchAllowPrivate bool
+	fetchTimeout      time.Duration
+	fetchClient       *http.Client
+)
+
+// loadFetchConfig reads FETCH_ENABLED, FETCH_ALLOW_PRIVATE and FETCH_TIMEOUT.
+func loadFetchConfig() {
+	fetchEnabled = getEnv("FETCH_ENABLED", "true") == "true"
+	fetchAllowPrivate = getEnv("FETCH_ALLOW_PRIVATE", "false") == "true"
+
+	timeoutStr := getEnv("FETCH_TIMEOUT", "10m")
+	var err error
+	fetchTimeout, err = parseDuration(timeoutStr)
+	if err != nil || fetchTimeout <= 0 {
+		log.Printf("Invalid FETCH_TIMEOUT value '%s', using default 10 minutes", timeoutStr)
+		fetchTimeout = 10 * time.Minute
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: fetchDialControl}
+	fetchClient = &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			Proxy:                 nil, // a proxy would hide the address being checked
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   15 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// fetchDialControl runs once the host name is resolved, so a name that
+// resolves (or later re-resolves) to an internal address is caught too.
+func fetchDialControl(network, address string, _ syscall.RawConn) error {
+	if fetchAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+	for _, blocked := range fetchBlockedNets {
+		if blocked.Contains(ip) {
+			return fmt.Errorf("refusing to connect to %s", host)
+		}
+	}
+	return nil
+}
+
+type fetchRequest struct {
+	URL       string `json:"url"`
+	Filename  string `json:"filename"`
+	Expires   string `json:"expires"`
+	Downloads string `json:"downloads"`
+	// The release window, see availability.go
+	AvailableFrom  string `json:"available_from"`
+	AvailableUntil string `json:"available_until"`
+	Password       string `json:"password"`
+	Slug           string `json:"slug"`
+}
+
+// fetchFilename picks the name to store a fetched file under: the one asked
+// for, then the server's Content-Disposition, then the last path segment.
+func fetchFilename(requested string, resp *http.Response) string {
+	if requested != "" {
+		return sanitizeFilename(requested)
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil && params["filename"] != "" {
+			return sanitizeFilename(params["filename"])
+		}
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return sanitizeFilename(name)
+	}
+	return "download.bin"
+}
+
+func fetchError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(UploadResponse{
+		Success: false,
+		Message: message,
+	})
+}
+
+// handleFetchUpload is POST /api/fetch: {"url": "https://...", "filename",
+// "expires", "downloads", "password"}, all but url optional.
+func handleFetchUpload(c *fiber.Ctx) error {
+	if !fetchEnabled {
+		return fetchError(c, 404, "Upload by URL is disabled")
+	}
+
+	var req fetchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fetchError(c, 400, "Invalid request body")
+	}
+	source, err := url.Parse(req.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		return fetchError(c, 400, "url must be an http or https URL")
+	}
+
+	// Checked now, worked out again once the size is known
+	window, err := parseReleaseWindow(req.AvailableFrom, req.AvailableUntil)
+	if err != nil {
+		return fetchError(c, 400, err.Error())
+	}
+	expiresAt, err := window.expiry(req.Expires, 0)
+	if err != nil {
+		return fetchError(c, 400, err.Error())
+	}
+	fileMaxDownloads, err := resolveMaxDownloads(req.Downloads)
+	if err != nil {
+		return fetchError(c, 400, fmt.Sprintf("Invalid download limit '%s'", req.Downloads))
+	}
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		return fetchError(c, 400, "Invalid password")
+	}
+	if req.Slug == "" {
+		req.Slug = requestedSlug(c)
+	}
+	slug, err := resolveSlug(req.Slug)
+	if err != nil {
+		return fetchError(c, slugStatus(err), slugErrorMessage(req.Slug, err))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", source.String(), nil)
+	if err != nil {
+		return fetchError(c, 400, "Invalid url")
+	}
+	httpReq.Header.Set("User-Agent", "bashupload")
+	resp, err := fetchClient.Do(httpReq)
+	if err != nil {
+		requestLog(c).Warn("Remote fetch failed", "url", source.Redacted(), "error", err)
+		return fetchError(c, 502, fmt.Sprintf("Failed to fetch %s", source.Redacted()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fetchError(c, 502, fmt.Sprintf("Remote server answered %s", resp.Status))
+	}
+
+	// Refuse what's known to be too big before reading any of it
+	if resp.ContentLength > maxUpload {
+		return fetchError(c, 413, fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)))
+	}
+	if quotaErr := checkUploadQuota(c.IP(), max(resp.ContentLength, 0)); quotaErr != nil {
+		return fetchError(c, quotaErr.status, quotaErr.message)
+	}
+	ticket, refusal := admitUpload(max(resp.ContentLength, 0))
+	if refusal != nil {
+		setUploadRetryAfter(c, refusal)
+		return fetchError(c, refusal.status, refusal.message)
+	}
+	defer ticket.release()
+
+	filename := fetchFilename(req.Filename, resp)
+	declaredType := resp.Header.Get("Content-Type")
+	if err := checkFileType(filename, declaredType); err != nil {
+		return fetchError(c, 415, err.Error())
+	}
+
+	uniqueID := newFileID()
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+	storageKey := newStorageKey(ext)
+
+	// Stream into staging, stopping one byte past the limit so a server
+	// that lied about (or omitted) the length is caught
+	stagedPath := newStagingPath()
+	staged, err := saveStream(stagedPath, io.LimitReader(resp.Body, maxUpload+1))
+	if err != nil {
+		os.Remove(stagedPath)
+		requestLog(c).Warn("Remote fetch failed", "url", source.Redacted(), "error", err)
+		return fetchError(c, 502, fmt.Sprintf("Failed to fetch %s", source.Redacted()))
+	}
+	if staged.Size > maxUpload {
+		os.Remove(stagedPath)
+		return fetchError(c, 413, fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)))
+	}
+
+	// Apply the type policy to what was actually received as well
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return fetchError(c, 415, err.Error())
+	}
+
+	// Without a Content-Length the storage quota can only be checked now
+	if resp.ContentLength <= 0 {
+		if quotaErr := checkUploadQuota(c.IP(), staged.Size); quotaErr != nil {
+			os.Remove(stagedPath)
+			return fetchError(c, quotaErr.status, quotaErr.message)
+		}
+	}
+	// The retention tier of the actual size may end before the release
+	// window opens
+	if expiresAt, err = window.expiry(req.Expires, staged.Size); err != nil {
+		os.Remove(stagedPath)
+		return fetchError(c, 400, err.Error())
+	}
+
+	storageKey, nonce, err := storeBlob(storageKey, staged)
+	if err != nil {
+		log.Printf("Failed to store %s: %v", storageKey, err)
+		return fetchError(c, 500, "Failed to save file")
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+
+	fileRecord := FileRecord{
+		UniqueID:         uniqueID,
+		OriginalName:     filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         staged.Size,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: declaredType,
+		Extension:        ext,
+		MaxDownloads:     fileMaxDownloads,
+		PasswordHash:     passwordHash,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        storedIP(c.IP()),
+		UserID:           currentUserID(c),
+		APIKeyID:         currentAPIKeyID(c),
+		Slug:             slug,
+		ExpiresAt:        expiresAt,
+		AvailableFrom:    window.from,
+	}
+
+	if err := createFileRecord(db, &fileRecord); err != nil {
+		// Clean up file if database save fails
+		releaseBlob(storageKey)
+		if isSlugConflict(err, &fileRecord) {
+			return fetchError(c, 409, slugErrorMessage(req.Slug, errSlugTaken))
+		}
+		return fetchError(c, 500, "Failed to save file metadata")
+	}
+	queueScan(fileRecord)
+	logUpload(c, &fileRecord)
+	requestLog(c).Info("Fetched remote file", "file_id", fileRecord.UniqueID, "url", source.Redacted())
+	sendWebhook(c, webhookUploaded, &fileRecord, "")
+
+	return c.JSON(UploadResponse{
+		Success:       true,
+		Message:       "File fetched successfully",
+		UniqueID:      fileRecord.UniqueID,
+		DownloadURL:   signLink(getBaseURL(c)+fileRecord.downloadPath(), &fileRecord),
+		FileSize:      staged.Size,
+		ExpiresAt:     expiresAt,
+		AvailableFrom: window.from,
+		DeleteToken:   deleteToken,
+		ViewURL:       viewURL(getBaseURL(c), &fileRecord),
+		SHA256:        staged.Digest.SHA256,
+		MD5:           staged.Digest.MD5,
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestFetchDialControl(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"100.63.255.255:80", true},
+		{"100.128.0.0:80", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.0.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"0.1.2.3:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"[::ffff:100.64.0.1]:80", false},
+		{"[::ffff:0.0.0.1]:80", false},
+	}
+	for _, tt := range tests {
+		err := fetchDialControl("tcp", tt.address, nil)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("fetchDialControl(%s): allowed = %v, want %v (%v)", tt.address, allowed, tt.allowed, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// Upload policy by file type. Extensions and MIME types can each be limited
+// to an allow list and/or excluded with a deny list; the deny lists win.
+// MIME entries may end in "/*" to match a whole family such as "image/*".
+
+var (
+	allowedExtensions []string
+	blockedExtensions []string
+	allowedMimeTypes  []string
+	blockedMimeTypes  []string
+)
+
+// loadFileTypeConfig reads ALLOWED_EXTENSIONS, BLOCKED_EXTENSIONS,
+// ALLOWED_MIME_TYPES and BLOCKED_MIME_TYPES (comma-separated lists).
+func loadFileTypeConfig() {
+	allowedExtensions = normalizeExtensions(splitList(getEnv("ALLOWED_EXTENSIONS", "")))
+	blockedExtensions = normalizeExtensions(splitList(getEnv("BLOCKED_EXTENSIONS", "")))
+	allowedMimeTypes = normalizeMimeTypes(splitList(getEnv("ALLOWED_MIME_TYPES", "")))
+	blockedMimeTypes = normalizeMimeTypes(splitList(getEnv("BLOCKED_MIME_TYPES", "")))
+
+	if len(allowedExtensions) > 0 {
+		log.Printf("Allowed extensions: %s", strings.Join(allowedExtensions, ", "))
+	}
+	if len(blockedExtensions) > 0 {
+		log.Printf("Blocked extensions: %s", strings.Join(blockedExtensions, ", "))
+	}
+	if len(allowedMimeTypes) > 0 {
+		log.Printf("Allowed MIME types: %s", strings.Join(allowedMimeTypes, ", "))
+	}
+	if len(blockedMimeTypes) > 0 {
+		log.Printf("Blocked MIME types: %s", strings.Join(blockedMimeTypes, ", "))
+	}
+}
+
+// normalizeExtensions lowercases entries and adds the leading dot, so "EXE",
+// "exe" and ".exe" are the same.
+func normalizeExtensions(entries []string) []string {
+	for i, entry := range entries {
+		entry = strings.ToLower(entry)
+		if !strings.HasPrefix(entry, ".") {
+			entry = "." + entry
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+func normalizeMimeTypes(entries []string) []string {
+	for i, entry := range entries {
+		entries[i] = strings.ToLower(entry)
+	}
+	return entries
+}
+
+// fileTypeError is returned when an upload breaks the file type policy. Its
+// message explains the policy and is meant for the client.
+type fileTypeError struct {
+	message string
+}
+
+func (e *fileTypeError) Error() string {
+	return e.message
+}
+
+// checkFileType applies the upload policy to a file name and declared MIME
+// type, before any data is received.
+func checkFileType(filename, mimeType string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		ext = ".bin" // Stored as .bin, so judged as one
+	}
+
+	if containsString(blockedExtensions, ext) {
+		return &fileTypeError{fmt.Sprintf("Files with extension %s are not allowed on this server", ext)}
+	}
+	if len(allowedExtensions) > 0 && !containsString(allowedExtensions, ext) {
+		return &fileTypeError{fmt.Sprintf("Files with extension %s are not allowed on this server. Allowed extensions: %s",
+			ext, strings.Join(allowedExtensions, ", "))}
+	}
+	if mimeType == "" {
+		return nil // Judged by the detected type once received
+	}
+	return checkMimeType(mimeType)
+}
+
+// checkMimeType applies the MIME type policy. Uploads are checked against
+// both the declared type and the type detected from their contents, so a
+// misleading Content-Type doesn't get a file past the lists.
+func checkMimeType(mimeType string) error {
+	mediaType := "application/octet-stream"
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mediaType = parsed
+	}
+
+	if matchesMimeType(blockedMimeTypes, mediaType) {
+		return &fileTypeError{fmt.Sprintf("Files of type %s are not allowed on this server", mediaType)}
+	}
+	if len(allowedMimeTypes) > 0 && !matchesMimeType(allowedMimeTypes, mediaType) {
+		return &fileTypeError{fmt.Sprintf("Files of type %s are not allowed on this server. Allowed types: %s",
+			mediaType, strings.Join(allowedMimeTypes, ", "))}
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesMimeType reports whether mediaType is in patterns, honouring
+// "type/*" wildcards.
+func matchesMimeType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if pattern == mediaType || pattern == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
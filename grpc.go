@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"bashupload/filespb"
+)
+
+// gRPC API for programmatic integrations, served on GRPC_PORT when it's set
+// (see filespb/files.proto). Uploads and downloads are streamed in chunks
+// under gRPC's flow control and go through the same checks, storage and
+// database as over HTTP. The API key comes in the x-api-key metadata, and is
+// checked as on the HTTP API: only with REQUIRE_API_KEY, except that files
+// are always attributed to it.
+
+var grpcPort string
+
+// grpcChunkSize is how much of a file each Download message carries.
+const grpcChunkSize = 64 * 1024
+
+// grpcScopes is the scope each method needs with REQUIRE_API_KEY, as the
+// HTTP routes they mirror. Downloads need none.
+var grpcScopes = map[string]string{
+	"Upload":  scopeUpload,
+	"GetInfo": scopeRead,
+	"Delete":  scopeUpload,
+}
+
+// loadGRPCConfig reads GRPC_PORT.
+func loadGRPCConfig() {
+	grpcPort = getEnv("GRPC_PORT", "")
+}
+
+// serveGRPC serves the gRPC API until the process exits, over TLS when
+// TLS_CERT and TLS_KEY are set.
+func serveGRPC() {
+	if grpcPort == "" {
+		return
+	}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	}
+	if tlsCertFile != "" {
+		creds, err := grpccredentials.NewServerTLSFromFile(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate for gRPC: %v", err)
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(options...)
+	filespb.RegisterFilesServer(server, &filesServer{})
+
+	listener, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC on port %s: %v", grpcPort, err)
+	}
+	log.Printf("gRPC API on port %s", grpcPort)
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("gRPC server failed: %v", err)
+	}
+}
+
+// grpcCaller is who made a call: where from and with which API key, if any.
+type grpcCaller struct {
+	ip        string
+	local     net.Addr // address the client connected to
+	key       *APIKey
+	userAgent string
+}
+
+type grpcCallerKey struct{}
+
+func callerFrom(ctx context.Context) *grpcCaller {
+	caller, _ := ctx.Value(grpcCallerKey{}).(*grpcCaller)
+	return caller
+}
+
+// apiKeyID is the issued key to record on a new upload, as currentAPIKeyID.
+func (c *grpcCaller) apiKeyID() *uint {
+	if c.key != nil && c.key != &legacyAPIKey {
+		return &c.key.ID
+	}
+	return nil
+}
+
+// audit records event for the caller, as audit does for HTTP requests.
+func (c *grpcCaller) audit(event, fileID, detail string) {
+	auditAs(keyActor(c.key), c.ip, event, fileID, detail)
+}
+
+// owns reports whether the file was uploaded with the caller's key.
+func (c *grpcCaller) owns(fileRecord *FileRecord) bool {
+	keyID := c.apiKeyID()
+	return keyID != nil && fileRecord.APIKeyID != nil && *keyID == *fileRecord.APIKeyID
+}
+
+// grpcAuthorize identifies the caller of method, refusing banned addresses
+// and, with REQUIRE_API_KEY, calls without a key with the right scope.
+func grpcAuthorize(ctx context.Context, method string) (context.Context, error) {
+	caller := &grpcCaller{}
+	if p, ok := peer.FromContext(ctx); ok {
+		caller.ip = addrIP(p.Addr)
+		caller.local = p.LocalAddr
+	}
+	if isBanned(caller.ip) {
+		return nil, status.Error(codes.PermissionDenied, "Access denied: your IP address has been banned")
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if agents := md.Get("user-agent"); len(agents) > 0 {
+			caller.userAgent = agents[0]
+		}
+		if keys := md.Get("x-api-key"); len(keys) > 0 {
+			if caller.key = lookupAPIKey(keys[0]); caller.key == nil {
+				caller.audit(auditAuthFailure, "", "invalid API key over gRPC")
+			}
+		}
+	}
+
+	if scope := grpcScopes[path.Base(method)]; apiKeyRequired && scope != "" {
+		if caller.key == nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid or missing API key")
+		}
+		if !caller.key.hasScope(scope) {
+			caller.audit(auditAuthFailure, "", "API key lacks the "+scope+" scope")
+			return nil, status.Errorf(codes.PermissionDenied, "API key lacks the '%s' scope", scope)
+		}
+	}
+	return context.WithValue(ctx, grpcCallerKey{}, caller), nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuthorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthorize(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authorizedStream carries the caller in its context.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context { return s.ctx }
+
+type filesServer struct {
+	filespb.UnimplementedFilesServer
+}
+
+// fileInfo describes a file. Its link isn't signed: only the uploader gets
+// a signed one.
+func (c *grpcCaller) fileInfo(fileRecord *FileRecord) *filespb.FileInfo {
+	info := &filespb.FileInfo{
+		Id:                fileRecord.UniqueID,
+		Filename:          fileRecord.OriginalName,
+		Size:              fileRecord.FileSize,
+		MimeType:          fileRecord.MimeType,
+		Sha256:            fileRecord.SHA256,
+		Md5:               fileRecord.MD5,
+		DownloadUrl:       localBaseURL(c.local) + fileRecord.downloadPath(),
+		UploadedAt:        timestamppb.New(fileRecord.UploadedAt),
+		Downloads:         int32(fileRecord.Downloads),
+		MaxDownloads:      int32(fileRecord.downloadLimit()),
+		PasswordProtected: fileRecord.PasswordHash != "",
+		ScanStatus:        fileRecord.ScanStatus,
+	}
+	if fileRecord.ExpiresAt != nil {
+		info.ExpiresAt = timestamppb.New(*fileRecord.ExpiresAt)
+	}
+	return info
+}
+
+// Upload stores a file sent as a metadata message followed by its contents.
+func (s *filesServer) Upload(stream filespb.Files_UploadServer) error {
+	caller := callerFrom(stream.Context())
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "No file was sent")
+	}
+	if err != nil {
+		return err
+	}
+	meta := first.GetMetadata()
+	if meta == nil {
+		return status.Error(codes.InvalidArgument, "The first message must carry the file's metadata")
+	}
+
+	filename := meta.Filename
+	if filename == "" {
+		filename = "upload.bin"
+	}
+	filename = sanitizeFilename(filename)
+	if err := checkFileType(filename, meta.ContentType); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if meta.Size > maxUpload {
+		return status.Errorf(codes.InvalidArgument, "File too large. Maximum size is %s", formatBytes(maxUpload))
+	}
+	if quotaErr := checkUploadQuota(caller.ip, meta.Size); quotaErr != nil {
+		return status.Error(codes.ResourceExhausted, quotaErr.message)
+	}
+	ticket, refusal := admitUpload(meta.Size)
+	if refusal != nil {
+		if refusal.status == 503 {
+			return status.Error(codes.Unavailable, refusal.message)
+		}
+		return status.Error(codes.ResourceExhausted, refusal.message)
+	}
+	defer ticket.release()
+	expiresAt, err := resolveExpiry(meta.Expires, meta.Size)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid expiration '%s'", meta.Expires)
+	}
+	fileMaxDownloads, err := resolveMaxDownloads(meta.MaxDownloads)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid download limit '%s'", meta.MaxDownloads)
+	}
+	passwordHash, err := hashPassword(meta.Password)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "Invalid password")
+	}
+
+	stagedPath := newStagingPath()
+	staged, err := saveStream(stagedPath, uploadThrottle().reader(&grpcUploadReader{stream: stream}))
+	if err != nil {
+		os.Remove(stagedPath)
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, "Failed to save file")
+	}
+	if meta.Sha256 != "" && !strings.EqualFold(meta.Sha256, staged.Digest.SHA256) {
+		os.Remove(stagedPath)
+		return status.Errorf(codes.DataLoss, "Checksum mismatch: received data has SHA-256 %s", staged.Digest.SHA256)
+	}
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if meta.Size == 0 {
+		if quotaErr := checkUploadQuota(caller.ip, staged.Size); quotaErr != nil {
+			os.Remove(stagedPath)
+			return status.Error(codes.ResourceExhausted, quotaErr.message)
+		}
+		// Now the size is known, for its retention tier (already validated)
+		expiresAt, _ = resolveExpiry(meta.Expires, staged.Size)
+	}
+
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+	storageKey, nonce, err := storeBlob(newStorageKey(ext), staged)
+	if err != nil {
+		slog.Error("Failed to store gRPC upload", "key", storageKey, "error", err)
+		return status.Error(codes.Internal, "Failed to save file")
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+	fileRecord := FileRecord{
+		UniqueID:         newFileID(),
+		OriginalName:     filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         staged.Size,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: meta.ContentType,
+		Extension:        ext,
+		MaxDownloads:     fileMaxDownloads,
+		PasswordHash:     passwordHash,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        storedIP(caller.ip),
+		APIKeyID:         caller.apiKeyID(),
+		ExpiresAt:        expiresAt,
+	}
+	if err := createFileRecord(db, &fileRecord); err != nil {
+		releaseBlob(storageKey)
+		return status.Error(codes.Internal, "Failed to save file metadata")
+	}
+	queueScan(fileRecord)
+	recordUploadUsage(&fileRecord)
+	slog.Info("File uploaded over gRPC",
+		"file_id", fileRecord.UniqueID,
+		"name", fileRecord.OriginalName,
+		"size", fileRecord.FileSize,
+		"ip", storedIP(caller.ip))
+	caller.audit(auditUpload, fileRecord.UniqueID, fmt.Sprintf("%d bytes over gRPC", fileRecord.FileSize))
+	sendWebhook(nil, webhookUploaded, &fileRecord, "")
+
+	info := caller.fileInfo(&fileRecord)
+	info.DownloadUrl = signLink(info.DownloadUrl, &fileRecord)
+	return stream.SendAndClose(&filespb.UploadResponse{File: info, DeleteToken: deleteToken})
+}
+
+// grpcUploadReader reads the contents of an upload from its chunk messages,
+// failing once there's more than MAX_UPLOAD_SIZE of it.
+type grpcUploadReader struct {
+	stream filespb.Files_UploadServer
+	chunk  []byte
+	read   int64
+}
+
+func (r *grpcUploadReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if msg.GetMetadata() != nil {
+			return 0, status.Error(codes.InvalidArgument, "Metadata may only be sent in the first message")
+		}
+		r.chunk = msg.GetChunk()
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.read += int64(n)
+	if r.read > maxUpload {
+		return n, status.Errorf(codes.InvalidArgument, "File too large. Maximum size is %s", formatBytes(maxUpload))
+	}
+	return n, nil
+}
+
+// Download streams a file from req.Offset on, after a message with its info.
+func (s *filesServer) Download(req *filespb.DownloadRequest, stream filespb.Files_DownloadServer) error {
+	caller := callerFrom(stream.Context())
+	fileRecord, err := caller.lookupDownload(req)
+	if err != nil {
+		return err
+	}
+	if req.Offset < 0 || (req.Offset > 0 && req.Offset >= fileRecord.FileSize) {
+		return status.Errorf(codes.OutOfRange, "Offset %d is outside the file's %d bytes", req.Offset, fileRecord.FileSize)
+	}
+
+	// As over HTTP, a later offset joins a download the caller has in
+	// flight or may resume, or counts as one of its own
+	var claim *downloadClaim
+	if req.Offset > 0 {
+		claim = joinTransfer(fileRecord, caller.ip)
+	}
+	countsAsDownload := claim == nil
+	if countsAsDownload {
+		if claim = claimDownload(fileRecord, caller.ip); claim == nil {
+			if !transferInFlight(fileRecord.ID) {
+				removeIfUsedUp(fileRecord.ID)
+			}
+			return status.Error(codes.FailedPrecondition, usedUpMessage(fileRecord.downloadLimit()))
+		}
+		claim.by(caller.ip, caller.userAgent)
+		slog.Info("File downloaded", "file_id", fileRecord.UniqueID, "downloads", fileRecord.Downloads)
+		caller.audit(auditDownload, fileRecord.UniqueID, "over gRPC")
+		sendWebhook(nil, webhookDownloaded, fileRecord, "")
+	}
+	length := fileRecord.FileSize - req.Offset
+	recordDownloadUsage(fileRecord, length, countsAsDownload)
+
+	reader, err := openFileRecord(fileRecord)
+	if err != nil {
+		claim.refund()
+		slog.Error("Failed to open file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return status.Error(codes.Internal, "Failed to open file")
+	}
+	defer reader.Close()
+	if _, err := reader.Seek(req.Offset, io.SeekStart); err != nil {
+		claim.refund()
+		return status.Error(codes.Internal, "Failed to open file")
+	}
+
+	var sent int64
+	defer func() { claim.finish(sent, length) }()
+	if err := stream.Send(&filespb.DownloadResponse{Data: &filespb.DownloadResponse_Info{Info: caller.fileInfo(fileRecord)}}); err != nil {
+		return err
+	}
+	body := downloadThrottle().reader(io.LimitReader(reader, length))
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&filespb.DownloadResponse{Data: &filespb.DownloadResponse_Chunk{Chunk: buf[:n]}}); err != nil {
+				return err
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Error(codes.Internal, "Failed to read file")
+		}
+	}
+}
+
+// lookupDownload finds a file to download and checks it may be served, as
+// lookupDownload and admitDownload do for HTTP.
+func (c *grpcCaller) lookupDownload(req *filespb.DownloadRequest) (*FileRecord, error) {
+	var fileRecord FileRecord
+	if err := findFile(req.Id, &fileRecord); err != nil {
+		return nil, status.Error(codes.NotFound, "File not found")
+	}
+
+	if signedURLsRequired && !linkSignatureValid(&fileRecord, req.Exp, req.Sig) && !c.owns(&fileRecord) {
+		if req.Sig != "" {
+			return nil, status.Error(codes.PermissionDenied, "This link has expired or its signature is invalid")
+		}
+		return nil, status.Error(codes.PermissionDenied, "This link must be signed")
+	}
+
+	if fileRecord.ExpiresAt != nil && time.Now().After(*fileRecord.ExpiresAt) {
+		if !transferInFlight(fileRecord.ID) && removeFile(&fileRecord, "expired") == nil {
+			slog.Info("Removed expired file", "file_id", fileRecord.UniqueID, "name", fileRecord.OriginalName)
+			sendWebhook(nil, webhookExpired, &fileRecord, "expired")
+		}
+		return nil, status.Error(codes.NotFound, "File has expired")
+	}
+	if fileRecord.usedUp() && !resumable(fileRecord.ID, c.ip) {
+		return nil, status.Error(codes.FailedPrecondition, usedUpMessage(fileRecord.downloadLimit()))
+	}
+	if _, err := statBlob(fileRecord.FilePath); err != nil {
+		return nil, status.Error(codes.NotFound, "File not found on disk")
+	}
+
+	switch fileRecord.ScanStatus {
+	case scanInfected:
+		return nil, status.Error(codes.PermissionDenied, "File blocked: malware detected")
+	case scanPending:
+		return nil, status.Error(codes.Unavailable, "File is still being scanned for malware, try again shortly")
+	}
+	if fileRecord.Moderation == moderationHeld {
+		return nil, status.Error(codes.FailedPrecondition, "File is awaiting review by an admin")
+	}
+	if fileRecord.unreleased() {
+		return nil, status.Error(codes.FailedPrecondition,
+			fmt.Sprintf("File is not available until %s", fileRecord.AvailableFrom.UTC().Format(time.RFC3339)))
+	}
+
+	if fileRecord.PasswordHash != "" {
+		if req.Password == "" {
+			return nil, status.Error(codes.Unauthenticated, "Password required")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(fileRecord.PasswordHash), []byte(req.Password)) != nil {
+			c.audit(auditAuthFailure, fileRecord.UniqueID, "file password")
+			return nil, status.Error(codes.Unauthenticated, "Wrong password")
+		}
+	}
+	return &fileRecord, nil
+}
+
+// GetInfo describes a file, as GET /api/files/:id.
+func (s *filesServer) GetInfo(ctx context.Context, req *filespb.GetInfoRequest) (*filespb.FileInfo, error) {
+	var fileRecord FileRecord
+	if err := findFile(req.Id, &fileRecord); err != nil {
+		return nil, status.Error(codes.NotFound, "File not found")
+	}
+	return callerFrom(ctx).fileInfo(&fileRecord), nil
+}
+
+// Delete removes a file given its deletion token.
+func (s *filesServer) Delete(ctx context.Context, req *filespb.DeleteRequest) (*filespb.DeleteResponse, error) {
+	var fileRecord FileRecord
+	if err := findFile(req.Id, &fileRecord); err != nil {
+		return nil, status.Error(codes.NotFound, "File not found")
+	}
+	if req.DeleteToken == "" {
+		return nil, status.Error(codes.Unauthenticated, "Deletion token required")
+	}
+	if !tokenMatches(req.DeleteToken, fileRecord.DeleteToken) {
+		callerFrom(ctx).audit(auditAuthFailure, fileRecord.UniqueID, "deletion token")
+		return nil, status.Error(codes.PermissionDenied, "Invalid deletion token")
+	}
+
+	if err := removeFile(&fileRecord, "uploader"); err != nil {
+		slog.Error("Failed to delete file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return nil, status.Error(codes.Internal, "Failed to delete file")
+	}
+	slog.Info("File deleted by uploader", "file_id", fileRecord.UniqueID)
+	callerFrom(ctx).audit(auditDelete, fileRecord.UniqueID, "uploader")
+	sendWebhook(nil, webhookDeleted, &fileRecord, "uploader")
+	return &filespb.DeleteResponse{}, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Health probes for orchestrators and load balancers. /healthz is the
+// liveness probe and only checks that the process can reach its database;
+// /readyz also checks that uploads can be written and disk space remains, so
+// a full or read-only instance is taken out of rotation without a restart.
+
+var minFreeDisk int64
+
+// healthCheck is the result of one probe check.
+type healthCheck struct {
+	Status  string `json:"status"` // "ok" or "fail"
+	Message string `json:"message,omitempty"`
+}
+
+func loadHealthConfig() {
+	minFreeStr := getEnv("MIN_FREE_DISK_SPACE", "1GB")
+	var err error
+	minFreeDisk, err = parseSize(minFreeStr)
+	if err != nil || minFreeDisk < 0 {
+		log.Printf("Invalid MIN_FREE_DISK_SPACE value '%s', using default 1GB", minFreeStr)
+		minFreeDisk = 1024 * 1024 * 1024
+	}
+}
+
+func setupHealthRoutes(app *fiber.App) {
+	app.Get("/healthz", handleHealthz)
+	app.Get("/readyz", handleReadyz)
+}
+
+func handleHealthz(c *fiber.Ctx) error {
+	return healthResponse(c, map[string]healthCheck{
+		"database": checkDatabase(),
+	})
+}
+
+func handleReadyz(c *fiber.Ctx) error {
+	return healthResponse(c, map[string]healthCheck{
+		"database":    checkDatabase(),
+		"uploads_dir": checkUploadsWritable(),
+		"disk_space":  checkDiskSpace(),
+	})
+}
+
+// healthResponse answers 200 when every check passed and 503 otherwise.
+func healthResponse(c *fiber.Ctx, checks map[string]healthCheck) error {
+	status, code := "ok", 200
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status, code = "fail", 503
+		}
+	}
+	c.Set("Cache-Control", "no-store")
+	return c.Status(code).JSON(fiber.Map{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+func checkDatabase() healthCheck {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return healthCheck{Status: "fail", Message: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return healthCheck{Status: "fail", Message: err.Error()}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+// checkUploadsWritable creates and removes a file in the staging area, where
+// every upload is first written.
+func checkUploadsWritable() healthCheck {
+	f, err := os.CreateTemp(stagingDir(), "healthcheck-*")
+	if err != nil {
+		return healthCheck{Status: "fail", Message: err.Error()}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return healthCheck{Status: "ok"}
+}
+
+func checkDiskSpace() healthCheck {
+	free, err := freeDiskSpace(uploadDir)
+	if err != nil {
+		// Not supported on this platform; don't fail the probe over it
+		return healthCheck{Status: "ok", Message: err.Error()}
+	}
+	message := fmt.Sprintf("%s free", formatBytes(free))
+	if free < minFreeDisk {
+		return healthCheck{Status: "fail", Message: fmt.Sprintf("%s, below the %s minimum", message, formatBytes(minFreeDisk))}
+	}
+	return healthCheck{Status: "ok", Message: message}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Public IDs of files and bundles, the part of a link after /d/ or /b/.
+// ID_ALPHABET and ID_LENGTH trade short, friendly links for long, unguessable
+// ones. Short IDs can collide, so a new ID is checked against existing files
+// and slugs, and an insert that still loses a race retries with a fresh one.
+// Storage keys and tokens stay 32 random hex characters whatever the setting.
+
+const idMaxAttempts = 10
+
+var idAlphabets = map[string]string{
+	"hex":    "0123456789abcdef",
+	"base36": "0123456789abcdefghijklmnopqrstuvwxyz",
+	"base58": "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz",
+	"base62": "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+}
+
+var (
+	idAlphabet = idAlphabets["hex"]
+	idLength   = 32
+)
+
+// loadIDConfig reads ID_ALPHABET (hex, base36, base58, base62 or the
+// characters to use) and ID_LENGTH.
+func loadIDConfig() {
+	alphabetStr := getEnv("ID_ALPHABET", "hex")
+	if preset, ok := idAlphabets[strings.ToLower(alphabetStr)]; ok {
+		idAlphabet = preset
+	} else if validIDAlphabet(alphabetStr) {
+		idAlphabet = alphabetStr
+	} else {
+		log.Printf("Invalid ID_ALPHABET value '%s', using default hex", alphabetStr)
+		idAlphabet = idAlphabets["hex"]
+	}
+
+	lengthStr := getEnv("ID_LENGTH", "32")
+	var err error
+	idLength, err = strconv.Atoi(lengthStr)
+	if err != nil || idLength < 4 || idLength > 64 {
+		log.Printf("Invalid ID_LENGTH value '%s', using default 32", lengthStr)
+		idLength = 32
+	}
+
+	bits := float64(idLength) * math.Log2(float64(len(idAlphabet)))
+	if bits < 64 {
+		log.Printf("File IDs are %d characters from a %d-character alphabet (%.0f bits): links can be guessed, don't rely on them staying private",
+			idLength, len(idAlphabet), bits)
+	}
+}
+
+// validIDAlphabet reports whether a custom alphabet is at least two distinct
+// characters that are safe in a URL path and can't be taken for an extension.
+func validIDAlphabet(alphabet string) bool {
+	if len(alphabet) < 2 {
+		return false
+	}
+	seen := make(map[rune]bool)
+	for _, r := range alphabet {
+		if seen[r] || !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+		seen[r] = true
+	}
+	return true
+}
+
+// randomID returns idLength characters drawn uniformly from idAlphabet.
+func randomID() string {
+	max := big.NewInt(int64(len(idAlphabet)))
+	id := make([]byte, idLength)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		id[i] = idAlphabet[n.Int64()]
+	}
+	return string(id)
+}
+
+// newFileID returns an ID no file uses as its ID or slug yet.
+func newFileID() string {
+	var id string
+	for attempt := 0; attempt < idMaxAttempts; attempt++ {
+		id = randomID()
+		var taken int64
+		// Files in the trash still hold their ID
+		db.Unscoped().Model(&FileRecord{}).Where("unique_id = ? OR slug = ?", id, strings.ToLower(id)).Count(&taken)
+		if taken == 0 {
+			return id
+		}
+	}
+	log.Printf("No free file ID after %d attempts; consider a longer ID_LENGTH", idMaxAttempts)
+	return id
+}
+
+// newBundleID returns an ID no bundle uses yet.
+func newBundleID() string {
+	var id string
+	for attempt := 0; attempt < idMaxAttempts; attempt++ {
+		id = randomID()
+		var taken int64
+		db.Model(&Bundle{}).Where("bundle_id = ?", id).Count(&taken)
+		if taken == 0 {
+			return id
+		}
+	}
+	return id
+}
+
+// newStorageKey names a new blob. It is independent of the file's public
+// ID, which may be short enough to collide.
+func newStorageKey(ext string) string {
+	return generateUniqueID() + ext
+}
+
+// isIDConflict reports whether err is the unique index on unique_id refusing
+// an insert.
+func isIDConflict(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "unique_id") &&
+		(strings.Contains(message, "unique") || strings.Contains(message, "duplicate"))
+}
+
+// createFileRecord inserts fileRecord, picking a new ID and trying again if
+// another upload took the same one in the meantime. Each attempt runs in its
+// own (nested) transaction so a failed insert doesn't abort tx.
+func createFileRecord(tx *gorm.DB, fileRecord *FileRecord) error {
+	if fileRecord.ViewToken == nil {
+		token := generateUniqueID()
+		fileRecord.ViewToken = &token
+	}
+	var err error
+	for attempt := 0; attempt < idMaxAttempts; attempt++ {
+		err = tx.Transaction(func(tx *gorm.DB) error {
+			return tx.Create(fileRecord).Error
+		})
+		if err == nil || !isIDConflict(err) {
+			return err
+		}
+		fileRecord.ID = 0
+		fileRecord.UniqueID = newFileID()
+	}
+	return err
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Image transforms on download links: /d/:id?w=800&h=600&format=webp&q=80
+// sends an image upload scaled down to fit the box and re-encoded, so
+// screenshots can be embedded at a sensible size straight from their link.
+// A transformed download is still a download: it needs the password and
+// counts against the limit. Results are cached on local disk under
+// IMAGE_CACHE_DIR per blob and parameters, so they go when the blob does,
+// and the least recently used are dropped once the cache outgrows
+// IMAGE_CACHE_SIZE. Files encrypted at rest are transformed on each request
+// instead of being cached in the clear.
+
+const (
+	imageTransformMaxDimension     = 4096
+	imageTransformDefaultQuality   = 80
+	imageTransformCacheTrimPercent = 90
+)
+
+var (
+	imageTransformsEnabled bool
+	imageCacheDir          string
+	imageCacheSize         int64 // 0 turns the cache off
+
+	imageCacheMu       sync.Mutex
+	imageCacheUsed     int64 // bytes cached, as of the last trim plus what was added since
+	imageCacheTrimming bool
+)
+
+// loadImageTransformConfig reads IMAGE_TRANSFORMS_ENABLED, IMAGE_CACHE_DIR
+// and IMAGE_CACHE_SIZE. It runs after initStorage, which sets uploadDir.
+func loadImageTransformConfig() {
+	imageTransformsEnabled = getEnv("IMAGE_TRANSFORMS_ENABLED", "true") == "true"
+	if !imageTransformsEnabled {
+		return
+	}
+	imageCacheDir = getEnv("IMAGE_CACHE_DIR", filepath.Join(uploadDir, ".transforms"))
+	sizeStr := getEnv("IMAGE_CACHE_SIZE", "1GB")
+	var err error
+	imageCacheSize, err = parseSize(sizeStr)
+	if err != nil || imageCacheSize < 0 {
+		log.Printf("Invalid IMAGE_CACHE_SIZE value '%s', using default 1GB", sizeStr)
+		imageCacheSize = 1024 * 1024 * 1024
+	}
+	if imageCacheSize == 0 {
+		log.Printf("Image transforms enabled, without a cache")
+		return
+	}
+	log.Printf("Image transforms enabled, caching up to %s in %s", formatBytes(imageCacheSize), imageCacheDir)
+	// Measure what earlier runs left behind
+	imageCacheMu.Lock()
+	imageCacheTrimming = true
+	imageCacheMu.Unlock()
+	go trimImageCache()
+}
+
+// imageTransform is the scaling and encoding a download asks for.
+type imageTransform struct {
+	width   int    // 0 when unconstrained
+	height  int    // 0 when unconstrained
+	format  string // jpeg, png or webp
+	quality int    // JPEG quality; 0 for the lossless formats
+}
+
+// parseImageTransform reads the transform a download of fileRecord asks for
+// through w, h, format and q, or returns nil when it asks for none. Without
+// format, JPEG and WebP images keep their format and others become PNG.
+func parseImageTransform(c *fiber.Ctx, fileRecord *FileRecord) (*imageTransform, error) {
+	if c.Query("w") == "" && c.Query("h") == "" && c.Query("format") == "" && c.Query("q") == "" {
+		return nil, nil
+	}
+
+	t := &imageTransform{quality: imageTransformDefaultQuality}
+	for _, param := range []struct {
+		name string
+		dest *int
+	}{{"w", &t.width}, {"h", &t.height}} {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > imageTransformMaxDimension {
+			return nil, fmt.Errorf("%s must be between 1 and %d", param.name, imageTransformMaxDimension)
+		}
+		*param.dest = n
+	}
+	if value := c.Query("q"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("q must be between 1 and 100")
+		}
+		t.quality = n
+	}
+
+	switch format := strings.ToLower(c.Query("format")); format {
+	case "jpeg", "jpg":
+		t.format = "jpeg"
+	case "png", "webp":
+		t.format = format
+	case "":
+		switch strings.TrimSpace(strings.SplitN(fileRecord.MimeType, ";", 2)[0]) {
+		case "image/jpeg":
+			t.format = "jpeg"
+		case "image/webp":
+			t.format = "webp"
+		default:
+			t.format = "png"
+		}
+	default:
+		return nil, fmt.Errorf("invalid format '%s', use jpeg, png or webp", format)
+	}
+	if t.format != "jpeg" {
+		// PNG and WebP are written losslessly, with nothing for q to set
+		if c.Query("q") != "" {
+			return nil, fmt.Errorf("q only applies to JPEG output; %s is lossless", strings.ToUpper(t.format))
+		}
+		t.quality = 0
+	}
+	return t, nil
+}
+
+// variant names the result of the transform, as a cache file and in ETags.
+func (t *imageTransform) variant() string {
+	return fmt.Sprintf("w%d-h%d-q%d.%s", t.width, t.height, t.quality, t.format)
+}
+
+func (t *imageTransform) contentType() string {
+	return "image/" + t.format
+}
+
+func (t *imageTransform) extension() string {
+	if t.format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + t.format
+}
+
+// etag tags the transformed image apart from the original.
+func (t *imageTransform) etag(fileRecord *FileRecord) string {
+	return strings.TrimSuffix(downloadETag(fileRecord, ""), `"`) + "-" + t.variant() + `"`
+}
+
+// apply decodes the image fileRecord holds and returns it transformed.
+func (t *imageTransform) apply(fileRecord *FileRecord) ([]byte, error) {
+	reader, err := openFileRecord(fileRecord)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+
+	img, err := decodeImage(reader)
+	if err != nil {
+		return nil, err
+	}
+	scaled := fitImage(img, t.width, t.height)
+
+	var out bytes.Buffer
+	switch t.format {
+	case "jpeg":
+		// JPEG has no transparency; flatten onto white
+		if !scaled.Opaque() {
+			flat := image.NewRGBA(scaled.Bounds())
+			draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+			draw.Draw(flat, flat.Bounds(), scaled, image.Point{}, draw.Over)
+			scaled = flat
+		}
+		err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: t.quality})
+	case "png":
+		err = png.Encode(&out, scaled)
+	case "webp":
+		err = encodeWebP(&out, scaled)
+	}
+	return out.Bytes(), err
+}
+
+// serveImageTransform answers a download of fileRecord that asks for a
+// transform with the transformed image.
+func serveImageTransform(c *fiber.Ctx, fileRecord *FileRecord, t *imageTransform) error {
+	if !thumbnailable(fileRecord) {
+		return c.Status(415).SendString("Only images can be transformed")
+	}
+	etag := t.etag(fileRecord)
+	if notModified(c, fileRecord, etag) {
+		setCacheHeaders(c, fileRecord)
+		c.Set("ETag", etag)
+		return c.SendStatus(304)
+	}
+
+	// Ranges are of the original; a transformed image is always sent whole
+	ok, claim, err := admitDownload(c, fileRecord, true)
+	if !ok {
+		return err
+	}
+
+	cachePath := ""
+	if imageCacheSize > 0 && fileRecord.EncryptionNonce == "" {
+		cachePath = filepath.Join(imageCacheDir, filepath.FromSlash(fileRecord.FilePath), t.variant())
+	}
+	var data []byte
+	if cachePath != "" {
+		if cached, err := os.ReadFile(cachePath); err == nil {
+			data = cached
+			// Keep recently used results from being trimmed
+			now := time.Now()
+			os.Chtimes(cachePath, now, now)
+		}
+	}
+	if data == nil {
+		data, err = t.apply(fileRecord)
+		if err != nil {
+			claim.refund()
+			requestLog(c).Warn("Failed to transform image", "file_id", fileRecord.UniqueID, "error", err)
+			return c.Status(415).SendString("Could not transform this image")
+		}
+		if cachePath != "" {
+			cacheImageTransform(cachePath, data)
+		}
+	}
+	claim.serving(int64(len(data)))
+	recordDownloadUsage(fileRecord, int64(len(data)), true)
+
+	name := strings.TrimSuffix(fileRecord.OriginalName, filepath.Ext(fileRecord.OriginalName)) + t.extension()
+	c.Set("Content-Type", t.contentType())
+	c.Set("Content-Disposition", contentDisposition("inline", name))
+	c.Set("X-Content-Type-Options", "nosniff")
+	setCacheHeaders(c, fileRecord)
+	c.Set("ETag", etag)
+	if err = c.Send(data); err != nil {
+		claim.refund()
+		return err
+	}
+	claim.finish(int64(len(data)), int64(len(data)))
+	return nil
+}
+
+// cacheImageTransform stores a transformed image at path, trimming the
+// cache in the background once it's over IMAGE_CACHE_SIZE.
+func cacheImageTransform(path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("Failed to cache transformed image %s: %v", path, err)
+		return
+	}
+	// Write aside and rename, so readers never see half a file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		log.Printf("Failed to cache transformed image %s: %v", path, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Printf("Failed to cache transformed image %s: %v", path, err)
+		return
+	}
+
+	imageCacheMu.Lock()
+	imageCacheUsed += int64(len(data))
+	trim := imageCacheUsed > imageCacheSize && !imageCacheTrimming
+	if trim {
+		imageCacheTrimming = true
+	}
+	imageCacheMu.Unlock()
+	if trim {
+		go trimImageCache()
+	}
+}
+
+// trimImageCache measures the transform cache and, when it's over
+// IMAGE_CACHE_SIZE, removes the least recently used results until it's
+// back under 90% of it.
+func trimImageCache() {
+	defer func() {
+		imageCacheMu.Lock()
+		imageCacheTrimming = false
+		imageCacheMu.Unlock()
+	}()
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	filepath.WalkDir(imageCacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	removed := 0
+	if total > imageCacheSize {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+		target := imageCacheSize * imageTransformCacheTrimPercent / 100
+		for _, e := range entries {
+			if total <= target {
+				break
+			}
+			if err := os.Remove(e.path); err != nil {
+				continue
+			}
+			// Drop the blob's directory once its last result goes
+			os.Remove(filepath.Dir(e.path))
+			total -= e.size
+			removed++
+		}
+		log.Printf("Trimmed %d transformed images from the image cache", removed)
+	}
+
+	imageCacheMu.Lock()
+	imageCacheUsed = total
+	imageCacheMu.Unlock()
+}
+
+// deleteImageTransforms removes the cached transforms of the blob under key.
+func deleteImageTransforms(key string) {
+	if imageCacheDir == "" || key == "" {
+		return
+	}
+	os.RemoveAll(filepath.Join(imageCacheDir, filepath.FromSlash(key)))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Listening without a TCP port, for shared hosts where nginx or caddy sits
+// in front. LISTEN=unix:/run/bashupload.sock serves on a Unix socket created
+// with LISTEN_SOCKET_MODE (0660 by default) and, when LISTEN_SOCKET_GROUP is
+// set, owned by that group so the proxy's user can connect. Under systemd
+// socket activation (LISTEN_PID and LISTEN_FDS in the environment) the
+// socket systemd passes in is served instead, whatever it is bound to.
+// Otherwise the server listens on PORT as usual.
+//
+// Connections over a Unix socket have no client address: they appear as
+// 0.0.0.0, which TRUSTED_PROXIES must list for forwarded headers to be used.
+
+// systemdFirstFD is the first descriptor passed by socket activation
+const systemdFirstFD = 3
+
+var (
+	listenSocketPath  string
+	listenSocketMode  os.FileMode
+	listenSocketGroup int
+	// The socket passed by systemd; nil when not socket activated
+	activatedListener net.Listener
+)
+
+// loadListenConfig reads LISTEN, LISTEN_SOCKET_MODE and LISTEN_SOCKET_GROUP,
+// and takes over a socket passed by systemd. It runs after loadHTTPConfig.
+func loadListenConfig() {
+	listenAddr := getEnv("LISTEN", "")
+	switch {
+	case listenAddr == "" || listenAddr == "systemd":
+		ln, err := systemdListener()
+		if err != nil {
+			log.Fatalf("Socket activation failed: %v", err)
+		}
+		if ln == nil && listenAddr == "systemd" {
+			log.Fatal("LISTEN=systemd but no socket was passed by systemd (LISTEN_FDS)")
+		}
+		activatedListener = ln
+	case strings.HasPrefix(listenAddr, "unix:"):
+		listenSocketPath = strings.TrimPrefix(listenAddr, "unix:")
+		if listenSocketPath == "" {
+			log.Fatal("LISTEN=unix: needs a socket path, e.g. unix:/run/bashupload.sock")
+		}
+	default:
+		log.Fatalf("Unknown LISTEN value '%s' (expected unix:/path/to/socket or systemd)", listenAddr)
+	}
+	if listenSocketPath == "" && activatedListener == nil {
+		return
+	}
+	if prefork {
+		log.Fatal("PREFORK needs its own TCP port; it can't serve a Unix or systemd socket")
+	}
+
+	modeStr := getEnv("LISTEN_SOCKET_MODE", "0660")
+	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	if err != nil || mode > 0777 {
+		log.Printf("Invalid LISTEN_SOCKET_MODE value '%s', using default 0660", modeStr)
+		mode = 0660
+	}
+	listenSocketMode = os.FileMode(mode)
+
+	listenSocketGroup = -1
+	if group := getEnv("LISTEN_SOCKET_GROUP", ""); group != "" {
+		gid, err := lookupGroup(group)
+		if err != nil {
+			log.Fatalf("Invalid LISTEN_SOCKET_GROUP: %v", err)
+		}
+		listenSocketGroup = gid
+	}
+}
+
+// listenDescription is where the server listens, for the startup log.
+func listenDescription(port string) string {
+	switch {
+	case activatedListener != nil:
+		return fmt.Sprintf("socket %s (systemd)", activatedListener.Addr())
+	case listenSocketPath != "":
+		return "socket " + listenSocketPath
+	default:
+		return "port " + port
+	}
+}
+
+// customListener reports whether the server listens anywhere but PORT.
+func customListener() bool {
+	return activatedListener != nil || listenSocketPath != ""
+}
+
+// openListener opens the listener the server is configured for: the socket
+// from systemd, the Unix socket or PORT.
+func openListener(port string) (net.Listener, error) {
+	if activatedListener != nil {
+		return activatedListener, nil
+	}
+	if listenSocketPath != "" {
+		return listenUnix(listenSocketPath)
+	}
+	return net.Listen("tcp", ":"+port)
+}
+
+// listenUnix creates the Unix socket at path, replacing one left behind by
+// an earlier run, with the configured mode and group.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// A live server still answers on it; a stale socket refuses
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, listenSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if listenSocketGroup >= 0 {
+		if err := os.Chown(path, -1, listenSocketGroup); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// systemdListener takes over the first socket passed by systemd socket
+// activation, or returns nil when the process wasn't socket activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		log.Printf("systemd passed %d sockets; serving the first only", fds)
+	}
+
+	// As sd_listen_fds(3) does, so nothing started later takes the
+	// sockets for its own
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(systemdFirstFD, "systemd-socket")
+	ln, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("descriptor %d is not a listening socket: %w", systemdFirstFD, err)
+	}
+	return ln, nil
+}
+
+// lookupGroup resolves a group name or numeric ID.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		var unknown user.UnknownGroupError
+		if errors.As(err, &unknown) {
+			return 0, fmt.Errorf("no group named '%s'", group)
+		}
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// File listings shared by GET /api/files, /api/my/files and the admin API.
+// Each starts from a query already narrowed to the files the caller may see
+// and adds the filters, sorting and paging from the query string.
+
+var fileSortColumns = []string{"uploaded_at", "file_size", "downloads", "expires_at", "original_name"}
+
+// fileListEntry is a file in a listing.
+type fileListEntry struct {
+	FileRecord
+	DownloadURL  string `json:"download_url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"` // for images
+}
+
+// parseListTime reads a date (2024-05-01) or RFC 3339 timestamp.
+func parseListTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// filterFiles applies the listing filters: name (substring, any case),
+// mime_type (image/png or image/*), min_size/max_size (e.g. 10MB),
+// older_than/newer_than (e.g. 2D), uploaded_after/uploaded_before and
+// expires_after/expires_before (dates or RFC 3339),
+// min_downloads/max_downloads, and tag and meta.<name> (see tags.go).
+func filterFiles(c *fiber.Ctx, query *gorm.DB) (*gorm.DB, error) {
+	if name := c.Query("name"); name != "" {
+		pattern := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(name))
+		query = query.Where("LOWER(original_name) LIKE ? ESCAPE '!'", "%"+pattern+"%")
+	}
+	if mimeType := strings.ToLower(c.Query("mime_type")); mimeType != "" {
+		if prefix, ok := strings.CutSuffix(mimeType, "/*"); ok {
+			query = query.Where("mime_type LIKE ?", prefix+"/%")
+		} else {
+			// Detected types may carry parameters, e.g. text/plain; charset=utf-8
+			query = query.Where("mime_type = ? OR mime_type LIKE ?", mimeType, mimeType+";%")
+		}
+	}
+	for _, filter := range []struct{ param, clause string }{
+		{"min_size", "file_size >= ?"},
+		{"max_size", "file_size <= ?"},
+	} {
+		if value := c.Query(filter.param); value != "" {
+			size, err := parseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s '%s'", filter.param, value)
+			}
+			query = query.Where(filter.clause, size)
+		}
+	}
+	for _, filter := range []struct{ param, clause string }{
+		{"older_than", "uploaded_at < ?"},
+		{"newer_than", "uploaded_at > ?"},
+	} {
+		if value := c.Query(filter.param); value != "" {
+			age, err := parseDuration(value)
+			if err != nil || age <= 0 {
+				return nil, fmt.Errorf("Invalid %s '%s'", filter.param, value)
+			}
+			query = query.Where(filter.clause, time.Now().Add(-age))
+		}
+	}
+	for _, filter := range []struct{ param, clause string }{
+		{"uploaded_after", "uploaded_at >= ?"},
+		{"uploaded_before", "uploaded_at < ?"},
+		{"expires_after", "expires_at >= ?"},
+		{"expires_before", "expires_at < ?"},
+	} {
+		if value := c.Query(filter.param); value != "" {
+			t, err := parseListTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s '%s' (expected YYYY-MM-DD or RFC 3339)", filter.param, value)
+			}
+			query = query.Where(filter.clause, t)
+		}
+	}
+	for _, filter := range []struct{ param, clause string }{
+		{"min_downloads", "downloads >= ?"},
+		{"max_downloads", "downloads <= ?"},
+	} {
+		if value := c.Query(filter.param); value != "" {
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("Invalid %s '%s'", filter.param, value)
+			}
+			query = query.Where(filter.clause, count)
+		}
+	}
+	return filterFileLabels(c, query), nil
+}
+
+// listFiles answers a listing of the files in query, newest first by
+// default. Paging: page, per_page (up to maxPerPage). Sorting: sort
+// (uploaded_at, file_size, downloads, expires_at, original_name) and order
+// (asc, desc).
+func listFiles(c *fiber.Ctx, query *gorm.DB, maxPerPage int) error {
+	query, err := filterFiles(c, query)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+
+	var total int64
+	query.Count(&total)
+
+	sort := c.Query("sort", "uploaded_at")
+	if !containsString(fileSortColumns, sort) {
+		return c.Status(400).JSON(fiber.Map{"success": false, "message": fmt.Sprintf("Invalid sort '%s'", sort)})
+	}
+	order := "desc"
+	if strings.EqualFold(c.Query("order"), "asc") {
+		order = "asc"
+	}
+
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	perPage := c.QueryInt("per_page", 50)
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = 50
+	}
+
+	var records []FileRecord
+	query.Order(sort + " " + order).Offset((page - 1) * perPage).Limit(perPage).Find(&records)
+	attachFileLabels(records)
+
+	baseURL := getBaseURL(c)
+	files := make([]fileListEntry, 0, len(records))
+	for _, rec := range records {
+		entry := fileListEntry{
+			FileRecord:  rec,
+			DownloadURL: signLink(baseURL+rec.downloadPath(), &rec),
+		}
+		if thumbnailsEnabled && thumbnailable(&rec) {
+			entry.ThumbnailURL = signLink(fmt.Sprintf("%s/t/%s", baseURL, rec.UniqueID), &rec)
+		}
+		files = append(files, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"data":     files,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// handleListFiles is GET /api/files. Admins and the static API_KEY see every
+// file; issued keys and signed-in users see the files they uploaded.
+func handleListFiles(c *fiber.Ctx) error {
+	query := db.Model(&FileRecord{})
+
+	key := requestAPIKey(c)
+	user := currentUser(c)
+	switch {
+	case hasValidAdminKey(c), key == &legacyAPIKey:
+	case key != nil && user != nil:
+		query = query.Where("api_key_id = ? OR user_id = ?", key.ID, user.ID)
+	case key != nil:
+		query = query.Where("api_key_id = ?", key.ID)
+	case user != nil:
+		query = query.Where("user_id = ?", user.ID)
+	default:
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Listing files requires an API key or signing in",
+		})
+	}
+
+	return listFiles(c, query, 500)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// Structured logging. Every log line, including the standard log package's,
+// goes through slog in the format picked by LOG_FORMAT. Each request carries
+// an X-Request-ID, taken from the client or a proxy when it sends one, which
+// is echoed in the response and attached to that request's log lines.
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+var logJSON bool // LOG_FORMAT=json
+
+// loadLogConfig reads LOG_FORMAT (text or json) and LOG_LEVEL (debug, info,
+// warn or error) and installs the matching default logger. It runs first so
+// the rest of the startup output uses it.
+func loadLogConfig() {
+	var level slog.Level
+	levelStr := getEnv("LOG_LEVEL", "info")
+	levelErr := level.UnmarshalText([]byte(levelStr))
+	if levelErr != nil {
+		level = slog.LevelInfo
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	formatStr := strings.ToLower(getEnv("LOG_FORMAT", "text"))
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	logJSON = formatStr == "json"
+	if logJSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if levelErr != nil {
+		log.Printf("Invalid LOG_LEVEL value '%s', using default info", levelStr)
+	}
+	if formatStr != "json" && formatStr != "text" {
+		log.Printf("Invalid LOG_FORMAT value '%s', using default text", formatStr)
+	}
+}
+
+// requestIDMiddleware assigns the request its ID. A client-supplied ID is
+// kept so a request can be followed across proxies, unless it is too long or
+// not printable ASCII, in which case a fresh one is generated.
+func requestIDMiddleware(c *fiber.Ctx) error {
+	id := c.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = utils.UUIDv4()
+	}
+	c.Set(requestIDHeader, id)
+	c.Locals("request_id", id)
+	return c.Next()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLog returns the logger for lines about the current request.
+func requestLog(c *fiber.Ctx) *slog.Logger {
+	id, _ := c.Locals("request_id").(string)
+	return slog.Default().With("request_id", id)
+}
+
+// logFileID records which file the request is about, for the access log.
+func logFileID(c *fiber.Ctx, uniqueID string) {
+	c.Locals("file_id", uniqueID)
+}
+
+// accessLog writes one line per request once it has been answered. Server
+// errors are logged at error level and client errors at warn level.
+func accessLog(c *fiber.Ctx) error {
+	start := time.Now()
+
+	// Let the error handler write the response first, so the logged
+	// status is the one the client gets
+	if err := c.Next(); err != nil {
+		if err := c.App().ErrorHandler(c, err); err != nil {
+			_ = c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+
+	status := c.Response().StatusCode()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+
+	attrs := []any{
+		"method", c.Method(),
+		"path", c.Path(),
+		"status", status,
+		"duration_ms", time.Since(start).Milliseconds(),
+		"ip", storedIP(c.IP()),
+	}
+	if fileID, ok := c.Locals("file_id").(string); ok {
+		attrs = append(attrs, "file_id", fileID)
+	}
+	requestLog(c).Log(c.Context(), level, "request", attrs...)
+	return nil
+}
+
+// logUpload records a stored upload and tags the request with its file ID.
+func logUpload(c *fiber.Ctx, fileRecord *FileRecord) {
+	recordUploadUsage(fileRecord)
+	logFileID(c, fileRecord.UniqueID)
+	requestLog(c).Info("File uploaded",
+		"file_id", fileRecord.UniqueID,
+		"name", fileRecord.OriginalName,
+		"size", fileRecord.FileSize,
+		"mime_type", fileRecord.MimeType)
+	audit(c, auditUpload, fileRecord.UniqueID, strconv.FormatInt(fileRecord.FileSize, 10)+" bytes")
+}
+
+// newGormLogger sends GORM's slow query and error reports through the
+// default logger instead of colouring them on stdout. Lookups that find
+// nothing are routine here and aren't reported.
+func newGormLogger() gormlogger.Interface {
+	level := gormlogger.Warn
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		level = gormlogger.Info // log every query
+	}
+	return gormlogger.New(log.Default(), gormlogger.Config{
+		SlowThreshold:             200 * time.Millisecond,
+		LogLevel:                  level,
+		IgnoreRecordNotFoundError: true,
+	})
+}
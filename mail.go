@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Upload notifications. With SMTP_HOST set, an upload can ask for its links
+// to be emailed with ?notify=someone@example.com (or the "notify" form
+// field). Messages are rendered from templates/notify.txt (or its
+// TEMPLATES_DIR replacement) and sent in the background, so a slow mail
+// server doesn't hold up the upload.
+
+const (
+	maxNotifyRecipients = 5
+	mailTimeout         = 30 * time.Second
+	mailQueueSize       = 256
+)
+
+var (
+	smtpHost     string
+	smtpPort     string
+	smtpUsername string
+	smtpPassword string
+	smtpFrom     *mail.Address
+
+	notifyTemplate *template.Template
+	mailQueue      chan outgoingMail
+)
+
+type outgoingMail struct {
+	to  []string
+	msg []byte
+}
+
+// notifyFile is one file in a notification, as the template sees it.
+type notifyFile struct {
+	Name      string
+	URL       string
+	Size      string
+	ExpiresAt *time.Time
+	Protected bool // the recipient needs a password from the sender
+}
+
+// loadMailConfig reads SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and
+// SMTP_FROM.
+func loadMailConfig() {
+	smtpHost = getEnv("SMTP_HOST", "")
+	if smtpHost == "" {
+		return
+	}
+	smtpPort = getEnv("SMTP_PORT", "587")
+	smtpUsername = getEnv("SMTP_USERNAME", "")
+	smtpPassword = getEnv("SMTP_PASSWORD", "")
+
+	fromStr := getEnv("SMTP_FROM", smtpUsername)
+	from, err := mail.ParseAddress(fromStr)
+	if err != nil {
+		log.Fatalf("Invalid SMTP_FROM value '%s': %v", fromStr, err)
+	}
+	smtpFrom = from
+
+	notifyTemplate, err = template.New("notify.txt").Funcs(template.FuncMap{
+		"date": func(t *time.Time) string { return t.UTC().Format("2 Jan 2006 15:04 MST") },
+	}).ParseFiles(templatePath("notify.txt"))
+	if err != nil {
+		log.Fatalf("Failed to load the notification template: %v", err)
+	}
+
+	mailQueue = make(chan outgoingMail, mailQueueSize)
+	go deliverMail()
+	log.Printf("Upload notifications enabled, sent through %s", net.JoinHostPort(smtpHost, smtpPort))
+}
+
+func mailEnabled() bool {
+	return smtpHost != ""
+}
+
+// parseNotify reads the recipients of ?notify=: up to five comma-separated
+// addresses. An empty value asks for no notification.
+func parseNotify(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	if !mailEnabled() {
+		return nil, errors.New("Email notifications are not enabled on this server")
+	}
+	var recipients []string
+	for _, part := range splitList(value) {
+		addr, err := mail.ParseAddress(part)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid notify address '%s'", part)
+		}
+		if !containsString(recipients, addr.Address) {
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	if len(recipients) > maxNotifyRecipients {
+		return nil, fmt.Errorf("At most %d notify addresses are allowed", maxNotifyRecipients)
+	}
+	return recipients, nil
+}
+
+// notifyUpload emails the links to files to recipients. urls are the
+// download links, in the order of files.
+func notifyUpload(recipients []string, baseURL string, files []*FileRecord, urls []string) {
+	if len(recipients) == 0 || len(files) == 0 {
+		return
+	}
+
+	data := struct {
+		Files    []notifyFile
+		BaseURL  string
+		Instance string
+	}{BaseURL: baseURL, Instance: brand.Name}
+	for i, file := range files {
+		data.Files = append(data.Files, notifyFile{
+			Name:      file.OriginalName,
+			URL:       urls[i],
+			Size:      formatBytes(file.FileSize),
+			ExpiresAt: file.ExpiresAt,
+			Protected: file.PasswordHash != "",
+		})
+	}
+
+	var subject, body bytes.Buffer
+	if err := notifyTemplate.ExecuteTemplate(&subject, "subject", data); err != nil {
+		log.Printf("Failed to render the notification subject: %v", err)
+		return
+	}
+	if err := notifyTemplate.ExecuteTemplate(&body, "notify.txt", data); err != nil {
+		log.Printf("Failed to render the notification: %v", err)
+		return
+	}
+
+	msg := buildMail(recipients, strings.TrimSpace(subject.String()), strings.TrimLeft(body.String(), "\n"))
+	select {
+	case mailQueue <- outgoingMail{to: recipients, msg: msg}:
+	default:
+		slog.Warn("Mail queue full, dropping notification", "file_id", files[0].UniqueID)
+	}
+}
+
+// buildMail formats a plain text message.
+func buildMail(to []string, subject, body string) []byte {
+	var msg bytes.Buffer
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := smtpFrom.Address[strings.LastIndex(smtpFrom.Address, "@")+1:]
+
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpFrom.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	return msg.Bytes()
+}
+
+func deliverMail() {
+	for outgoing := range mailQueue {
+		err := sendMail(outgoing.to, outgoing.msg)
+		if err != nil {
+			// One retry covers a dropped connection or a greylisting server
+			time.Sleep(time.Minute)
+			err = sendMail(outgoing.to, outgoing.msg)
+		}
+		if err != nil {
+			slog.Error("Failed to send upload notification", "recipients", len(outgoing.to), "error", err)
+			continue
+		}
+		slog.Info("Upload notification sent", "recipients", len(outgoing.to))
+	}
+}
+
+// sendMail delivers msg over SMTP: with TLS from the start on port 465,
+// otherwise upgrading with STARTTLS whenever the server offers it.
+func sendMail(to []string, msg []byte) error {
+	addr := net.JoinHostPort(smtpHost, smtpPort)
+	tlsConfig := &tls.Config{ServerName: smtpHost}
+	dialer := &net.Dialer{Timeout: mailTimeout}
+
+	var conn net.Conn
+	var err error
+	if smtpPort == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+
+	client, err := smtp.NewClient(conn, smtpHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if smtpPort != "465" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if smtpUsername != "" {
+		if err := client.Auth(smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(smtpFrom.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -1,47 +1,107 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/template/html/v2"
-	"gorm.io/driver/sqlite"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type FileRecord struct {
-	ID           uint       `json:"id" gorm:"primaryKey"`
-	UniqueID     string     `json:"unique_id" gorm:"unique;not null"`
-	OriginalName string     `json:"original_name" gorm:"not null"`
-	FilePath     string     `json:"file_path" gorm:"not null"`
-	FileSize     int64      `json:"file_size" gorm:"not null"`
-	MimeType     string     `json:"mime_type"`
-	Extension    string     `json:"extension"`
-	UploadedAt   time.Time  `json:"uploaded_at" gorm:"autoCreateTime"`
-	Downloads    int        `json:"downloads" gorm:"default:0"`
-	IPAddress    string     `json:"ip_address"`
-	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	UniqueID         string     `json:"unique_id" gorm:"unique;not null"`
+	OriginalName     string     `json:"original_name" gorm:"not null"`
+	FilePath         string     `json:"file_path" gorm:"not null"`
+	FileSize         int64      `json:"file_size" gorm:"not null"`
+	SHA256           string     `json:"sha256,omitempty" gorm:"index"`
+	MD5              string     `json:"md5,omitempty"`
+	IPFSCID          string     `json:"ipfs_cid,omitempty" gorm:"column:ipfs_cid"`
+	Compression      string     `json:"compression,omitempty"`
+	CompressedSize   int64      `json:"compressed_size,omitempty"`
+	MimeType         string     `json:"mime_type"`                    // detected from the contents
+	DeclaredMimeType string     `json:"declared_mime_type,omitempty"` // Content-Type sent by the client
+	Extension        string     `json:"extension"`
+	UploadedAt       time.Time  `json:"uploaded_at" gorm:"autoCreateTime;index:idx_file_records_ip_uploaded,priority:2"`
+	Downloads        int        `json:"downloads" gorm:"default:0;index"`
+	MaxDownloads     *int       `json:"max_downloads,omitempty"` // nil uses the server default
+	PasswordHash     string     `json:"-"`                       // bcrypt hash, empty when unprotected
+	DeleteToken      string     `json:"-"`                       // SHA-256 of the deletion token
+	EncryptionNonce  string     `json:"-"`                       // per-file nonce prefix when encrypted at rest
+	ScanStatus       string     `json:"scan_status,omitempty"`   // malware scan verdict, empty when scanning is off
+	ScanResult       string     `json:"scan_result,omitempty"`   // signature name or scan error
+	ScannedAt        *time.Time `json:"scanned_at,omitempty"`
+	Moderation       string     `json:"moderation,omitempty" gorm:"index"` // "held" while awaiting review, see quarantine.go
+	HoldReason       string     `json:"hold_reason,omitempty"`
+	IPAddress        string     `json:"ip_address" gorm:"index:idx_file_records_ip_uploaded,priority:1"`
+	UserID           *uint      `json:"user_id,omitempty" gorm:"index"`    // owner when uploaded while signed in
+	APIKeyID         *uint      `json:"api_key_id,omitempty" gorm:"index"` // issued key the file was uploaded with
+	PasteLanguage    string     `json:"paste_language,omitempty"`          // set for text pastes, shown at /p/:id
+	BundleID         *uint      `json:"bundle_id,omitempty" gorm:"index"`  // bundle the file is part of, see /b/:id
+	Slug             *string    `json:"slug,omitempty" gorm:"uniqueIndex"` // vanity alias for the ID, e.g. /d/my-report
+	ViewToken        *string    `json:"-" gorm:"uniqueIndex"`              // opens the view-only page at /v/:token
+	Views            int        `json:"views" gorm:"default:0"`            // times the view-only page was opened
+	ExpiresAt        *time.Time `json:"expires_at,omitempty" gorm:"index"`
+	AvailableFrom    *time.Time `json:"available_from,omitempty"` // not served before, see availability.go
+	ScrubbedAt       *time.Time `json:"scrubbed_at,omitempty"`    // when METADATA_RETENTION cleared the IP and name
+	// Kept in their own tables, see tags.go
+	Tags     []string          `json:"tags,omitempty" gorm:"-"`
+	Metadata map[string]string `json:"metadata,omitempty" gorm:"-"`
+	// Set while the file is in the trash, see trash.go
+	DeletedAt    gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
+	DeleteReason string         `json:"delete_reason,omitempty"`
+	DeletedSlug  string         `json:"deleted_slug,omitempty"` // given back on restore if still free
 }
 
 type UploadResponse struct {
-	Success     bool   `json:"success"`
-	Message     string `json:"message"`
-	UniqueID    string `json:"unique_id,omitempty"`
-	DownloadURL string `json:"download_url,omitempty"`
-	FileSize    int64  `json:"file_size,omitempty"`
+	Success     bool       `json:"success"`
+	Message     string     `json:"message"`
+	UniqueID    string     `json:"unique_id,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	FileSize    int64      `json:"file_size,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// Set when downloads only open later
+	AvailableFrom *time.Time `json:"available_from,omitempty"`
+	DeleteToken   string     `json:"delete_token,omitempty"`
+	ViewURL       string     `json:"view_url,omitempty"`
+	SHA256        string     `json:"sha256,omitempty"`
+	MD5           string     `json:"md5,omitempty"`
+	// One entry per file, in the order they were sent
+	Files []UploadResult `json:"files,omitempty"`
+}
+
+// UploadResult is one file of a multipart upload.
+type UploadResult struct {
+	Filename      string     `json:"filename"`
+	UniqueID      string     `json:"unique_id"`
+	DownloadURL   string     `json:"download_url"`
+	FileSize      int64      `json:"file_size"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	AvailableFrom *time.Time `json:"available_from,omitempty"`
+	DeleteToken   string     `json:"delete_token"`
+	ViewURL       string     `json:"view_url,omitempty"`
+	SHA256        string     `json:"sha256,omitempty"`
+	MD5           string     `json:"md5,omitempty"`
 }
 
 var (
@@ -50,18 +110,37 @@ var (
 	maxUpload      int64
 	maxDownloads   int
 	expireDuration time.Duration
+	maxExpire      time.Duration
+	publicBaseURL  string // BASE_URL, empty to derive it from each request
 )
 
 func main() {
+	// Read the config file, then set up logging before anything is logged
+	configPath := loadConfigFile()
+	loadLogConfig()
+	if configPath != "" {
+		log.Printf("Loaded configuration from %s", configPath)
+	}
+
 	// Initialize database
 	initDB()
 
-	// Get API key from environment
-	apiKey = os.Getenv("API_KEY")
-	if apiKey != "" {
-		log.Printf("API Key authentication enabled")
-	} else {
-		log.Printf("API Key authentication disabled - public access")
+	// Get API key settings from environment
+	loadAPIKeyConfig()
+	loadAccountsConfig()
+	loadCaptchaConfig()
+	loadUsageConfig()
+	loadFetchConfig()
+
+	// Get the public address used in download links
+	publicBaseURL = strings.TrimRight(getEnv("BASE_URL", ""), "/")
+	if publicBaseURL != "" {
+		if u, err := url.Parse(publicBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Printf("Invalid BASE_URL value '%s', deriving links from each request", publicBaseURL)
+			publicBaseURL = ""
+		} else {
+			log.Printf("Download links use %s", publicBaseURL)
+		}
 	}
 
 	// Get max upload size from environment (default 1GB)
@@ -72,33 +151,143 @@ func main() {
 		log.Printf("Invalid MAX_UPLOAD_SIZE value '%s', using default 1GB", maxUploadStr)
 		maxUpload = 1073741824 // 1GB
 	}
-	// Get max download count from environment (default 1)
-	maxDownloadStr := getEnv("MAX_DOWNLOADS", "1")
-	var err2 error
-	maxDownloads, err2 = strconv.Atoi(maxDownloadStr)
-	if err2 != nil || maxDownloads < 1 {
-		log.Printf("Invalid MAX_DOWNLOADS value '%s', using default 1", maxDownloadStr)
-		maxDownloads = 1
-	}
-	log.Printf("Maximum downloads per file: %d", maxDownloads)
-
-	// Get file expiration duration from environment (default 3D)
+	loadPasteConfig()
+	loadThumbnailConfig()
+	loadTorrentConfig()
+	loadIDConfig()
+	loadSignedURLConfig()
+	loadCORSConfig()
+	loadContentConfig()
+	loadCacheConfig()
+	loadThrottleConfig()
+	loadTrashConfig()
+	loadPrivacyConfig()
+	loadAuditConfig()
+	loadBrandConfig()
+	loadMailConfig()
+	loadReconcileConfig()
+	loadCleanupConfig()
+	loadBackupConfig()
+	loadPreviewConfig()
+	loadStatsConfig()
+	loadAliasConfig()
+
+	// Get file expiration duration from environment (default 3D, "never" or 0 disables expiry)
 	expireStr := getEnv("FILE_EXPIRE_AFTER", "3D")
 	var err3 error
 	expireDuration, err3 = parseDuration(expireStr)
-	if err3 != nil {
+	if err3 != nil || expireDuration < 0 {
 		log.Printf("Invalid FILE_EXPIRE_AFTER value '%s', using default 3 days", expireStr)
 		expireDuration = 72 * time.Hour // 3 days
 	}
-	log.Printf("Files expire after: %s", formatDuration(expireDuration))
+	if expireDuration == 0 {
+		log.Printf("Files never expire")
+	} else {
+		log.Printf("Files expire after: %s", formatDuration(expireDuration))
+	}
+
+	// Get the longest expiration uploaders may request (defaults to
+	// FILE_EXPIRE_AFTER, so uploads can only shorten it; "never" lifts the cap)
+	maxExpireStr := getEnv("FILE_EXPIRE_MAX", expireStr)
+	maxExpire, err3 = parseDuration(maxExpireStr)
+	if err3 != nil || maxExpire < 0 {
+		log.Printf("Invalid FILE_EXPIRE_MAX value '%s', using FILE_EXPIRE_AFTER", maxExpireStr)
+		maxExpire = expireDuration
+	}
+	if maxExpire > 0 {
+		log.Printf("Maximum requested expiration: %s", formatDuration(maxExpire))
+	}
+	loadRetentionConfig()
+
+	// Get max download count from environment (default 1, 0 means unlimited).
+	// Never-expiring files default to unlimited downloads so they persist until
+	// explicitly deleted.
+	defaultDownloads := "1"
+	if expireDuration == 0 {
+		defaultDownloads = "0"
+	}
+	maxDownloadStr := getEnv("MAX_DOWNLOADS", defaultDownloads)
+	var err2 error
+	maxDownloads, err2 = strconv.Atoi(maxDownloadStr)
+	if err2 != nil || maxDownloads < 0 {
+		log.Printf("Invalid MAX_DOWNLOADS value '%s', using default %s", maxDownloadStr, defaultDownloads)
+		maxDownloads, _ = strconv.Atoi(defaultDownloads)
+	}
+	if maxDownloads == 0 {
+		log.Printf("Maximum downloads per file: unlimited")
+	} else {
+		log.Printf("Maximum downloads per file: %d", maxDownloads)
+	}
+
+	// Optionally compute MD5 digests next to SHA-256
+	computeMD5 = getEnv("CHECKSUM_MD5", "false") == "true"
+
+	// Get encryption at rest key from environment
+	loadEncryptionConfig()
+	loadCompressionConfig()
+
+	// Get upload file type policy from environment
+	loadFileTypeConfig()
+
+	// Get rate limiting configuration from environment
+	loadRateLimitConfig()
+
+	// Get per-client upload quotas from environment
+	loadQuotaConfig()
+
+	// Get caps on uploads in flight at once
+	loadBackpressureConfig()
+
+	// Get admin key and load IP bans
+	loadAdminConfig()
+	loadPprofConfig()
+
+	// Initialize storage backend (creates the uploads directory)
+	initStorage()
+	loadMirrorConfig()
 
-	// Create uploads and templates directories
-	os.MkdirAll("./uploads", os.ModePerm)
+	// Get image transform settings; the cache lives under the uploads directory
+	loadImageTransformConfig()
+
+	// Get idle timeout for unfinished chunked/tus uploads
+	loadUploadSessionConfig()
+
+	// Check the settings replicas must share when running several
+	loadClusterConfig()
+
+	// Get clamd address for malware scanning
+	loadScanConfig()
+	loadQuarantineConfig()
+
+	// Get free disk space threshold for the readiness probe
+	loadHealthConfig()
+
+	// Get webhook receiver and events
+	loadWebhookConfig()
+	loadChatConfig()
+
+	// Get HTTPS certificate settings
+	loadTLSConfig()
+
+	// Get the HTTP server's performance knobs
+	loadHTTPConfig()
+
+	// Get the Unix or systemd socket to serve on instead of PORT
+	loadListenConfig()
+
+	// Get reverse proxies allowed to forward client addresses
+	loadProxyConfig()
+
+	// Get the SFTP listener's port and logins
+	loadSFTPConfig()
+	loadGRPCConfig()
+
+	// Create templates and static directories
 	os.MkdirAll("./templates", os.ModePerm)
 	os.MkdirAll("./static", os.ModePerm)
 
-	// Initialize template engine
-	engine := html.New("./templates", ".html")
+	// Initialize template engine, over TEMPLATES_DIR when there is one
+	engine := html.NewFileSystem(http.FS(templateFiles()), ".html")
 
 	// Initialize Fiber app with optimized settings and template engine
 	app := fiber.New(fiber.Config{
@@ -109,145 +298,223 @@ func main() {
 		ServerHeader:      "bashupload/2.0",
 		AppName:           "bashupload - High Performance File Uploader",
 		StreamRequestBody: true,
+		// Multipart uploads are read part by part, see multipart.go
+		DisablePreParseMultipartForm: true,
+		// The banner would break up machine-readable logs
+		DisableStartupMessage: logJSON,
+		// Client IP and scheme come from forwarded headers only when the
+		// request arrives from a trusted proxy
+		EnableTrustedProxyCheck: behindProxy(),
+		TrustedProxies:          trustedProxies,
+		ProxyHeader:             proxyHeader,
+		EnableIPValidation:      true,
+		// WebDAV's methods, see dav.go
+		RequestMethods: append(append([]string{}, fiber.DefaultMethods...), davMethods...),
+		// Performance knobs, see tuning.go
+		Prefork:         prefork,
+		Concurrency:     httpConcurrency,
+		ReadBufferSize:  readBufferSize,
+		WriteBufferSize: writeBufferSize,
 	})
 
 	// Middleware
 	app.Use(recover.New())
-	app.Use(logger.New())
-	app.Use(cors.New())
+	app.Use(forwardedClient)
+	app.Use(requestIDMiddleware)
+	app.Use(accessLog)
+	setupCORS(app)
+
+	// Turn away banned clients before they count against the rate limit
+	app.Use(banMiddleware)
 
 	// Rate limiting
-	app.Use(limiter.New(limiter.Config{
-		Max:        100,
-		Expiration: 1 * time.Minute,
-		KeyGenerator: func(c *fiber.Ctx) string {
-			return c.IP()
-		},
-	}))
+	setupRateLimiting(app)
 
 	// Routes
 	setupRoutes(app)
 
-	// Clean up expired files periodically
-	go cleanupExpiredFiles()
+	// Clean up expired files periodically, on one replica at a time
+	go holdMaintenanceLease()
+	go refreshBansLoop()
+	go cleanupLoop()
+	go mirrorLoop()
+	go backupLoop()
+
+	// Check storage against the database periodically
+	go reconcileLoop()
+
+	// Take uploads over SFTP when SFTP_PORT is set. With PREFORK only the
+	// parent listens, as the children would fight over the ports
+	if !fiber.IsChild() {
+		go serveSFTP()
+		go serveGRPC()
+		go servePprof()
+	}
 
 	// Start server
 	port := getEnv("PORT", "3000")
-	log.Printf("Server starting on port %s", port)
-	log.Printf("Upload endpoint: http://localhost:%s/api/upload", port)
-	log.Printf("Web interface: http://localhost:%s", port)
+	scheme := "http"
+	if tlsEnabled() {
+		scheme = "https"
+	}
+	log.Printf("Server starting on %s", listenDescription(port))
+	if !customListener() {
+		log.Printf("Upload endpoint: %s://localhost:%s/api/v1/upload", scheme, port)
+		log.Printf("Web interface: %s://localhost:%s", scheme, port)
+	}
 	log.Printf("bashupload server ready!")
 
-	log.Fatal(app.Listen(":" + port))
+	log.Fatal(listen(app, port))
 }
 
-func cleanupExpiredFiles() {
-	ticker := time.NewTicker(1 * time.Hour) // Check every hour
-	defer ticker.Stop()
+func setupRoutes(app *fiber.App) {
+	// Short links, first so a short domain's /<code> wins
+	setupAliasRoutes(app)
 
-	for range ticker.C {
-		var expiredFiles []FileRecord
-		db.Where("expires_at < ? OR downloads >= ?", time.Now(), maxDownloads).Find(&expiredFiles)
+	// Health probes (no auth)
+	setupHealthRoutes(app)
 
-		for _, file := range expiredFiles {
-			// Remove file from disk
-			os.Remove(file.FilePath)
-			// Remove from database
-			db.Delete(&file)
-		}
+	// API description and Swagger UI (no auth)
+	setupDocsRoutes(app)
 
-		if len(expiredFiles) > 0 {
-			log.Printf("Cleaned up %d expired files", len(expiredFiles))
-		}
-	}
-}
+	setupDashboardRoutes(app)
+	setupOIDCRoutes(app)
 
-func initDB() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("bashupload.db"), &gorm.Config{})
-	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
-	}
+	// The API key's files as a network drive
+	setupDAVRoutes(app)
 
-	// Migrate the schema
-	err = db.AutoMigrate(&FileRecord{})
-	if err != nil {
-		log.Fatal("Failed to migrate database:", err)
-	}
+	// S3-compatible uploads, signed with an API key
+	setupS3Routes(app)
 
-	log.Println("Database initialized successfully")
-}
-
-func setupRoutes(app *fiber.App) {
-	// API routes
-	api := app.Group("/api")
-
-	// Apply API key middleware if API_KEY is set
-	if apiKey != "" {
-		api.Use(apiKeyMiddleware)
-		// Also protect the main upload route for cURL uploads
-		app.Put("/", apiKeyMiddleware, handleCurlUpload)
-	} else {
-		app.Put("/", handleCurlUpload)
+	// API routes, each requiring an API key with the right scope when
+	// REQUIRE_API_KEY is on
+	upload := requireAPIKey(scopeUpload)
+	read := requireAPIKey(scopeRead)
+	for _, prefix := range apiPrefixes {
+		setupAPIRoutes(app.Group(prefix), upload, read)
 	}
 
-	api.Post("/upload", handleFileUpload)
-	api.Get("/files/:id", getFileInfo)
-	api.Get("/stats", getStats)
+	app.Put("/", upload, handleCurlUpload)
 
-	// Download route (no auth required for downloads)
+	// Download route (no auth required for downloads). HEAD is registered
+	// first so probing a link never counts as a download.
+	app.Head("/d/:filename", handleFileHead)
+	app.Head("/download/:filename", handleFileHead)
 	app.Get("/d/:filename", handleFileDownload)
 	app.Get("/download/:filename", handleFileDownload)
+	app.Delete("/d/:filename", handleFileDelete)
+	// Password prompt submissions
+	app.Post("/d/:filename", handleFileDownload)
+	app.Post("/download/:filename", handleFileDownload)
+
+	// Content-addressed links, by SHA-256
+	setupContentRoutes(app)
+
+	// Text pastes, viewable with syntax highlighting
+	setupPasteRoutes(app, upload)
+
+	// Preview pages, which don't count as downloads
+	setupPreviewRoutes(app)
+	setupPlayRoutes(app)
+	setupStatsRoutes(app)
+	setupThumbnailRoutes(app)
+	setupQRRoutes(app)
+
+	// Bundles of files, downloaded together as a zip
+	app.Get("/b/:id", handleBundleDownload)
+	app.Get("/zip", handleZipDownload)
+
+	// Anything else under /api gets a JSON error rather than a page
+	app.Use("/api", handleAPINotFound)
 
 	// Web interface
 	app.Get("/", serveWebInterface)
 	app.Static("/static", "./static")
 }
 
-func apiKeyMiddleware(c *fiber.Ctx) error {
-	if apiKey == "" {
-		return c.Next()
-	}
+// setupAPIRoutes registers the JSON API under one of apiPrefixes.
+func setupAPIRoutes(api fiber.Router, upload, read fiber.Handler) {
+	// Admin routes (separate key)
+	setupAdminRoutes(api)
+
+	// Sign-in and the signed-in user's own files
+	setupAccountRoutes(api)
+
+	api.Post("/captcha", handleCaptcha)
+	api.Post("/token", handleIssueUploadToken)
+	api.Post("/upload", upload, handleFileUpload)
+	api.Post("/fetch", upload, handleFetchUpload)
+	api.Post("/upload/init", upload, handleChunkInit)
+	api.Put("/upload/chunk/:session/:index", upload, handleChunkUpload)
+	api.Post("/upload/complete", upload, handleChunkComplete)
+	api.Get("/upload/session/:session", upload, handleChunkStatus)
+	api.Delete("/upload/session/:session", upload, handleChunkCancel)
+	setupProgressRoutes(api)
+	setupTusRoutes(api, upload)
+	api.Get("/files", read, handleListFiles)
+	api.Get("/files/:id", read, getFileInfo)
+	api.Delete("/files/:id", upload, handleFileDelete)
+	api.Post("/files/:id/sign", upload, handleSignFile)
+	api.Get("/files/:id/torrent", read, handleFileTorrent)
+	api.Get("/files/:id/downloads", read, handleFileDownloads)
+	setupAliasAPIRoutes(api, upload, read)
+	api.Get("/stats", read, getStats)
+	api.Post("/report/:id", handleReportFile) // anyone with the link
+	setupBundleRoutes(api, upload, read)
+}
 
+// providedAPIKey returns the API key sent with the request, if any
+func providedAPIKey(c *fiber.Ctx) string {
 	// Check for API key in header
 	providedKey := c.Get("X-API-Key")
+	if providedKey == "" {
+		// Upload tokens may come as bearer tokens, see uploadtokens.go
+		if bearer := strings.TrimPrefix(c.Get("Authorization"), "Bearer "); strings.HasPrefix(bearer, uploadTokenPrefix) {
+			providedKey = bearer
+		}
+	}
 	if providedKey == "" {
 		// Check for API key in query parameter
 		providedKey = c.Query("api_key")
 	}
 	if providedKey == "" {
-		// Check for API key in form data
-		providedKey = c.FormValue("api_key")
-	}
-
-	if providedKey != apiKey {
-		return c.Status(401).JSON(fiber.Map{
-			"success": false,
-			"message": "Invalid or missing API key",
-		})
+		// Check for API key in form data; a streamed upload only has the
+		// fields sent before its first file
+		if streamsMultipart(c) {
+			providedKey = formAPIKey(c)
+		} else {
+			providedKey = c.FormValue("api_key")
+		}
 	}
+	return providedKey
+}
 
-	return c.Next()
+// hasValidAPIKey reports whether the request carries a valid API key
+func hasValidAPIKey(c *fiber.Ctx) bool {
+	return requestAPIKey(c) != nil
 }
 
 func handleCurlUpload(c *fiber.Ctx) error {
-	// Get filename from URL or Content-Disposition
-	filename := c.Get("Content-Disposition")
-	if filename == "" {
-		// Try to get from query parameter or default
-		filename = c.Query("filename", "upload.bin")
-	} else {
-		// Extract filename from Content-Disposition header
-		if idx := strings.Index(filename, `filename="`); idx != -1 {
-			start := idx + 10
-			if end := strings.Index(filename[start:], `"`); end != -1 {
-				filename = filename[start : start+end]
-			}
+	// Let the client follow the upload through /api/progress
+	progress := startProgress(c, int64(c.Request().Header.ContentLength()))
+	defer progress.end(c)
+
+	// Get filename from Content-Disposition, falling back to the query parameter or default
+	filename := c.Query("filename", "upload.bin")
+	if disposition := c.Get("Content-Disposition"); disposition != "" {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil && params["filename"] != "" {
+			filename = params["filename"]
 		}
 	}
+	filename = sanitizeFilename(filename)
+
+	// Refuse file types the operator doesn't accept
+	if err := checkFileType(filename, c.Get("Content-Type")); err != nil {
+		return c.Status(415).SendString(err.Error())
+	}
 
 	// Generate unique ID
-	uniqueID := generateUniqueID()
+	uniqueID := newFileID()
 
 	// Get file extension
 	ext := filepath.Ext(filename)
@@ -255,9 +522,8 @@ func handleCurlUpload(c *fiber.Ctx) error {
 		ext = ".bin" // Default extension for files without extension
 	}
 
-	// Create file path with original extension
-	newFilename := uniqueID + ext
-	filePath := filepath.Join("uploads", newFilename)
+	// Storage key with original extension
+	storageKey := newStorageKey(ext)
 
 	// Get file size
 	contentLength := c.Get("Content-Length")
@@ -268,58 +534,221 @@ func handleCurlUpload(c *fiber.Ctx) error {
 		return c.Status(413).SendString(fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)))
 	}
 
-	// Save uploaded data to file
-	file, err := os.Create(filePath)
+	// Check the client's upload count and storage quotas
+	if quotaErr := checkUploadQuota(c.IP(), fileSize); quotaErr != nil {
+		return c.Status(quotaErr.status).SendString(quotaErr.message)
+	}
+
+	// Hold off while too many uploads are in flight or the disk is full
+	ticket, refusal := admitUpload(fileSize)
+	if refusal != nil {
+		return refuseUpload(c, refusal)
+	}
+	defer ticket.release()
+
+	// Per-upload expiration from ?expires= or the X-Expire-After header
+	expiresValue := c.Query("expires")
+	if expiresValue == "" {
+		expiresValue = c.Get("X-Expire-After")
+	}
+	// and the release window from available_from and available_until
+	window, err := requestedWindow(c, nil)
 	if err != nil {
-		return c.Status(500).SendString("Failed to create file")
+		return c.Status(400).SendString(err.Error())
+	}
+	expiresAt, err := window.expiry(expiresValue, fileSize)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
 	}
-	defer file.Close()
 
-	// Stream body to file
-	_, err = io.Copy(file, c.Context().RequestBodyStream())
+	// Per-upload download limit from ?downloads= or the X-Max-Downloads header
+	downloadsValue := c.Query("downloads")
+	if downloadsValue == "" {
+		downloadsValue = c.Get("X-Max-Downloads")
+	}
+	fileMaxDownloads, err := resolveMaxDownloads(downloadsValue)
 	if err != nil {
-		os.Remove(filePath)
+		return c.Status(400).SendString(fmt.Sprintf("Invalid download limit '%s'", downloadsValue))
+	}
+
+	// Optional download password from the X-File-Password header
+	passwordHash, err := hashPassword(c.Get("X-File-Password"))
+	if err != nil {
+		return c.Status(400).SendString("Invalid password")
+	}
+
+	// Who to email the link to, from ?notify= or the X-Notify header
+	notifyValue := c.Query("notify")
+	if notifyValue == "" {
+		notifyValue = c.Get("X-Notify")
+	}
+	recipients, err := parseNotify(notifyValue)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
+
+	// Optional vanity alias from ?slug= or the X-Slug header
+	slugValue := requestedSlug(c)
+	slug, err := resolveSlug(slugValue)
+	if err != nil {
+		return c.Status(slugStatus(err)).SendString(slugErrorMessage(slugValue, err))
+	}
+
+	// Optional tags and metadata from ?tags=, X-Tags and X-Meta-* headers
+	labels, err := requestLabels(c, nil)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
+
+	// The body stream is gone once something has read the whole body, e.g.
+	// the api_key form lookup on a url-encoded request
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	body = progress.reader(uploadThrottle().reader(body))
+
+	// Stream body to a staging file, hashing it on the way
+	stagedPath := newStagingPath()
+	staged, err := saveStream(stagedPath, body)
+	if err != nil {
+		os.Remove(stagedPath)
 		return c.Status(500).SendString("Failed to save file")
 	}
 
-	// Get actual file size
-	fileInfo, _ := os.Stat(filePath)
-	actualSize := fileInfo.Size()
+	// Reject transfers that don't match the checksum the client sent
+	if !clientChecksumMatches(c, staged.Digest) {
+		os.Remove(stagedPath)
+		return c.Status(422).SendString(fmt.Sprintf("Checksum mismatch: received data has SHA-256 %s", staged.Digest.SHA256))
+	}
+
+	// Apply the type policy to what was actually received as well
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return c.Status(415).SendString(err.Error())
+	}
+
+	// Without a Content-Length the storage quota can only be checked now
+	if fileSize == 0 {
+		if quotaErr := checkUploadQuota(c.IP(), staged.Size); quotaErr != nil {
+			os.Remove(stagedPath)
+			return c.Status(quotaErr.status).SendString(quotaErr.message)
+		}
+		// and the retention tier worked out, which may end before the
+		// release window opens
+		if expiresAt, err = window.expiry(expiresValue, staged.Size); err != nil {
+			os.Remove(stagedPath)
+			return c.Status(400).SendString(err.Error())
+		}
+	}
+
+	storageKey, nonce, err := storeBlob(storageKey, staged)
+	if err != nil {
+		log.Printf("Failed to store %s: %v", storageKey, err)
+		return c.Status(500).SendString("Failed to save file")
+	}
 
 	// Get client IP
-	clientIP := c.IP()
+	clientIP := storedIP(c.IP())
+
+	// One-time token that lets the uploader delete the file early
+	deleteToken, deleteTokenHash := newDeleteToken()
 
 	// Save to database with configurable expiration
-	expiresAt := time.Now().Add(expireDuration)
 	fileRecord := FileRecord{
-		UniqueID:     uniqueID,
-		OriginalName: filename,
-		FilePath:     filePath,
-		FileSize:     actualSize,
-		MimeType:     c.Get("Content-Type"),
-		Extension:    ext,
-		IPAddress:    clientIP,
-		ExpiresAt:    &expiresAt,
-	}
-
-	result := db.Create(&fileRecord)
-	if result.Error != nil {
+		UniqueID:         uniqueID,
+		OriginalName:     filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         staged.Size,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: c.Get("Content-Type"),
+		Extension:        ext,
+		MaxDownloads:     fileMaxDownloads,
+		PasswordHash:     passwordHash,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        clientIP,
+		UserID:           currentUserID(c),
+		APIKeyID:         currentAPIKeyID(c),
+		Slug:             slug,
+		ExpiresAt:        expiresAt,
+		AvailableFrom:    window.from,
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := createFileRecord(tx, &fileRecord); err != nil {
+			return err
+		}
+		return saveFileLabels(tx, &fileRecord, labels)
+	})
+	if err != nil {
 		// Clean up file if database save fails
-		os.Remove(filePath)
+		releaseBlob(storageKey)
+		if isSlugConflict(err, &fileRecord) {
+			return c.Status(409).SendString(slugErrorMessage(slugValue, errSlugTaken))
+		}
 		return c.Status(500).SendString("Failed to save file metadata")
 	}
+	queueScan(fileRecord)
+	logUpload(c, &fileRecord)
+	sendWebhook(c, webhookUploaded, &fileRecord, "")
+	progress.stored(fileRecord.UniqueID)
 
 	// Generate download URL with extension
-	baseURL := getBaseURL(c)
-	downloadURL := fmt.Sprintf("%s/d/%s%s", baseURL, uniqueID, ext)
+	fileURL := getBaseURL(c) + fileRecord.downloadPath()
+	downloadURL := signLink(fileURL, &fileRecord)
+	notifyUpload(recipients, getBaseURL(c), []*FileRecord{&fileRecord}, []string{downloadURL})
+
+	// Return plain text response (bashupload style); the link stays on the
+	// first line so scripts can keep using `head -1`
+	c.Set("X-Delete-Token", deleteToken)
+	c.Set("X-View-URL", viewURL(getBaseURL(c), &fileRecord))
+	if fileRecord.ExpiresAt != nil {
+		c.Set("X-Expires-At", fileRecord.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if fileRecord.AvailableFrom != nil {
+		c.Set("X-Available-From", fileRecord.AvailableFrom.UTC().Format(http.TimeFormat))
+	}
+	c.Set("X-Checksum-SHA256", staged.Digest.SHA256)
+	if staged.Digest.MD5 != "" {
+		c.Set("X-Checksum-MD5", staged.Digest.MD5)
+	}
+	response := fmt.Sprintf("%s\ndelete token: %s (curl -X DELETE -H \"X-Delete-Token: %s\" %s)\nview only: %s\n",
+		downloadURL, deleteToken, deleteToken, fileURL, viewURL(getBaseURL(c), &fileRecord))
+	if fileRecord.Moderation == moderationHeld {
+		response += "awaiting review: the link works once an admin approves the file\n"
+	}
+	return c.SendString(response)
+}
+
+// uploadFormFields are the multipart fields files are read from: "file" for
+// a single file, "files[]" (or "files") for several.
+var uploadFormFields = []string{"file", "files[]", "files"}
+
+// stagedPart is one file of a multipart upload once it's been received.
+type stagedPart struct {
+	filename    string
+	contentType string
+	staged      *stagedFile
+}
 
-	// Return plain text response (bashupload style)
-	return c.SendString(downloadURL)
+// storedPart is one file of a multipart upload once its blob is stored.
+type storedPart struct {
+	record      FileRecord
+	deleteToken string
 }
 
 func handleFileUpload(c *fiber.Ctx) error {
-	// Get file from multipart form
-	file, err := c.FormFile("file")
+	// Read the files part by part as they arrive
+	upload, err := openMultipartUpload(c)
 	if err != nil {
 		return c.Status(400).JSON(UploadResponse{
 			Success: false,
@@ -327,75 +756,415 @@ func handleFileUpload(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check file size (configurable limit)
-	if file.Size > maxUpload {
-		return c.Status(413).JSON(UploadResponse{
+	// Let the client follow the upload through /api/progress
+	progress := startProgress(c, int64(c.Request().Header.ContentLength()))
+	defer progress.end(c)
+	upload.tracked.track(progress)
+
+	// Anonymous web uploads need a solved CAPTCHA when it's on
+	if refusal := checkCaptcha(c, captchaToken(c, upload.leadingValue)); refusal != nil {
+		return c.Status(refusal.status).JSON(UploadResponse{
 			Success: false,
-			Message: fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)),
+			Message: refusal.message,
 		})
 	}
 
-	// Generate unique ID
-	uniqueID := generateUniqueID()
+	// Fail early when the client has no uploads left today
+	if quotaErr := checkUploadQuota(c.IP(), 0); quotaErr != nil {
+		return c.Status(quotaErr.status).JSON(UploadResponse{
+			Success: false,
+			Message: quotaErr.message,
+		})
+	}
 
-	// Get file extension
-	ext := filepath.Ext(file.Filename)
-	if ext == "" {
-		ext = ".bin" // Default extension for files without extension
+	// Hold off while too many uploads are in flight or the disk is full
+	ticket, refusal := admitUpload(max(int64(c.Request().Header.ContentLength()), 0))
+	if refusal != nil {
+		setUploadRetryAfter(c, refusal)
+		return c.Status(refusal.status).JSON(UploadResponse{
+			Success: false,
+			Message: refusal.message,
+		})
 	}
+	defer ticket.release()
+
+	// Errors about one file of several say which one. While the files are
+	// still coming that's known from the second on.
+	var received []stagedPart
+	partError := func(filename, message string, several bool) string {
+		if several {
+			return fmt.Sprintf("%s: %s", filename, message)
+		}
+		return message
+	}
+	removeReceived := func(parts []stagedPart) {
+		for _, part := range parts {
+			os.Remove(part.staged.Path)
+		}
+	}
+
+	// Stage every file as it arrives, refusing one as soon as it breaks the
+	// type or size limits
+	for {
+		file, err := upload.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			removeReceived(received)
+			status, message := 400, "Malformed multipart body"
+			if errors.Is(err, errFormFieldTooLarge) {
+				status, message = 413, fmt.Sprintf("Form fields are limited to %s", formatBytes(maxFormFieldSize))
+			} else if errors.Is(err, errTooManyFormFields) {
+				status, message = 413, fmt.Sprintf("Uploads are limited to %d form fields, %s in all", maxFormFields, formatBytes(maxFormFieldsSize))
+			}
+			return c.Status(status).JSON(UploadResponse{
+				Success: false,
+				Message: message,
+			})
+		}
+
+		filename := sanitizeFilename(file.FileName())
+		contentType := file.Header.Get("Content-Type")
+		several := len(received) > 0
+
+		// Refuse file types the operator doesn't accept
+		if err := checkFileType(filename, contentType); err != nil {
+			removeReceived(received)
+			return c.Status(415).JSON(UploadResponse{
+				Success: false,
+				Message: partError(filename, err.Error(), several),
+			})
+		}
 
-	// Create file path with original extension
-	fileName := uniqueID + ext
-	filePath := filepath.Join("uploads", fileName)
+		// Save file, hashing it on the way, reading no more than one byte
+		// past the size limit (configurable)
+		stagedPath := newStagingPath()
+		staged, err := saveStream(stagedPath, io.LimitReader(file, maxUpload+1))
+		if err != nil || staged.Size > maxUpload {
+			os.Remove(stagedPath)
+			removeReceived(received)
+			status, message := 500, "Failed to save file"
+			if err == nil {
+				status, message = 413, fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload))
+			}
+			return c.Status(status).JSON(UploadResponse{
+				Success: false,
+				Message: partError(filename, message, several),
+			})
+		}
+		received = append(received, stagedPart{filename: filename, contentType: contentType, staged: staged})
+	}
+	if len(received) == 0 {
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: "No file provided",
+		})
+	}
+	several := len(received) > 1
 
-	// Save file
-	err = c.SaveFile(file, filePath)
+	// Check the client's upload count and storage quotas for all of them
+	var totalSize int64
+	for _, part := range received {
+		totalSize += part.staged.Size
+	}
+	if quotaErr := checkBatchQuota(c.IP(), len(received), totalSize); quotaErr != nil {
+		removeReceived(received)
+		return c.Status(quotaErr.status).JSON(UploadResponse{
+			Success: false,
+			Message: quotaErr.message,
+		})
+	}
+
+	// Per-upload expiration from ?expires=, the X-Expire-After header or the
+	// "expires" form field
+	expiresValue := c.Query("expires")
+	if expiresValue == "" {
+		expiresValue = c.Get("X-Expire-After")
+	}
+	if expiresValue == "" {
+		expiresValue = upload.value("expires")
+	}
+	// and the release window from available_from and available_until, with
+	// each file's expiry worked out by its size
+	window, err := requestedWindow(c, upload.value)
 	if err != nil {
-		return c.Status(500).JSON(UploadResponse{
+		removeReceived(received)
+		return c.Status(400).JSON(UploadResponse{
 			Success: false,
-			Message: "Failed to save file",
+			Message: err.Error(),
 		})
 	}
+	expiries := make([]*time.Time, len(received))
+	for i := range received {
+		if expiries[i], err = window.expiry(expiresValue, received[i].staged.Size); err != nil {
+			removeReceived(received)
+			return c.Status(400).JSON(UploadResponse{
+				Success: false,
+				Message: partError(received[i].filename, err.Error(), several),
+			})
+		}
+	}
 
-	// Get client IP
-	clientIP := c.IP()
+	// Per-upload download limit from ?downloads=, the X-Max-Downloads header
+	// or the "downloads" form field
+	downloadsValue := c.Query("downloads")
+	if downloadsValue == "" {
+		downloadsValue = c.Get("X-Max-Downloads")
+	}
+	if downloadsValue == "" {
+		downloadsValue = upload.value("downloads")
+	}
+	fileMaxDownloads, err := resolveMaxDownloads(downloadsValue)
+	if err != nil {
+		removeReceived(received)
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid download limit '%s'", downloadsValue),
+		})
+	}
 
-	// Save to database with configurable expiration
-	expiresAt := time.Now().Add(expireDuration)
-	fileRecord := FileRecord{
-		UniqueID:     uniqueID,
-		OriginalName: file.Filename,
-		FilePath:     filePath,
-		FileSize:     file.Size,
-		MimeType:     file.Header.Get("Content-Type"),
-		Extension:    ext,
-		IPAddress:    clientIP,
-		ExpiresAt:    &expiresAt,
-	}
-
-	result := db.Create(&fileRecord)
-	if result.Error != nil {
-		// Clean up file if database save fails
-		os.Remove(filePath)
+	// Who to email the links to, from ?notify=, the X-Notify header or the
+	// "notify" form field
+	notifyValue := c.Query("notify")
+	if notifyValue == "" {
+		notifyValue = c.Get("X-Notify")
+	}
+	if notifyValue == "" {
+		notifyValue = upload.value("notify")
+	}
+	recipients, err := parseNotify(notifyValue)
+	if err != nil {
+		removeReceived(received)
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+	}
+
+	// Optional download password from the X-File-Password header or the
+	// "password" form field
+	password := c.Get("X-File-Password")
+	if password == "" {
+		password = upload.value("password")
+	}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		removeReceived(received)
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+	}
+
+	// Optional vanity alias from ?slug=, the X-Slug header or the "slug" form
+	// field, for a single file
+	slugValue := requestedSlug(c)
+	if slugValue == "" {
+		slugValue = upload.value("slug")
+	}
+	if slugValue != "" && several {
+		removeReceived(received)
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: "A slug can only be given when uploading a single file",
+		})
+	}
+	slug, err := resolveSlug(slugValue)
+	if err != nil {
+		removeReceived(received)
+		return c.Status(slugStatus(err)).JSON(UploadResponse{
+			Success: false,
+			Message: slugErrorMessage(slugValue, err),
+		})
+	}
+
+	// Optional tags and metadata, given to every file, from ?tags=, X-Tags
+	// and X-Meta-* headers or the "tags" and "meta[name]" form fields
+	labels, err := requestLabels(c, upload.fields)
+	if err != nil {
+		removeReceived(received)
+		return c.Status(400).JSON(UploadResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+	}
+
+	// Store every file before recording any, so a failure part way through
+	// leaves nothing behind
+	parts := make([]storedPart, 0, len(received))
+	releaseParts := func() {
+		for _, part := range parts {
+			releaseBlob(part.record.FilePath)
+		}
+	}
+	for i := range received {
+		part, status, message := storeUploadPart(c, &received[i], !several)
+		if status != 0 {
+			releaseParts()
+			removeReceived(received[i+1:])
+			return c.Status(status).JSON(UploadResponse{
+				Success: false,
+				Message: partError(received[i].filename, message, several),
+				SHA256:  part.record.SHA256,
+			})
+		}
+		part.record.MaxDownloads = fileMaxDownloads
+		part.record.PasswordHash = passwordHash
+		part.record.ExpiresAt = expiries[i]
+		part.record.AvailableFrom = window.from
+		part.record.Slug = slug
+		parts = append(parts, part)
+	}
+
+	// Save to database with configurable expiration, all or nothing
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range parts {
+			if err := createFileRecord(tx, &parts[i].record); err != nil {
+				return err
+			}
+			if err := saveFileLabels(tx, &parts[i].record, labels); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Clean up files if database save fails
+		releaseParts()
+		if isSlugConflict(err, &parts[0].record) {
+			return c.Status(409).JSON(UploadResponse{
+				Success: false,
+				Message: slugErrorMessage(slugValue, errSlugTaken),
+			})
+		}
 		return c.Status(500).JSON(UploadResponse{
 			Success: false,
 			Message: "Failed to save file metadata",
 		})
 	}
 
-	// Generate download URL with extension
 	baseURL := getBaseURL(c)
-	downloadURL := fmt.Sprintf("%s/d/%s%s", baseURL, uniqueID, ext)
-
+	results := make([]UploadResult, 0, len(parts))
+	notified := make([]*FileRecord, 0, len(parts))
+	notifiedURLs := make([]string, 0, len(parts))
+	for i := range parts {
+		fileRecord := &parts[i].record
+		queueScan(*fileRecord)
+		logUpload(c, fileRecord)
+		sendWebhook(c, webhookUploaded, fileRecord, "")
+		progress.stored(fileRecord.UniqueID)
+
+		// Generate download URL with extension
+		results = append(results, UploadResult{
+			Filename:      fileRecord.OriginalName,
+			UniqueID:      fileRecord.UniqueID,
+			DownloadURL:   signLink(baseURL+fileRecord.downloadPath(), fileRecord),
+			FileSize:      fileRecord.FileSize,
+			ExpiresAt:     fileRecord.ExpiresAt,
+			AvailableFrom: fileRecord.AvailableFrom,
+			DeleteToken:   parts[i].deleteToken,
+			ViewURL:       viewURL(baseURL, fileRecord),
+			SHA256:        fileRecord.SHA256,
+			MD5:           fileRecord.MD5,
+		})
+		notified = append(notified, fileRecord)
+		notifiedURLs = append(notifiedURLs, results[i].DownloadURL)
+	}
+	notifyUpload(recipients, baseURL, notified, notifiedURLs)
+
+	if len(results) > 1 {
+		return c.JSON(UploadResponse{
+			Success:  true,
+			Message:  uploadMessage(fmt.Sprintf("%d files uploaded successfully", len(results))),
+			FileSize: totalSize,
+			Files:    results,
+		})
+	}
+	// A single file keeps its details at the top level as well
+	first := results[0]
 	return c.JSON(UploadResponse{
-		Success:     true,
-		Message:     "File uploaded successfully",
-		UniqueID:    uniqueID,
-		DownloadURL: downloadURL,
-		FileSize:    file.Size,
+		Success:       true,
+		Message:       uploadMessage("File uploaded successfully"),
+		UniqueID:      first.UniqueID,
+		DownloadURL:   first.DownloadURL,
+		FileSize:      first.FileSize,
+		ExpiresAt:     first.ExpiresAt,
+		AvailableFrom: first.AvailableFrom,
+		DeleteToken:   first.DeleteToken,
+		ViewURL:       first.ViewURL,
+		SHA256:        first.SHA256,
+		MD5:           first.MD5,
+		Files:         results,
 	})
 }
 
+// storeUploadPart checks one received multipart file and stores its blob,
+// returning the record to create. A non-zero status means it was refused and
+// nothing was kept. The X-Content-SHA256 header only applies to a request
+// with a single file.
+func storeUploadPart(c *fiber.Ctx, received *stagedPart, checkClientChecksum bool) (storedPart, int, string) {
+	var part storedPart
+	staged := received.staged
+
+	// Generate unique ID
+	uniqueID := newFileID()
+
+	// Get file extension
+	ext := filepath.Ext(received.filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+
+	// Reject transfers that don't match the checksum the client sent
+	if checkClientChecksum && !clientChecksumMatches(c, staged.Digest) {
+		os.Remove(staged.Path)
+		part.record.SHA256 = staged.Digest.SHA256
+		return part, 422, fmt.Sprintf("Checksum mismatch: received data has SHA-256 %s", staged.Digest.SHA256)
+	}
+
+	// Apply the type policy to what was actually received as well
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(staged.Path)
+		return part, 415, err.Error()
+	}
+
+	// Storage key with original extension
+	storageKey, nonce, err := storeBlob(newStorageKey(ext), staged)
+	if err != nil {
+		log.Printf("Failed to store %s: %v", storageKey, err)
+		return part, 500, "Failed to save file"
+	}
+
+	// One-time token that lets the uploader delete the file early
+	deleteToken, deleteTokenHash := newDeleteToken()
+
+	part.deleteToken = deleteToken
+	part.record = FileRecord{
+		UniqueID:         uniqueID,
+		OriginalName:     received.filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         staged.Size,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: received.contentType,
+		Extension:        ext,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        storedIP(c.IP()),
+		UserID:           currentUserID(c),
+		APIKeyID:         currentAPIKeyID(c),
+	}
+	return part, 0, ""
+}
+
 func handleFileDownload(c *fiber.Ctx) error {
 	filename := c.Params("filename")
 
@@ -407,68 +1176,513 @@ func handleFileDownload(c *fiber.Ctx) error {
 	} else {
 		uniqueID = filename
 	}
+	return serveDownload(c, uniqueID)
+}
+
+// serveDownload sends the file with the given ID or slug, honouring Range.
+func serveDownload(c *fiber.Ctx, uniqueID string) error {
+	fileRecord, err := lookupDownload(c, uniqueID)
+	if fileRecord == nil {
+		return err
+	}
 
+	// The password comes first, so that revalidating can't tell anyone
+	// without it whether a guessed checksum is the file's
+	if ok, password := fileUnlocked(c, fileRecord); !ok {
+		return passwordRequired(c, fileRecord, password != "")
+	}
+
+	// ?w=, ?h=, ?format= and ?q= ask for the image scaled or re-encoded
+	if imageTransformsEnabled {
+		transform, err := parseImageTransform(c, fileRecord)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if transform != nil {
+			return serveImageTransform(c, fileRecord, transform)
+		}
+	}
+
+	// A client revalidating its copy gets 304 without using up a download
+	if notModified(c, fileRecord) {
+		setCacheHeaders(c, fileRecord)
+		return c.SendStatus(304)
+	}
+
+	// Parse a Range header so interrupted downloads can resume, unless
+	// If-Range shows the client's partial copy is of something else
+	if !ifRangeMatches(c, fileRecord) {
+		// The whole file is sent instead
+		c.Request().Header.Del("Range")
+	}
+	start, end, partial, err := parseByteRange(c.Get("Range"), fileRecord.FileSize)
+	if err != nil {
+		c.Set("Content-Range", fmt.Sprintf("bytes */%d", fileRecord.FileSize))
+		return c.Status(416).SendString("Requested range not satisfiable")
+	}
+
+	// A request from the first byte counts as a download. A later range
+	// joins a download the same client has in flight or may resume, and
+	// otherwise counts as one of its own
+	var joined *downloadClaim
+	if start > 0 {
+		joined = joinTransfer(fileRecord, c.IP())
+	}
+	countsAsDownload := joined == nil
+	ok, claim, err := admitDownload(c, fileRecord, countsAsDownload)
+	if !ok {
+		joined.refund()
+		return err
+	}
+	if joined != nil {
+		claim = joined
+	}
+	served := fileRecord.FileSize
+	if partial {
+		served = end - start + 1
+		if end < fileRecord.FileSize-1 {
+			claim.stopsShort()
+		}
+	}
+	claim.serving(served)
+	recordDownloadUsage(fileRecord, served, countsAsDownload)
+
+	// With an IPFS gateway configured, the gateway sends the bytes
+	if link := ipfsGatewayLink(fileRecord); link != "" {
+		claim.finish(served, served)
+		return c.Redirect(link, fiber.StatusFound)
+	}
+
+	// Set appropriate headers
+	setDownloadHeaders(c, fileRecord)
+	setInlineHeaders(c, fileRecord)
+	return sendFileRecord(c, fileRecord, start, end, partial, claim)
+}
+
+// sendFileRecord streams a file, or the inclusive span start-end of it when
+// partial, once the headers are set, and finishes claim when it's sent.
+func sendFileRecord(c *fiber.Ctx, fileRecord *FileRecord, start, end int64, partial bool, claim *downloadClaim) error {
+	// Stream file, using sendfile when the blob is a plain file on local disk
+	// and the download isn't throttled
+	throttle := downloadThrottle()
+	if local, ok := fileStorage.(localPather); ok && fileRecord.EncryptionNonce == "" &&
+		fileRecord.Compression == "" && len(throttle) == 0 {
+		if !partial {
+			start, end = 0, fileRecord.FileSize-1
+		} else {
+			c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileRecord.FileSize))
+			c.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			c.Status(206)
+		}
+		if sent, err := sendLocalFile(c, local.LocalPath(fileRecord.FilePath), start, end, claim); sent {
+			return err
+		}
+	}
+
+	// Clients that accept the stored encoding get the compressed bytes
+	open := openFileRecord
+	length := fileRecord.FileSize
+	if servesEncoded(c, fileRecord) {
+		setEncodedHeaders(c, fileRecord)
+		open = openStoredFile
+		length = fileRecord.CompressedSize
+	}
+
+	reader, err := open(fileRecord)
+	if err != nil {
+		claim.refund()
+		requestLog(c).Error("Failed to open file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return c.Status(500).SendString("Failed to open file")
+	}
+	var body io.Reader = reader
+	if partial {
+		if _, err := reader.Seek(start, io.SeekStart); err != nil {
+			reader.Close()
+			claim.refund()
+			return c.Status(500).SendString("Failed to open file")
+		}
+		length = end - start + 1
+		body = io.LimitReader(reader, length)
+		c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileRecord.FileSize))
+		c.Set("Content-Length", strconv.FormatInt(length, 10))
+		c.Status(206)
+	}
+	return c.SendStream(&claimedReader{
+		Reader:   throttle.reader(body),
+		closer:   reader,
+		claim:    claim,
+		expected: length,
+	}, int(length))
+}
+
+// lookupDownload finds the file behind a download link, refusing files that
+// have expired, gone missing from storage or not passed the malware scan.
+// When the file can't be served the response is already written and the
+// record is nil.
+func lookupDownload(c *fiber.Ctx, uniqueID string) (*FileRecord, error) {
 	var fileRecord FileRecord
-	result := db.Where("unique_id = ?", uniqueID).First(&fileRecord)
-	if result.Error != nil {
-		return c.Status(404).SendString("File not found")
+	if err := findFile(uniqueID, &fileRecord); err != nil {
+		return nil, c.Status(404).SendString("File not found")
+	}
+	return servableFile(c, &fileRecord)
+}
+
+// servableFile checks a file that was asked for can be served: it's signed
+// if need be, not expired or used up, released, in storage, scanned and not
+// held for review.
+func servableFile(c *fiber.Ctx, fileRecord *FileRecord) (*FileRecord, error) {
+	logFileID(c, fileRecord.UniqueID)
+
+	// Refuse links without a valid signature when they're required
+	if refused, err := refuseUnsigned(c, fileRecord); refused {
+		return nil, err
 	}
 
 	// Check if file has expired
 	if fileRecord.ExpiresAt != nil && time.Now().After(*fileRecord.ExpiresAt) {
-		// Clean up expired file
-		os.Remove(fileRecord.FilePath)
-		db.Delete(&fileRecord)
-		return c.Status(404).SendString("File has expired")
+		// Clean up expired file, unless someone is still downloading it
+		if !transferInFlight(fileRecord.ID) && removeFile(fileRecord, "expired") == nil {
+			requestLog(c).Info("Removed expired file", "file_id", fileRecord.UniqueID, "name", fileRecord.OriginalName)
+			sendWebhook(c, webhookExpired, fileRecord, "expired")
+		}
+		return nil, c.Status(404).SendString("File has expired")
 	}
 
-	// Check if file exists on disk
-	if _, err := os.Stat(fileRecord.FilePath); os.IsNotExist(err) {
-		return c.Status(404).SendString("File not found on disk")
+	// Nor once its downloads are used up, but for later ranges of a download
+	// the client has in flight or may resume
+	if fileRecord.usedUp() && !resumable(fileRecord.ID, c.IP()) {
+		if !transferInFlight(fileRecord.ID) {
+			removeIfUsedUp(fileRecord.ID)
+		}
+		return nil, c.Status(410).SendString(usedUpMessage(fileRecord.downloadLimit()))
 	}
 
-	// Check if download limit exceeded
-	if fileRecord.Downloads >= maxDownloads {
-		// Clean up file after max downloads reached
-		os.Remove(fileRecord.FilePath)
-		db.Delete(&fileRecord)
-		if maxDownloads == 1 {
-			return c.Status(410).SendString("File has already been downloaded and removed")
-		} else {
-			return c.Status(410).SendString(fmt.Sprintf("File has reached maximum download limit (%d) and was removed", maxDownloads))
+	// Nor before its release window opens
+	if refused, err := refuseUnreleased(c, fileRecord); refused {
+		return nil, err
+	}
+
+	// Check if file exists in storage
+	if _, err := statBlob(fileRecord.FilePath); err != nil {
+		return nil, c.Status(404).SendString("File not found on disk")
+	}
+
+	// Never serve malware, or files that haven't been scanned yet
+	if refused, err := refuseUnscanned(c, fileRecord); refused {
+		return nil, err
+	}
+	// Nor files waiting for an admin's review
+	if refused, err := refuseHeld(c, fileRecord); refused {
+		return nil, err
+	}
+	return fileRecord, nil
+}
+
+// fileUnlocked reports whether the request may read a file: it has no
+// password, the password checks out, or the request carries the token the
+// player page gives its media element. Like checkFilePassword it also
+// returns the password that was tried.
+func fileUnlocked(c *fiber.Ctx, fileRecord *FileRecord) (bool, string) {
+	if fileRecord.PasswordHash == "" || previewTokenValid(c, fileRecord.UniqueID) {
+		return true, ""
+	}
+	return checkFilePassword(c, fileRecord)
+}
+
+// admitDownload enforces the download limit of a file about to be read,
+// whose password the caller has checked with fileUnlocked, and claims the
+// download when countsAsDownload; the caller must finish the claim once the
+// transfer ends. When it reports false the response is already written.
+func admitDownload(c *fiber.Ctx, fileRecord *FileRecord, countsAsDownload bool) (bool, *downloadClaim, error) {
+	if !countsAsDownload {
+		return true, nil, nil
+	}
+
+	// Count the download, unless the limit (0 means unlimited) was reached
+	// since the file was looked up
+	claim := claimDownload(fileRecord, c.IP())
+	if claim == nil {
+		if !transferInFlight(fileRecord.ID) {
+			removeIfUsedUp(fileRecord.ID)
 		}
+		return false, nil, c.Status(410).SendString(usedUpMessage(fileRecord.downloadLimit()))
 	}
+	claim.by(c.IP(), c.Get("User-Agent"))
+	requestLog(c).Info("File downloaded", "file_id", fileRecord.UniqueID, "downloads", fileRecord.Downloads)
+	audit(c, auditDownload, fileRecord.UniqueID, "")
+	sendWebhook(c, webhookDownloaded, fileRecord, "")
+	return true, claim, nil
+}
+
+// handleFileHead answers HEAD requests on download links with the headers a
+// download would carry, without sending the body or counting a download.
+func handleFileHead(c *fiber.Ctx) error {
+	filename := c.Params("filename")
+	return headDownload(c, strings.TrimSuffix(filename, filepath.Ext(filename)))
+}
 
-	// Increment download counter
-	db.Model(&fileRecord).Update("downloads", fileRecord.Downloads+1)
+// headDownload answers a HEAD request for the file with the given ID or slug.
+func headDownload(c *fiber.Ctx, uniqueID string) error {
+	var fileRecord FileRecord
+	if err := findFile(uniqueID, &fileRecord); err != nil {
+		return c.SendStatus(404)
+	}
 
-	// Set appropriate headers
-	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileRecord.OriginalName))
+	if refused, err := refuseUnsigned(c, &fileRecord); refused {
+		return err
+	}
+
+	if fileRecord.ExpiresAt != nil && time.Now().After(*fileRecord.ExpiresAt) {
+		return c.SendStatus(404)
+	}
+
+	if refused, err := refuseUnreleased(c, &fileRecord); refused {
+		return err
+	}
+
+	if _, err := statBlob(fileRecord.FilePath); err != nil {
+		return c.SendStatus(404)
+	}
+
+	if fileRecord.usedUp() && !resumable(fileRecord.ID, c.IP()) {
+		return c.SendStatus(410)
+	}
+
+	if refused, err := refuseUnscanned(c, &fileRecord); refused {
+		return err
+	}
+	if refused, err := refuseHeld(c, &fileRecord); refused {
+		return err
+	}
+
+	if ok, _ := fileUnlocked(c, &fileRecord); !ok {
+		return c.SendStatus(401)
+	}
+
+	if notModified(c, &fileRecord) {
+		setCacheHeaders(c, &fileRecord)
+		return c.SendStatus(304)
+	}
+
+	setDownloadHeaders(c, &fileRecord)
+	if fileRecord.ExpiresAt != nil {
+		c.Set("X-Expires-At", fileRecord.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 {
+		c.Set("X-Downloads-Remaining", strconv.Itoa(limit-fileRecord.Downloads))
+	}
+	length := fileRecord.FileSize
+	if servesEncoded(c, &fileRecord) {
+		setEncodedHeaders(c, &fileRecord)
+		length = fileRecord.CompressedSize
+	}
+
+	// Keep the real length: fasthttp would otherwise report the empty body's
+	c.Context().Response.SkipBody = true
+	c.Context().Response.Header.SetContentLength(int(length))
+	return nil
+}
+
+// setDownloadHeaders sets the headers describing a file about to be served.
+func setDownloadHeaders(c *fiber.Ctx, fileRecord *FileRecord) {
+	c.Set("Content-Disposition", contentDisposition("attachment", fileRecord.OriginalName))
 	c.Set("Content-Length", strconv.FormatInt(fileRecord.FileSize, 10))
+	c.Set("Accept-Ranges", "bytes")
 
 	if fileRecord.MimeType != "" {
 		c.Set("Content-Type", fileRecord.MimeType)
 	}
+	// The type was detected from the contents; browsers shouldn't guess again
+	c.Set("X-Content-Type-Options", "nosniff")
+	setChecksumHeaders(c, fileRecord)
+	setCacheHeaders(c, fileRecord)
+}
+
+// checkFilePassword reports whether the request may access a file, checking
+// the password given via ?password=, X-File-Password or the prompt form for
+// protected files. It also returns the password that was tried.
+func checkFilePassword(c *fiber.Ctx, fileRecord *FileRecord) (bool, string) {
+	if fileRecord.PasswordHash == "" {
+		return true, ""
+	}
+
+	password := c.Query("password")
+	if password == "" {
+		password = c.Get("X-File-Password")
+	}
+	if password == "" && c.Method() == fiber.MethodPost {
+		password = c.FormValue("password")
+	}
+	return bcrypt.CompareHashAndPassword([]byte(fileRecord.PasswordHash), []byte(password)) == nil, password
+}
+
+// parseByteRange parses a single-range "bytes=" Range header against a file
+// of the given size and returns the inclusive byte span to send. partial is
+// false when the whole file should be sent, including when the header is
+// absent, malformed or asks for several ranges (which are not supported).
+func parseByteRange(header string, size int64) (start, end int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size - 1, false, nil
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size - 1, false, nil
+	}
+
+	if first == "" {
+		// Suffix range: the last N bytes
+		n, parseErr := strconv.ParseInt(last, 10, 64)
+		if parseErr != nil || n < 0 {
+			return 0, size - 1, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, fmt.Errorf("unsatisfiable range: %s", header)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, nil
+	}
+
+	start, parseErr := strconv.ParseInt(first, 10, 64)
+	if parseErr != nil || start < 0 {
+		return 0, size - 1, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, fmt.Errorf("unsatisfiable range: %s", header)
+	}
+
+	end = size - 1
+	if last != "" {
+		end, parseErr = strconv.ParseInt(last, 10, 64)
+		if parseErr != nil || end < start {
+			return 0, size - 1, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end, true, nil
+}
+
+// passwordRequired answers a download of a protected file that came without
+// the right password: browsers get a prompt page, other clients a plain 401.
+func passwordRequired(c *fiber.Ctx, fileRecord *FileRecord, wrongPassword bool) error {
+	message := "Password required"
+	if wrongPassword {
+		message = "Wrong password"
+		audit(c, auditAuthFailure, fileRecord.UniqueID, "file password")
+	}
 
-	// Stream file
-	return c.SendFile(fileRecord.FilePath)
+	if !strings.Contains(c.Get("Accept"), "text/html") {
+		return c.Status(401).SendString(message + " (pass ?password= or the X-File-Password header)")
+	}
+
+	return c.Status(401).Render("password", fiber.Map{
+		"Brand":         brand,
+		"Filename":      fileRecord.OriginalName,
+		"WrongPassword": wrongPassword,
+		"DownloadURL":   getBaseURL(c) + c.Path(),
+	})
+}
+
+// hashPassword returns the bcrypt hash of a download password, or an empty
+// string when no password was given.
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// handleFileDelete removes a file before it expires when the request carries
+// the deletion token handed out at upload time (X-Delete-Token header or
+// ?token=). It serves both DELETE /d/:filename and DELETE /api/files/:id.
+func handleFileDelete(c *fiber.Ctx) error {
+	uniqueID := c.Params("id")
+	isAPI := uniqueID != ""
+	if !isAPI {
+		filename := c.Params("filename")
+		uniqueID = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+
+	reply := func(status int, message string) error {
+		if isAPI {
+			return c.Status(status).JSON(fiber.Map{
+				"success": status == 200,
+				"message": message,
+			})
+		}
+		return c.Status(status).SendString(message)
+	}
+
+	var fileRecord FileRecord
+	if err := findFile(uniqueID, &fileRecord); err != nil {
+		return reply(404, "File not found")
+	}
+	logFileID(c, fileRecord.UniqueID)
+
+	token := c.Get("X-Delete-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	if token == "" {
+		return reply(401, "Deletion token required")
+	}
+	if !tokenMatches(token, fileRecord.DeleteToken) {
+		audit(c, auditAuthFailure, fileRecord.UniqueID, "deletion token")
+		return reply(403, "Invalid deletion token")
+	}
+
+	if err := removeFile(&fileRecord, "uploader"); err != nil {
+		requestLog(c).Error("Failed to delete file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return reply(500, "Failed to delete file")
+	}
+	requestLog(c).Info("File deleted by uploader", "file_id", fileRecord.UniqueID)
+	audit(c, auditDelete, fileRecord.UniqueID, "uploader")
+	sendWebhook(c, webhookDeleted, &fileRecord, "uploader")
+
+	return reply(200, "File deleted")
+}
+
+// newDeleteToken returns a fresh deletion token and the hash to store for it.
+func newDeleteToken() (string, string) {
+	token := generateUniqueID()
+	return token, hashDeleteToken(token)
+}
+
+// hashDeleteToken hashes a deletion token for storage. Tokens are random, so
+// a plain SHA-256 is enough.
+func hashDeleteToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
 }
 
 func getFileInfo(c *fiber.Ctx) error {
 	uniqueID := c.Params("id")
 
 	var fileRecord FileRecord
-	result := db.Where("unique_id = ?", uniqueID).First(&fileRecord)
-	if result.Error != nil {
+	if err := findFile(uniqueID, &fileRecord); err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"success": false,
 			"message": "File not found",
 		})
 	}
 
+	records := []FileRecord{fileRecord}
+	attachFileLabels(records)
+
 	return c.JSON(fiber.Map{
-		"success": true,
-		"data":    fileRecord,
+		"success":            true,
+		"data":               records[0],
+		"password_protected": fileRecord.PasswordHash != "",
 	})
 }
 
@@ -479,16 +1693,35 @@ func getStats(c *fiber.Ctx) error {
 	db.Model(&FileRecord{}).Count(&totalFiles)
 	db.Model(&FileRecord{}).Select("COALESCE(SUM(file_size), 0)").Row().Scan(&totalSize)
 
-	return c.JSON(fiber.Map{
+	stats := fiber.Map{
 		"success":              true,
 		"total_files":          totalFiles,
 		"total_size":           totalSize,
 		"total_size_formatted": formatBytes(totalSize),
-	})
+	}
+
+	// The public aggregates, to everyone when PUBLIC_STATS is on
+	if publicStatsEnabled || hasValidAdminKey(c) {
+		stats["activity"] = collectPublicStats()
+	}
+
+	// Authenticated callers also get usage per key, user and IP
+	if requestAPIKey(c) != nil || currentUser(c) != nil || hasValidAdminKey(c) {
+		usage, err := usageBreakdown(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"success": false, "message": err.Error()})
+		}
+		for k, v := range usage {
+			stats[k] = v
+		}
+	}
+	return c.JSON(stats)
 }
 
 func serveWebInterface(c *fiber.Ctx) error {
-	requiresAuth := apiKey != ""
+	// Signed-in users upload with their session instead of a key
+	user := currentUser(c)
+	requiresAuth := apiKeyRequired && user == nil
 
 	// Prepare auth header for curl example
 	authHeader := ""
@@ -498,44 +1731,251 @@ func serveWebInterface(c *fiber.Ctx) error {
 
 	// Prepare download limit description
 	downloadLimit := "single download"
-	if maxDownloads > 1 {
+	if maxDownloads == 0 {
+		downloadLimit = "unlimited downloads"
+	} else if maxDownloads > 1 {
 		downloadLimit = fmt.Sprintf("%d downloads", maxDownloads)
 	}
 
 	// Prepare expiration description
-	expireText := formatDuration(expireDuration)
+	expireText := "never"
+	if expireDuration > 0 {
+		expireText = formatDuration(expireDuration)
+	}
+	// and the tiers the page picks a file's default from, by its size
+	retentionTiers := make([]fiber.Map, 0, len(retentionPolicy))
+	for _, tier := range retentionPolicy {
+		lifetime := "never"
+		if tier.lifetime > 0 {
+			lifetime = formatDuration(tier.lifetime)
+		}
+		retentionTiers = append(retentionTiers, fiber.Map{"max_size": tier.maxSize, "lifetime": lifetime})
+	}
 
 	// Template data
 	data := fiber.Map{
-		"RequiresAuth":  requiresAuth,
-		"AuthHeader":    authHeader,
-		"MaxUploadSize": formatBytes(maxUpload),
-		"DownloadLimit": downloadLimit,
-		"MaxDownloads":  maxDownloads,
-		"ExpireTime":    expireText,
+		"Brand":           brand,
+		"RequiresAuth":    requiresAuth,
+		"AuthHeader":      authHeader,
+		"BaseURL":         getBaseURL(c),
+		"MaxUploadSize":   formatBytes(maxUpload),
+		"MaxUploadBytes":  maxUpload,
+		"DownloadLimit":   downloadLimit,
+		"MaxDownloads":    maxDownloads,
+		"ExpireTime":      expireText,
+		"NeverExpires":    expireDuration == 0,
+		"RetentionPolicy": describeRetentionPolicy(),
+		"RetentionTiers":  retentionTiers,
+		"PasteMaxSize":    formatBytes(pasteMaxSize),
+		"MailEnabled":     mailEnabled(),
+		"Captcha":         captchaProvider != "" && user == nil,
+		"CaptchaProvider": captchaProvider,
+		"CaptchaSiteKey":  captchaSiteKey,
+
+		"AccountsEnabled":  accountsEnabled(),
+		"LocalLogin":       accountsLocal,
+		"OIDCLogin":        accountsOIDC,
+		"RegistrationOpen": accountsLocal && registrationOpen,
+		"User":             user,
 	}
 
 	return c.Render("index", data)
 }
 
+// computeExpiry returns the expiration time for a new upload of size
+// bytes, or nil when such files are configured to never expire.
+func computeExpiry(size int64) *time.Time {
+	lifetime, _ := retentionFor(size)
+	if lifetime == 0 {
+		return nil
+	}
+	expiresAt := time.Now().Add(lifetime)
+	return &expiresAt
+}
+
+// resolveExpiry returns the expiration time for an upload of size bytes that
+// asked for value ("12h", "7d", "never", ...), capped at FILE_EXPIRE_MAX or
+// the size's retention tier. An empty value uses the server default.
+func resolveExpiry(value string, size int64) (*time.Time, error) {
+	if value == "" {
+		return computeExpiry(size), nil
+	}
+
+	requested, err := parseDuration(value)
+	if err != nil || requested < 0 {
+		return nil, fmt.Errorf("invalid expiration: %s", value)
+	}
+	if _, limit := retentionFor(size); limit > 0 && (requested == 0 || requested > limit) {
+		requested = limit
+	}
+	if requested == 0 {
+		return nil, nil
+	}
+
+	expiresAt := time.Now().Add(requested)
+	return &expiresAt, nil
+}
+
+// resolveMaxDownloads returns the download limit for an upload that asked
+// for value. The global MAX_DOWNLOADS is both the default and the upper
+// bound; a nil result means the server default applies.
+func resolveMaxDownloads(value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	requested, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || requested < 0 {
+		return nil, fmt.Errorf("invalid download limit: %s", value)
+	}
+	if maxDownloads > 0 && (requested == 0 || requested > maxDownloads) {
+		requested = maxDownloads
+	}
+	return &requested, nil
+}
+
+// downloadLimit returns how many times the file may be downloaded, or 0 for
+// unlimited.
+func (f *FileRecord) downloadLimit() int {
+	if f.MaxDownloads != nil {
+		return *f.MaxDownloads
+	}
+	return maxDownloads
+}
+
 func generateUniqueID() string {
 	bytes := make([]byte, 16)
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)
 }
 
+// maxFilenameLength caps stored original filenames (in bytes), matching common
+// filesystem limits.
+const maxFilenameLength = 255
+
+// sanitizeFilename reduces a client-supplied filename to a safe base name:
+// path components, control characters (including CR/LF) and invalid UTF-8 are
+// stripped and the result is truncated to maxFilenameLength bytes while
+// keeping the extension.
+func sanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+
+	// Drop any directory components, whichever separator the client used
+	if idx := strings.LastIndexAny(name, `/\`); idx != -1 {
+		name = name[idx+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	name = strings.TrimLeft(name, ".")
+
+	if name == "" {
+		return "upload.bin"
+	}
+
+	if len(name) > maxFilenameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		base := name[:maxFilenameLength-len(ext)]
+		// Don't cut a multi-byte character in half
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+
+	return name
+}
+
+// contentDisposition builds an RFC 6266 Content-Disposition header value with
+// an ASCII-only quoted fallback and an RFC 5987 encoded filename* parameter, so
+// non-ASCII names survive and quotes or CRLF can never break out of the header.
+func contentDisposition(disposition, filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	var encoded strings.Builder
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, encoded.String())
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 ext-value.
+func isAttrChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) != -1
+}
+
+// getBaseURL returns the server's public address for links: BASE_URL when
+// set, otherwise the scheme and host the request came in on.
 func getBaseURL(c *fiber.Ctx) string {
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
 	scheme := "http"
 	if c.Protocol() == "https" {
 		scheme = "https"
 	}
-	return fmt.Sprintf("%s://%s", scheme, c.Get("Host"))
+	host := c.Get("Host")
+	if behindProxy() {
+		host = c.Hostname() // X-Forwarded-Host from a trusted proxy
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
 }
 
+// localBaseURL is where download links point for uploads that didn't come
+// over HTTP (SFTP, gRPC): BASE_URL, else the HTTP server on the address the
+// client connected to.
+func localBaseURL(local net.Addr) string {
+	if publicBaseURL != "" {
+		return publicBaseURL
+	}
+	scheme := "http"
+	if tlsEnabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(addrIP(local), getEnv("PORT", "3000")))
+}
+
+// addrIP is the IP of a connection's address, which uploads over SFTP and
+// gRPC are recorded and rate limited under.
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// getEnv returns the setting key from the environment, falling back to the
+// config file and then to defaultVal.
 func getEnv(key, defaultVal string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
+	if value := configValues[key]; value != "" {
+		return value
+	}
 	return defaultVal
 }
 
@@ -543,6 +1983,11 @@ func parseDuration(durationStr string) (time.Duration, error) {
 	// Remove spaces and convert to lowercase
 	durationStr = strings.TrimSpace(strings.ToLower(durationStr))
 
+	// "never" disables expiration entirely
+	if durationStr == "never" {
+		return 0, nil
+	}
+
 	// If it's just a number, treat as hours
 	if num, err := strconv.ParseFloat(durationStr, 64); err == nil {
 		return time.Duration(num * float64(time.Hour)), nil
@@ -574,6 +2019,8 @@ func parseDuration(durationStr string) (time.Duration, error) {
 	// Convert based on unit
 	var multiplier time.Duration
 	switch unit {
+	case "s", "sec", "second", "seconds":
+		multiplier = time.Second
 	case "", "h", "hour", "hours":
 		multiplier = time.Hour
 	case "m", "min", "minute", "minutes":
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// TestMain points the database and storage at a scratch directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "bashupload-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DB_DRIVER", "sqlite")
+	os.Setenv("DB_DSN", filepath.Join(dir, "test.db"))
+	os.Setenv("UPLOAD_DIR", filepath.Join(dir, "uploads"))
+	initDB()
+	initStorage()
+	loadCleanupConfig()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	longUTF8 := strings.Repeat("é", 200) + ".txt"
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"unix traversal", "../../etc/passwd", "passwd"},
+		{"windows traversal", `..\..\boot.ini`, "boot.ini"},
+		{"mixed separators", `a/b\c.txt`, "c.txt"},
+		{"trailing separator", "dir/", "upload.bin"},
+		{"CRLF", "evil\r\nSet-Cookie: x.txt", "evilSet-Cookie: x.txt"},
+		{"NUL", "a\x00b.txt", "ab.txt"},
+		{"quote kept", `say "hi".txt`, `say "hi".txt`},
+		{"leading dots", "..hidden", "hidden"},
+		{"surrounding space", "  notes.md  ", "notes.md"},
+		{"UTF-8", "résumé 日本.pdf", "résumé 日本.pdf"},
+		{"invalid UTF-8", "bad\xff\xfename.txt", "badname.txt"},
+		{"replacement char", "a�b.txt", "ab.txt"},
+		{"empty", "", "upload.bin"},
+		{"only dots", "...", "upload.bin"},
+		{"only control", "\r\n\t", "upload.bin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		got := sanitizeFilename(longUTF8)
+		if len(got) > maxFilenameLength {
+			t.Errorf("got %d bytes, want at most %d", len(got), maxFilenameLength)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("got invalid UTF-8 %q", got)
+		}
+		if !strings.HasSuffix(got, ".txt") {
+			t.Errorf("got %q, want the .txt extension kept", got)
+		}
+	})
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"plain", "report.pdf", `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`},
+		{"quote", `a"b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%22b.txt`},
+		{"backslash", `a\b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%5Cb.txt`},
+		{"CRLF", "a\r\nb.txt", `attachment; filename="a__b.txt"; filename*=UTF-8''a%0D%0Ab.txt`},
+		{"traversal", "../x", `attachment; filename="../x"; filename*=UTF-8''..%2Fx`},
+		{"space", "my file.txt", `attachment; filename="my file.txt"; filename*=UTF-8''my%20file.txt`},
+		{"UTF-8", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentDisposition("attachment", tt.filename)
+			if got != tt.want {
+				t.Errorf("contentDisposition(%q) = %s, want %s", tt.filename, got, tt.want)
+			}
+			if strings.ContainsAny(got, "\r\n") {
+				t.Errorf("contentDisposition(%q) contains CR or LF", tt.filename)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"5s", 5 * time.Second, false},
+		{"30sec", 30 * time.Second, false},
+		{"1.5s", 1500 * time.Millisecond, false},
+		{"30m", 30 * time.Minute, false},
+		{"2", 2 * time.Hour, false},
+		{"1d", 24 * time.Hour, false},
+		{"1mo", 30 * 24 * time.Hour, false},
+		{"never", 0, false},
+		{"5x", 0, true},
+		{"s", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseDuration(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDuration(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseDuration(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		size        int64
+		start, end  int64
+		partial     bool
+		unsatisfied bool
+	}{
+		{"no header", "", 100, 0, 99, false, false},
+		{"from the start", "bytes=0-", 100, 0, 99, true, false},
+		{"from an offset", "bytes=40-", 100, 40, 99, true, false},
+		{"closed", "bytes=10-19", 100, 10, 19, true, false},
+		{"end past EOF", "bytes=90-200", 100, 90, 99, true, false},
+		{"suffix", "bytes=-10", 100, 90, 99, true, false},
+		{"suffix over the size", "bytes=-500", 100, 0, 99, true, false},
+		{"zero suffix", "bytes=-0", 100, 0, 0, false, true},
+		{"start at EOF", "bytes=100-", 100, 0, 0, false, true},
+		{"start past EOF", "bytes=150-", 100, 0, 0, false, true},
+		{"multiple ranges", "bytes=0-9,20-29", 100, 0, 99, false, false},
+		{"empty file", "", 0, 0, -1, false, false},
+		{"empty file from the start", "bytes=0-", 0, 0, 0, false, true},
+		{"empty file suffix", "bytes=-10", 0, 0, 0, false, true},
+		{"other unit", "items=0-9", 100, 0, 99, false, false},
+		{"no dash", "bytes=10", 100, 0, 99, false, false},
+		{"not a number", "bytes=a-b", 100, 0, 99, false, false},
+		{"negative start", "bytes=--5", 100, 0, 99, false, false},
+		{"end before start", "bytes=20-10", 100, 0, 99, false, false},
+		{"bare unit", "bytes=", 100, 0, 99, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, partial, err := parseByteRange(tt.header, tt.size)
+			if (err != nil) != tt.unsatisfied {
+				t.Fatalf("parseByteRange(%q, %d) error = %v, want unsatisfiable %v", tt.header, tt.size, err, tt.unsatisfied)
+			}
+			if tt.unsatisfied {
+				return
+			}
+			if start != tt.start || end != tt.end || partial != tt.partial {
+				t.Errorf("parseByteRange(%q, %d) = %d, %d, %v; want %d, %d, %v",
+					tt.header, tt.size, start, end, partial, tt.start, tt.end, tt.partial)
+			}
+		})
+	}
+}
+
+func TestMultipartFieldLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  int
+		size    int
+		wantErr error
+	}{
+		{"few small fields", 10, 100, io.EOF},
+		{"field too large", 1, maxFormFieldSize + 1, errFormFieldTooLarge},
+		{"too many fields", maxFormFields + 1, 1, errTooManyFormFields},
+		{"too much in all", maxFormFieldsSize/maxFormFieldSize + 1, maxFormFieldSize, errTooManyFormFields},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			for i := 0; i < tt.fields; i++ {
+				writer.WriteField(fmt.Sprintf("field%d", i), strings.Repeat("x", tt.size))
+			}
+			writer.Close()
+
+			upload := &multipartUpload{
+				body:   &body,
+				reader: multipart.NewReader(&body, writer.Boundary()),
+				fields: make(map[string]string),
+			}
+			if _, err := upload.next(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("next() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
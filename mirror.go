@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Mirroring for cheap disaster recovery. With MIRROR_BACKEND set, every blob
+// an upload stores is copied to a second storage target (a directory, e.g. on
+// another disk, or another S3 bucket), and deleted from it once the primary
+// copy goes. Copies and deletions are queued in the database and run in the
+// background by the maintenance replica, retried with backoff while the
+// mirror is unreachable. A blob missing from the primary storage is served
+// from the mirror, and reconciliation with repair copies it back.
+
+const (
+	mirrorPollInterval = 30 * time.Second
+	mirrorBatchSize    = 100
+	mirrorMaxBackoff   = 6 * time.Hour
+)
+
+// What a MirrorJob does
+const (
+	mirrorCopy   = "copy"
+	mirrorDelete = "delete"
+)
+
+// MirrorJob is a blob waiting to be copied to, or deleted from, the mirror.
+type MirrorJob struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	Key           string    `json:"key" gorm:"not null;index"`
+	Op            string    `json:"op" gorm:"not null"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at" gorm:"not null;index"`
+	LastError     string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+var (
+	// The second storage target; nil when mirroring is off
+	mirrorStorage Storage
+	// Wakes mirrorLoop when a job is queued
+	mirrorWake = make(chan struct{}, 1)
+)
+
+// loadMirrorConfig reads MIRROR_BACKEND and its settings: MIRROR_DIR for a
+// local mirror, MIRROR_S3_* for a bucket. It runs after initStorage.
+func loadMirrorConfig() {
+	backend := strings.ToLower(getEnv("MIRROR_BACKEND", ""))
+	switch backend {
+	case "":
+		return
+	case "local":
+		dir := getEnv("MIRROR_DIR", "")
+		if dir == "" {
+			log.Fatal("MIRROR_BACKEND=local needs MIRROR_DIR")
+		}
+		if sameDir(dir, uploadDir) {
+			log.Fatal("MIRROR_DIR must not be UPLOAD_DIR")
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			log.Fatalf("Failed to create MIRROR_DIR: %v", err)
+		}
+		mirrorStorage = &LocalStorage{root: dir}
+		log.Printf("Mirroring uploads to %s", dir)
+	case "s3":
+		s3, err := newS3StorageFromEnv("MIRROR_S3_")
+		if err != nil {
+			log.Fatal("Failed to configure the S3 mirror: ", err)
+		}
+		mirrorStorage = s3
+		log.Printf("Mirroring uploads to s3 (bucket %s at %s)", s3.bucket, s3.endpoint)
+	default:
+		log.Fatalf("Unknown MIRROR_BACKEND '%s' (expected local or s3)", backend)
+	}
+}
+
+// sameDir reports whether a and b name the same directory.
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// enqueueMirror queues op on the blob stored under key.
+func enqueueMirror(key, op string) {
+	if mirrorStorage == nil {
+		return
+	}
+	job := MirrorJob{Key: key, Op: op, NextAttemptAt: time.Now()}
+	if err := db.Create(&job).Error; err != nil {
+		log.Printf("Failed to queue mirror %s of %s: %v", op, key, err)
+		return
+	}
+	select {
+	case mirrorWake <- struct{}{}:
+	default:
+	}
+}
+
+// mirrorLoop runs the queued jobs as they come, and retries failed ones
+// when they're due.
+func mirrorLoop() {
+	if mirrorStorage == nil {
+		return
+	}
+	ticker := time.NewTicker(mirrorPollInterval)
+	defer ticker.Stop()
+	for {
+		if isLeader() {
+			runMirrorJobs()
+		}
+		select {
+		case <-ticker.C:
+		case <-mirrorWake:
+		}
+	}
+}
+
+// runMirrorJobs works through the jobs that are due, oldest first.
+func runMirrorJobs() {
+	for {
+		var jobs []MirrorJob
+		db.Where("next_attempt_at <= ?", time.Now()).Order("id").Limit(mirrorBatchSize).Find(&jobs)
+		for i := range jobs {
+			runMirrorJob(&jobs[i])
+		}
+		if len(jobs) < mirrorBatchSize {
+			return
+		}
+	}
+}
+
+func runMirrorJob(job *MirrorJob) {
+	var err error
+	if job.Op == mirrorDelete {
+		err = mirrorStorage.Delete(job.Key)
+	} else {
+		err = mirrorBlob(job.Key)
+	}
+	if err == nil {
+		db.Delete(job)
+		return
+	}
+
+	// Back off from a minute, doubling up to mirrorMaxBackoff
+	job.Attempts++
+	backoff := mirrorMaxBackoff
+	if job.Attempts < 10 {
+		backoff = min(time.Minute<<(job.Attempts-1), mirrorMaxBackoff)
+	}
+	db.Model(job).Updates(map[string]interface{}{
+		"attempts":        job.Attempts,
+		"next_attempt_at": time.Now().Add(backoff),
+		"last_error":      err.Error(),
+	})
+	log.Printf("Mirror %s of %s failed (attempt %d, retrying in %s): %v", job.Op, job.Key, job.Attempts, formatDuration(backoff), err)
+}
+
+// mirrorBlob copies the blob stored under key to the mirror, unless it's
+// already there or has been deleted since.
+func mirrorBlob(key string) error {
+	size, err := fileStorage.Stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if mirrored, err := mirrorStorage.Stat(key); err == nil && mirrored == size {
+		return nil
+	}
+
+	reader, err := fileStorage.Open(key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return mirrorStorage.Save(key, reader, size)
+}
+
+// openBlob opens the blob stored under key, from the mirror when the primary
+// storage can't.
+func openBlob(key string) (io.ReadSeekCloser, error) {
+	reader, err := fileStorage.Open(key)
+	if err == nil || mirrorStorage == nil {
+		return reader, err
+	}
+	mirrored, mirrorErr := mirrorStorage.Open(key)
+	if mirrorErr != nil {
+		return nil, err
+	}
+	log.Printf("Serving %s from the mirror: %v", key, err)
+	return mirrored, nil
+}
+
+// statBlob returns the size of the blob stored under key, looking in the
+// mirror when it's missing from the primary storage.
+func statBlob(key string) (int64, error) {
+	size, err := fileStorage.Stat(key)
+	if err == nil || mirrorStorage == nil {
+		return size, err
+	}
+	if mirrored, mirrorErr := mirrorStorage.Stat(key); mirrorErr == nil {
+		return mirrored, nil
+	}
+	return size, err
+}
+
+// inMirror reports whether the mirror holds the blob stored under key.
+func inMirror(key string) bool {
+	if mirrorStorage == nil {
+		return false
+	}
+	_, err := mirrorStorage.Stat(key)
+	return err == nil
+}
+
+// restoreFromMirror copies the blob stored under key back from the mirror.
+func restoreFromMirror(key string) error {
+	size, err := mirrorStorage.Stat(key)
+	if err != nil {
+		return err
+	}
+	reader, err := mirrorStorage.Open(key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return fileStorage.Save(key, reader, size)
+}
+
+// handleAdminMirrorStatus is GET /api/admin/mirror: the jobs waiting, and
+// the ones that are failing with their last error.
+func handleAdminMirrorStatus(c *fiber.Ctx) error {
+	if mirrorStorage == nil {
+		return apiError(c, 404, "Mirroring is not enabled on this server")
+	}
+	var pending, failing int64
+	db.Model(&MirrorJob{}).Count(&pending)
+	db.Model(&MirrorJob{}).Where("attempts > 0").Count(&failing)
+	var failed []MirrorJob
+	db.Where("attempts > 0").Order("id").Limit(100).Find(&failed)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"pending": pending,
+			"failing": failing,
+			"failed":  failed,
+		},
+	})
+}
+
+// handleAdminMirrorSync is POST /api/admin/mirror/sync, which queues every
+// stored file for copying, e.g. after mirroring is turned on. Blobs already
+// mirrored are skipped when their turn comes.
+func handleAdminMirrorSync(c *fiber.Ctx) error {
+	if mirrorStorage == nil {
+		return apiError(c, 404, "Mirroring is not enabled on this server")
+	}
+	var keys []string
+	db.Unscoped().Model(&FileRecord{}).Distinct().Pluck("file_path", &keys)
+	for _, key := range keys {
+		enqueueMirror(key, mirrorCopy)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"queued":  len(keys),
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Multipart uploads to /api/upload are read part by part straight off the
+// connection, so a file goes to staging as it arrives instead of being
+// buffered whole first. Form fields can come anywhere, except api_key, which
+// has to come before the first file to authenticate the upload.
+
+// maxFormFieldSize caps a non-file form field, maxFormFields how many of
+// them an upload may send and maxFormFieldsSize their total size.
+const (
+	maxFormFieldSize  = 64 * 1024
+	maxFormFields     = 100
+	maxFormFieldsSize = 1024 * 1024
+)
+
+var (
+	errFormFieldTooLarge = errors.New("form field too large")
+	errTooManyFormFields = errors.New("too many form fields")
+)
+
+// multipartUpload reads one multipart request body in order. It's kept in
+// the request's locals, as the API key lookup may have started reading it.
+type multipartUpload struct {
+	body    io.Reader
+	tracked *progressReader
+	reader  *multipart.Reader
+	// Fields seen so far, first value wins
+	fields map[string]string
+	// Non-file parts read so far, and their total size
+	fieldCount int
+	fieldBytes int
+	// A file part read while looking for a field, not yet handed out
+	pending *multipart.Part
+	err     error
+}
+
+// streamsMultipart reports whether the request is a multipart upload that is
+// read as a stream rather than parsed into a form.
+func streamsMultipart(c *fiber.Ctx) bool {
+	_, route, _ := splitAPIPath(strings.TrimSuffix(c.Path(), "/"))
+	return c.Method() == fiber.MethodPost && route == "/upload" &&
+		strings.HasPrefix(strings.ToLower(c.Get(fiber.HeaderContentType)), fiber.MIMEMultipartForm)
+}
+
+// openMultipartUpload returns the request's multipart reader, creating it
+// the first time.
+func openMultipartUpload(c *fiber.Ctx) (*multipartUpload, error) {
+	if upload, ok := c.Locals("multipart_upload").(*multipartUpload); ok {
+		return upload, nil
+	}
+	_, params, err := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if err != nil || params["boundary"] == "" {
+		return nil, errors.New("missing multipart boundary")
+	}
+
+	// The body stream is gone once something has read the whole body
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	tracked := &progressReader{r: uploadThrottle().reader(body)}
+	upload := &multipartUpload{
+		body:    tracked,
+		tracked: tracked,
+		reader:  multipart.NewReader(tracked, params["boundary"]),
+		fields:  make(map[string]string),
+	}
+	c.Locals("multipart_upload", upload)
+	return upload, nil
+}
+
+// isFilePart reports whether part is a file in one of uploadFormFields.
+func isFilePart(part *multipart.Part) bool {
+	return part.FileName() != "" && containsString(uploadFormFields, part.FormName())
+}
+
+// next returns the next file part, collecting the fields before it, or
+// io.EOF after the last one. Files under other field names are skipped.
+func (u *multipartUpload) next() (*multipart.Part, error) {
+	if u.pending != nil {
+		part := u.pending
+		u.pending = nil
+		return part, nil
+	}
+	for u.err == nil {
+		part, err := u.reader.NextPart()
+		if err != nil {
+			u.err = err
+			// Read what follows the closing boundary, or a chunked body's
+			// last chunk would be left on the connection and taken for the
+			// next request
+			if err == io.EOF {
+				io.Copy(io.Discard, io.LimitReader(u.body, maxFormFieldSize))
+			}
+			break
+		}
+		if isFilePart(part) {
+			return part, nil
+		}
+		if part.FileName() != "" {
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+		if err != nil {
+			u.err = err
+			break
+		}
+		if len(value) > maxFormFieldSize {
+			u.err = errFormFieldTooLarge
+			break
+		}
+		u.fieldCount++
+		u.fieldBytes += len(value)
+		if u.fieldCount > maxFormFields || u.fieldBytes > maxFormFieldsSize {
+			u.err = errTooManyFormFields
+			break
+		}
+		if _, seen := u.fields[part.FormName()]; !seen {
+			u.fields[part.FormName()] = string(value)
+		}
+	}
+	return nil, u.err
+}
+
+// leadingValue returns a field sent before the first file, reading up to
+// that file if need be.
+func (u *multipartUpload) leadingValue(name string) string {
+	if u.pending == nil {
+		if part, err := u.next(); err == nil {
+			u.pending = part
+		}
+	}
+	return u.fields[name]
+}
+
+// value returns a field seen so far; after the last file, that's all of them.
+func (u *multipartUpload) value(name string) string {
+	return u.fields[name]
+}
+
+// formAPIKey is the api_key field of a streamed multipart upload.
+func formAPIKey(c *fiber.Ctx) string {
+	upload, err := openMultipartUpload(c)
+	if err != nil {
+		return ""
+	}
+	return upload.leadingValue("api_key")
+}
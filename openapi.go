@@ -0,0 +1,109 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/filesystem"
+	swaggerFiles "github.com/swaggo/files/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// The OpenAPI document is kept by hand in openapi.yaml next to the handlers
+// it describes, and served as JSON at /api/openapi.json so clients can be
+// generated from it. /api/docs/ serves Swagger UI pointed at that document.
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+// swaggerInitializer replaces the initializer bundled with Swagger UI, which
+// loads the petstore example.
+const swaggerInitializer = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "/api/openapi.json",
+    dom_id: '#swagger-ui',
+    deepLinking: true,
+    presets: [
+      SwaggerUIBundle.presets.apis,
+      SwaggerUIStandalonePreset
+    ],
+    plugins: [
+      SwaggerUIBundle.plugins.DownloadUrl
+    ],
+    layout: "StandaloneLayout"
+  });
+};
+`
+
+func setupDocsRoutes(app *fiber.App) {
+	app.Get("/api/openapi.json", handleOpenAPI)
+	app.Get("/api/v1/openapi.json", handleOpenAPI)
+	app.Get("/api/docs", func(c *fiber.Ctx) error {
+		// Swagger UI loads its assets relative to the page. Routing isn't
+		// strict, so this also matches /api/docs/.
+		if !strings.HasSuffix(c.Path(), "/") {
+			return c.Redirect("/api/docs/", fiber.StatusMovedPermanently)
+		}
+		return c.Next()
+	})
+	app.Get("/api/docs/swagger-initializer.js", func(c *fiber.Ctx) error {
+		c.Type("js")
+		return c.SendString(swaggerInitializer)
+	})
+	app.Use("/api/docs", filesystem.New(filesystem.Config{
+		Root:   http.FS(swaggerFiles.FS),
+		MaxAge: 3600,
+	}))
+}
+
+// loadOpenAPIDoc parses the embedded document once. It's checked into the
+// repository, so a parse error is a bug rather than something to recover from
+// at runtime; the endpoint answers 500 and the error is logged.
+func loadOpenAPIDoc() map[string]interface{} {
+	openAPIOnce.Do(func() {
+		if err := yaml.Unmarshal(openAPISpec, &openAPIDoc); err != nil {
+			log.Printf("Failed to parse openapi.yaml: %v", err)
+		}
+	})
+	return openAPIDoc
+}
+
+func handleOpenAPI(c *fiber.Ctx) error {
+	doc := loadOpenAPIDoc()
+	if doc == nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "API description unavailable",
+		})
+	}
+
+	// Point "Try it out" and generated clients at this instance. The parsed
+	// document is shared, so only the top level is copied.
+	served := make(map[string]interface{}, len(doc)+1)
+	for k, v := range doc {
+		served[k] = v
+	}
+	served["servers"] = []fiber.Map{{"url": getBaseURL(c)}}
+
+	body, err := json.Marshal(served)
+	if err != nil {
+		log.Printf("Failed to encode OpenAPI document: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "API description unavailable",
+		})
+	}
+	c.Set("Cache-Control", "public, max-age=300")
+	c.Type("json")
+	return c.Send(body)
+}
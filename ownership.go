@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Who may manage an upload. Files and bundles are managed with the delete
+// token handed out when they were made, or by whoever they're attributed
+// to. Deletes, short links, bundles and signing all check the same way.
+
+// ownsUpload reports whether the request comes from whoever a file or bundle
+// is attributed to: an admin, the signed-in user or the issued API key. An
+// upload token stands in for its issuer to upload, never to manage what the
+// issuer uploaded.
+func ownsUpload(c *fiber.Ctx, userID, apiKeyID *uint) bool {
+	if hasValidAdminKey(c) {
+		return true
+	}
+	// Resolving the key marks a request that carries an upload token
+	requestAPIKey(c)
+	if token, _ := c.Locals("upload_token").(bool); token {
+		return false
+	}
+	if user := currentUser(c); user != nil && userID != nil && *userID == user.ID {
+		return true
+	}
+	if keyID := currentAPIKeyID(c); keyID != nil && apiKeyID != nil && *keyID == *apiKeyID {
+		return true
+	}
+	return false
+}
+
+// tokenMatches compares a token from the client with a stored hash, in
+// constant time.
+func tokenMatches(token, hash string) bool {
+	return token != "" && hash != "" &&
+		subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), []byte(hash)) == 1
+}
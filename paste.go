@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Pastebin-style text snippets. A paste is an ordinary upload marked with
+// its language, so expiry, download limits, passwords and deletion work as
+// for any file; /p/:id shows it highlighted and /p/:id/raw as plain text.
+// Both count as a download, like /d/.
+
+var (
+	pasteMaxSize int64
+	pasteStyle   *chroma.Style
+)
+
+// loadPasteConfig reads PASTE_MAX_SIZE (default 1MB, never more than
+// MAX_UPLOAD_SIZE) and PASTE_STYLE.
+func loadPasteConfig() {
+	sizeStr := getEnv("PASTE_MAX_SIZE", "1MB")
+	var err error
+	pasteMaxSize, err = parseSize(sizeStr)
+	if err != nil || pasteMaxSize <= 0 {
+		log.Printf("Invalid PASTE_MAX_SIZE value '%s', using default 1MB", sizeStr)
+		pasteMaxSize = 1024 * 1024
+	}
+	if pasteMaxSize > maxUpload {
+		pasteMaxSize = maxUpload
+	}
+
+	styleName := getEnv("PASTE_STYLE", "monokai")
+	pasteStyle = styles.Get(styleName)
+	if pasteStyle == styles.Fallback && styleName != styles.Fallback.Name {
+		log.Printf("Unknown PASTE_STYLE '%s', using %s", styleName, styles.Fallback.Name)
+	}
+}
+
+func setupPasteRoutes(app *fiber.App, upload fiber.Handler) {
+	app.Put("/paste", upload, handlePasteUpload)
+	app.Get("/p/:id", handlePasteView)
+	app.Get("/p/:id/raw", handlePasteRaw)
+	// Password prompt submissions
+	app.Post("/p/:id", handlePasteView)
+	app.Post("/p/:id/raw", handlePasteRaw)
+}
+
+// pasteLexer picks the lexer for a paste: the language asked for, then one
+// matching the file name, then a guess from the text itself.
+func pasteLexer(language, filename, text string) chroma.Lexer {
+	if language != "" {
+		return lexers.Get(language)
+	}
+	if lexer := lexers.Match(filename); lexer != nil {
+		return lexer
+	}
+	if lexer := lexers.Analyse(text); lexer != nil {
+		return lexer
+	}
+	return lexers.Fallback
+}
+
+// handlePasteUpload is PUT /paste: the body is the text. Options as for curl
+// uploads (?expires=, ?downloads=, X-File-Password) plus ?lang= or the
+// X-Paste-Language header and ?filename=.
+func handlePasteUpload(c *fiber.Ctx) error {
+	filename := sanitizeFilename(c.Query("filename", "paste.txt"))
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		ext = ".txt"
+	}
+
+	if int64(c.Request().Header.ContentLength()) > pasteMaxSize {
+		return c.Status(413).SendString(fmt.Sprintf("Paste too large. Maximum size is %s", formatBytes(pasteMaxSize)))
+	}
+	text := c.Body()
+	if len(text) == 0 {
+		return c.Status(400).SendString("Empty paste")
+	}
+	if int64(len(text)) > pasteMaxSize {
+		return c.Status(413).SendString(fmt.Sprintf("Paste too large. Maximum size is %s", formatBytes(pasteMaxSize)))
+	}
+	if !utf8.Valid(text) {
+		return c.Status(415).SendString("Pastes must be UTF-8 text; upload binary files with PUT /")
+	}
+
+	language := c.Query("lang")
+	if language == "" {
+		language = c.Get("X-Paste-Language")
+	}
+	lexer := pasteLexer(language, filename, string(text))
+	if lexer == nil {
+		return c.Status(400).SendString(fmt.Sprintf("Unknown language '%s'", language))
+	}
+
+	if quotaErr := checkUploadQuota(c.IP(), int64(len(text))); quotaErr != nil {
+		return c.Status(quotaErr.status).SendString(quotaErr.message)
+	}
+	ticket, refusal := admitUpload(int64(len(text)))
+	if refusal != nil {
+		return refuseUpload(c, refusal)
+	}
+	defer ticket.release()
+
+	expiresValue := c.Query("expires")
+	if expiresValue == "" {
+		expiresValue = c.Get("X-Expire-After")
+	}
+	expiresAt, err := resolveExpiry(expiresValue, int64(len(text)))
+	if err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Invalid expiration '%s'", expiresValue))
+	}
+	downloadsValue := c.Query("downloads")
+	if downloadsValue == "" {
+		downloadsValue = c.Get("X-Max-Downloads")
+	}
+	fileMaxDownloads, err := resolveMaxDownloads(downloadsValue)
+	if err != nil {
+		return c.Status(400).SendString(fmt.Sprintf("Invalid download limit '%s'", downloadsValue))
+	}
+	passwordHash, err := hashPassword(c.Get("X-File-Password"))
+	if err != nil {
+		return c.Status(400).SendString("Invalid password")
+	}
+	slugValue := requestedSlug(c)
+	slug, err := resolveSlug(slugValue)
+	if err != nil {
+		return c.Status(slugStatus(err)).SendString(slugErrorMessage(slugValue, err))
+	}
+
+	uniqueID := newFileID()
+	stagedPath := newStagingPath()
+	staged, err := saveStream(stagedPath, bytes.NewReader(text))
+	if err != nil {
+		os.Remove(stagedPath)
+		return c.Status(500).SendString("Failed to save paste")
+	}
+	storageKey, nonce, err := storeBlob(newStorageKey(ext), staged)
+	if err != nil {
+		log.Printf("Failed to store %s: %v", storageKey, err)
+		return c.Status(500).SendString("Failed to save paste")
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+
+	fileRecord := FileRecord{
+		UniqueID:        uniqueID,
+		OriginalName:    filename,
+		FilePath:        storageKey,
+		IPFSCID:         blobCID(storageKey),
+		Compression:     staged.Compression,
+		CompressedSize:  staged.CompressedSize,
+		FileSize:        staged.Size,
+		SHA256:          staged.Digest.SHA256,
+		MD5:             staged.Digest.MD5,
+		EncryptionNonce: nonce,
+		// Served as text whatever it looks like, so it can't become HTML
+		MimeType:      "text/plain; charset=utf-8",
+		Extension:     ext,
+		PasteLanguage: lexer.Config().Name,
+		MaxDownloads:  fileMaxDownloads,
+		PasswordHash:  passwordHash,
+		DeleteToken:   deleteTokenHash,
+		ScanStatus:    initialScanStatus(),
+		Moderation:    initialModeration(),
+		HoldReason:    initialHoldReason(),
+		IPAddress:     storedIP(c.IP()),
+		UserID:        currentUserID(c),
+		APIKeyID:      currentAPIKeyID(c),
+		Slug:          slug,
+		ExpiresAt:     expiresAt,
+	}
+
+	if err := createFileRecord(db, &fileRecord); err != nil {
+		// Clean up file if database save fails
+		releaseBlob(storageKey)
+		if isSlugConflict(err, &fileRecord) {
+			return c.Status(409).SendString(slugErrorMessage(slugValue, errSlugTaken))
+		}
+		return c.Status(500).SendString("Failed to save paste metadata")
+	}
+	queueScan(fileRecord)
+	logUpload(c, &fileRecord)
+	sendWebhook(c, webhookUploaded, &fileRecord, "")
+
+	baseURL := getBaseURL(c)
+	pasteURL := signLink(baseURL+fileRecord.pastePath(), &fileRecord)
+	rawURL := signLink(baseURL+fileRecord.pastePath()+"/raw", &fileRecord)
+	downloadURL := baseURL + fileRecord.downloadPath()
+	c.Set("X-Delete-Token", deleteToken)
+	c.Set("X-Checksum-SHA256", staged.Digest.SHA256)
+	return c.SendString(fmt.Sprintf("%s\nraw: %s\ndelete token: %s (curl -X DELETE -H \"X-Delete-Token: %s\" %s)\n",
+		pasteURL, rawURL, deleteToken, deleteToken, downloadURL))
+}
+
+// readPaste applies the usual download checks to a paste and returns its
+// text. When it returns nil the response is already written.
+func readPaste(c *fiber.Ctx) (*FileRecord, []byte, error) {
+	fileRecord, err := lookupDownload(c, c.Params("id"))
+	if fileRecord == nil {
+		return nil, nil, err
+	}
+	if fileRecord.PasteLanguage == "" {
+		// An ordinary upload: send it to its download link
+		return nil, nil, c.Redirect(forwardSignature(c, fileRecord.downloadPath(), fileRecord), 302)
+	}
+	if ok, password := fileUnlocked(c, fileRecord); !ok {
+		return nil, nil, passwordRequired(c, fileRecord, password != "")
+	}
+	// Probing a link with HEAD doesn't use up a download
+	countsAsDownload := c.Method() != fiber.MethodHead
+	ok, claim, err := admitDownload(c, fileRecord, countsAsDownload)
+	if !ok {
+		return nil, nil, err
+	}
+
+	reader, err := openFileRecord(fileRecord)
+	if err != nil {
+		claim.refund()
+		requestLog(c).Error("Failed to open file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return nil, nil, c.Status(500).SendString("Failed to open paste")
+	}
+	defer reader.Close()
+	text, err := io.ReadAll(reader)
+	// Pastes are small and sent from memory, so reading one is the transfer
+	if err != nil {
+		claim.refund()
+		return nil, nil, c.Status(500).SendString("Failed to read paste")
+	}
+	claim.serving(int64(len(text)))
+	claim.finish(int64(len(text)), int64(len(text)))
+	if countsAsDownload {
+		recordDownloadUsage(fileRecord, int64(len(text)), true)
+		audit(c, auditDownload, fileRecord.UniqueID, "paste")
+	}
+	return fileRecord, text, nil
+}
+
+func handlePasteRaw(c *fiber.Ctx) error {
+	fileRecord, text, err := readPaste(c)
+	if fileRecord == nil {
+		return err
+	}
+	c.Set("Content-Type", "text/plain; charset=utf-8")
+	c.Set("Content-Disposition", contentDisposition("inline", fileRecord.OriginalName))
+	c.Set("X-Content-Type-Options", "nosniff")
+	setChecksumHeaders(c, fileRecord)
+	return c.Send(text)
+}
+
+func handlePasteView(c *fiber.Ctx) error {
+	fileRecord, text, err := readPaste(c)
+	if fileRecord == nil {
+		return err
+	}
+
+	lexer := lexers.Get(fileRecord.PasteLanguage)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	var highlighted bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithLineNumbers(true), chromahtml.LineNumbersInTable(true), chromahtml.TabWidth(4))
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(text))
+	if err == nil {
+		err = formatter.Format(&highlighted, pasteStyle, iterator)
+	}
+	if err != nil {
+		// Fall back to the plain text
+		highlighted.Reset()
+		highlighted.WriteString("<pre>")
+		template.HTMLEscape(&highlighted, text)
+		highlighted.WriteString("</pre>")
+	}
+
+	expires := "never"
+	if fileRecord.ExpiresAt != nil {
+		expires = fileRecord.ExpiresAt.Format("2006-01-02 15:04")
+	}
+	baseURL := getBaseURL(c)
+	return c.Render("paste", fiber.Map{
+		"Brand":       brand,
+		"Filename":    fileRecord.OriginalName,
+		"Language":    fileRecord.PasteLanguage,
+		"Size":        formatBytes(fileRecord.FileSize),
+		"Expires":     expires,
+		"Highlighted": template.HTML(highlighted.String()),
+		"RawURL":      forwardSignature(c, fmt.Sprintf("%s/p/%s/raw", baseURL, fileRecord.UniqueID), fileRecord),
+		"DownloadURL": forwardSignature(c, baseURL+fileRecord.downloadPath(), fileRecord),
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The player: /play/:filename is a page with an HTML5 player for a video or
+// audio upload, so a screen recording can be watched in the browser instead
+// of downloaded. The player streams from the download link with ?inline=1,
+// which serves media inline, and seeks with Range requests; as with any
+// download, only requests from the first byte count toward the limit. Other
+// files are sent to their preview page.
+
+func setupPlayRoutes(app *fiber.App) {
+	app.Get("/play/:filename", handlePlay)
+	// Password prompt submissions
+	app.Post("/play/:filename", handlePlay)
+}
+
+// playable reports whether fileRecord is audio or video.
+func playable(fileRecord *FileRecord) bool {
+	kind := previewKind(fileRecord)
+	return kind == previewVideo || kind == previewAudio
+}
+
+func handlePlay(c *fiber.Ctx) error {
+	filename := c.Params("filename")
+	fileRecord, err := lookupDownload(c, strings.TrimSuffix(filename, filepath.Ext(filename)))
+	if fileRecord == nil {
+		return err
+	}
+	baseURL := getBaseURL(c)
+	name := fileRecord.UniqueID + fileRecord.Extension
+	if !playable(fileRecord) {
+		return c.Redirect(forwardSignature(c, fmt.Sprintf("%s/v/%s", baseURL, name), fileRecord), 302)
+	}
+	if ok, password := checkFilePassword(c, fileRecord); !ok {
+		return passwordRequired(c, fileRecord, password != "")
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 && fileRecord.Downloads >= limit {
+		return c.Status(410).SendString(fmt.Sprintf("File has reached maximum download limit (%d)", limit))
+	}
+
+	downloadURL := baseURL + fileRecord.downloadPath()
+	mediaURL := downloadURL + "?inline=1"
+	if fileRecord.PasswordHash != "" {
+		// The media element can't send the password, so it gets a token
+		expires := time.Now().Add(previewTokenTTL).Unix()
+		mediaURL += fmt.Sprintf("&expires=%d&token=%s", expires, previewToken(fileRecord.UniqueID, expires))
+	}
+
+	data := fiber.Map{
+		"Brand":       brand,
+		"Filename":    fileRecord.OriginalName,
+		"Size":        formatBytes(fileRecord.FileSize),
+		"MimeType":    fileRecord.MimeType,
+		"Kind":        previewKind(fileRecord),
+		"MediaURL":    forwardSignature(c, mediaURL, fileRecord),
+		"DownloadURL": forwardSignature(c, downloadURL, fileRecord),
+		"Expires":     "never",
+	}
+	if fileRecord.ExpiresAt != nil {
+		data["Expires"] = fileRecord.ExpiresAt.Format("2006-01-02 15:04")
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 {
+		data["DownloadsLeft"] = limit - fileRecord.Downloads
+	}
+	return c.Render("play", data)
+}
+
+// setInlineHeaders serves a download asked for with ?inline=1 for the
+// browser to play, when it's audio or video, under a CSP that keeps it
+// from doing anything else.
+func setInlineHeaders(c *fiber.Ctx, fileRecord *FileRecord) {
+	if !c.QueryBool("inline") || !playable(fileRecord) {
+		return
+	}
+	c.Set("Content-Disposition", contentDisposition("inline", fileRecord.OriginalName))
+	c.Set("Content-Security-Policy", "default-src 'none'; media-src 'self'; sandbox")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// Profiling endpoints for operators chasing a misbehaving server. With
+// DEBUG_PPROF=true the Go runtime's pprof handlers are served under
+// /debug/pprof/ on DEBUG_PPROF_ADDR, a listener of their own kept off the
+// public port (loopback by default), and every request needs the admin key
+// in X-Admin-Key or "Authorization: Bearer <key>", or an API key with the
+// admin scope:
+//
+//	curl -H "X-Admin-Key: $ADMIN_KEY" -o cpu.pprof "localhost:6060/debug/pprof/profile?seconds=30"
+//	go tool pprof cpu.pprof
+
+// pprofWriteTimeout leaves room for the longest CPU profiles and traces
+const pprofWriteTimeout = 5 * time.Minute
+
+var (
+	pprofEnabled bool
+	pprofAddr    string
+)
+
+// loadPprofConfig reads DEBUG_PPROF and DEBUG_PPROF_ADDR. It runs after
+// loadAdminConfig.
+func loadPprofConfig() {
+	pprofEnabled = getEnv("DEBUG_PPROF", "false") == "true"
+	if !pprofEnabled {
+		return
+	}
+	if adminKey == "" {
+		log.Fatal("DEBUG_PPROF needs ADMIN_KEY, which its endpoints require")
+	}
+	pprofAddr = getEnv("DEBUG_PPROF_ADDR", "127.0.0.1:6060")
+}
+
+// servePprof serves the profiling endpoints until the process exits.
+func servePprof() {
+	if !pprofEnabled {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	server := &http.Server{
+		Addr:              pprofAddr,
+		Handler:           requireAdminKey(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      pprofWriteTimeout,
+	}
+	log.Printf("Profiling endpoints at http://%s/debug/pprof/ (admin key required)", pprofAddr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Profiling listener failed: %v", err)
+	}
+}
+
+// requireAdminKey lets through requests carrying an admin credential.
+func requireAdminKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.Header.Get("X-Admin-Key")
+		if provided == "" {
+			provided = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if !isAdminCredential(provided) {
+			log.Printf("Refused profiling request from %s: invalid or missing admin key", r.RemoteAddr)
+			http.Error(w, "Invalid or missing admin key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
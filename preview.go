@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/gofiber/fiber/v2"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"gorm.io/gorm"
+)
+
+// Preview pages: /v/:filename shows a file in the browser (images, video,
+// audio, PDFs, Markdown and text) with its details and a download button.
+// Viewing doesn't count as a download, so a link can be shared for looking at
+// without using up its download limit. Media is fetched by the page from
+// /v/:filename/content, served inline under a sandboxing CSP.
+//
+// Every file also gets a view-only link, /v/:token, with a token of its own
+// in place of the ID. Its page has no download button and doesn't give the
+// ID away, so a burn-after-reading file can be shown to someone without
+// their being able to use up the download. Opening it counts as a view, up
+// to MAX_VIEWS.
+
+const (
+	previewImage    = "image"
+	previewVideo    = "video"
+	previewAudio    = "audio"
+	previewPDF      = "pdf"
+	previewMarkdown = "markdown"
+	previewText     = "text"
+
+	// Larger text files are shown truncated
+	previewTextLimit = 512 * 1024
+	// How long the media link on a password-protected file's page works
+	previewTokenTTL = time.Hour
+)
+
+// maxViews is how often a view-only link can be opened; 0 means no limit.
+var maxViews int
+
+// loadPreviewConfig reads MAX_VIEWS.
+func loadPreviewConfig() {
+	viewsStr := getEnv("MAX_VIEWS", "0")
+	var err error
+	maxViews, err = strconv.Atoi(viewsStr)
+	if err != nil || maxViews < 0 {
+		log.Printf("Invalid MAX_VIEWS value '%s', using default unlimited", viewsStr)
+		maxViews = 0
+	}
+}
+
+// previewSecret signs media links of password-protected files, which the
+// browser fetches without the password. Links die with the process.
+var previewSecret = func() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+}()
+
+func setupPreviewRoutes(app *fiber.App) {
+	app.Get("/v/:filename", handlePreview)
+	app.Get("/v/:filename/content", handlePreviewContent)
+	// Password prompt submissions
+	app.Post("/v/:filename", handlePreview)
+}
+
+// previewKind says how a file is shown, or "" when it can't be previewed.
+func previewKind(fileRecord *FileRecord) string {
+	mimeType, _, _ := strings.Cut(fileRecord.MimeType, ";")
+	mimeType = strings.TrimSpace(strings.ToLower(mimeType))
+	ext := strings.ToLower(fileRecord.Extension)
+
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return previewImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return previewVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return previewAudio
+	case mimeType == "application/pdf":
+		return previewPDF
+	case ext == ".md" || ext == ".markdown" || mimeType == "text/markdown":
+		return previewMarkdown
+	case strings.HasPrefix(mimeType, "text/"), mimeType == "application/json",
+		mimeType == "application/xml", mimeType == "application/javascript":
+		return previewText
+	}
+	return ""
+}
+
+func previewToken(uniqueID string, expires int64) string {
+	mac := hmac.New(sha256.New, previewSecret)
+	fmt.Fprintf(mac, "%s:%d", uniqueID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// previewTokenValid checks the ?expires= and ?token= of a media link.
+func previewTokenValid(c *fiber.Ctx, uniqueID string) bool {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(c.Query("token")), []byte(previewToken(uniqueID, expires)))
+}
+
+// lookupPreview finds a file to preview, by its view-only token or its ID,
+// and says whether it was the token. Like a download it must be live,
+// scanned and within its download limit, but viewing doesn't count.
+func lookupPreview(c *fiber.Ctx) (*FileRecord, bool, error) {
+	filename := c.Params("filename")
+	var fileRecord *FileRecord
+	var err error
+	var byToken FileRecord
+	viewOnly := db.Where("view_token = ?", filename).First(&byToken).Error == nil
+	if viewOnly {
+		fileRecord, err = servableFile(c, &byToken)
+	} else {
+		fileRecord, err = lookupDownload(c, strings.TrimSuffix(filename, filepath.Ext(filename)))
+	}
+	if fileRecord == nil {
+		return nil, false, err
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 && fileRecord.Downloads >= limit {
+		return nil, false, c.Status(410).SendString(fmt.Sprintf("File has reached maximum download limit (%d)", limit))
+	}
+	return fileRecord, viewOnly, nil
+}
+
+// countView counts an opening of fileRecord's view-only page, reporting
+// false once MAX_VIEWS have been used up.
+func countView(fileRecord *FileRecord) bool {
+	query := db.Model(&FileRecord{}).Where("id = ?", fileRecord.ID)
+	if maxViews > 0 {
+		query = query.Where("views < ?", maxViews)
+	}
+	result := query.UpdateColumn("views", gorm.Expr("views + 1"))
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	fileRecord.Views++
+	return true
+}
+
+// viewURL is fileRecord's view-only link, or "" for a file from before they
+// were given out.
+func viewURL(baseURL string, fileRecord *FileRecord) string {
+	if fileRecord.ViewToken == nil {
+		return ""
+	}
+	return signLink(baseURL+"/v/"+*fileRecord.ViewToken, fileRecord)
+}
+
+// readPreviewText returns the start of a text file, and whether it was cut
+// short. ok is false when it isn't UTF-8 after all.
+func readPreviewText(fileRecord *FileRecord) (text []byte, truncated, ok bool) {
+	reader, err := openFileRecord(fileRecord)
+	if err != nil {
+		return nil, false, false
+	}
+	defer reader.Close()
+	text, err = io.ReadAll(io.LimitReader(reader, previewTextLimit+1))
+	if err != nil {
+		return nil, false, false
+	}
+	if len(text) > previewTextLimit {
+		text, truncated = text[:previewTextLimit], true
+		// Drop a character cut in half by the limit
+		for i := 0; i < utf8.UTFMax && !utf8.Valid(text); i++ {
+			text = text[:len(text)-1]
+		}
+	}
+	return text, truncated, utf8.Valid(text)
+}
+
+// renderPreviewText highlights text with the lexer matching its file name,
+// with line numbers.
+func renderPreviewText(filename string, text []byte) template.HTML {
+	lexer := lexers.Match(filename)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	var highlighted bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithLineNumbers(true), chromahtml.LineNumbersInTable(true), chromahtml.TabWidth(4))
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(text))
+	if err == nil {
+		err = formatter.Format(&highlighted, pasteStyle, iterator)
+	}
+	if err != nil {
+		highlighted.Reset()
+		highlighted.WriteString("<pre>")
+		template.HTMLEscape(&highlighted, text)
+		highlighted.WriteString("</pre>")
+	}
+	return template.HTML(highlighted.String())
+}
+
+// markdown renders GitHub-flavoured Markdown. Raw HTML in the source is left
+// out, so a document can't bring its own scripts.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+func renderPreviewMarkdown(text []byte) template.HTML {
+	var rendered bytes.Buffer
+	if err := markdown.Convert(text, &rendered); err != nil {
+		rendered.Reset()
+		rendered.WriteString("<pre>")
+		template.HTMLEscape(&rendered, text)
+		rendered.WriteString("</pre>")
+	}
+	return template.HTML(rendered.String())
+}
+
+// handlePreview is GET /v/:filename, the preview page, and GET /v/:token,
+// its view-only form.
+func handlePreview(c *fiber.Ctx) error {
+	fileRecord, viewOnly, err := lookupPreview(c)
+	if fileRecord == nil {
+		return err
+	}
+	if ok, password := checkFilePassword(c, fileRecord); !ok {
+		return passwordRequired(c, fileRecord, password != "")
+	}
+	if viewOnly && !countView(fileRecord) {
+		return c.Status(410).SendString(fmt.Sprintf("This view link has reached its limit (%d views)", maxViews))
+	}
+
+	baseURL := getBaseURL(c)
+	name := fileRecord.UniqueID + fileRecord.Extension
+	if viewOnly {
+		name = *fileRecord.ViewToken
+	}
+	data := fiber.Map{
+		"Brand":     brand,
+		"Filename":  fileRecord.OriginalName,
+		"Size":      formatBytes(fileRecord.FileSize),
+		"MimeType":  fileRecord.MimeType,
+		"Uploaded":  fileRecord.UploadedAt.Format("2006-01-02 15:04"),
+		"Expires":   "never",
+		"Downloads": fileRecord.Downloads,
+		"SHA256":    fileRecord.SHA256,
+		"Kind":      previewKind(fileRecord),
+		"ViewOnly":  viewOnly,
+	}
+	if viewOnly {
+		data["Views"] = fileRecord.Views
+		if maxViews > 0 {
+			data["ViewsLeft"] = maxViews - fileRecord.Views
+		}
+	} else {
+		data["DownloadURL"] = forwardSignature(c, baseURL+fileRecord.downloadPath(), fileRecord)
+		if playable(fileRecord) {
+			data["PlayURL"] = forwardSignature(c, fmt.Sprintf("%s/play/%s", baseURL, name), fileRecord)
+		}
+	}
+	if fileRecord.ExpiresAt != nil {
+		data["Expires"] = fileRecord.ExpiresAt.Format("2006-01-02 15:04")
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 {
+		data["DownloadsLeft"] = limit - fileRecord.Downloads
+	}
+
+	switch data["Kind"] {
+	case previewImage, previewVideo, previewAudio, previewPDF:
+		contentURL := fmt.Sprintf("%s/v/%s/content", baseURL, name)
+		if fileRecord.PasswordHash != "" {
+			expires := time.Now().Add(previewTokenTTL).Unix()
+			contentURL += fmt.Sprintf("?expires=%d&token=%s", expires, previewToken(fileRecord.UniqueID, expires))
+		}
+		data["ContentURL"] = forwardSignature(c, contentURL, fileRecord)
+	case previewMarkdown, previewText:
+		text, truncated, ok := readPreviewText(fileRecord)
+		if !ok {
+			data["Kind"] = ""
+			break
+		}
+		data["Truncated"] = truncated
+		if data["Kind"] == previewMarkdown {
+			data["Rendered"] = renderPreviewMarkdown(text)
+		} else {
+			data["Rendered"] = renderPreviewText(fileRecord.OriginalName, text)
+		}
+	}
+
+	return c.Render("preview", data)
+}
+
+// handlePreviewContent is GET /v/:filename/content, the file itself served
+// inline for the preview page's media element. Only media types are served
+// this way, and none count as a download.
+func handlePreviewContent(c *fiber.Ctx) error {
+	fileRecord, _, err := lookupPreview(c)
+	if fileRecord == nil {
+		return err
+	}
+	switch previewKind(fileRecord) {
+	case previewImage, previewVideo, previewAudio, previewPDF:
+	default:
+		return c.Status(404).SendString("No preview for this file type")
+	}
+	if ok, _ := fileUnlocked(c, fileRecord); !ok {
+		return c.Status(401).SendString("Password required")
+	}
+
+	// Let the player seek
+	start, end, partial, err := parseByteRange(c.Get("Range"), fileRecord.FileSize)
+	if err != nil {
+		c.Set("Content-Range", fmt.Sprintf("bytes */%d", fileRecord.FileSize))
+		return c.Status(416).SendString("Requested range not satisfiable")
+	}
+	served := fileRecord.FileSize
+	if partial {
+		served = end - start + 1
+	}
+	recordDownloadUsage(fileRecord, served, false)
+
+	setDownloadHeaders(c, fileRecord)
+	c.Set("Content-Disposition", contentDisposition("inline", fileRecord.OriginalName))
+	// Opened directly, an SVG must not run scripts on this origin. Browsers
+	// won't show PDFs in a sandbox; their viewer doesn't run the page's scripts
+	csp := "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'"
+	if previewKind(fileRecord) != previewPDF {
+		csp += "; sandbox"
+	}
+	c.Set("Content-Security-Policy", csp)
+	c.Set("Cache-Control", "private, max-age=300")
+	return sendFileRecord(c, fileRecord, start, end, partial, nil)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Privacy settings. ANONYMIZE_IPS keeps client addresses out of the database:
+// "truncate" (or "true") stores only the network, the /24 of an IPv4 address
+// or the /48 of an IPv6 one, and "hash" stores a keyed hash that still tells
+// clients apart but can't be turned back into an address. Bans, rate limits
+// and quotas are still checked against the full address of each request,
+// as are the rights to resume a download (see downloaderKey).
+//
+// METADATA_RETENTION scrubs the uploader's address and the original file
+// name from records older than it, files still being served included.
+
+const (
+	anonymizeOff      = ""
+	anonymizeTruncate = "truncate"
+	anonymizeHash     = "hash"
+
+	scrubbedNamePrefix = "file"
+)
+
+var (
+	anonymizeIPs      string
+	ipHashSecret      []byte
+	ipHashSecretIsSet bool
+	metadataRetention time.Duration // 0 keeps metadata for the file's lifetime
+)
+
+// loadPrivacyConfig reads ANONYMIZE_IPS, IP_HASH_SECRET and
+// METADATA_RETENTION.
+func loadPrivacyConfig() {
+	switch mode := getEnv("ANONYMIZE_IPS", "false"); mode {
+	case "false", "":
+		anonymizeIPs = anonymizeOff
+	case "true", anonymizeTruncate:
+		anonymizeIPs = anonymizeTruncate
+		loadIPHashSecret()
+		log.Printf("Storing truncated client IP addresses")
+	case anonymizeHash:
+		anonymizeIPs = anonymizeHash
+		if !loadIPHashSecret() {
+			log.Printf("IP_HASH_SECRET is not set, per-client quotas and usage restart counting on restart")
+		}
+		log.Printf("Storing hashed client IP addresses")
+	default:
+		log.Fatalf("Invalid ANONYMIZE_IPS value '%s': use false, truncate or hash", mode)
+	}
+
+	retentionStr := getEnv("METADATA_RETENTION", "0")
+	var err error
+	metadataRetention, err = parseDuration(retentionStr)
+	if err != nil || metadataRetention < 0 {
+		log.Printf("Invalid METADATA_RETENTION value '%s', keeping metadata", retentionStr)
+		metadataRetention = 0
+	}
+	if metadataRetention > 0 {
+		log.Printf("Uploader IPs and file names are scrubbed after %s", formatDuration(metadataRetention))
+	}
+}
+
+// loadIPHashSecret reads IP_HASH_SECRET, making up a key for this run when
+// it's empty, and reports whether it was set.
+func loadIPHashSecret() bool {
+	if secret := getEnv("IP_HASH_SECRET", ""); secret != "" {
+		ipHashSecret = []byte(secret)
+		ipHashSecretIsSet = true
+		return true
+	}
+	ipHashSecret = make([]byte, 32)
+	rand.Read(ipHashSecret)
+	return false
+}
+
+// storedIP is the form of a client address kept in the database. Anything
+// that isn't an address, such as a value storedIP returned before, comes
+// back as it is.
+func storedIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	switch anonymizeIPs {
+	case anonymizeTruncate:
+		return truncateIP(parsed)
+	case anonymizeHash:
+		return hashIP(parsed)
+	}
+	return ip
+}
+
+// downloaderKey tells one downloader apart from another for the rights to
+// join or resume a download: the full address, or its keyed hash when
+// addresses are anonymized, never a network other clients share.
+func downloaderKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || anonymizeIPs == anonymizeOff {
+		return ip
+	}
+	return hashIP(parsed)
+}
+
+// hashIP is the keyed hash of an address.
+func hashIP(ip net.IP) string {
+	mac := hmac.New(sha256.New, ipHashSecret)
+	mac.Write([]byte(ip.String()))
+	return "h-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// truncateIP is the network of an address: its /24, or /48 for IPv6.
+func truncateIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// bannableAddress turns an address as stored back into something that can
+// be banned: the address itself, or the network it was truncated to. Hashed
+// and scrubbed addresses give "".
+func bannableAddress(stored string) string {
+	parsed := net.ParseIP(stored)
+	if parsed == nil {
+		return ""
+	}
+	if anonymizeIPs == anonymizeTruncate {
+		if parsed.To4() != nil {
+			return stored + "/24"
+		}
+		return stored + "/48"
+	}
+	return stored
+}
+
+// scrubMetadata clears the uploader's address and the original file name of
+// files, trashed ones included, uploaded more than METADATA_RETENTION ago.
+// The name becomes "file" plus the extension the link carries, which is
+// what downloads are then saved as. Bundles, abuse reports and download
+// events lose their addresses too.
+func scrubMetadata() {
+	if metadataRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-metadataRetention)
+
+	scrubbed := 0
+	var batch []FileRecord
+	db.Unscoped().Where("scrubbed_at IS NULL AND uploaded_at < ?", cutoff).
+		FindInBatches(&batch, 200, func(tx *gorm.DB, _ int) error {
+			now := time.Now()
+			for _, file := range batch {
+				err := db.Unscoped().Model(&FileRecord{}).Where("id = ?", file.ID).Updates(map[string]interface{}{
+					"ip_address":    "",
+					"original_name": scrubbedNamePrefix + file.Extension,
+					"scrubbed_at":   now,
+				}).Error
+				if err != nil {
+					log.Printf("Failed to scrub metadata of %s: %v", file.UniqueID, err)
+					continue
+				}
+				scrubbed++
+			}
+			return nil
+		})
+
+	db.Model(&Bundle{}).Where("ip_address <> '' AND created_at < ?", cutoff).Update("ip_address", "")
+	db.Model(&AbuseReport{}).Where("reporter_ip <> '' AND created_at < ?", cutoff).Update("reporter_ip", "")
+	db.Model(&DownloadEvent{}).Where("ip_address <> '' AND downloaded_at < ?", cutoff).Update("ip_address", "")
+
+	if scrubbed > 0 {
+		log.Printf("Scrubbed the metadata of %d files", scrubbed)
+	}
+}
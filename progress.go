@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Upload progress. A client streaming a file to PUT / or POST /api/upload
+// can follow how much of it the server has received, from another process
+// or page if need be, through GET /api/progress/:id or as Server-Sent
+// Events from GET /api/progress/:id/events. The ID is one issued by POST
+// /api/progress, or one the client picks, sent as X-Upload-ID or
+// ?upload_id=; an upload without one is given one, returned in X-Upload-ID.
+// Progress is kept in memory by the instance receiving the upload, until a
+// minute after the upload ends.
+
+const (
+	// How long progress stays readable once the upload ended
+	progressRetention = time.Minute
+	// How long an issued ID waits for its upload
+	progressReservation   = 10 * time.Minute
+	progressEventInterval = 500 * time.Millisecond
+	progressKeepAlive     = 15 * time.Second
+)
+
+const (
+	progressPending   = "pending"
+	progressUploading = "uploading"
+	progressDone      = "done"
+	progressFailed    = "failed"
+)
+
+// Client-picked IDs must be hard enough to guess
+var progressIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+var (
+	progressMu      sync.Mutex
+	progressEntries = make(map[string]*uploadProgress)
+)
+
+// uploadProgress is the progress of one upload.
+type uploadProgress struct {
+	id       string
+	received atomic.Int64
+
+	mu        sync.Mutex
+	state     string
+	expected  int64 // -1 when unknown
+	uniqueIDs []string
+	status    int
+	startedAt time.Time
+	endedAt   time.Time
+}
+
+// progressReport is what GET /api/progress/:id answers.
+type progressReport struct {
+	UploadID  string     `json:"upload_id"`
+	State     string     `json:"state"` // pending, uploading, done or failed
+	Received  int64      `json:"received"`
+	Expected  int64      `json:"expected"` // -1 when the client sent no length
+	Percent   *float64   `json:"percent,omitempty"`
+	UniqueIDs []string   `json:"unique_ids,omitempty"`
+	Status    int        `json:"status,omitempty"` // the response status of a failed upload
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+}
+
+func (p *uploadProgress) report() progressReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	report := progressReport{
+		UploadID:  p.id,
+		State:     p.state,
+		Received:  p.received.Load(),
+		Expected:  p.expected,
+		UniqueIDs: p.uniqueIDs,
+		Status:    p.status,
+	}
+	if p.expected > 0 {
+		percent := min(100, float64(report.Received)*100/float64(p.expected))
+		report.Percent = &percent
+	}
+	if !p.startedAt.IsZero() {
+		report.StartedAt = &p.startedAt
+	}
+	if !p.endedAt.IsZero() {
+		report.EndedAt = &p.endedAt
+	}
+	return report
+}
+
+func setupProgressRoutes(api fiber.Router) {
+	api.Post("/progress", handleProgressReserve)
+	api.Get("/progress/:id", handleProgress)
+	api.Get("/progress/:id/events", handleProgressEvents)
+}
+
+// startProgress begins tracking an upload of expected bytes (0 when not
+// known) under the ID the request names, or a new one, and says which in
+// X-Upload-ID. The caller must call end when the upload is over.
+func startProgress(c *fiber.Ctx, expected int64) *uploadProgress {
+	id := c.Get("X-Upload-ID")
+	if id == "" {
+		id = c.Query("upload_id")
+	}
+
+	if expected <= 0 {
+		expected = -1
+	}
+
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p := progressEntries[id]
+	switch {
+	case p != nil && p.currentState() == progressPending:
+		// An issued ID: whoever is already following it sees the upload
+		p.mu.Lock()
+		p.state, p.expected, p.startedAt = progressUploading, expected, time.Now()
+		p.mu.Unlock()
+	default:
+		// An ID that's malformed or taken by an upload under way is replaced
+		if !progressIDPattern.MatchString(id) || (p != nil && p.currentState() == progressUploading) {
+			id = generateUniqueID()
+		}
+		p = &uploadProgress{id: id, state: progressUploading, expected: expected, startedAt: time.Now()}
+		progressEntries[id] = p
+	}
+
+	c.Set("X-Upload-ID", id)
+	return p
+}
+
+func (p *uploadProgress) currentState() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// reader counts what is read from r as received.
+func (p *uploadProgress) reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, progress: p}
+}
+
+// progressReader counts what is read through it towards an upload's
+// progress. It can be set up before it's known which; what was read until
+// then is carried over.
+type progressReader struct {
+	r        io.Reader
+	progress *uploadProgress
+	before   int64
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if pr.progress != nil {
+		pr.progress.received.Add(int64(n))
+	} else {
+		pr.before += int64(n)
+	}
+	return n, err
+}
+
+// track starts counting towards p.
+func (pr *progressReader) track(p *uploadProgress) {
+	p.received.Add(pr.before)
+	pr.progress = p
+}
+
+// stored records a file the upload produced.
+func (p *uploadProgress) stored(uniqueID string) {
+	p.mu.Lock()
+	p.uniqueIDs = append(p.uniqueIDs, uniqueID)
+	p.mu.Unlock()
+}
+
+// end marks the upload done when it stored files and failed otherwise, with
+// the status the response carries, and forgets it after a while.
+func (p *uploadProgress) end(c *fiber.Ctx) {
+	p.mu.Lock()
+	p.endedAt = time.Now()
+	if len(p.uniqueIDs) > 0 {
+		p.state = progressDone
+	} else {
+		p.state = progressFailed
+		p.status = c.Response().StatusCode()
+		if p.status < 400 {
+			p.status = 500
+		}
+	}
+	p.mu.Unlock()
+	time.AfterFunc(progressRetention, func() { forgetProgress(p) })
+}
+
+// forgetProgress drops p, unless its ID has been reused since.
+func forgetProgress(p *uploadProgress) {
+	progressMu.Lock()
+	if progressEntries[p.id] == p {
+		delete(progressEntries, p.id)
+	}
+	progressMu.Unlock()
+}
+
+func findProgress(id string) *uploadProgress {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	return progressEntries[id]
+}
+
+// handleProgressReserve is POST /api/progress: it issues an ID to send
+// along with an upload.
+func handleProgressReserve(c *fiber.Ctx) error {
+	p := &uploadProgress{id: generateUniqueID(), state: progressPending, expected: -1}
+	progressMu.Lock()
+	progressEntries[p.id] = p
+	progressMu.Unlock()
+	time.AfterFunc(progressReservation, func() {
+		if p.currentState() == progressPending {
+			forgetProgress(p)
+		}
+	})
+	return c.Status(201).JSON(p.report())
+}
+
+// handleProgress is GET /api/progress/:id.
+func handleProgress(c *fiber.Ctx) error {
+	p := findProgress(c.Params("id"))
+	if p == nil {
+		return c.Status(404).JSON(fiber.Map{"success": false, "message": "No upload with this ID on this server"})
+	}
+	c.Set("Cache-Control", "no-store")
+	return c.JSON(p.report())
+}
+
+// handleProgressEvents is GET /api/progress/:id/events: the progress as
+// Server-Sent Events, one whenever it changes, until the upload ends.
+func handleProgressEvents(c *fiber.Ctx) error {
+	p := findProgress(c.Params("id"))
+	if p == nil {
+		return c.Status(404).JSON(fiber.Map{"success": false, "message": "No upload with this ID on this server"})
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-store")
+	// Keep proxies from holding events back
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ticker := time.NewTicker(progressEventInterval)
+		defer ticker.Stop()
+		var last []byte
+		lastSent := time.Now()
+		for {
+			report := p.report()
+			data, _ := json.Marshal(report)
+			if string(data) != string(last) {
+				fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+				last, lastSent = data, time.Now()
+			} else if time.Since(lastSent) >= progressKeepAlive {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				lastSent = time.Now()
+			}
+			// A failed flush means the client went away
+			if err := w.Flush(); err != nil {
+				return
+			}
+			if report.State == progressDone || report.State == progressFailed {
+				return
+			}
+			<-ticker.C
+		}
+	})
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reverse proxy support. Requests from the addresses in TRUSTED_PROXIES are
+// taken at their word about the client: its IP from PROXY_HEADER, and the
+// scheme and host from X-Forwarded-Proto and X-Forwarded-Host. Every stored
+// IP, rate limit key, ban and generated URL goes through c.IP(),
+// c.Protocol() and getBaseURL, so they all follow these headers.
+//
+// A proxy appending to X-Forwarded-For keeps whatever the client sent in
+// front, so the client is the right-most address no trusted proxy added,
+// not the left-most one Fiber would take.
+
+var (
+	trustedProxies     []string
+	trustedProxyRanges []*net.IPNet
+	proxyHeader        string
+)
+
+// loadProxyConfig reads TRUSTED_PROXIES (IPs and CIDR ranges) and
+// PROXY_HEADER. It runs before the Fiber app is created, which takes them
+// in its config.
+func loadProxyConfig() {
+	trustedProxies, trustedProxyRanges = nil, nil
+	for _, entry := range splitList(getEnv("TRUSTED_PROXIES", "")) {
+		ipNet, err := parseIPOrCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry '%s'", entry)
+			continue
+		}
+		trustedProxies = append(trustedProxies, entry)
+		trustedProxyRanges = append(trustedProxyRanges, ipNet)
+	}
+	if len(trustedProxies) == 0 {
+		// Fiber trusts everyone while the proxy check is off, so the
+		// header must stay unset or any client could pick its own IP
+		proxyHeader = ""
+		return
+	}
+
+	proxyHeader = textproto.CanonicalMIMEHeaderKey(getEnv("PROXY_HEADER", "X-Forwarded-For"))
+	log.Printf("Trusting %s from proxies: %s", proxyHeader, strings.Join(trustedProxies, ", "))
+}
+
+// behindProxy reports whether forwarded headers are honoured at all.
+func behindProxy() bool {
+	return len(trustedProxies) > 0
+}
+
+// isTrustedProxy reports whether ip is in TRUSTED_PROXIES.
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxyRanges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP picks the client out of a forwarded address list: the
+// right-most address that isn't a trusted proxy, or the left-most one when
+// they all are. It returns "" when an entry it reaches isn't an IP.
+func forwardedClientIP(value string) string {
+	entries := strings.Split(value, ",")
+	client := ""
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil {
+			return ""
+		}
+		client = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedClient narrows PROXY_HEADER on requests from a trusted proxy
+// down to the client's address, before anything reads c.IP().
+func forwardedClient(c *fiber.Ctx) error {
+	if !behindProxy() || !c.IsProxyTrusted() {
+		return c.Next()
+	}
+	if value := c.Get(proxyHeader); value != "" {
+		if ip := forwardedClientIP(value); ip != "" {
+			c.Request().Header.Set(proxyHeader, ip)
+		} else {
+			c.Request().Header.Del(proxyHeader)
+		}
+	}
+	return c.Next()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	// app.Test connects from 0.0.0.0, which stands in for the proxy
+	t.Setenv("TRUSTED_PROXIES", "0.0.0.0,10.0.0.0/8")
+	loadProxyConfig()
+	defer func() {
+		t.Setenv("TRUSTED_PROXIES", "")
+		loadProxyConfig()
+	}()
+
+	app := fiber.New(fiber.Config{
+		EnableTrustedProxyCheck: behindProxy(),
+		TrustedProxies:          trustedProxies,
+		ProxyHeader:             proxyHeader,
+		EnableIPValidation:      true,
+	})
+	app.Use(forwardedClient)
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(c.IP())
+	})
+
+	tests := []struct {
+		name      string
+		forwarded string
+		want      string
+	}{
+		{"proxy's own entry", "203.0.113.7", "203.0.113.7"},
+		{"spoofed left-most entry", "6.6.6.6, 203.0.113.7", "203.0.113.7"},
+		{"through an inner proxy", "6.6.6.6, 203.0.113.7, 10.0.0.5", "203.0.113.7"},
+		{"only proxies", "10.0.0.9, 10.0.0.5", "10.0.0.9"},
+		{"IPv6 client", "6.6.6.6, 2001:db8::1", "2001:db8::1"},
+		{"garbage behind the client", "not-an-ip, 203.0.113.7", "203.0.113.7"},
+		{"garbage from the proxy", "203.0.113.7, not-an-ip", "0.0.0.0"},
+		{"no header", "", "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if got := string(body); got != tt.want {
+			t.Errorf("%s: client IP %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
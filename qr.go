@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QR codes of download links, so a file uploaded on a desktop can be opened
+// on a phone by pointing its camera at the screen. /qr/:id encodes the
+// file's /d/ link, or the /p/ link for a paste.
+
+const (
+	qrDefaultSize = 256
+	qrMinSize     = 64
+	qrMaxSize     = 1024
+)
+
+func setupQRRoutes(app *fiber.App) {
+	app.Get("/qr/:id", handleQRCode)
+}
+
+// fileShareURL is the link a QR code for fileRecord points at, signed like
+// the request for it when links must be signed.
+func fileShareURL(c *fiber.Ctx, fileRecord *FileRecord) string {
+	if fileRecord.PasteLanguage != "" {
+		return forwardSignature(c, getBaseURL(c)+fileRecord.pastePath(), fileRecord)
+	}
+	return forwardSignature(c, getBaseURL(c)+fileRecord.downloadPath(), fileRecord)
+}
+
+// qrSVG draws a QR code as SVG, one square per dark module, scaled to size.
+func qrSVG(code *qrcode.QRCode, size int) string {
+	bitmap := code.Bitmap()
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	modules := len(bitmap)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size, size, modules, modules, path.String())
+}
+
+// handleQRCode is GET /qr/:id?format=png|svg&size=256. Looking up a code
+// doesn't count as a download.
+func handleQRCode(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var fileRecord FileRecord
+	if err := findFile(strings.TrimSuffix(id, filepath.Ext(id)), &fileRecord); err != nil {
+		return c.Status(404).SendString("File not found")
+	}
+	if fileRecord.ExpiresAt != nil && time.Now().After(*fileRecord.ExpiresAt) {
+		return c.Status(404).SendString("File has expired")
+	}
+	if refused, err := refuseUnsigned(c, &fileRecord); refused {
+		return err
+	}
+
+	size := c.QueryInt("size", qrDefaultSize)
+	if size < qrMinSize || size > qrMaxSize {
+		return c.Status(400).SendString(fmt.Sprintf("size must be between %d and %d", qrMinSize, qrMaxSize))
+	}
+
+	code, err := qrcode.New(fileShareURL(c, &fileRecord), qrcode.Medium)
+	if err != nil {
+		return c.Status(500).SendString("Failed to make QR code")
+	}
+
+	// The link never changes for the life of the file
+	c.Set("Cache-Control", "public, max-age=86400")
+	switch strings.ToLower(c.Query("format", "png")) {
+	case "png":
+		png, err := code.PNG(size)
+		if err != nil {
+			return c.Status(500).SendString("Failed to make QR code")
+		}
+		c.Set("Content-Type", "image/png")
+		return c.Send(png)
+	case "svg":
+		c.Set("Content-Type", "image/svg+xml")
+		return c.SendString(qrSVG(code, size))
+	}
+	return c.Status(400).SendString("format must be png or svg")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Quarantine: files held for an admin to review before they're served.
+// With REQUIRE_APPROVAL=true every new upload is held; otherwise files are
+// only held when something looks off: QUARANTINE_UNSCANNED=true holds files
+// clamd couldn't scan (unreachable or too large) instead of serving them
+// unscanned, and QUARANTINE_REPORTS=N takes a file down for review once N
+// addresses have reported it. Held files answer 423 Locked wherever they'd be
+// served until an admin approves them, or rejects them into the trash.
+// They still expire as usual.
+
+const (
+	moderationHeld     = "held"
+	moderationApproved = "approved"
+
+	holdApproval  = "approval required"
+	holdUnscanned = "not scanned"
+	holdReported  = "reported"
+)
+
+var (
+	requireApproval     bool
+	quarantineUnscanned bool
+	quarantineReports   int
+)
+
+// loadQuarantineConfig reads REQUIRE_APPROVAL, QUARANTINE_UNSCANNED and
+// QUARANTINE_REPORTS.
+func loadQuarantineConfig() {
+	requireApproval = getEnv("REQUIRE_APPROVAL", "false") == "true"
+	quarantineUnscanned = getEnv("QUARANTINE_UNSCANNED", "false") == "true"
+
+	reportsStr := getEnv("QUARANTINE_REPORTS", "0")
+	var err error
+	quarantineReports, err = strconv.Atoi(reportsStr)
+	if err != nil || quarantineReports < 0 {
+		log.Printf("Invalid QUARANTINE_REPORTS value '%s', using default 0", reportsStr)
+		quarantineReports = 0
+	}
+	if requireApproval {
+		log.Printf("New uploads are held until an admin approves them")
+	}
+}
+
+// initialModeration is the moderation state new file records start in,
+// and initialHoldReason why.
+func initialModeration() string {
+	if requireApproval {
+		return moderationHeld
+	}
+	return ""
+}
+
+func initialHoldReason() string {
+	if requireApproval {
+		return holdApproval
+	}
+	return ""
+}
+
+// uploadMessage adds to the message of an upload response that the files
+// won't be served until approved, when that's so.
+func uploadMessage(message string) string {
+	if requireApproval {
+		return message + "; it will be available once an admin approves it"
+	}
+	return message
+}
+
+// holdFile takes a file out of service until an admin reviews it.
+func holdFile(fileRecord *FileRecord, reason string) {
+	if fileRecord.Moderation == moderationHeld {
+		return
+	}
+	db.Model(&FileRecord{}).Where("id = ?", fileRecord.ID).Updates(map[string]interface{}{
+		"moderation":  moderationHeld,
+		"hold_reason": reason,
+	})
+	fileRecord.Moderation = moderationHeld
+	fileRecord.HoldReason = reason
+	slog.Warn("File held for review", "file_id", fileRecord.UniqueID, "reason", reason)
+}
+
+// holdUnscannedFile holds a file when verdict says clamd couldn't scan it,
+// and releases one held for that once a later scan finds it clean.
+func holdUnscannedFile(fileRecord *FileRecord, verdict string) {
+	if !quarantineUnscanned {
+		return
+	}
+	switch verdict {
+	case scanFailed, scanSkipped:
+		holdFile(fileRecord, holdUnscanned)
+	case scanClean:
+		db.Model(&FileRecord{}).
+			Where("id = ? AND moderation = ? AND hold_reason = ?", fileRecord.ID, moderationHeld, holdUnscanned).
+			Updates(map[string]interface{}{"moderation": "", "hold_reason": ""})
+	}
+}
+
+// holdReportedFile holds a file once QUARANTINE_REPORTS addresses have
+// reported it and the reports are still open.
+func holdReportedFile(fileRecord *FileRecord) {
+	if quarantineReports == 0 || fileRecord.Moderation != "" {
+		return
+	}
+	var reporters int64
+	db.Model(&AbuseReport{}).
+		Where("file_id = ? AND status = ?", fileRecord.UniqueID, reportOpen).
+		Distinct("reporter_ip").
+		Count(&reporters)
+	if reporters >= int64(quarantineReports) {
+		holdFile(fileRecord, holdReported)
+	}
+}
+
+// refuseHeld stops files waiting for review from being served. It reports
+// whether a response was sent.
+func refuseHeld(c *fiber.Ctx, fileRecord *FileRecord) (bool, error) {
+	if fileRecord.Moderation != moderationHeld {
+		return false, nil
+	}
+	return true, c.Status(423).SendString("File is awaiting review by an admin")
+}
+
+// handleAdminListHeld lists the files waiting for review, with the filters,
+// sorting and paging of listFiles.
+func handleAdminListHeld(c *fiber.Ctx) error {
+	return listFiles(c, db.Model(&FileRecord{}).Where("moderation = ?", moderationHeld), 500)
+}
+
+// heldFile loads the held file an approve or reject request is about.
+func heldFile(c *fiber.Ctx) (*FileRecord, error) {
+	var fileRecord FileRecord
+	if err := db.Where("unique_id = ?", c.Params("id")).First(&fileRecord).Error; err != nil {
+		return nil, apiError(c, 404, "File not found")
+	}
+	if fileRecord.Moderation != moderationHeld {
+		return nil, apiError(c, 409, "File is not awaiting review")
+	}
+	return &fileRecord, nil
+}
+
+// handleAdminApproveFile releases a held file. The abuse reports that got it
+// held stay open for the report queue.
+func handleAdminApproveFile(c *fiber.Ctx) error {
+	fileRecord, err := heldFile(c)
+	if fileRecord == nil {
+		return err
+	}
+	db.Model(fileRecord).Updates(map[string]interface{}{"moderation": moderationApproved, "hold_reason": ""})
+	fileRecord.Moderation = moderationApproved
+	fileRecord.HoldReason = ""
+
+	slog.Info("Admin approved file", "file_id", fileRecord.UniqueID)
+	audit(c, auditAdmin, fileRecord.UniqueID, "approved")
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    fileRecord,
+	})
+}
+
+// handleAdminRejectFile removes a held file into the trash: {"ban": true}
+// bans the uploader's address too ("duration" as for bans).
+func handleAdminRejectFile(c *fiber.Ctx) error {
+	var req struct {
+		Ban      bool   `json:"ban" form:"ban"`
+		Duration string `json:"duration" form:"duration"`
+	}
+	c.BodyParser(&req)
+	var banDuration time.Duration
+	if req.Duration != "" {
+		var err error
+		banDuration, err = parseDuration(req.Duration)
+		if err != nil || banDuration < 0 {
+			return apiError(c, 400, fmt.Sprintf("Invalid duration '%s'", req.Duration))
+		}
+	}
+
+	fileRecord, err := heldFile(c)
+	if fileRecord == nil {
+		return err
+	}
+	var banTarget string
+	if req.Ban {
+		if banTarget = bannableAddress(fileRecord.IPAddress); banTarget == "" {
+			return apiError(c, 409, "The uploader's address isn't stored")
+		}
+	}
+
+	if err := removeFile(fileRecord, "rejected"); err != nil {
+		log.Printf("Failed to delete %s: %v", fileRecord.FilePath, err)
+		return apiError(c, 500, "Failed to delete file")
+	}
+	slog.Info("Admin rejected file", "file_id", fileRecord.UniqueID, "reason", fileRecord.HoldReason)
+	audit(c, auditDelete, fileRecord.UniqueID, "rejected")
+	sendWebhook(c, webhookDeleted, fileRecord, "rejected")
+
+	response := fiber.Map{
+		"success": true,
+		"message": "File rejected",
+	}
+	if banTarget != "" {
+		ban, err := banAddress(c, banTarget, "rejected upload", banDuration)
+		if err != nil {
+			return apiError(c, 500, "Failed to save ban")
+		}
+		response["ban"] = ban
+	}
+	return c.JSON(response)
+}
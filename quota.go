@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Per-client quotas on top of the request rate limiter, so a single IP can't
+// fill the disk or flood the instance with uploads. Both are computed from
+// the live FileRecords of the client's IP address.
+
+var (
+	maxStoragePerIP    int64 // bytes held at once, 0 means unlimited
+	maxUploadsPerIPDay int   // uploads per rolling 24 hours, 0 means unlimited
+)
+
+// loadQuotaConfig reads MAX_STORAGE_PER_IP and MAX_UPLOADS_PER_IP_PER_DAY.
+func loadQuotaConfig() {
+	storageStr := getEnv("MAX_STORAGE_PER_IP", "0")
+	var err error
+	maxStoragePerIP, err = parseSize(storageStr)
+	if err != nil || maxStoragePerIP < 0 {
+		log.Printf("Invalid MAX_STORAGE_PER_IP value '%s', using default unlimited", storageStr)
+		maxStoragePerIP = 0
+	}
+	if maxStoragePerIP > 0 {
+		log.Printf("Maximum storage per IP: %s", formatBytes(maxStoragePerIP))
+	}
+
+	uploadsStr := getEnv("MAX_UPLOADS_PER_IP_PER_DAY", "0")
+	maxUploadsPerIPDay, err = strconv.Atoi(uploadsStr)
+	if err != nil || maxUploadsPerIPDay < 0 {
+		log.Printf("Invalid MAX_UPLOADS_PER_IP_PER_DAY value '%s', using default unlimited", uploadsStr)
+		maxUploadsPerIPDay = 0
+	}
+	if maxUploadsPerIPDay > 0 {
+		log.Printf("Maximum uploads per IP per day: %d", maxUploadsPerIPDay)
+	}
+}
+
+// quotaError is returned when an upload would take a client over its quota.
+type quotaError struct {
+	status  int
+	message string
+}
+
+func (e *quotaError) Error() string {
+	return e.message
+}
+
+// checkUploadQuota reports whether ip may upload another file of size bytes.
+// Pass a size of 0 when it isn't known yet to check the upload count only.
+func checkUploadQuota(ip string, size int64) *quotaError {
+	return checkBatchQuota(ip, 1, size)
+}
+
+// checkBatchQuota reports whether ip may upload count more files of size
+// bytes in total.
+func checkBatchQuota(ip string, count int, size int64) *quotaError {
+	ip = storedIP(ip)
+	if maxUploadsPerIPDay > 0 {
+		var uploads int64
+		db.Model(&FileRecord{}).
+			Where("ip_address = ? AND uploaded_at > ?", ip, time.Now().Add(-24*time.Hour)).
+			Count(&uploads)
+		if uploads+int64(count) > int64(maxUploadsPerIPDay) {
+			return &quotaError{429, fmt.Sprintf("Upload limit reached: %d uploads per day per client. Try again later", maxUploadsPerIPDay)}
+		}
+	}
+
+	if maxStoragePerIP > 0 {
+		var used int64
+		db.Model(&FileRecord{}).
+			Where("ip_address = ?", ip).
+			Select("COALESCE(SUM(file_size), 0)").
+			Scan(&used)
+		if used+size > maxStoragePerIP {
+			return &quotaError{507, fmt.Sprintf("Storage quota exceeded: %s of %s used per client. Delete files or wait for them to expire",
+				formatBytes(used), formatBytes(maxStoragePerIP))}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Request classes with a budget of their own. Requests outside them, and in
+// classes without a RATE_LIMIT_<CLASS>_MAX, share one budget.
+const (
+	rateLimitUpload   = "upload"
+	rateLimitDownload = "download"
+	rateLimitMetadata = "metadata"
+)
+
+var (
+	rateLimitMax       int
+	rateLimitAuthMax   int
+	rateLimitWindow    time.Duration
+	rateLimitBudgets   map[string]int // per class, for anonymous clients
+	rateLimitExempt    []string
+	rateLimitTrustedIP []*net.IPNet
+	rateLimits         rateLimitStore
+)
+
+// loadRateLimitConfig reads the RATE_LIMIT_* environment variables. Without
+// any of them set, every client gets 100 requests per minute as before.
+func loadRateLimitConfig() {
+	maxStr := getEnv("RATE_LIMIT_MAX", "100")
+	var err error
+	rateLimitMax, err = strconv.Atoi(maxStr)
+	if err != nil || rateLimitMax < 1 {
+		log.Printf("Invalid RATE_LIMIT_MAX value '%s', using default 100", maxStr)
+		rateLimitMax = 100
+	}
+
+	authMaxStr := getEnv("RATE_LIMIT_AUTH_MAX", strconv.Itoa(rateLimitMax))
+	rateLimitAuthMax, err = strconv.Atoi(authMaxStr)
+	if err != nil || rateLimitAuthMax < 1 {
+		log.Printf("Invalid RATE_LIMIT_AUTH_MAX value '%s', using %d", authMaxStr, rateLimitMax)
+		rateLimitAuthMax = rateLimitMax
+	}
+
+	windowStr := getEnv("RATE_LIMIT_WINDOW", "1m")
+	rateLimitWindow, err = parseDuration(windowStr)
+	if err != nil || rateLimitWindow <= 0 {
+		log.Printf("Invalid RATE_LIMIT_WINDOW value '%s', using default 1 minute", windowStr)
+		rateLimitWindow = time.Minute
+	}
+
+	rateLimitBudgets = make(map[string]int)
+	for _, class := range []string{rateLimitUpload, rateLimitDownload, rateLimitMetadata} {
+		name := "RATE_LIMIT_" + strings.ToUpper(class) + "_MAX"
+		value := getEnv(name, "")
+		if value == "" {
+			continue
+		}
+		budget, err := strconv.Atoi(value)
+		if err != nil || budget < 1 {
+			log.Printf("Invalid %s value '%s', counting %s requests against RATE_LIMIT_MAX", name, value, class)
+			continue
+		}
+		rateLimitBudgets[class] = budget
+	}
+
+	rateLimitExempt = splitList(getEnv("RATE_LIMIT_EXEMPT_PATHS", ""))
+
+	rateLimitTrustedIP = nil
+	for _, entry := range splitList(getEnv("RATE_LIMIT_TRUSTED_IPS", "")) {
+		ipNet, err := parseIPOrCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid RATE_LIMIT_TRUSTED_IPS entry '%s'", entry)
+			continue
+		}
+		rateLimitTrustedIP = append(rateLimitTrustedIP, ipNet)
+	}
+
+	rateLimits = &memoryRateLimitStore{windows: make(map[string]*keyWindow)}
+	if redisURL := getEnv("RATE_LIMIT_REDIS_URL", ""); redisURL != "" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_REDIS_URL: %v", err)
+		}
+		client := redis.NewClient(opts)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := client.Ping(ctx).Err(); err != nil {
+			log.Printf("Warning: Redis at %s unreachable (%v); requests are let through until it is", opts.Addr, err)
+		}
+		cancel()
+		rateLimits = &redisRateLimitStore{client: client}
+		log.Printf("Rate limits shared through Redis at %s", opts.Addr)
+	}
+
+	log.Printf("Rate limit: %d requests per %s (%d when authenticated)", rateLimitMax, formatDuration(rateLimitWindow), rateLimitAuthMax)
+	for _, class := range []string{rateLimitUpload, rateLimitDownload, rateLimitMetadata} {
+		if budget, ok := rateLimitBudgets[class]; ok {
+			log.Printf("Rate limit for %s requests: %d per %s", class, budget, formatDuration(rateLimitWindow))
+		}
+	}
+	if len(rateLimitExempt) > 0 {
+		log.Printf("Rate limit exempt paths: %s", strings.Join(rateLimitExempt, ", "))
+	}
+	if len(rateLimitTrustedIP) > 0 {
+		log.Printf("Rate limit exempt IP ranges: %d", len(rateLimitTrustedIP))
+	}
+}
+
+func setupRateLimiting(app *fiber.App) {
+	app.Use(rateLimit)
+}
+
+// rateLimit counts each request against its class's budget for the caller.
+// Anonymous clients are counted per IP at RATE_LIMIT_MAX or the class's
+// RATE_LIMIT_<CLASS>_MAX. API_KEY holders are counted per IP too, since the
+// key is shared, at RATE_LIMIT_AUTH_MAX; issued keys per key, wherever their
+// requests come from, at the key's own rate_limit. Authenticated callers get
+// their limit in each class that has a budget of its own. Exempt paths and
+// trusted IP ranges aren't counted.
+func rateLimit(c *fiber.Ctx) error {
+	if isRateLimitExempt(c) {
+		return c.Next()
+	}
+
+	class := rateLimitClassOf(c)
+	limit, separate := rateLimitBudgets[class]
+	if !separate {
+		class, limit = "all", rateLimitMax
+	}
+	subject := "ip:" + c.IP()
+	switch key := requestAPIKey(c); {
+	case key != nil && key.ID == 0: // API_KEY, or an upload token not issued to a key
+		subject, limit = "auth:"+c.IP(), rateLimitAuthMax
+	case key != nil:
+		subject, limit = "key:"+strconv.FormatUint(uint64(key.ID), 10), key.RateLimit
+		if limit <= 0 {
+			limit = rateLimitAuthMax
+		}
+	}
+
+	count, reset, err := rateLimits.take(class+":"+subject, rateLimitWindow)
+	if err != nil {
+		// A limiter outage shouldn't take the service down with it
+		logRateLimitError(err)
+		return c.Next()
+	}
+
+	remaining := limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	c.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Set("X-RateLimit-Reset", strconv.Itoa(int(time.Until(reset).Seconds())))
+	if count > limit {
+		c.Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+		return c.SendStatus(fiber.StatusTooManyRequests)
+	}
+	return c.Next()
+}
+
+// rateLimitClassOf sorts a request into uploads, downloads and metadata
+// reads, or "" for everything else (pages, deletions, admin changes).
+func rateLimitClassOf(c *fiber.Ctx) string {
+	method, path := c.Method(), c.Path()
+	read := method == fiber.MethodGet || method == fiber.MethodHead
+
+	if _, route, ok := splitAPIPath(path); ok {
+		switch {
+		case strings.HasPrefix(route, "/upload"), route == "/fetch", strings.HasPrefix(route, "/tus"):
+			return rateLimitUpload
+		case read:
+			return rateLimitMetadata
+		}
+		return ""
+	}
+
+	switch {
+	case method == fiber.MethodPut && (path == "/" || path == "/paste" ||
+		strings.HasPrefix(path, "/dav/") || strings.HasPrefix(path, "/s3/")):
+		return rateLimitUpload
+	case method == "PROPFIND", method == fiber.MethodHead && isDownloadPath(path):
+		return rateLimitMetadata
+	case isDownloadPath(path), strings.HasPrefix(path, "/b/"),
+		method == fiber.MethodGet && strings.HasPrefix(path, "/dav/"),
+		strings.HasPrefix(path, "/p/") && strings.HasSuffix(path, "/raw"):
+		return rateLimitDownload
+	}
+	return ""
+}
+
+func isDownloadPath(path string) bool {
+	return strings.HasPrefix(path, "/d/") || strings.HasPrefix(path, "/download/")
+}
+
+var rateLimitErrorLogged atomic.Int64
+
+// logRateLimitError logs a store failure at most once a minute, as while
+// Redis is down every request would log one.
+func logRateLimitError(err error) {
+	now := time.Now().Unix()
+	last := rateLimitErrorLogged.Load()
+	if now-last >= 60 && rateLimitErrorLogged.CompareAndSwap(last, now) {
+		log.Printf("Rate limiting unavailable, letting requests through: %v", err)
+	}
+}
+
+// rateLimitStore counts requests in fixed windows. take counts one request
+// against key and returns the count in the current window and when the
+// window ends.
+type rateLimitStore interface {
+	take(key string, window time.Duration) (int, time.Time, error)
+}
+
+// keyWindow counts a caller's requests in the current window.
+type keyWindow struct {
+	start time.Time
+	count int
+}
+
+// memoryRateLimitStore keeps the counts in this process, which is all a
+// single instance needs.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	windows map[string]*keyWindow
+	swept   time.Time
+}
+
+func (s *memoryRateLimitStore) take(key string, window time.Duration) (int, time.Time, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget callers whose windows ended, once per window
+	if now.Sub(s.swept) >= window {
+		for k, w := range s.windows {
+			if now.Sub(w.start) >= window {
+				delete(s.windows, k)
+			}
+		}
+		s.swept = now
+	}
+
+	w := s.windows[key]
+	if w == nil || now.Sub(w.start) >= window {
+		w = &keyWindow{start: now}
+		s.windows[key] = w
+	}
+	w.count++
+	return w.count, w.start.Add(window), nil
+}
+
+// redisRateLimitStore keeps the counts in Redis, so replicas behind a load
+// balancer enforce one limit between them.
+type redisRateLimitStore struct {
+	client *redis.Client
+}
+
+// rateLimitScript increments a counter, starting its window on the first
+// request. Running it as one script keeps the two steps atomic.
+var rateLimitScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+func (s *redisRateLimitStore) take(key string, window time.Duration) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := rateLimitScript.Run(ctx, s.client, []string{"bashupload:ratelimit:" + key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return int(result[0]), time.Now().Add(time.Duration(result[1]) * time.Millisecond), nil
+}
+
+// isRateLimitExempt reports whether the request path or client IP is excluded
+// from rate limiting. Path entries ending in "*" match as prefixes.
+func isRateLimitExempt(c *fiber.Ctx) bool {
+	path := c.Path()
+	for _, exempt := range rateLimitExempt {
+		if strings.HasSuffix(exempt, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(exempt, "*")) {
+				return true
+			}
+		} else if path == exempt {
+			return true
+		}
+	}
+
+	if len(rateLimitTrustedIP) > 0 {
+		if ip := net.ParseIP(c.IP()); ip != nil {
+			for _, ipNet := range rateLimitTrustedIP {
+				if ipNet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// parseIPOrCIDR accepts either a CIDR range or a single IP address.
+func parseIPOrCIDR(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+			entry += "/32"
+		} else {
+			entry += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(entry)
+	return ipNet, err
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Reconciliation compares the database with storage, since the two drift on
+// long-running instances: files whose blob has gone missing, blobs whose size
+// doesn't match their file, and blobs no file refers to. It runs every
+// RECONCILE_INTERVAL and on demand through the admin API, and only reports
+// unless asked to repair: missing files are restored from the mirror or else
+// dropped, mismatched ones moved to the trash and orphaned blobs deleted.
+
+// reconcileGrace keeps recently written blobs out of the orphan list; an
+// upload stores its blob a moment before its record.
+const reconcileGrace = time.Hour
+
+var (
+	reconcileInterval time.Duration
+	reconcileRepair   bool
+
+	// Held while a pass runs, so passes never overlap
+	reconcileMu   sync.Mutex
+	lastReconcile *reconcileReport
+	// Guards lastReconcile
+	reconcileReportMu sync.Mutex
+)
+
+// loadReconcileConfig reads RECONCILE_INTERVAL and RECONCILE_REPAIR.
+func loadReconcileConfig() {
+	intervalStr := getEnv("RECONCILE_INTERVAL", "24h")
+	var err error
+	reconcileInterval, err = parseDuration(intervalStr)
+	if err != nil || reconcileInterval < 0 {
+		log.Printf("Invalid RECONCILE_INTERVAL value '%s', using default 24 hours", intervalStr)
+		reconcileInterval = 24 * time.Hour
+	}
+	reconcileRepair = getEnv("RECONCILE_REPAIR", "false") == "true"
+}
+
+// reconcileIssue is one blob that doesn't agree with the database.
+type reconcileIssue struct {
+	Key          string   `json:"key"`
+	FileIDs      []string `json:"file_ids,omitempty"`
+	ExpectedSize int64    `json:"expected_size,omitempty"`
+	ActualSize   int64    `json:"actual_size,omitempty"`
+	Mirrored     bool     `json:"mirrored,omitempty"` // a missing blob the mirror still has
+	Repaired     bool     `json:"repaired"`
+}
+
+type reconcileReport struct {
+	StartedAt      time.Time        `json:"started_at"`
+	FinishedAt     time.Time        `json:"finished_at"`
+	Repair         bool             `json:"repair"`
+	FilesChecked   int              `json:"files_checked"`
+	BlobsListed    int              `json:"blobs_listed"`
+	Missing        []reconcileIssue `json:"missing"`
+	SizeMismatches []reconcileIssue `json:"size_mismatches"`
+	// Only found on backends that can list their blobs
+	Orphans []reconcileIssue `json:"orphans"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// storedBlob is what storage holds under a key.
+type storedBlob struct {
+	size    int64
+	modTime time.Time
+}
+
+// reconcileLoop runs a pass every RECONCILE_INTERVAL.
+func reconcileLoop() {
+	if reconcileInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		if report := reconcile(reconcileRepair); report != nil {
+			logReconcile(report)
+		}
+	}
+}
+
+func logReconcile(report *reconcileReport) {
+	if report.Error != "" {
+		log.Printf("Reconciliation failed: %s", report.Error)
+		return
+	}
+	log.Printf("Reconciliation checked %d files: %d missing, %d size mismatches, %d orphaned blobs",
+		report.FilesChecked, len(report.Missing), len(report.SizeMismatches), len(report.Orphans))
+}
+
+// reconcile runs one pass, repairing what it finds when repair is set. It
+// returns nil if a pass is already running.
+func reconcile(repair bool) *reconcileReport {
+	if !reconcileMu.TryLock() {
+		return nil
+	}
+	defer reconcileMu.Unlock()
+
+	report := &reconcileReport{
+		StartedAt:      time.Now(),
+		Repair:         repair,
+		Missing:        []reconcileIssue{},
+		SizeMismatches: []reconcileIssue{},
+		Orphans:        []reconcileIssue{},
+	}
+	defer func() {
+		report.FinishedAt = time.Now()
+		reconcileReportMu.Lock()
+		lastReconcile = report
+		reconcileReportMu.Unlock()
+	}()
+
+	// Every file, trashed ones included, grouped by blob since deduplicated
+	// files share one
+	var records []FileRecord
+	db.Unscoped().Select("id", "unique_id", "file_path", "file_size", "encryption_nonce", "compression", "compressed_size", "deleted_at").Find(&records)
+	report.FilesChecked = len(records)
+	byKey := make(map[string][]FileRecord)
+	for _, record := range records {
+		byKey[record.FilePath] = append(byKey[record.FilePath], record)
+	}
+
+	// What storage holds, listed in one go where the backend can
+	var stored map[string]storedBlob
+	if lister, ok := fileStorage.(blobLister); ok {
+		stored = make(map[string]storedBlob)
+		err := lister.List(func(key string, size int64, modTime time.Time) error {
+			stored[key] = storedBlob{size: size, modTime: modTime}
+			return nil
+		})
+		if err != nil {
+			report.Error = "Failed to list storage: " + err.Error()
+			return report
+		}
+		report.BlobsListed = len(stored)
+	}
+
+	for key, files := range byKey {
+		var blob storedBlob
+		found := false
+		if stored != nil {
+			blob, found = stored[key]
+		} else if size, err := fileStorage.Stat(key); err == nil {
+			blob, found = storedBlob{size: size}, true
+		}
+
+		issue := reconcileIssue{Key: key, ExpectedSize: storedSize(&files[0])}
+		for _, file := range files {
+			issue.FileIDs = append(issue.FileIDs, file.UniqueID)
+		}
+		switch {
+		case !found:
+			issue.Mirrored = inMirror(key)
+			if repair && issue.Mirrored {
+				if err := restoreFromMirror(key); err != nil {
+					log.Printf("Reconciliation: failed to restore %s from the mirror: %v", key, err)
+				} else {
+					log.Printf("Reconciliation: restored %s from the mirror", key)
+					issue.Repaired = true
+				}
+			} else if repair {
+				issue.Repaired = dropMissingFiles(key, files)
+			}
+			report.Missing = append(report.Missing, issue)
+		case blob.size != issue.ExpectedSize && !allTrashed(files):
+			issue.ActualSize = blob.size
+			if repair {
+				issue.Repaired = trashMismatchedFiles(files)
+			}
+			report.SizeMismatches = append(report.SizeMismatches, issue)
+		}
+	}
+
+	cutoff := time.Now().Add(-reconcileGrace)
+	for key, blob := range stored {
+		if _, ok := byKey[key]; ok || blob.modTime.After(cutoff) {
+			continue
+		}
+		// Cached thumbnails and torrent pieces belong to their original's blob
+		if base, ok := cachedFileOf(key); ok {
+			if _, ok := byKey[base]; ok {
+				continue
+			}
+		}
+		issue := reconcileIssue{Key: key, ActualSize: blob.size}
+		if repair {
+			if err := fileStorage.Delete(key); err != nil {
+				log.Printf("Reconciliation: failed to delete orphaned blob %s: %v", key, err)
+			} else {
+				db.Where("file_path = ?", key).Delete(&Blob{})
+				enqueueMirror(key, mirrorDelete)
+				issue.Repaired = true
+			}
+		}
+		report.Orphans = append(report.Orphans, issue)
+	}
+	return report
+}
+
+// storedSize is how big a file's blob should be.
+func storedSize(fileRecord *FileRecord) int64 {
+	return blobSize(fileRecord.FileSize, fileRecord.Compression, fileRecord.CompressedSize, fileRecord.EncryptionNonce)
+}
+
+// allTrashed reports whether every file is already in the trash, where a
+// bad blob does no harm until it's purged.
+func allTrashed(files []FileRecord) bool {
+	for _, file := range files {
+		if !file.DeletedAt.Valid {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedFileOf returns the original's key when key is a cached thumbnail or
+// torrent pieces.
+func cachedFileOf(key string) (string, bool) {
+	if base, ok := strings.CutSuffix(key, ".pieces"); ok {
+		return base, true
+	}
+	i := strings.LastIndex(key, ".thumb")
+	if i < 0 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(key[i+len(".thumb"):]); err != nil {
+		return "", false
+	}
+	return key[:i], true
+}
+
+// dropMissingFiles removes the records of files whose blob is gone; there is
+// nothing left to restore.
+func dropMissingFiles(key string, files []FileRecord) bool {
+	for i := range files {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := deleteFileLabels(tx, files[i].ID); err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&files[i]).Error
+		})
+		if err != nil {
+			log.Printf("Reconciliation: failed to drop %s: %v", files[i].UniqueID, err)
+			return false
+		}
+		log.Printf("Reconciliation: dropped %s, its blob %s is missing", files[i].UniqueID, key)
+		if !files[i].DeletedAt.Valid {
+			audit(nil, auditDelete, files[i].UniqueID, "missing")
+			sendWebhook(nil, webhookDeleted, &files[i], "missing")
+		}
+	}
+	db.Where("file_path = ?", key).Delete(&Blob{})
+	return true
+}
+
+// trashMismatchedFiles moves files whose blob has the wrong size to the
+// trash, where an admin can look at them before they're purged.
+func trashMismatchedFiles(files []FileRecord) bool {
+	for i := range files {
+		if files[i].DeletedAt.Valid {
+			continue
+		}
+		if err := removeFile(&files[i], "size_mismatch"); err != nil {
+			log.Printf("Reconciliation: failed to trash %s: %v", files[i].UniqueID, err)
+			return false
+		}
+		log.Printf("Reconciliation: moved %s to the trash, its blob has the wrong size", files[i].UniqueID)
+	}
+	return true
+}
+
+// handleAdminReconcileReport is GET /api/admin/reconcile, the last pass's
+// report.
+func handleAdminReconcileReport(c *fiber.Ctx) error {
+	reconcileReportMu.Lock()
+	report := lastReconcile
+	reconcileReportMu.Unlock()
+	if report == nil {
+		return apiError(c, 404, "Reconciliation hasn't run yet")
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    report,
+	})
+}
+
+// handleAdminReconcile is POST /api/admin/reconcile?repair=true, which runs
+// a pass now and answers with its report.
+func handleAdminReconcile(c *fiber.Ctx) error {
+	report := reconcile(c.QueryBool("repair"))
+	if report == nil {
+		return apiError(c, 409, "Reconciliation is already running")
+	}
+	logReconcile(report)
+	if report.Error != "" {
+		return apiError(c, 500, report.Error)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    report,
+	})
+}
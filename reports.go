@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Abuse reports. Anyone with a link can report the file behind it through
+// POST /api/v1/report/:id; reports queue up for an admin, who dismisses them
+// or takes the file down, optionally banning the address it came from.
+
+const (
+	reportOpen      = "open"
+	reportDismissed = "dismissed"
+	reportRemoved   = "removed"
+
+	maxReportDetails = 2000
+	maxReportContact = 254
+)
+
+// reportReasons are the categories a report can be filed under.
+var reportReasons = []string{"malware", "phishing", "copyright", "illegal", "spam", "other"}
+
+// AbuseReport is one report about a file, open until an admin resolves it.
+type AbuseReport struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	FileID     string     `json:"file_id" gorm:"index;not null"` // UniqueID of the reported file
+	Reason     string     `json:"reason" gorm:"not null"`
+	Details    string     `json:"details,omitempty"`
+	Contact    string     `json:"contact,omitempty"` // how to reach the reporter, if they left a way
+	ReporterIP string     `json:"reporter_ip"`
+	Status     string     `json:"status" gorm:"index;not null"`
+	Note       string     `json:"note,omitempty"` // the admin's, on resolving
+	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+func validReportReason(reason string) bool {
+	for _, r := range reportReasons {
+		if reason == r {
+			return true
+		}
+	}
+	return false
+}
+
+// handleReportFile is POST /api/report/:id: {"reason", "details", "contact"}.
+// The ID may carry the link's extension. Reporting a file again while the
+// first report is open only acknowledges it.
+func handleReportFile(c *fiber.Ctx) error {
+	var req struct {
+		Reason  string `json:"reason" form:"reason"`
+		Details string `json:"details" form:"details"`
+		Contact string `json:"contact" form:"contact"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(c, 400, "Invalid request body")
+	}
+
+	req.Reason = strings.ToLower(strings.TrimSpace(req.Reason))
+	if !validReportReason(req.Reason) {
+		return apiError(c, 400, fmt.Sprintf("reason must be one of %s", strings.Join(reportReasons, ", ")))
+	}
+	req.Details = strings.TrimSpace(req.Details)
+	req.Contact = strings.TrimSpace(req.Contact)
+	if len(req.Details) > maxReportDetails {
+		return apiError(c, 400, fmt.Sprintf("details may be at most %d bytes", maxReportDetails))
+	}
+	if len(req.Contact) > maxReportContact {
+		return apiError(c, 400, fmt.Sprintf("contact may be at most %d bytes", maxReportContact))
+	}
+
+	id := c.Params("id")
+	id = strings.TrimSuffix(id, filepath.Ext(id))
+	var fileRecord FileRecord
+	if err := findFile(id, &fileRecord); err != nil {
+		return apiError(c, 404, "File not found")
+	}
+
+	var existing int64
+	db.Model(&AbuseReport{}).
+		Where("file_id = ? AND reporter_ip = ? AND status = ?", fileRecord.UniqueID, storedIP(c.IP()), reportOpen).
+		Count(&existing)
+	if existing > 0 {
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "This file has already been reported",
+		})
+	}
+
+	report := AbuseReport{
+		FileID:     fileRecord.UniqueID,
+		Reason:     req.Reason,
+		Details:    req.Details,
+		Contact:    req.Contact,
+		ReporterIP: storedIP(c.IP()),
+		Status:     reportOpen,
+	}
+	if err := db.Create(&report).Error; err != nil {
+		return apiError(c, 500, "Failed to save report")
+	}
+	requestLog(c).Info("File reported", "file_id", fileRecord.UniqueID, "reason", report.Reason, "report_id", report.ID)
+	holdReportedFile(&fileRecord)
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Report received, thank you",
+	})
+}
+
+// reportEntry is a report with the file it is about, which may have been
+// removed since.
+type reportEntry struct {
+	AbuseReport
+	File *FileRecord `json:"file"`
+}
+
+// handleAdminListReports lists reports, newest first: the open ones, or
+// ?status=dismissed, removed or all.
+func handleAdminListReports(c *fiber.Ctx) error {
+	status := c.Query("status", reportOpen)
+	query := db.Order("created_at desc")
+	switch status {
+	case "all":
+	case reportOpen, reportDismissed, reportRemoved:
+		query = query.Where("status = ?", status)
+	default:
+		return apiError(c, 400, fmt.Sprintf("Invalid status '%s'", status))
+	}
+	var reports []AbuseReport
+	if err := query.Find(&reports).Error; err != nil {
+		return apiError(c, 500, "Failed to list reports")
+	}
+
+	ids := make([]string, 0, len(reports))
+	for _, report := range reports {
+		ids = append(ids, report.FileID)
+	}
+	var files []FileRecord
+	if len(ids) > 0 {
+		db.Unscoped().Where("unique_id IN ?", ids).Find(&files)
+	}
+	byID := make(map[string]*FileRecord, len(files))
+	for i := range files {
+		byID[files[i].UniqueID] = &files[i]
+	}
+
+	entries := make([]reportEntry, 0, len(reports))
+	for _, report := range reports {
+		entries = append(entries, reportEntry{AbuseReport: report, File: byID[report.FileID]})
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    entries,
+	})
+}
+
+// handleAdminResolveReport closes a report and every other open report about
+// the same file: {"action": "dismiss"} leaves the file alone, {"action":
+// "remove"} takes it down, adding "ban": true bans the uploader's address
+// ("duration" as for bans) too. "note" is kept with the reports.
+func handleAdminResolveReport(c *fiber.Ctx) error {
+	var req struct {
+		Action   string `json:"action" form:"action"`
+		Ban      bool   `json:"ban" form:"ban"`
+		Duration string `json:"duration" form:"duration"`
+		Note     string `json:"note" form:"note"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(c, 400, "Invalid request body")
+	}
+
+	var report AbuseReport
+	if err := db.First(&report, c.Params("id")).Error; err != nil {
+		return apiError(c, 404, "Report not found")
+	}
+
+	var status string
+	switch req.Action {
+	case "dismiss":
+		status = reportDismissed
+	case "remove":
+		status = reportRemoved
+	default:
+		return apiError(c, 400, "action must be dismiss or remove")
+	}
+	if req.Ban && status != reportRemoved {
+		return apiError(c, 400, "ban needs action remove")
+	}
+	var banDuration time.Duration
+	if req.Duration != "" {
+		var err error
+		banDuration, err = parseDuration(req.Duration)
+		if err != nil || banDuration < 0 {
+			return apiError(c, 400, fmt.Sprintf("Invalid duration '%s'", req.Duration))
+		}
+	}
+
+	// Look the uploader up first, so a ban that can't be made leaves the file
+	var banTarget string
+	if req.Ban {
+		var uploader FileRecord
+		db.Unscoped().Where("unique_id = ?", report.FileID).First(&uploader)
+		if banTarget = bannableAddress(uploader.IPAddress); banTarget == "" {
+			return apiError(c, 409, "The uploader's address isn't stored")
+		}
+	}
+
+	response := fiber.Map{"success": true}
+	if status == reportRemoved {
+		var fileRecord FileRecord
+		if err := db.Where("unique_id = ?", report.FileID).First(&fileRecord).Error; err == nil {
+			if err := removeFile(&fileRecord, "abuse"); err != nil {
+				log.Printf("Failed to delete %s: %v", fileRecord.FilePath, err)
+				return apiError(c, 500, "Failed to delete file")
+			}
+			slog.Info("Admin removed reported file", "file_id", fileRecord.UniqueID, "report_id", report.ID)
+			audit(c, auditDelete, fileRecord.UniqueID, "abuse")
+			sendWebhook(c, webhookDeleted, &fileRecord, "abuse")
+		}
+		if banTarget != "" {
+			ban, err := banAddress(c, banTarget, "abuse report: "+report.Reason, banDuration)
+			if err != nil {
+				return apiError(c, 500, "Failed to save ban")
+			}
+			response["ban"] = ban
+		}
+	}
+
+	now := time.Now()
+	result := db.Model(&AbuseReport{}).
+		Where("file_id = ? AND (status = ? OR id = ?)", report.FileID, reportOpen, report.ID).
+		Updates(map[string]interface{}{"status": status, "note": req.Note, "resolved_at": now})
+	if result.Error != nil {
+		return apiError(c, 500, "Failed to resolve report")
+	}
+	response["resolved"] = result.RowsAffected
+	return c.JSON(response)
+}
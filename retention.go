@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Size-tiered retention, 0x0.st style: RETENTION_POLICY=100MB:30d,1GB:7d,10GB:1d
+// keeps files up to 100 MB for 30 days, up to 1 GB for 7 days and anything
+// bigger for a day. A file's tier sets both its default lifetime and the
+// longest one its uploader may ask for, in place of FILE_EXPIRE_AFTER and
+// FILE_EXPIRE_MAX, so big files can't be parked for long. The lifetime is
+// fixed at upload time.
+
+// retentionTier keeps files of up to maxSize bytes for lifetime (0 =
+// forever).
+type retentionTier struct {
+	maxSize  int64
+	lifetime time.Duration
+}
+
+// retentionPolicy is sorted by size; empty when the flat settings apply.
+var retentionPolicy []retentionTier
+
+// loadRetentionConfig reads RETENTION_POLICY. It runs after
+// FILE_EXPIRE_AFTER is read.
+func loadRetentionConfig() {
+	value := getEnv("RETENTION_POLICY", "")
+	if value == "" {
+		return
+	}
+	policy, err := parseRetentionPolicy(value)
+	if err != nil {
+		log.Fatalf("Invalid RETENTION_POLICY value '%s': %v", value, err)
+	}
+	retentionPolicy = policy
+	log.Printf("Retention by size: %s", describeRetentionPolicy())
+}
+
+// parseRetentionPolicy reads comma-separated size:lifetime tiers, in any
+// order.
+func parseRetentionPolicy(value string) ([]retentionTier, error) {
+	var policy []retentionTier
+	for _, entry := range splitList(value) {
+		sizeStr, lifetimeStr, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not size:lifetime", entry)
+		}
+		size, err := parseSize(strings.TrimSpace(sizeStr))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size '%s'", sizeStr)
+		}
+		lifetime, err := parseDuration(strings.TrimSpace(lifetimeStr))
+		if err != nil || lifetime < 0 {
+			return nil, fmt.Errorf("invalid lifetime '%s'", lifetimeStr)
+		}
+		policy = append(policy, retentionTier{maxSize: size, lifetime: lifetime})
+	}
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("no tiers")
+	}
+	sort.Slice(policy, func(i, j int) bool { return policy[i].maxSize < policy[j].maxSize })
+	for i := 1; i < len(policy); i++ {
+		if policy[i].maxSize == policy[i-1].maxSize {
+			return nil, fmt.Errorf("%s is given twice", formatBytes(policy[i].maxSize))
+		}
+	}
+	return policy, nil
+}
+
+// retentionFor returns how long a file of size bytes is kept by default and
+// the longest an upload may ask for; 0 means forever and no cap.
+func retentionFor(size int64) (lifetime, limit time.Duration) {
+	if len(retentionPolicy) == 0 {
+		return expireDuration, maxExpire
+	}
+	// Files bigger than every tier get the last one
+	tier := retentionPolicy[len(retentionPolicy)-1]
+	for _, t := range retentionPolicy {
+		if size <= t.maxSize {
+			tier = t
+			break
+		}
+	}
+	return tier.lifetime, tier.lifetime
+}
+
+// describeRetentionPolicy spells the policy out for people, e.g. "up to
+// 100.00 MB: 30 days, up to 1.00 GB: 7 days, larger: 1 day".
+func describeRetentionPolicy() string {
+	parts := make([]string, 0, len(retentionPolicy))
+	for i, tier := range retentionPolicy {
+		lifetime := "never expire"
+		if tier.lifetime > 0 {
+			lifetime = formatDuration(tier.lifetime)
+		}
+		if i == len(retentionPolicy)-1 && i > 0 {
+			parts = append(parts, fmt.Sprintf("larger: %s", lifetime))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("up to %s: %s", formatBytes(tier.maxSize), lifetime))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A minimal S3-compatible API at /s3/, enough for `aws s3 cp`, rclone and
+// the AWS SDKs to upload here. PUT Object is an ordinary upload named after
+// the last part of the object key; the bucket is accepted and ignored, and
+// every other operation answers NotImplemented.
+//
+// Requests are signed with AWS Signature Version 4 using an API key as both
+// the access key id and the secret access key: only a hash of each key is
+// kept, so the secret can't be looked up from any other id.
+
+const (
+	// s3MaxClockSkew is how far X-Amz-Date may be from the server's clock.
+	s3MaxClockSkew = 15 * time.Minute
+	// s3MaxChunkSize caps one chunk of an aws-chunked body, which is held in
+	// memory until its signature has been checked.
+	s3MaxChunkSize = 16 << 20
+
+	s3StreamingSigned          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3StreamingSignedTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	s3StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// s3Failure is an error answered in S3's XML error format.
+type s3Failure struct {
+	status  int
+	code    string
+	message string
+}
+
+func (f *s3Failure) Error() string { return f.message }
+
+type s3ErrorBody struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId,omitempty"`
+}
+
+func sendS3Error(c *fiber.Ctx, status int, code, message string) error {
+	id, _ := c.Locals("request_id").(string)
+	body, _ := xml.Marshal(s3ErrorBody{Code: code, Message: message, Resource: c.Path(), RequestID: id})
+	c.Set("x-amz-request-id", id)
+	c.Set(fiber.HeaderContentType, "application/xml")
+	return c.Status(status).Send(append([]byte(xml.Header), body...))
+}
+
+func sendS3Failure(c *fiber.Ctx, f *s3Failure) error {
+	return sendS3Error(c, f.status, f.code, f.message)
+}
+
+func setupS3Routes(app *fiber.App) {
+	s3 := app.Group("/s3", s3Auth)
+	s3.Put("/:bucket/+", handleS3PutObject)
+	s3.All("/*", handleS3NotImplemented)
+}
+
+// s3Signature is a verified request signature, kept to check the chunks of
+// a streamed body against.
+type s3Signature struct {
+	key        *APIKey
+	time       time.Time
+	scope      string
+	signingKey []byte
+	signature  string
+}
+
+// s3Auth checks the request's signature and requires the upload scope, with
+// or without REQUIRE_API_KEY.
+func s3Auth(c *fiber.Ctx) error {
+	signature, failure := verifyS3Signature(c)
+	if failure != nil {
+		audit(c, auditAuthFailure, "", "S3 "+failure.code)
+		return sendS3Failure(c, failure)
+	}
+	if !signature.key.hasScope(scopeUpload) {
+		audit(c, auditAuthFailure, "", "API key lacks the "+scopeUpload+" scope")
+		return sendS3Error(c, 403, "AccessDenied", fmt.Sprintf("API key lacks the '%s' scope", scopeUpload))
+	}
+	c.Locals("api_key", signature.key)
+	c.Locals("s3_signature", signature)
+	return c.Next()
+}
+
+// verifyS3Signature checks the Authorization header of a request signed with
+// Signature Version 4.
+func verifyS3Signature(c *fiber.Ctx) (*s3Signature, *s3Failure) {
+	params, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), sigV4Algorithm+" ")
+	if !ok {
+		return nil, &s3Failure{403, "AccessDenied", "Requests must be signed with AWS Signature Version 4"}
+	}
+	var credential, signedHeaders, signature string
+	for _, field := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+
+	// The access key id is the API key, which could itself hold slashes
+	parts := strings.Split(credential, "/")
+	if len(parts) < 5 || parts[len(parts)-2] != "s3" || parts[len(parts)-1] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return nil, &s3Failure{400, "AuthorizationHeaderMalformed", "The Authorization header is malformed"}
+	}
+	accessKey := strings.Join(parts[:len(parts)-4], "/")
+	date, region := parts[len(parts)-4], parts[len(parts)-3]
+
+	signedAt, err := time.Parse(sigV4TimeFormat, c.Get("X-Amz-Date"))
+	if err != nil || signedAt.Format(sigV4DateFormat) != date {
+		return nil, &s3Failure{403, "AccessDenied", "X-Amz-Date is missing or doesn't match the credential scope"}
+	}
+	if skew := time.Since(signedAt); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return nil, &s3Failure{403, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	}
+	payloadHash := c.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, &s3Failure{400, "InvalidRequest", "Missing required header x-amz-content-sha256"}
+	}
+
+	key := lookupAPIKey(accessKey)
+	if key == nil {
+		return nil, &s3Failure{403, "InvalidAccessKeyId", "The access key id must be a valid API key"}
+	}
+
+	names := strings.Split(signedHeaders, ";")
+	headers := make(map[string]string, len(names))
+	for _, name := range names {
+		headers[name] = strings.Join(strings.Fields(c.Get(name)), " ")
+	}
+	requestPath, err := url.PathUnescape(c.Path())
+	if err != nil {
+		requestPath = c.Path()
+	}
+	query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+
+	canonical := sigV4CanonicalRequest(c.Method(), requestPath, query, headers, names, payloadHash)
+	expected := sigV4Signature(accessKey, signedAt, region, "s3", canonical)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, &s3Failure{403, "SignatureDoesNotMatch", "The request signature does not match; sign with the API key as the secret access key"}
+	}
+
+	return &s3Signature{
+		key:        key,
+		time:       signedAt,
+		scope:      sigV4Scope(signedAt, region, "s3"),
+		signingKey: sigV4SigningKey(accessKey, signedAt, region, "s3"),
+		signature:  signature,
+	}, nil
+}
+
+// chunkSignature is the signature of one chunk of a streamed body, chained
+// to the one before it.
+func (s *s3Signature) chunkSignature(previous string, data []byte) string {
+	hash := sha256.Sum256(data)
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm + "-PAYLOAD",
+		s.time.Format(sigV4TimeFormat),
+		s.scope,
+		previous,
+		sigV4EmptyBodyHash,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(s.signingKey, stringToSign))
+}
+
+func handleS3NotImplemented(c *fiber.Ctx) error {
+	return sendS3Error(c, 501, "NotImplemented", "Only PUT Object is supported")
+}
+
+// handleS3PutObject uploads the body as a file named after the object key.
+// The share link comes back in X-Download-URL.
+func handleS3PutObject(c *fiber.Ctx) error {
+	if c.Get("X-Amz-Copy-Source") != "" {
+		return sendS3Error(c, 501, "NotImplemented", "CopyObject is not supported")
+	}
+	if c.Query("uploadId") != "" || c.Query("partNumber") != "" {
+		return sendS3Error(c, 501, "NotImplemented", "Multipart uploads are not supported")
+	}
+	signature := c.Locals("s3_signature").(*s3Signature)
+
+	objectKey, err := url.PathUnescape(c.Params("+"))
+	if err != nil {
+		objectKey = c.Params("+")
+	}
+	filename := sanitizeFilename(path.Base(objectKey))
+
+	if err := checkFileType(filename, c.Get("Content-Type")); err != nil {
+		return sendS3Error(c, 415, "InvalidArgument", err.Error())
+	}
+	sizeHeader := c.Get("X-Amz-Decoded-Content-Length")
+	if sizeHeader == "" {
+		sizeHeader = c.Get("Content-Length")
+	}
+	fileSize, _ := strconv.ParseInt(sizeHeader, 10, 64)
+	if fileSize > maxUpload {
+		return sendS3Error(c, 400, "EntityTooLarge", fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)))
+	}
+	if quotaErr := checkUploadQuota(c.IP(), fileSize); quotaErr != nil {
+		return sendS3Error(c, quotaErr.status, "QuotaExceeded", quotaErr.message)
+	}
+	ticket, refusal := admitUpload(fileSize)
+	if refusal != nil {
+		setUploadRetryAfter(c, refusal)
+		code := "SlowDown"
+		if refusal.status == 507 {
+			code = "InsufficientStorage"
+		}
+		return sendS3Error(c, refusal.status, code, refusal.message)
+	}
+	defer ticket.release()
+
+	var body io.Reader = c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	payloadHash := c.Get("X-Amz-Content-Sha256")
+	switch payloadHash {
+	case sigV4UnsignedBody:
+	case s3StreamingSigned, s3StreamingSignedTrailer:
+		body = &awsChunkedReader{r: bufio.NewReader(body), signature: signature, previous: signature.signature}
+	case s3StreamingUnsignedTrailer:
+		body = &awsChunkedReader{r: bufio.NewReader(body)}
+	default:
+		if _, err := hex.DecodeString(payloadHash); err != nil || len(payloadHash) != sha256.Size*2 {
+			return sendS3Error(c, 400, "InvalidArgument", "Unsupported x-amz-content-sha256 value")
+		}
+	}
+
+	md5sum := md5.New()
+	stagedPath := newStagingPath()
+	// The declared length may be missing or wrong; cap what's read as well
+	body = io.LimitReader(body, maxUpload+1)
+	staged, err := saveStream(stagedPath, io.TeeReader(uploadThrottle().reader(body), md5sum))
+	if err != nil {
+		os.Remove(stagedPath)
+		var failure *s3Failure
+		if errors.As(err, &failure) {
+			return sendS3Failure(c, failure)
+		}
+		return sendS3Error(c, 500, "InternalError", "Failed to save file")
+	}
+	if staged.Size > maxUpload {
+		os.Remove(stagedPath)
+		return sendS3Error(c, 400, "EntityTooLarge", fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)))
+	}
+	if len(payloadHash) == sha256.Size*2 && !strings.EqualFold(payloadHash, staged.Digest.SHA256) {
+		os.Remove(stagedPath)
+		return sendS3Error(c, 400, "XAmzContentSHA256Mismatch", "The SHA-256 of the body doesn't match x-amz-content-sha256")
+	}
+	etag := hex.EncodeToString(md5sum.Sum(nil))
+	if contentMD5 := c.Get("Content-MD5"); contentMD5 != "" {
+		if expected, err := base64.StdEncoding.DecodeString(contentMD5); err != nil || hex.EncodeToString(expected) != etag {
+			os.Remove(stagedPath)
+			return sendS3Error(c, 400, "BadDigest", "The Content-MD5 you specified did not match what was received")
+		}
+	}
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return sendS3Error(c, 415, "InvalidArgument", err.Error())
+	}
+	if fileSize == 0 {
+		if quotaErr := checkUploadQuota(c.IP(), staged.Size); quotaErr != nil {
+			os.Remove(stagedPath)
+			return sendS3Error(c, quotaErr.status, "QuotaExceeded", quotaErr.message)
+		}
+	}
+
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+	storageKey, nonce, err := storeBlob(newStorageKey(ext), staged)
+	if err != nil {
+		requestLog(c).Error("Failed to store file", "key", storageKey, "error", err)
+		return sendS3Error(c, 500, "InternalError", "Failed to save file")
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+	fileRecord := FileRecord{
+		UniqueID:         newFileID(),
+		OriginalName:     filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         staged.Size,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: c.Get("Content-Type"),
+		Extension:        ext,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        storedIP(c.IP()),
+		APIKeyID:         currentAPIKeyID(c),
+		ExpiresAt:        computeExpiry(staged.Size),
+	}
+	if err := createFileRecord(db, &fileRecord); err != nil {
+		releaseBlob(storageKey)
+		return sendS3Error(c, 500, "InternalError", "Failed to save file metadata")
+	}
+	queueScan(fileRecord)
+	logUpload(c, &fileRecord)
+	sendWebhook(c, webhookUploaded, &fileRecord, "")
+
+	id, _ := c.Locals("request_id").(string)
+	c.Set("x-amz-request-id", id)
+	c.Set("ETag", `"`+etag+`"`)
+	c.Set("X-Download-URL", signLink(getBaseURL(c)+fileRecord.downloadPath(), &fileRecord))
+	c.Set("X-Delete-Token", deleteToken)
+	c.Set("X-Checksum-SHA256", staged.Digest.SHA256)
+	return c.Status(200).Send(nil)
+}
+
+// awsChunkedReader decodes an aws-chunked body, checking each chunk's
+// signature when the body is signed. Checksums sent as trailers after the
+// last chunk are skipped: the upload's SHA-256 is recorded anyway.
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	signature *s3Signature // nil for unsigned chunks
+	previous  string       // signature of the chunk before, the request's first
+
+	buf   []byte
+	chunk []byte // what's left of the current chunk
+	done  bool
+}
+
+func (r *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// next reads the following chunk.
+func (r *awsChunkedReader) next() error {
+	malformed := &s3Failure{400, "IncompleteBody", "The aws-chunked body is malformed"}
+
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		return malformed
+	}
+	sizeField, extension, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return malformed
+	}
+	if int64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+	data := r.buf[:size]
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return malformed
+	}
+
+	if r.signature != nil {
+		signature, _ := strings.CutPrefix(extension, "chunk-signature=")
+		if !hmac.Equal([]byte(r.signature.chunkSignature(r.previous, data)), []byte(signature)) {
+			return &s3Failure{403, "SignatureDoesNotMatch", "A chunk signature does not match"}
+		}
+		r.previous = signature
+	}
+
+	if size == 0 {
+		r.done = true
+		io.Copy(io.Discard, r.r)
+		return nil
+	}
+	if crlf, err := r.r.ReadString('\n'); err != nil || strings.TrimRight(crlf, "\r\n") != "" {
+		return malformed
+	}
+	r.chunk = data
+	return nil
+}
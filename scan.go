@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Malware scanning. When CLAMAV_ADDR points at a clamd daemon, every upload is
+// streamed to it with the INSTREAM command once it has been stored. Files stay
+// "pending" (and are not served) until the scan finishes; infected files are
+// kept in the database but never served again.
+
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+	scanFailed   = "error"   // clamd unreachable or failed; retried hourly
+	scanSkipped  = "skipped" // larger than clamd's StreamMaxLength
+
+	clamdChunkSize   = 64 * 1024
+	clamdConcurrency = 4
+)
+
+var (
+	clamavNetwork string
+	clamavAddr    string
+	scanSlots     chan struct{}
+)
+
+// loadScanConfig reads CLAMAV_ADDR: "host:port", "tcp://host:port",
+// "unix:///path/clamd.sock" or a plain socket path.
+func loadScanConfig() {
+	addr := strings.TrimSpace(getEnv("CLAMAV_ADDR", ""))
+	clamavNetwork, clamavAddr = "", ""
+	if addr == "" {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		clamavNetwork, clamavAddr = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "unix:"):
+		clamavNetwork, clamavAddr = "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "/"):
+		clamavNetwork, clamavAddr = "unix", addr
+	default:
+		clamavNetwork, clamavAddr = "tcp", strings.TrimPrefix(addr, "tcp://")
+	}
+
+	scanSlots = make(chan struct{}, clamdConcurrency)
+	log.Printf("Malware scanning enabled (clamd at %s %s)", clamavNetwork, clamavAddr)
+
+	// Pick up files whose scan was interrupted by a restart
+	go rescanFiles(scanPending, scanFailed)
+}
+
+func scanningEnabled() bool {
+	return clamavAddr != ""
+}
+
+// initialScanStatus is the scan status new file records start with.
+func initialScanStatus() string {
+	if scanningEnabled() {
+		return scanPending
+	}
+	return ""
+}
+
+// queueScan scans a freshly stored file in the background.
+func queueScan(fileRecord FileRecord) {
+	if !scanningEnabled() {
+		return
+	}
+	go func() {
+		scanSlots <- struct{}{}
+		defer func() { <-scanSlots }()
+		scanFileRecord(&fileRecord)
+	}()
+}
+
+// rescanFiles queues every file with one of the given scan statuses.
+func rescanFiles(statuses ...string) {
+	if !scanningEnabled() {
+		return
+	}
+	var pending []FileRecord
+	db.Where("scan_status IN ?", statuses).Find(&pending)
+	for _, fileRecord := range pending {
+		queueScan(fileRecord)
+	}
+}
+
+// scanFileRecord scans a stored file and records the verdict.
+func scanFileRecord(fileRecord *FileRecord) {
+	status, result := scanFailed, ""
+
+	// Deduplicated uploads share a blob; reuse a verdict already reached for it
+	var scanned FileRecord
+	if err := db.Where("file_path = ? AND id <> ? AND scan_status IN ?", fileRecord.FilePath, fileRecord.ID,
+		[]string{scanClean, scanInfected, scanSkipped}).First(&scanned).Error; err == nil {
+		status, result = scanned.ScanStatus, scanned.ScanResult
+	} else if reader, err := openFileRecord(fileRecord); err != nil {
+		result = err.Error()
+	} else {
+		status, result = clamdScan(reader)
+		reader.Close()
+	}
+
+	now := time.Now()
+	db.Model(fileRecord).Updates(map[string]interface{}{
+		"scan_status": status,
+		"scan_result": result,
+		"scanned_at":  &now,
+	})
+	holdUnscannedFile(fileRecord, status)
+
+	switch status {
+	case scanInfected:
+		log.Printf("Malware detected in %s (%s): %s", fileRecord.UniqueID, fileRecord.OriginalName, result)
+	case scanFailed:
+		log.Printf("Failed to scan %s: %s", fileRecord.UniqueID, result)
+	}
+}
+
+// clamdScan streams r to clamd and returns the resulting scan status along
+// with the signature name or error message.
+func clamdScan(r io.Reader) (string, string) {
+	conn, err := net.DialTimeout(clamavNetwork, clamavAddr, 10*time.Second)
+	if err != nil {
+		return scanFailed, err.Error()
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return scanFailed, err.Error()
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			conn.SetWriteDeadline(time.Now().Add(time.Minute))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection once StreamMaxLength is
+				// exceeded; its reply says so
+				break
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return scanFailed, readErr.Error()
+		}
+	}
+	conn.Write([]byte{0, 0, 0, 0})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return scanFailed, fmt.Sprintf("reading clamd reply: %v", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets replies such as "stream: OK",
+// "stream: Eicar-Signature FOUND" and "INSTREAM size limit exceeded. ERROR".
+func parseClamdReply(reply string) (string, string) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return scanClean, ""
+	case strings.HasSuffix(reply, " FOUND"):
+		return scanInfected, strings.TrimSuffix(reply, " FOUND")
+	case strings.Contains(reply, "size limit exceeded"):
+		return scanSkipped, strings.TrimSuffix(reply, " ERROR")
+	default:
+		return scanFailed, reply
+	}
+}
+
+// refuseUnscanned stops files that are infected or still being scanned from
+// being served. It reports whether a response was sent.
+func refuseUnscanned(c *fiber.Ctx, fileRecord *FileRecord) (bool, error) {
+	switch fileRecord.ScanStatus {
+	case scanInfected:
+		return true, c.Status(403).SendString("File blocked: malware detected")
+	case scanPending:
+		c.Set("Retry-After", "10")
+		return true, c.Status(503).SendString("File is still being scanned for malware, try again shortly")
+	}
+	return false, nil
+}
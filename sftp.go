@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP ingestion for tools that can't do multipart HTTP. With SFTP_PORT set,
+// an SFTP server on that port takes logins with an API key (any user name,
+// the key as the password) or with a public key listed in
+// SFTP_AUTHORIZED_KEYS. Each connection sees an empty folder of its own:
+// every file written there becomes an upload, and <name>.url appears next to
+// it with the download link and deletion token. Files can't be read back,
+// only their .url files.
+
+var (
+	sftpPort           string
+	sftpHostKeyFile    string
+	sftpAuthorizedKeys map[string]bool // marshalled public keys
+)
+
+// loadSFTPConfig reads SFTP_PORT, SFTP_HOST_KEY and SFTP_AUTHORIZED_KEYS.
+func loadSFTPConfig() {
+	sftpPort = getEnv("SFTP_PORT", "")
+	if sftpPort == "" {
+		return
+	}
+	sftpHostKeyFile = getEnv("SFTP_HOST_KEY", "./sftp_host_key")
+
+	sftpAuthorizedKeys = make(map[string]bool)
+	if keysFile := getEnv("SFTP_AUTHORIZED_KEYS", ""); keysFile != "" {
+		data, err := os.ReadFile(keysFile)
+		if err != nil {
+			log.Fatalf("Failed to read SFTP_AUTHORIZED_KEYS: %v", err)
+		}
+		for len(bytes.TrimSpace(data)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				log.Fatalf("Invalid key in SFTP_AUTHORIZED_KEYS: %v", err)
+			}
+			sftpAuthorizedKeys[string(key.Marshal())] = true
+			data = rest
+		}
+	}
+}
+
+// serveSFTP accepts SFTP connections until the process exits.
+func serveSFTP() {
+	if sftpPort == "" {
+		return
+	}
+	config, err := sftpServerConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up SFTP: %v", err)
+	}
+	listener, err := net.Listen("tcp", ":"+sftpPort)
+	if err != nil {
+		log.Fatalf("Failed to listen for SFTP on port %s: %v", sftpPort, err)
+	}
+	log.Printf("SFTP uploads on port %s (%d authorized keys)", sftpPort, len(sftpAuthorizedKeys))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			slog.Error("SFTP accept failed", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go handleSFTPConn(conn, config)
+	}
+}
+
+// sftpAuthFailureDelay slows down each wrong password, so API keys can't be
+// guessed at speed.
+const sftpAuthFailureDelay = time.Second
+
+// sftpServerConfig sets up authentication and the host key.
+func sftpServerConfig() (*ssh.ServerConfig, error) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			ip := addrIP(meta.RemoteAddr())
+			if isBanned(ip) {
+				return nil, errors.New("address banned")
+			}
+			if !sftpPasswordAllowed(ip) {
+				return nil, errors.New("too many password attempts")
+			}
+			key := lookupAPIKey(string(password))
+			if key == nil || !key.hasScope(scopeUpload) {
+				auditAs("anonymous", ip, auditAuthFailure, "", "SFTP password")
+				time.Sleep(sftpAuthFailureDelay)
+				return nil, errors.New("invalid API key")
+			}
+			permissions := &ssh.Permissions{Extensions: map[string]string{"actor": keyActor(key)}}
+			if key != &legacyAPIKey {
+				permissions.Extensions["api_key_id"] = strconv.FormatUint(uint64(key.ID), 10)
+			}
+			return permissions, nil
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if isBanned(addrIP(meta.RemoteAddr())) {
+				return nil, errors.New("address banned")
+			}
+			if !sftpAuthorizedKeys[string(key.Marshal())] {
+				auditAs("anonymous", addrIP(meta.RemoteAddr()), auditAuthFailure, "", "SFTP public key "+ssh.FingerprintSHA256(key))
+				return nil, errors.New("key not authorized")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"actor": "ssh_key:" + ssh.FingerprintSHA256(key)}}, nil
+		},
+	}
+
+	hostKey, err := loadSFTPHostKey(sftpHostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(hostKey)
+	return config, nil
+}
+
+// sftpPasswordAllowed counts a password attempt from ip against the
+// anonymous RATE_LIMIT_MAX, reporting whether it's within the budget.
+// Trusted IP ranges aren't counted.
+func sftpPasswordAllowed(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, ipNet := range rateLimitTrustedIP {
+			if ipNet.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	count, _, err := rateLimits.take("sftp_auth:ip:"+ip, rateLimitWindow)
+	if err != nil {
+		// A limiter outage shouldn't lock everyone out
+		logRateLimitError(err)
+		return true
+	}
+	return count <= rateLimitMax
+}
+
+// loadSFTPHostKey reads the server's host key, generating an Ed25519 key on
+// first start so clients see the same key across restarts.
+func loadSFTPHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(private, "bashupload")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("saving host key: %w", err)
+		}
+		log.Printf("Generated SFTP host key %s", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// handleSFTPConn serves one SSH connection. All its SFTP channels share one
+// session folder.
+func handleSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	session := &sftpSession{
+		ip:      addrIP(serverConn.RemoteAddr()),
+		actor:   serverConn.Permissions.Extensions["actor"],
+		baseURL: localBaseURL(serverConn.LocalAddr()),
+		entries: make(map[string]*sftpEntry),
+	}
+	if id, err := strconv.ParseUint(serverConn.Permissions.Extensions["api_key_id"], 10, 64); err == nil {
+		keyID := uint(id)
+		session.apiKeyID = &keyID
+	}
+	slog.Info("SFTP session started", "ip", storedIP(session.ip), "user", serverConn.User())
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			// Only the sftp subsystem is offered, no shell
+			for request := range channelRequests {
+				ok := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				handlers := sftp.Handlers{FileGet: session, FilePut: session, FileCmd: session, FileList: session}
+				server := sftp.NewRequestServer(channel, handlers)
+				if err := server.Serve(); err != nil && err != io.EOF {
+					slog.Warn("SFTP session failed", "ip", storedIP(session.ip), "error", err)
+				}
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+// sftpSession is the folder one connection sees: the files it uploaded and
+// their .url files.
+type sftpSession struct {
+	ip       string
+	actor    string // as in the audit log
+	apiKeyID *uint
+	baseURL  string
+
+	mu      sync.Mutex
+	entries map[string]*sftpEntry
+}
+
+// sftpEntry is a file in a session folder. Uploads carry their record, .url
+// files their contents.
+type sftpEntry struct {
+	name     string
+	size     int64
+	modTime  time.Time
+	record   *FileRecord
+	contents []byte
+}
+
+func (e *sftpEntry) Name() string       { return e.name }
+func (e *sftpEntry) Size() int64        { return e.size }
+func (e *sftpEntry) ModTime() time.Time { return e.modTime }
+func (e *sftpEntry) IsDir() bool        { return false }
+func (e *sftpEntry) Sys() interface{}   { return nil }
+func (e *sftpEntry) Mode() os.FileMode {
+	if e.record != nil {
+		return 0200 // written, but can't be read back
+	}
+	return 0400
+}
+
+// sftpRoot is the session folder itself.
+type sftpRoot struct{}
+
+func (sftpRoot) Name() string       { return "/" }
+func (sftpRoot) Size() int64        { return 0 }
+func (sftpRoot) Mode() os.FileMode  { return os.ModeDir | 0700 }
+func (sftpRoot) ModTime() time.Time { return time.Now() }
+func (sftpRoot) IsDir() bool        { return true }
+func (sftpRoot) Sys() interface{}   { return nil }
+
+// sftpName turns a request path into a name in the session folder, or ""
+// for the folder itself. There are no subfolders.
+func sftpName(requestPath string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+requestPath), "/")
+	if strings.Contains(name, "/") {
+		return "", sftp.ErrSSHFxNoSuchFile
+	}
+	return name, nil
+}
+
+// Fileread serves .url files. Uploads can only be fetched through their link.
+func (s *sftpSession) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	name, err := sftpName(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[name]
+	switch {
+	case !ok:
+		return nil, sftp.ErrSSHFxNoSuchFile
+	case entry.record != nil:
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return bytes.NewReader(entry.contents), nil
+}
+
+// Filewrite receives a file, which is uploaded once the client closes it.
+func (s *sftpSession) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	name, err := sftpName(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || strings.HasSuffix(name, ".url") {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	if quotaErr := checkUploadQuota(s.ip, 0); quotaErr != nil {
+		return nil, errors.New(quotaErr.message)
+	}
+	ticket, refusal := admitUpload(0)
+	if refusal != nil {
+		return nil, errors.New(refusal.message)
+	}
+
+	spoolPath := newStagingPath()
+	spool, err := os.OpenFile(spoolPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		ticket.release()
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return &sftpUpload{session: s, name: name, spool: spool, ticket: ticket}, nil
+}
+
+// sftpUpload is a file being written. Writes may come in any order, so they
+// go to a spool file that is uploaded as a whole on close.
+type sftpUpload struct {
+	session *sftpSession
+	name    string
+	spool   *os.File
+	aborted bool
+	ticket  *uploadTicket
+}
+
+func (u *sftpUpload) WriteAt(p []byte, offset int64) (int, error) {
+	if offset+int64(len(p)) > maxUpload {
+		return 0, fmt.Errorf("file too large, maximum size is %s", formatBytes(maxUpload))
+	}
+	return u.spool.WriteAt(p, offset)
+}
+
+// TransferError is called when the connection drops with the file open;
+// what arrived is thrown away rather than uploaded.
+func (u *sftpUpload) TransferError(err error) {
+	u.aborted = true
+}
+
+func (u *sftpUpload) Close() error {
+	defer u.ticket.release()
+	defer os.Remove(u.spool.Name())
+	if u.aborted {
+		u.spool.Close()
+		return nil
+	}
+	if _, err := u.spool.Seek(0, io.SeekStart); err != nil {
+		u.spool.Close()
+		return sftp.ErrSSHFxFailure
+	}
+	record, deleteToken, err := u.session.store(u.name, u.spool)
+	u.spool.Close()
+	if err != nil {
+		return err
+	}
+
+	link := signLink(u.session.baseURL+record.downloadPath(), record)
+	contents := []byte(fmt.Sprintf("%s\ndelete token: %s\n", link, deleteToken))
+	now := time.Now()
+	u.session.mu.Lock()
+	u.session.entries[u.name] = &sftpEntry{name: u.name, size: record.FileSize, modTime: now, record: record}
+	u.session.entries[u.name+".url"] = &sftpEntry{name: u.name + ".url", size: int64(len(contents)), modTime: now, contents: contents}
+	u.session.mu.Unlock()
+	return nil
+}
+
+// store registers a received file as an upload, returning its record and
+// deletion token. Errors are the messages the client sees.
+func (s *sftpSession) store(name string, data io.Reader) (*FileRecord, string, error) {
+	filename := sanitizeFilename(name)
+	if err := checkFileType(filename, ""); err != nil {
+		return nil, "", err
+	}
+
+	stagedPath := newStagingPath()
+	staged, err := saveStream(stagedPath, data)
+	if err != nil {
+		os.Remove(stagedPath)
+		return nil, "", errors.New("failed to save file")
+	}
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return nil, "", err
+	}
+	if quotaErr := checkUploadQuota(s.ip, staged.Size); quotaErr != nil {
+		os.Remove(stagedPath)
+		return nil, "", errors.New(quotaErr.message)
+	}
+
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+	storageKey, nonce, err := storeBlob(newStorageKey(ext), staged)
+	if err != nil {
+		slog.Error("Failed to store SFTP upload", "key", storageKey, "error", err)
+		return nil, "", errors.New("failed to save file")
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+	fileRecord := FileRecord{
+		UniqueID:        newFileID(),
+		OriginalName:    filename,
+		FilePath:        storageKey,
+		IPFSCID:         blobCID(storageKey),
+		Compression:     staged.Compression,
+		CompressedSize:  staged.CompressedSize,
+		FileSize:        staged.Size,
+		SHA256:          staged.Digest.SHA256,
+		MD5:             staged.Digest.MD5,
+		EncryptionNonce: nonce,
+		MimeType:        staged.MimeType,
+		Extension:       ext,
+		DeleteToken:     deleteTokenHash,
+		ScanStatus:      initialScanStatus(),
+		Moderation:      initialModeration(),
+		HoldReason:      initialHoldReason(),
+		IPAddress:       storedIP(s.ip),
+		APIKeyID:        s.apiKeyID,
+		ExpiresAt:       computeExpiry(staged.Size),
+	}
+	if err := createFileRecord(db, &fileRecord); err != nil {
+		releaseBlob(storageKey)
+		return nil, "", errors.New("failed to save file metadata")
+	}
+	queueScan(fileRecord)
+	recordUploadUsage(&fileRecord)
+	slog.Info("File uploaded over SFTP",
+		"file_id", fileRecord.UniqueID,
+		"name", fileRecord.OriginalName,
+		"size", fileRecord.FileSize,
+		"ip", storedIP(s.ip))
+	auditAs(s.actor, s.ip, auditUpload, fileRecord.UniqueID, strconv.FormatInt(fileRecord.FileSize, 10)+" bytes over SFTP")
+	sendWebhook(nil, webhookUploaded, &fileRecord, "")
+	return &fileRecord, deleteToken, nil
+}
+
+// Filecmd renames and removes files in the session folder. Removing an
+// upload deletes it from the server; renaming one renames the upload.
+// Attribute changes are accepted and ignored.
+func (s *sftpSession) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return nil
+	case "Remove", "Rename":
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+
+	name, err := sftpName(r.Filepath)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[name]
+	if !ok {
+		return sftp.ErrSSHFxNoSuchFile
+	}
+
+	if r.Method == "Remove" {
+		if entry.record != nil {
+			if err := removeFile(entry.record, "uploader"); err != nil {
+				return sftp.ErrSSHFxFailure
+			}
+			auditAs(s.actor, s.ip, auditDelete, entry.record.UniqueID, "uploader")
+			sendWebhook(nil, webhookDeleted, entry.record, "uploader")
+			delete(s.entries, name+".url")
+		}
+		delete(s.entries, name)
+		return nil
+	}
+
+	target, err := sftpName(r.Target)
+	if err != nil || target == "" || (entry.record != nil) == strings.HasSuffix(target, ".url") {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if entry.record != nil {
+		// Clients writing to a temporary name first, like WinSCP's .filepart
+		filename := sanitizeFilename(target)
+		if err := db.Model(entry.record).Update("original_name", filename).Error; err != nil {
+			return sftp.ErrSSHFxFailure
+		}
+		if link, ok := s.entries[name+".url"]; ok {
+			delete(s.entries, name+".url")
+			link.name = target + ".url"
+			s.entries[link.name] = link
+		}
+	}
+	delete(s.entries, name)
+	entry.name = target
+	s.entries[target] = entry
+	return nil
+}
+
+// Filelist lists the session folder and stats its files.
+func (s *sftpSession) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name, err := sftpName(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case "List":
+		if name != "" {
+			return nil, sftp.ErrSSHFxNoSuchFile
+		}
+		infos := make([]os.FileInfo, 0, len(s.entries))
+		for _, entry := range s.entries {
+			infos = append(infos, entry)
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		return sftpListing(infos), nil
+	case "Stat":
+		if name == "" {
+			return sftpListing{sftpRoot{}}, nil
+		}
+		if entry, ok := s.entries[name]; ok {
+			return sftpListing{entry}, nil
+		}
+		return nil, sftp.ErrSSHFxNoSuchFile
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpListing hands out a fixed list of files.
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(out []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(out, l[offset:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
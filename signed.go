@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Signed links: with SIGNED_URLS_REQUIRED on, a file is only served to
+// requests carrying ?exp=<unix time>&sig=<HMAC of its ID and exp>, so a
+// leaked or guessed ID is useless on its own and every link dies at its exp.
+// Upload responses hand out signed links valid for SIGNED_URL_TTL, and
+// POST /api/files/:id/sign makes new ones. The uploader (by delete token,
+// account or API key) and admins get through without a signature.
+
+var (
+	signedURLsRequired bool
+	signedURLSecret    []byte
+	// Whether SIGNED_URL_SECRET was given, rather than made up for this run
+	signedURLSecretIsSet bool
+	signedURLTTL         time.Duration
+)
+
+// loadSignedURLConfig reads SIGNED_URLS_REQUIRED, SIGNED_URL_SECRET and
+// SIGNED_URL_TTL.
+func loadSignedURLConfig() {
+	signedURLsRequired = getEnv("SIGNED_URLS_REQUIRED", "false") == "true"
+
+	if secret := getEnv("SIGNED_URL_SECRET", ""); secret != "" {
+		signedURLSecret = []byte(secret)
+		signedURLSecretIsSet = true
+	} else {
+		signedURLSecret = make([]byte, 32)
+		rand.Read(signedURLSecret)
+		if signedURLsRequired {
+			log.Printf("SIGNED_URL_SECRET is not set, signed links will stop working on restart")
+		}
+	}
+
+	ttlStr := getEnv("SIGNED_URL_TTL", "24h")
+	var err error
+	signedURLTTL, err = parseDuration(ttlStr)
+	if err != nil || signedURLTTL <= 0 {
+		log.Printf("Invalid SIGNED_URL_TTL value '%s', using default 24 hours", ttlStr)
+		signedURLTTL = 24 * time.Hour
+	}
+}
+
+func downloadSignature(uniqueID string, exp int64) string {
+	mac := hmac.New(sha256.New, signedURLSecret)
+	fmt.Fprintf(mac, "download:%s:%d", uniqueID, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// appendQuery adds an already encoded query string to link.
+func appendQuery(link, query string) string {
+	if strings.Contains(link, "?") {
+		return link + "&" + query
+	}
+	return link + "?" + query
+}
+
+// signLinkUntil adds a signature valid until exp to a link to fileRecord. A
+// link never outlives the file, so exp is capped at its expiry.
+func signLinkUntil(link string, fileRecord *FileRecord, exp time.Time) (string, time.Time) {
+	if fileRecord.ExpiresAt != nil && exp.After(*fileRecord.ExpiresAt) {
+		exp = *fileRecord.ExpiresAt
+	}
+	unix := exp.Unix()
+	return appendQuery(link, fmt.Sprintf("exp=%d&sig=%s", unix, downloadSignature(fileRecord.UniqueID, unix))), time.Unix(unix, 0)
+}
+
+// signLink signs a link to fileRecord for SIGNED_URL_TTL when signatures are
+// required, and leaves it alone otherwise.
+func signLink(link string, fileRecord *FileRecord) string {
+	if !signedURLsRequired {
+		return link
+	}
+	link, _ = signLinkUntil(link, fileRecord, time.Now().Add(signedURLTTL))
+	return link
+}
+
+// forwardSignature passes the signature a page was opened with on to the
+// links it shows, so they last exactly as long. Owners and admins, who may
+// have come without one, get fresh links.
+func forwardSignature(c *fiber.Ctx, link string, fileRecord *FileRecord) string {
+	if !signedURLsRequired {
+		return link
+	}
+	if c.Query("sig") != "" {
+		return appendQuery(link, fmt.Sprintf("exp=%s&sig=%s", c.Query("exp"), c.Query("sig")))
+	}
+	return signLink(link, fileRecord)
+}
+
+// signatureValid checks the ?exp= and ?sig= of a request for fileRecord.
+func signatureValid(c *fiber.Ctx, fileRecord *FileRecord) bool {
+	exp, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	return err == nil && linkSignatureValid(fileRecord, exp, c.Query("sig"))
+}
+
+// linkSignatureValid checks a signature for fileRecord that lasts until exp.
+func linkSignatureValid(fileRecord *FileRecord, exp int64, sig string) bool {
+	if time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(downloadSignature(fileRecord.UniqueID, exp)))
+}
+
+// refuseUnsigned answers 403 for a request without a valid signature when
+// signatures are required. The file's owner and admins don't need one.
+func refuseUnsigned(c *fiber.Ctx, fileRecord *FileRecord) (bool, error) {
+	if !signedURLsRequired || signatureValid(c, fileRecord) || ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+		return false, nil
+	}
+	if c.Query("sig") != "" {
+		return true, c.Status(403).SendString("This link has expired or its signature is invalid")
+	}
+	return true, c.Status(403).SendString("This link must be signed")
+}
+
+// handleSignFile is POST /api/files/:id/sign?expires_in=1h. It takes the
+// file's delete token (X-Delete-Token or ?token=), or comes from its owner
+// or an admin.
+func handleSignFile(c *fiber.Ctx) error {
+	var fileRecord FileRecord
+	if err := findFile(c.Params("id"), &fileRecord); err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "File not found",
+		})
+	}
+	logFileID(c, fileRecord.UniqueID)
+
+	token := c.Get("X-Delete-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	if !tokenMatches(token, fileRecord.DeleteToken) && !ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+		return c.Status(403).JSON(fiber.Map{
+			"success": false,
+			"message": "Signing a link takes the file's delete token or owning it",
+		})
+	}
+
+	ttl := signedURLTTL
+	if value := c.Query("expires_in"); value != "" {
+		var err error
+		ttl, err = parseDuration(value)
+		if err != nil || ttl <= 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Invalid expires_in '%s'", value),
+			})
+		}
+	}
+
+	baseURL := getBaseURL(c)
+	downloadURL, expiresAt := signLinkUntil(baseURL+fileRecord.downloadPath(), &fileRecord, time.Now().Add(ttl))
+	response := fiber.Map{
+		"success":      true,
+		"download_url": downloadURL,
+		"expires_at":   expiresAt,
+	}
+	if fileRecord.PasteLanguage != "" {
+		response["paste_url"], _ = signLinkUntil(baseURL+fileRecord.pastePath(), &fileRecord, expiresAt)
+	}
+	return c.JSON(response)
+}
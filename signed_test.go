@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// withSignedURLs requires signed links, with a known secret, for the rest
+// of the test.
+func withSignedURLs(t *testing.T) {
+	t.Helper()
+	saved := struct {
+		required bool
+		secret   []byte
+		ttl      time.Duration
+	}{signedURLsRequired, signedURLSecret, signedURLTTL}
+	signedURLsRequired, signedURLSecret, signedURLTTL = true, []byte("test signing secret"), time.Hour
+	t.Cleanup(func() {
+		signedURLsRequired, signedURLSecret, signedURLTTL = saved.required, saved.secret, saved.ttl
+	})
+}
+
+// signedLinkStatus asks for link through refuseUnsigned for fileRecord and
+// returns the status and body it got.
+func signedLinkStatus(t *testing.T, fileRecord *FileRecord, link string) (int, string) {
+	t.Helper()
+	app := fiber.New()
+	app.Get("/d/:filename", func(c *fiber.Ctx) error {
+		if refused, err := refuseUnsigned(c, fileRecord); refused {
+			return err
+		}
+		return c.SendString("ok")
+	})
+	resp, err := app.Test(httptest.NewRequest("GET", link, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestSignLink(t *testing.T) {
+	withSignedURLs(t)
+	fileRecord := &FileRecord{UniqueID: "abc123"}
+
+	link := signLink("http://localhost/d/abc123.txt", fileRecord)
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := strconv.ParseInt(parsed.Query().Get("exp"), 10, 64)
+	if err != nil {
+		t.Fatalf("signed link %s has no exp", link)
+	}
+	if want := time.Now().Add(signedURLTTL).Unix(); exp < want-5 || exp > want {
+		t.Errorf("exp = %d, want about %d", exp, want)
+	}
+	if !linkSignatureValid(fileRecord, exp, parsed.Query().Get("sig")) {
+		t.Errorf("signature of %s doesn't check out", link)
+	}
+
+	// A link never outlives its file
+	expiresAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	_, until := signLinkUntil("http://localhost/d/abc123.txt", &FileRecord{UniqueID: "abc123", ExpiresAt: &expiresAt}, time.Now().Add(time.Hour))
+	if !until.Equal(expiresAt) {
+		t.Errorf("link to a file expiring at %v lasts until %v", expiresAt, until)
+	}
+
+	signedURLsRequired = false
+	if got := signLink("http://localhost/d/abc123.txt", fileRecord); got != "http://localhost/d/abc123.txt" {
+		t.Errorf("signLink without signed links = %s, want the link unchanged", got)
+	}
+}
+
+func TestLinkSignatureValid(t *testing.T) {
+	withSignedURLs(t)
+	fileRecord := &FileRecord{UniqueID: "abc123"}
+	exp := time.Now().Add(time.Hour).Unix()
+	sig := downloadSignature(fileRecord.UniqueID, exp)
+	past := time.Now().Add(-time.Minute).Unix()
+
+	// The last character of a signature can differ from the right one
+	// in a single bit
+	lastFlipped := []byte(sig)
+	lastFlipped[len(lastFlipped)-1] ^= 1
+
+	tests := []struct {
+		name string
+		id   string
+		exp  int64
+		sig  string
+		want bool
+	}{
+		{"valid", fileRecord.UniqueID, exp, sig, true},
+		{"expired", fileRecord.UniqueID, past, downloadSignature(fileRecord.UniqueID, past), false},
+		{"expiry moved", fileRecord.UniqueID, exp + 3600, sig, false},
+		{"other file", "xyz789", exp, sig, false},
+		{"last character changed", fileRecord.UniqueID, exp, string(lastFlipped), false},
+		{"truncated", fileRecord.UniqueID, exp, sig[:len(sig)-1], false},
+		{"extended", fileRecord.UniqueID, exp, sig + "A", false},
+		{"empty", fileRecord.UniqueID, exp, "", false},
+		{"other secret", fileRecord.UniqueID, exp, func() string {
+			signedURLSecret = []byte("another secret")
+			defer func() { signedURLSecret = []byte("test signing secret") }()
+			return downloadSignature(fileRecord.UniqueID, exp)
+		}(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := linkSignatureValid(&FileRecord{UniqueID: tt.id}, tt.exp, tt.sig); got != tt.want {
+				t.Errorf("linkSignatureValid = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefuseUnsigned(t *testing.T) {
+	withSignedURLs(t)
+	fileRecord := &FileRecord{UniqueID: "abc123"}
+	link := signLink("/d/abc123.txt", fileRecord)
+	query, _ := url.ParseQuery(link[strings.Index(link, "?")+1:])
+	exp, sig := query.Get("exp"), query.Get("sig")
+	tamperedExp, _ := strconv.ParseInt(exp, 10, 64)
+
+	tests := []struct {
+		name       string
+		link       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"signed", link, 200, "ok"},
+		{"unsigned", "/d/abc123.txt", 403, "must be signed"},
+		{"expiry tampered", "/d/abc123.txt?exp=" + strconv.FormatInt(tamperedExp+60, 10) + "&sig=" + sig, 403, "expired or its signature is invalid"},
+		{"expiry missing", "/d/abc123.txt?sig=" + sig, 403, "expired or its signature is invalid"},
+		{"signature of another file", "/d/abc123.txt?exp=" + exp + "&sig=" + url.QueryEscape(downloadSignature("xyz789", tamperedExp)), 403, "expired or its signature is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := signedLinkStatus(t, fileRecord, tt.link)
+			if status != tt.wantStatus || !strings.Contains(body, tt.wantBody) {
+				t.Errorf("GET %s = %d %q, want %d with %q", tt.link, status, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+
+	// An expired link
+	past := time.Now().Add(-time.Minute)
+	expired, _ := signLinkUntil("/d/abc123.txt", fileRecord, past)
+	if status, body := signedLinkStatus(t, fileRecord, expired); status != 403 || !strings.Contains(body, "expired") {
+		t.Errorf("GET %s = %d %q, want 403 for an expired link", expired, status, body)
+	}
+
+	// Without SIGNED_URLS_REQUIRED nothing needs a signature
+	signedURLsRequired = false
+	if status, _ := signedLinkStatus(t, fileRecord, "/d/abc123.txt"); status != 200 {
+		t.Errorf("unsigned link without signed links required = %d, want 200", status)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The secret key of AWS's Signature Version 4 examples and test suite.
+const (
+	awsSuiteSecret = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	awsS3Secret    = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+)
+
+func mustParseTime(t *testing.T, layout, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(layout, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// TestSigV4Suite checks requests from AWS's Signature Version 4 test suite.
+func TestSigV4Suite(t *testing.T) {
+	signedAt := mustParseTime(t, sigV4TimeFormat, "20150830T123600Z")
+	headers := map[string]string{"host": "example.amazonaws.com", "x-amz-date": "20150830T123600Z"}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  string
+		want   string
+	}{
+		{"get-vanilla", "GET", "/", "", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "/", "Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"get-utf8", "GET", "/ሴ", "", "8318018e0b0f223aa2bbf98705b62bb787dc9c0e678f255a891fd03141be5d85"},
+		{"get-space", "GET", "/example space/", "", "652487583200325589f1fba4c7e578f72c47cb61beeca81406b39ddec1366741"},
+		{"post-vanilla", "POST", "/", "", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			canonical := sigV4CanonicalRequest(tt.method, tt.path, query, headers, []string{"host", "x-amz-date"}, sigV4EmptyBodyHash)
+			if got := sigV4Signature(awsSuiteSecret, signedAt, "us-east-1", "service", canonical); got != tt.want {
+				t.Errorf("signature = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSigV4SigningKey checks the key derivation example in AWS's docs.
+func TestSigV4SigningKey(t *testing.T) {
+	day := mustParseTime(t, sigV4DateFormat, "20120215")
+	const want = "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if got := hex.EncodeToString(sigV4SigningKey(awsSuiteSecret, day, "us-east-1", "iam")); got != want {
+		t.Errorf("signing key = %s, want %s", got, want)
+	}
+}
+
+// TestSigV4S3Examples checks the GET Object and streamed PUT Object examples
+// in AWS's S3 docs.
+func TestSigV4S3Examples(t *testing.T) {
+	signedAt := mustParseTime(t, sigV4TimeFormat, "20130524T000000Z")
+
+	headers := map[string]string{
+		"host":                 "examplebucket.s3.amazonaws.com",
+		"range":                "bytes=0-9",
+		"x-amz-content-sha256": sigV4EmptyBodyHash,
+		"x-amz-date":           "20130524T000000Z",
+	}
+	names := []string{"host", "range", "x-amz-content-sha256", "x-amz-date"}
+	canonical := sigV4CanonicalRequest("GET", "/test.txt", url.Values{}, headers, names, sigV4EmptyBodyHash)
+	const wantGet = "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41"
+	if got := sigV4Signature(awsS3Secret, signedAt, "us-east-1", "s3", canonical); got != wantGet {
+		t.Errorf("GET Object signature = %s, want %s", got, wantGet)
+	}
+
+	signature := &s3Signature{
+		time:       signedAt,
+		scope:      sigV4Scope(signedAt, "us-east-1", "s3"),
+		signingKey: sigV4SigningKey(awsS3Secret, signedAt, "us-east-1", "s3"),
+	}
+	previous := "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9" // the seed signature
+	for _, chunk := range []struct {
+		data []byte
+		want string
+	}{
+		{bytes.Repeat([]byte("a"), 65536), "ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648"},
+		{bytes.Repeat([]byte("a"), 1024), "0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497"},
+		{nil, "b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9"},
+	} {
+		got := signature.chunkSignature(previous, chunk.data)
+		if got != chunk.want {
+			t.Fatalf("signature of the %d-byte chunk = %s, want %s", len(chunk.data), got, chunk.want)
+		}
+		previous = got
+	}
+}
+
+func TestSigV4Escape(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"abcXYZ019-_.~", "abcXYZ019-_.~"},
+		{"a b", "a%20b"},
+		{"a+b=c&d", "a%2Bb%3Dc%26d"},
+		{"a/b", "a%2Fb"},
+		{"é", "%C3%A9"},
+	}
+	for _, tt := range tests {
+		if got := sigV4Escape(tt.in); got != tt.want {
+			t.Errorf("sigV4Escape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// s3TestRequest is a PUT to the S3 API, its header names lower-cased.
+type s3TestRequest struct {
+	path          string
+	headers       map[string]string
+	authorization string
+}
+
+// signS3Request signs req for the S3 API with secret as the secret access
+// key of accessKey, at signedAt.
+func signS3Request(req *s3TestRequest, accessKey, secret string, signedAt time.Time) {
+	req.headers["x-amz-date"] = signedAt.UTC().Format(sigV4TimeFormat)
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if _, ok := req.headers["content-type"]; ok {
+		names = []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	}
+	canonical := sigV4CanonicalRequest("PUT", req.path, url.Values{}, req.headers, names, req.headers["x-amz-content-sha256"])
+	signature := sigV4Signature(secret, signedAt, "us-east-1", "s3", canonical)
+	req.authorization = sigV4Algorithm + " Credential=" + accessKey + "/" + sigV4Scope(signedAt, "us-east-1", "s3") +
+		", SignedHeaders=" + strings.Join(names, ";") + ", Signature=" + signature
+}
+
+func TestS3SignatureVerification(t *testing.T) {
+	const key = "s3-test-key"
+	savedKey := apiKey
+	apiKey = key
+	defer func() { apiKey = savedKey }()
+
+	// Served for real, as app.Test loses the Host header
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Put("/s3/:bucket/+", s3Auth, func(c *fiber.Ctx) error { return c.SendStatus(200) })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(listener)
+	defer app.Shutdown()
+	host := listener.Addr().String()
+
+	tests := []struct {
+		name     string
+		prepare  func(req *s3TestRequest)
+		wantCode int
+		wantBody string
+	}{
+		{"signed", func(req *s3TestRequest) {
+			signS3Request(req, key, key, time.Now())
+		}, 200, ""},
+		{"unsigned payload", func(req *s3TestRequest) {
+			req.headers["x-amz-content-sha256"] = sigV4UnsignedBody
+			signS3Request(req, key, key, time.Now())
+		}, 200, ""},
+		{"wrong key", func(req *s3TestRequest) {
+			signS3Request(req, key, "some-other-secret", time.Now())
+		}, 403, "SignatureDoesNotMatch"},
+		{"unknown access key", func(req *s3TestRequest) {
+			signS3Request(req, "nobody", "nobody", time.Now())
+		}, 403, "InvalidAccessKeyId"},
+		{"expired X-Amz-Date", func(req *s3TestRequest) {
+			signS3Request(req, key, key, time.Now().Add(-s3MaxClockSkew-time.Minute))
+		}, 403, "RequestTimeTooSkewed"},
+		{"X-Amz-Date from the future", func(req *s3TestRequest) {
+			signS3Request(req, key, key, time.Now().Add(s3MaxClockSkew+time.Minute))
+		}, 403, "RequestTimeTooSkewed"},
+		{"tampered signed header", func(req *s3TestRequest) {
+			signS3Request(req, key, key, time.Now())
+			req.headers["content-type"] = "application/x-msdownload"
+		}, 403, "SignatureDoesNotMatch"},
+		{"tampered payload hash", func(req *s3TestRequest) {
+			signS3Request(req, key, key, time.Now())
+			req.headers["x-amz-content-sha256"] = sigV4UnsignedBody
+		}, 403, "SignatureDoesNotMatch"},
+		{"payload hash missing", func(req *s3TestRequest) {
+			signS3Request(req, key, key, time.Now())
+			delete(req.headers, "x-amz-content-sha256")
+		}, 400, "InvalidRequest"},
+		{"not signed", func(req *s3TestRequest) {}, 403, "AccessDenied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &s3TestRequest{
+				path: "/s3/bucket/notes.txt",
+				headers: map[string]string{
+					"host":                 host,
+					"content-type":         "text/plain",
+					"x-amz-content-sha256": sigV4EmptyBodyHash,
+				},
+			}
+			tt.prepare(req)
+
+			httpReq, err := http.NewRequest("PUT", "http://"+host+req.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range req.headers {
+				httpReq.Header.Set(name, value)
+			}
+			if req.authorization != "" {
+				httpReq.Header.Set("Authorization", req.authorization)
+			}
+			resp, err := http.DefaultClient.Do(httpReq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d (%s)", resp.StatusCode, tt.wantCode, body)
+			}
+			if tt.wantBody != "" && !strings.Contains(string(body), "<Code>"+tt.wantBody+"</Code>") {
+				t.Errorf("body = %s, want the %s error", body, tt.wantBody)
+			}
+		})
+	}
+}
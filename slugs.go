@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Vanity slugs: an upload may reserve a readable alias with ?slug=my-report
+// (or the X-Slug header, or a "slug" form field) that works wherever the
+// file's ID does, e.g. /d/my-report. Slugs are lower case letters, digits,
+// "-" and "_", 3 to 64 characters, and are free again once the file is gone.
+
+// slugPattern has no dots, so /d/my-report.pdf still resolves by stripping
+// the extension.
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,62}[a-z0-9]$`)
+
+// reservedSlugs would be confusing or clash with routes.
+var reservedSlugs = []string{
+	"admin", "api", "auth", "b", "bundle", "bundles", "d", "dashboard", "download",
+	"favicon", "files", "health", "healthz", "index", "login", "logout", "metrics",
+	"my", "null", "p", "paste", "play", "qr", "ready", "readyz", "robots", "static",
+	"stats", "t", "undefined", "upload", "v", "x",
+}
+
+var errSlugTaken = errors.New("slug taken")
+
+// requestedSlug returns the slug asked for with ?slug= or X-Slug.
+func requestedSlug(c *fiber.Ctx) string {
+	if slug := c.Query("slug"); slug != "" {
+		return slug
+	}
+	return c.Get("X-Slug")
+}
+
+// resolveSlug checks a requested slug and returns it normalised, or nil when
+// none was asked for. errSlugTaken means another file has it.
+func resolveSlug(value string) (*string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	slug := strings.ToLower(strings.TrimSpace(value))
+	if !slugPattern.MatchString(slug) {
+		return nil, fmt.Errorf("Invalid slug '%s': use 3-64 letters, digits, '-' or '_'", value)
+	}
+	if containsString(reservedSlugs, slug) {
+		return nil, fmt.Errorf("The slug '%s' is reserved", slug)
+	}
+
+	var taken int64
+	db.Model(&FileRecord{}).Where("slug = ? OR unique_id = ?", slug, slug).Count(&taken)
+	if taken > 0 {
+		return nil, errSlugTaken
+	}
+	return &slug, nil
+}
+
+// slugStatus is the status to answer a resolveSlug error with.
+func slugStatus(err error) int {
+	if errors.Is(err, errSlugTaken) {
+		return 409
+	}
+	return 400
+}
+
+// slugErrorMessage words a resolveSlug error for the client.
+func slugErrorMessage(value string, err error) string {
+	if errors.Is(err, errSlugTaken) {
+		return fmt.Sprintf("The slug '%s' is already taken", strings.ToLower(strings.TrimSpace(value)))
+	}
+	return err.Error()
+}
+
+// findFile loads the file with the given ID or slug into fileRecord.
+func findFile(id string, fileRecord *FileRecord) error {
+	query := db.Where("unique_id = ?", id)
+	if slug := strings.ToLower(id); slugPattern.MatchString(slug) {
+		query = query.Or("slug = ?", slug)
+	}
+	return query.First(fileRecord).Error
+}
+
+// downloadPath is the path a new upload is announced with: its slug when it
+// has one, its content address when those are on, else its ID, plus the
+// extension.
+func (f *FileRecord) downloadPath() string {
+	if f.Slug != nil {
+		return "/d/" + *f.Slug + f.Extension
+	}
+	if path := f.contentPath(); path != "" {
+		return path
+	}
+	return "/d/" + f.UniqueID + f.Extension
+}
+
+// pastePath is the /p/ path of a paste, by slug when it has one.
+func (f *FileRecord) pastePath() string {
+	if f.Slug != nil {
+		return "/p/" + *f.Slug
+	}
+	return "/p/" + f.UniqueID
+}
+
+// isSlugConflict reports whether err is the unique index on slug refusing a
+// slug taken between resolveSlug and the insert.
+func isSlugConflict(err error, fileRecord *FileRecord) bool {
+	if err == nil || fileRecord.Slug == nil {
+		return false
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "unique") || strings.Contains(message, "duplicate")
+}
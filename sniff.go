@@ -0,0 +1,29 @@
+package main
+
+import "net/http"
+
+// sniffLen is how much of an upload http.DetectContentType looks at.
+const sniffLen = 512
+
+// sniffer keeps the first bytes written to it so the content type of an
+// upload can be detected from its contents rather than the client's claim.
+type sniffer struct {
+	head []byte
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if room := sniffLen - len(s.head); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		s.head = append(s.head, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// mimeType returns the detected content type, e.g. "image/png" or
+// "text/plain; charset=utf-8". Unrecognised data is
+// "application/octet-stream".
+func (s *sniffer) mimeType() string {
+	return http.DetectContentType(s.head)
+}
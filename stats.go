@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Public statistics for transparency dashboards. Every upload, download and
+// removal adds to a counter row per day, kept for good, and with
+// PUBLIC_STATS=true the last STATS_DAYS of them are shown at /stats and under
+// "activity" in GET /api/stats: uploads and bandwidth per day, how long files
+// lived and the most common content types. Only instance-wide totals are published,
+// never names, IDs or addresses. Admins get the aggregates in /api/stats
+// either way.
+
+// statsCacheTTL is how long the aggregates are reused between requests
+const statsCacheTTL = time.Minute
+
+// DailyStat is the instance's traffic during one day (UTC).
+type DailyStat struct {
+	ID              uint   `json:"-" gorm:"primaryKey"`
+	Day             string `json:"day" gorm:"uniqueIndex;not null"` // YYYY-MM-DD
+	Uploads         int64  `json:"uploads"`
+	BytesUploaded   int64  `json:"bytes_uploaded"`
+	Downloads       int64  `json:"downloads"`
+	BytesServed     int64  `json:"bytes_served"`
+	FilesRemoved    int64  `json:"files_removed"`
+	LifetimeSeconds int64  `json:"-"` // summed over the files removed
+}
+
+// publicStats are the aggregates shown at /stats.
+type publicStats struct {
+	Days            int             `json:"days"`
+	PerDay          []DailyStat     `json:"per_day"`
+	Uploads         int64           `json:"uploads"`
+	BytesUploaded   int64           `json:"bytes_uploaded"`
+	Downloads       int64           `json:"downloads"`
+	BytesServed     int64           `json:"bytes_served"`
+	AverageLifetime int64           `json:"average_lifetime_seconds"` // of the files removed, 0 if none
+	TopMimeTypes    []mimeTypeCount `json:"top_mime_types"`
+	generatedAt     time.Time
+}
+
+// mimeTypeCount is how many of the stored files have a content type.
+type mimeTypeCount struct {
+	MimeType string `json:"mime_type"`
+	Files    int64  `json:"files"`
+}
+
+var (
+	publicStatsEnabled bool
+	statsDays          int
+
+	statsCacheMu sync.Mutex
+	statsCache   *publicStats
+)
+
+// loadStatsConfig reads PUBLIC_STATS and STATS_DAYS.
+func loadStatsConfig() {
+	publicStatsEnabled = getEnv("PUBLIC_STATS", "false") == "true"
+
+	daysStr := getEnv("STATS_DAYS", "30")
+	var err error
+	statsDays, err = strconv.Atoi(daysStr)
+	if err != nil || statsDays < 1 || statsDays > 366 {
+		log.Printf("Invalid STATS_DAYS value '%s', using default 30", daysStr)
+		statsDays = 30
+	}
+}
+
+func setupStatsRoutes(app *fiber.App) {
+	app.Get("/stats", handleStatsPage)
+}
+
+// addDailyStat adds counters to today's row.
+func addDailyStat(counters DailyStat) {
+	day := time.Now().UTC().Format("2006-01-02")
+	row := DailyStat{Day: day}
+	if err := db.Where(row).FirstOrCreate(&row).Error; err != nil {
+		// Lost the race to create the row, which now exists
+		if err = db.Where(DailyStat{Day: day}).First(&row).Error; err != nil {
+			log.Printf("Failed to record daily stats: %v", err)
+			return
+		}
+	}
+	db.Model(&row).UpdateColumns(map[string]interface{}{
+		"uploads":          gorm.Expr("uploads + ?", counters.Uploads),
+		"bytes_uploaded":   gorm.Expr("bytes_uploaded + ?", counters.BytesUploaded),
+		"downloads":        gorm.Expr("downloads + ?", counters.Downloads),
+		"bytes_served":     gorm.Expr("bytes_served + ?", counters.BytesServed),
+		"files_removed":    gorm.Expr("files_removed + ?", counters.FilesRemoved),
+		"lifetime_seconds": gorm.Expr("lifetime_seconds + ?", counters.LifetimeSeconds),
+	})
+}
+
+// recordFileRemoved counts a file taken out of service and how long it
+// lived.
+func recordFileRemoved(fileRecord *FileRecord) {
+	lifetime := time.Since(fileRecord.UploadedAt)
+	addDailyStat(DailyStat{FilesRemoved: 1, LifetimeSeconds: int64(max(lifetime, 0) / time.Second)})
+}
+
+// collectPublicStats sums up the last STATS_DAYS, reusing the answer for a
+// minute so a busy page doesn't keep the database busy.
+func collectPublicStats() *publicStats {
+	statsCacheMu.Lock()
+	defer statsCacheMu.Unlock()
+	if statsCache != nil && time.Since(statsCache.generatedAt) < statsCacheTTL {
+		return statsCache
+	}
+
+	stats := &publicStats{Days: statsDays, generatedAt: time.Now()}
+	since := time.Now().UTC().AddDate(0, 0, -(statsDays - 1)).Format("2006-01-02")
+	var rows []DailyStat
+	db.Where("day >= ?", since).Order("day").Find(&rows)
+
+	// Every day of the window, quiet ones included
+	byDay := make(map[string]DailyStat, len(rows))
+	for _, row := range rows {
+		byDay[row.Day] = row
+	}
+	var removed, lifetime int64
+	stats.PerDay = make([]DailyStat, 0, statsDays)
+	for i := statsDays - 1; i >= 0; i-- {
+		day := time.Now().UTC().AddDate(0, 0, -i).Format("2006-01-02")
+		row := byDay[day]
+		row.Day = day
+		stats.PerDay = append(stats.PerDay, row)
+		stats.Uploads += row.Uploads
+		stats.BytesUploaded += row.BytesUploaded
+		stats.Downloads += row.Downloads
+		stats.BytesServed += row.BytesServed
+		removed += row.FilesRemoved
+		lifetime += row.LifetimeSeconds
+	}
+	if removed > 0 {
+		stats.AverageLifetime = lifetime / removed
+	}
+
+	stats.TopMimeTypes = make([]mimeTypeCount, 0)
+	db.Model(&FileRecord{}).
+		Select("mime_type, COUNT(*) AS files").
+		Where("mime_type <> ''").
+		Group("mime_type").
+		Order("files desc").
+		Limit(10).
+		Scan(&stats.TopMimeTypes)
+
+	statsCache = stats
+	return stats
+}
+
+// statsBar is one day of the uploads chart on /stats.
+type statsBar struct {
+	Day         string
+	Uploads     int64
+	Size        string
+	BytesServed string
+	Percent     int
+}
+
+// handleStatsPage is /stats, the aggregates for people.
+func handleStatsPage(c *fiber.Ctx) error {
+	if !publicStatsEnabled {
+		return c.SendStatus(404)
+	}
+	stats := collectPublicStats()
+
+	var totalFiles, totalSize int64
+	db.Model(&FileRecord{}).Count(&totalFiles)
+	db.Model(&FileRecord{}).Select("COALESCE(SUM(file_size), 0)").Row().Scan(&totalSize)
+
+	var peak int64
+	for _, day := range stats.PerDay {
+		peak = max(peak, day.Uploads)
+	}
+	bars := make([]statsBar, 0, len(stats.PerDay))
+	for _, day := range stats.PerDay {
+		percent := 0
+		if peak > 0 {
+			percent = int(day.Uploads * 100 / peak)
+		}
+		bars = append(bars, statsBar{
+			Day:         day.Day,
+			Uploads:     day.Uploads,
+			Size:        formatBytes(day.BytesUploaded),
+			BytesServed: formatBytes(day.BytesServed),
+			Percent:     percent,
+		})
+	}
+
+	lifetime := "-"
+	if stats.AverageLifetime > 0 {
+		lifetime = formatDuration(time.Duration(stats.AverageLifetime) * time.Second)
+	}
+	return c.Render("stats", fiber.Map{
+		"Brand":         brand,
+		"BaseURL":       getBaseURL(c),
+		"Days":          stats.Days,
+		"TotalFiles":    totalFiles,
+		"TotalSize":     formatBytes(totalSize),
+		"Uploads":       stats.Uploads,
+		"BytesUploaded": formatBytes(stats.BytesUploaded),
+		"Downloads":     stats.Downloads,
+		"BytesServed":   formatBytes(stats.BytesServed),
+		"Lifetime":      lifetime,
+		"PerDay":        bars,
+		"MimeTypes":     stats.TopMimeTypes,
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is where uploaded file contents live. Keys are the FilePath values
+// stored on FileRecord, e.g. "3f2a...c9.zip".
+type Storage interface {
+	// Save stores size bytes read from r under key, replacing any existing blob.
+	Save(key string, r io.Reader, size int64) error
+	// Open returns a seekable reader over the blob stored under key.
+	Open(key string) (io.ReadSeekCloser, error)
+	// Delete removes the blob stored under key.
+	Delete(key string) error
+	// Stat returns the size of the blob stored under key, or an error
+	// satisfying errors.Is(err, os.ErrNotExist) when it is missing.
+	Stat(key string) (int64, error)
+}
+
+// fileMover is implemented by backends that can adopt a staged file without
+// copying it.
+type fileMover interface {
+	Move(key, srcPath string) error
+}
+
+// localPather is implemented by backends whose blobs are plain files, so
+// downloads can be served with sendfile.
+type localPather interface {
+	LocalPath(key string) string
+}
+
+// blobLister is implemented by backends that can enumerate their blobs, which
+// lets reconciliation find blobs no file refers to.
+type blobLister interface {
+	// List calls fn for every blob, leaving out the server's own working
+	// files such as staged uploads.
+	List(fn func(key string, size int64, modTime time.Time) error) error
+}
+
+// dirPruner is implemented by backends whose blobs leave directories behind
+// once deleted.
+type dirPruner interface {
+	// PruneEmptyDirs removes directories that are empty and haven't changed
+	// for grace.
+	PruneEmptyDirs(grace time.Duration)
+}
+
+// cidStorage is implemented by content-addressed backends, whose blobs have
+// a CID.
+type cidStorage interface {
+	CID(key string) (string, error)
+}
+
+var (
+	fileStorage Storage
+	uploadDir   string
+)
+
+// initStorage selects the storage backend from STORAGE_BACKEND (local, s3 or
+// ipfs).
+func initStorage() {
+	uploadDir = getEnv("UPLOAD_DIR", "./uploads")
+	os.MkdirAll(uploadDir, os.ModePerm)
+	os.MkdirAll(stagingDir(), os.ModePerm)
+
+	backend := strings.ToLower(getEnv("STORAGE_BACKEND", "local"))
+	switch backend {
+	case "local":
+		local := &LocalStorage{root: uploadDir}
+		local.migrateLayout()
+		fileStorage = local
+		log.Printf("Storage backend: local (%s)", uploadDir)
+	case "s3":
+		s3, err := newS3StorageFromEnv("S3_")
+		if err != nil {
+			log.Fatal("Failed to configure S3 storage: ", err)
+		}
+		fileStorage = s3
+		log.Printf("Storage backend: s3 (bucket %s at %s)", s3.bucket, s3.endpoint)
+	case "ipfs":
+		ipfs, err := newIPFSStorageFromEnv()
+		if err != nil {
+			log.Fatal("Failed to configure IPFS storage: ", err)
+		}
+		fileStorage = ipfs
+		log.Printf("Storage backend: ipfs (%s under %s)", ipfs.api, ipfs.root)
+		if ipfs.gateway != "" {
+			log.Printf("Downloads are redirected to the IPFS gateway %s", ipfs.gateway)
+		}
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND '%s' (expected local, s3 or ipfs)", backend)
+	}
+
+	migrateLegacyPaths()
+	dropLegacyTusUploads()
+}
+
+// migrateLegacyPaths rewrites FilePath values from the days when files were
+// written straight to ./uploads into plain storage keys.
+func migrateLegacyPaths() {
+	var records []FileRecord
+	db.Where("file_path LIKE ?", "uploads/%").Find(&records)
+	for _, record := range records {
+		db.Model(&record).Update("file_path", strings.TrimPrefix(record.FilePath, "uploads/"))
+	}
+	if len(records) > 0 {
+		log.Printf("Migrated %d legacy file paths to storage keys", len(records))
+	}
+}
+
+// stagingDir holds uploads that are still being received. It always lives on
+// local disk, whatever the storage backend.
+func stagingDir() string {
+	return filepath.Join(uploadDir, ".staging")
+}
+
+// newStagingPath returns a fresh path for an upload being received.
+func newStagingPath() string {
+	return filepath.Join(stagingDir(), generateUniqueID())
+}
+
+// persistStaged hands a fully received staged file over to the storage
+// backend under key. The staged file is consumed either way.
+func persistStaged(key, stagedPath string, size int64) error {
+	if mover, ok := fileStorage.(fileMover); ok {
+		err := mover.Move(key, stagedPath)
+		if err != nil {
+			os.Remove(stagedPath)
+		}
+		return err
+	}
+
+	defer os.Remove(stagedPath)
+	f, err := os.Open(stagedPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return fileStorage.Save(key, f, size)
+}
+
+// blobSequence reads the blobs under keys one after another, as pieces of
+// an upload are joined. Only one is open at a time: each is opened when
+// reading gets to it and closed once it's been read, so thousands of pieces
+// don't hold thousands of files or storage connections open. Close closes
+// the one being read, if any.
+type blobSequence struct {
+	keys    []string
+	current io.ReadCloser
+}
+
+func (b *blobSequence) Read(p []byte) (int, error) {
+	for {
+		if b.current == nil {
+			if len(b.keys) == 0 {
+				return 0, io.EOF
+			}
+			part, err := fileStorage.Open(b.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			b.current, b.keys = part, b.keys[1:]
+		}
+		n, err := b.current.Read(p)
+		if err == io.EOF {
+			b.current.Close()
+			b.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (b *blobSequence) Close() error {
+	if b.current == nil {
+		return nil
+	}
+	err := b.current.Close()
+	b.current = nil
+	return err
+}
+
+// LocalStorage keeps blobs as files under a root directory, two levels of
+// prefix directories down (ab/cd/abcd...) so no directory grows so big the
+// filesystem slows down.
+type LocalStorage struct {
+	root string
+}
+
+// shardKeyLength is how much of a key names its directories.
+const shardKeyLength = 4
+
+// shardedKey is the path of key under root. The server's own working files,
+// whose keys start with a dot, and keys that already have a directory or
+// are too short stay where they are.
+func shardedKey(key string) string {
+	if len(key) < shardKeyLength || strings.HasPrefix(key, ".") || strings.Contains(key, "/") {
+		return key
+	}
+	return key[0:2] + "/" + key[2:4] + "/" + key
+}
+
+// validStorageKey reports whether key has the form this server names blobs
+// with (see newStorageKey): a single path segment, not hidden, that can't
+// lead out of the storage root.
+func validStorageKey(key string) bool {
+	return key != "" && len(key) <= 255 && !strings.HasPrefix(key, ".") &&
+		!strings.Contains(key, "..") && !strings.ContainsAny(key, "/\\\x00")
+}
+
+func (l *LocalStorage) LocalPath(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(shardedKey(key)))
+}
+
+// migrateLayout moves blobs left in root itself, from before the prefix
+// directories, into them.
+func (l *LocalStorage) migrateLayout() {
+	entries, err := os.ReadDir(l.root)
+	if err != nil {
+		return
+	}
+	moved := 0
+	for _, entry := range entries {
+		key := entry.Name()
+		if !entry.Type().IsRegular() || shardedKey(key) == key {
+			continue
+		}
+		dest := l.LocalPath(key)
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			log.Printf("Failed to move %s into its directory: %v", key, err)
+			continue
+		}
+		if err := os.Rename(filepath.Join(l.root, key), dest); err != nil {
+			log.Printf("Failed to move %s into its directory: %v", key, err)
+			continue
+		}
+		moved++
+		if moved%10000 == 0 {
+			log.Printf("Moved %d files into prefix directories so far", moved)
+		}
+	}
+	if moved > 0 {
+		log.Printf("Moved %d files into prefix directories", moved)
+	}
+}
+
+func (l *LocalStorage) Save(key string, r io.Reader, size int64) error {
+	dest := l.LocalPath(key)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".save-*")
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("short write: %d of %d bytes", written, size)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (l *LocalStorage) Move(key, srcPath string) error {
+	dest := l.LocalPath(key)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(srcPath, dest); err == nil {
+		return nil
+	}
+
+	// Fall back to copying, e.g. when the staging area is on another device
+	defer os.Remove(srcPath)
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return l.Save(key, src, -1)
+}
+
+func (l *LocalStorage) Open(key string) (io.ReadSeekCloser, error) {
+	return os.Open(l.LocalPath(key))
+}
+
+func (l *LocalStorage) Delete(key string) error {
+	err := os.Remove(l.LocalPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *LocalStorage) Stat(key string) (int64, error) {
+	info, err := os.Stat(l.LocalPath(key))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// List walks the blobs under root. Hidden directories (staging, chunks and
+// tus uploads) and half-written saves are left out.
+func (l *LocalStorage) List(fn func(key string, size int64, modTime time.Time) error) error {
+	return filepath.WalkDir(l.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != l.root {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if shardedKey(entry.Name()) == key {
+			key = entry.Name()
+		}
+		return fn(key, info.Size(), info.ModTime())
+	})
+}
+
+// PruneEmptyDirs removes empty directories under root, deepest first, such
+// as prefix directories whose blobs are all gone and those of finished
+// chunked uploads. Root and the top-level working
+// directories (staging, chunks and tus uploads) stay.
+func (l *LocalStorage) PruneEmptyDirs(grace time.Duration) {
+	root := filepath.Clean(l.root)
+	cutoff := time.Now().Add(-grace)
+	// Judged by their age before any pruning, which touches the parent
+	var dirs []string
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || path == root {
+			return nil
+		}
+		if filepath.Dir(path) == root && strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+
+	pruned := 0
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// Fails, harmlessly, for a directory that isn't empty
+		if os.Remove(dirs[i]) == nil {
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		log.Printf("Removed %d empty directories", pruned)
+	}
+}
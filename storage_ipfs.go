@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IPFSStorage adds blobs to an IPFS node through its HTTP RPC API (Kubo's
+// /api/v0). Every blob is pinned and linked into the node's mutable file
+// system under root at its key, which is how keys are mapped to CIDs;
+// deleting a blob unlinks and unpins it, leaving the node's garbage
+// collector to free the space.
+type IPFSStorage struct {
+	api     string // scheme://host:port of the RPC API
+	root    string // MFS directory the blobs are linked under
+	gateway string // public gateway downloads are redirected to, empty to stream them
+	client  *http.Client
+}
+
+func newIPFSStorageFromEnv() (*IPFSStorage, error) {
+	s := &IPFSStorage{
+		api:     strings.TrimRight(getEnv("IPFS_API_URL", "http://127.0.0.1:5001"), "/"),
+		root:    "/" + strings.Trim(getEnv("IPFS_MFS_ROOT", "/bashupload"), "/"),
+		gateway: strings.TrimRight(getEnv("IPFS_GATEWAY_URL", ""), "/"),
+		client: &http.Client{
+			Timeout: 30 * time.Minute,
+		},
+	}
+	if u, err := url.Parse(s.api); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid IPFS_API_URL '%s'", s.api)
+	}
+	if s.gateway != "" {
+		if u, err := url.Parse(s.gateway); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid IPFS_GATEWAY_URL '%s'", s.gateway)
+		}
+	}
+	if s.root == "/" {
+		return nil, errors.New("IPFS_MFS_ROOT can't be the MFS root itself")
+	}
+
+	var version struct{ Version string }
+	if err := s.call("version", nil, nil, nil, &version); err != nil {
+		return nil, fmt.Errorf("can't reach the IPFS API at %s: %w", s.api, err)
+	}
+	return s, nil
+}
+
+func (s *IPFSStorage) mfsPath(key string) string {
+	return s.root + "/" + key
+}
+
+// call makes one RPC call. args are repeated ?arg= values; body, when not
+// nil, is sent as a multipart file part. The JSON answer is decoded into out
+// unless it is nil.
+func (s *IPFSStorage) call(command string, args []string, query url.Values, body io.Reader, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	for _, arg := range args {
+		query.Add("arg", arg)
+	}
+	endpoint := s.api + "/api/v0/" + command + "?" + query.Encode()
+
+	var req *http.Request
+	var err error
+	if body != nil {
+		pr, pw := io.Pipe()
+		form := multipart.NewWriter(pw)
+		go func() {
+			part, err := form.CreateFormFile("file", "blob")
+			if err == nil {
+				_, err = io.Copy(part, body)
+			}
+			if err == nil {
+				err = form.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		req, err = http.NewRequest("POST", endpoint, pr)
+		if err == nil {
+			req.Header.Set("Content-Type", form.FormDataContentType())
+		}
+	} else {
+		req, err = http.NewRequest("POST", endpoint, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ipfsError(command, args, resp)
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ipfsError turns a failed call into an error, mapping a missing MFS path to
+// os.ErrNotExist.
+func ipfsError(command string, args []string, resp *http.Response) error {
+	var answer struct{ Message string }
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if json.Unmarshal(detail, &answer) != nil || answer.Message == "" {
+		answer.Message = strings.TrimSpace(string(detail))
+	}
+	target := strings.Join(args, " ")
+	if strings.Contains(answer.Message, "does not exist") || strings.Contains(answer.Message, "not found") {
+		return fmt.Errorf("ipfs %s %s: %w", command, target, os.ErrNotExist)
+	}
+	return fmt.Errorf("ipfs %s %s: HTTP %d: %s", command, target, resp.StatusCode, answer.Message)
+}
+
+func (s *IPFSStorage) Save(key string, r io.Reader, size int64) error {
+	var added struct {
+		Hash string
+		Size string
+	}
+	query := url.Values{"pin": {"true"}, "cid-version": {"1"}, "quieter": {"true"}}
+	if err := s.call("add", nil, query, r, &added); err != nil {
+		return err
+	}
+
+	dest := s.mfsPath(key)
+	if err := s.call("files/mkdir", []string{path.Dir(dest)}, url.Values{"parents": {"true"}}, nil, nil); err != nil {
+		return err
+	}
+	// files/cp won't overwrite, and Save replaces
+	if err := s.call("files/rm", []string{dest}, url.Values{"force": {"true"}}, nil, nil); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := s.call("files/cp", []string{"/ipfs/" + added.Hash, dest}, nil, nil, nil); err != nil {
+		return err
+	}
+	if size >= 0 {
+		if stored, err := s.Stat(key); err == nil && stored != size {
+			return fmt.Errorf("short write: %d of %d bytes", stored, size)
+		}
+	}
+	return nil
+}
+
+// ipfsStat is the part of a files/stat answer the backend uses.
+type ipfsStat struct {
+	Hash string
+	Size int64
+	Type string
+}
+
+func (s *IPFSStorage) stat(key string) (*ipfsStat, error) {
+	var st ipfsStat
+	if err := s.call("files/stat", []string{s.mfsPath(key)}, nil, nil, &st); err != nil {
+		return nil, err
+	}
+	if st.Type != "file" {
+		return nil, fmt.Errorf("ipfs stat %s: not a file: %w", key, os.ErrNotExist)
+	}
+	return &st, nil
+}
+
+func (s *IPFSStorage) Open(key string) (io.ReadSeekCloser, error) {
+	st, err := s.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ipfsObject{storage: s, cid: st.Hash, size: st.Size}, nil
+}
+
+func (s *IPFSStorage) Delete(key string) error {
+	st, err := s.stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.call("files/rm", []string{s.mfsPath(key)}, url.Values{"force": {"true"}}, nil, nil); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Identical content under another key stays linked in MFS, which keeps
+	// it safe from garbage collection without the pin
+	if err := s.call("pin/rm", []string{st.Hash}, nil, nil, nil); err != nil && !strings.Contains(err.Error(), "not pinned") {
+		return err
+	}
+	return nil
+}
+
+func (s *IPFSStorage) Stat(key string) (int64, error) {
+	st, err := s.stat(key)
+	if err != nil {
+		return 0, err
+	}
+	return st.Size, nil
+}
+
+// CID returns the content identifier of the blob stored under key.
+func (s *IPFSStorage) CID(key string) (string, error) {
+	st, err := s.stat(key)
+	if err != nil {
+		return "", err
+	}
+	return st.Hash, nil
+}
+
+// ipfsGatewayLink is where a download of fileRecord is redirected to: the
+// file on IPFS_GATEWAY_URL, or "" to stream it. Files encrypted or
+// compressed at rest are always streamed, since the gateway only has their
+// stored bytes.
+func ipfsGatewayLink(fileRecord *FileRecord) string {
+	s, ok := fileStorage.(*IPFSStorage)
+	if !ok || s.gateway == "" || fileRecord.IPFSCID == "" || fileRecord.EncryptionNonce != "" || fileRecord.Compression != "" {
+		return ""
+	}
+	query := url.Values{"filename": {fileRecord.OriginalName}, "download": {"true"}}
+	return s.gateway + "/ipfs/" + fileRecord.IPFSCID + "?" + query.Encode()
+}
+
+// ipfsObject is a lazily opened, seekable view of a blob, read with cat from
+// the current offset after each seek.
+type ipfsObject struct {
+	storage *IPFSStorage
+	cid     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *ipfsObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		query := url.Values{"arg": {"/ipfs/" + o.cid}, "offset": {strconv.FormatInt(o.offset, 10)}}
+		req, err := http.NewRequest("POST", o.storage.api+"/api/v0/cat?"+query.Encode(), nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := o.storage.client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return 0, ipfsError("cat", []string{o.cid}, resp)
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *ipfsObject) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = o.offset + offset
+	case io.SeekEnd:
+		target = o.size + offset
+	default:
+		return 0, errors.New("ipfs seek: invalid whence")
+	}
+	if target < 0 {
+		return 0, errors.New("ipfs seek: negative position")
+	}
+
+	if target != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = target
+	return target, nil
+}
+
+func (o *ipfsObject) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage stores blobs in an S3-compatible bucket (AWS S3, MinIO, R2, ...).
+type S3Storage struct {
+	endpoint  string // scheme://host[:port]
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+// newS3StorageFromEnv reads the bucket's settings from the variables named
+// env plus ENDPOINT, BUCKET and so on: S3_ for the storage backend.
+func newS3StorageFromEnv(env string) (*S3Storage, error) {
+	s := &S3Storage{
+		endpoint:  strings.TrimRight(getEnv(env+"ENDPOINT", ""), "/"),
+		region:    getEnv(env+"REGION", "us-east-1"),
+		bucket:    getEnv(env+"BUCKET", ""),
+		prefix:    strings.Trim(getEnv(env+"PREFIX", ""), "/"),
+		accessKey: getEnv(env+"ACCESS_KEY_ID", ""),
+		secretKey: getEnv(env+"SECRET_ACCESS_KEY", ""),
+		client: &http.Client{
+			Timeout: 30 * time.Minute,
+		},
+	}
+
+	if s.bucket == "" {
+		return nil, fmt.Errorf("%sBUCKET is required", env)
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("%[1]sACCESS_KEY_ID and %[1]sSECRET_ACCESS_KEY are required", env)
+	}
+
+	// Custom endpoints (MinIO and friends) default to path-style addressing
+	if s.endpoint == "" {
+		s.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+		s.pathStyle = getEnv(env+"PATH_STYLE", "false") == "true"
+	} else {
+		s.pathStyle = getEnv(env+"PATH_STYLE", "true") == "true"
+	}
+
+	if _, err := url.Parse(s.endpoint); err != nil {
+		return nil, fmt.Errorf("invalid %sENDPOINT: %w", env, err)
+	}
+
+	return s, nil
+}
+
+// objectURL returns the URL of key, honouring the addressing style.
+func (s *S3Storage) objectURL(key string) *url.URL {
+	u, _ := url.Parse(s.endpoint)
+	objectKey := key
+	if s.prefix != "" {
+		objectKey = s.prefix + "/" + key
+	}
+
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + objectKey
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + objectKey
+	}
+	return u
+}
+
+// bucketURL returns the URL of the bucket itself, for listing.
+func (s *S3Storage) bucketURL() *url.URL {
+	u, _ := url.Parse(s.endpoint)
+	if s.pathStyle {
+		u.Path = "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/"
+	}
+	return u
+}
+
+// do signs and sends a request for key.
+func (s *S3Storage) do(method, key string, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	return s.send(method, s.objectURL(key), body, size, headers)
+}
+
+// send signs and sends a request for u.
+func (s *S3Storage) send(method string, u *url.URL, body io.Reader, size int64, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	payloadHash := sigV4EmptyBodyHash
+	if body != nil {
+		payloadHash = sigV4UnsignedBody
+	}
+
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format(sigV4TimeFormat),
+	}
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+
+	canonical := sigV4CanonicalRequest(method, u.Path, u.Query(), signed, signedHeaders, payloadHash)
+	signature := sigV4Signature(s.secretKey, now, s.region, "s3", canonical)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.accessKey, sigV4Scope(now, s.region, "s3"), strings.Join(signedHeaders, ";"), signature))
+
+	return s.client.Do(req)
+}
+
+// s3Error turns an unexpected response into an error, mapping 404 to
+// os.ErrNotExist.
+func s3Error(op, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3 %s %s: %w", op, key, os.ErrNotExist)
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: HTTP %d: %s", op, key, resp.StatusCode, strings.TrimSpace(string(detail)))
+}
+
+func (s *S3Storage) Save(key string, r io.Reader, size int64) error {
+	if size < 0 {
+		return errors.New("s3 uploads require a known size")
+	}
+	resp, err := s.do("PUT", key, r, size, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", key, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Open(key string) (io.ReadSeekCloser, error) {
+	size, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{storage: s, key: key, size: size}, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("delete", key, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Stat(key string) (int64, error) {
+	resp, err := s.do("HEAD", key, nil, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error("head", key, resp)
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response List needs.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List walks the objects under the prefix a page at a time. Like local
+// storage, it leaves out the working files under dot-prefixed keys.
+func (s *S3Storage) List(fn func(key string, size int64, modTime time.Time) error) error {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.bucketURL()
+		u.RawQuery = query.Encode()
+
+		resp, err := s.send("GET", u, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s3Error("list", prefix, resp)
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(object.Key, prefix)
+			if strings.HasPrefix(key, ".") {
+				continue // unfinished chunked and tus uploads
+			}
+			if err := fn(key, object.Size, object.LastModified); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// s3Object is a lazily opened, seekable view of an object. Each seek drops
+// the current response and the next read issues a ranged GET.
+type s3Object struct {
+	storage *S3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		resp, err := o.storage.do("GET", o.key, nil, 0, map[string]string{
+			"Range": "bytes=" + strconv.FormatInt(o.offset, 10) + "-",
+		})
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			return 0, s3Error("get", o.key, resp)
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = o.offset + offset
+	case io.SeekEnd:
+		target = o.size + offset
+	default:
+		return 0, errors.New("s3 seek: invalid whence")
+	}
+	if target < 0 {
+		return 0, errors.New("s3 seek: negative position")
+	}
+
+	if target != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = target
+	return target, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// countingStorage counts the blobs open at once.
+type countingStorage struct {
+	Storage
+	open, most int
+}
+
+type countedBlob struct {
+	io.ReadSeekCloser
+	storage *countingStorage
+}
+
+func (s *countingStorage) Open(key string) (io.ReadSeekCloser, error) {
+	blob, err := s.Storage.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	s.open++
+	s.most = max(s.most, s.open)
+	return &countedBlob{blob, s}, nil
+}
+
+func (b *countedBlob) Close() error {
+	b.storage.open--
+	return b.ReadSeekCloser.Close()
+}
+
+func TestBlobSequence(t *testing.T) {
+	counting := &countingStorage{Storage: fileStorage}
+	saved := fileStorage
+	fileStorage = counting
+	defer func() { fileStorage = saved }()
+
+	pieces := []string{"first ", "", "second ", strings.Repeat("x", 100000), " last"}
+	keys := make([]string, len(pieces))
+	for i, piece := range pieces {
+		keys[i] = ".test-sequence-" + generateUniqueID()
+		if err := fileStorage.Save(keys[i], strings.NewReader(piece), int64(len(piece))); err != nil {
+			t.Fatal(err)
+		}
+		defer fileStorage.Delete(keys[i])
+	}
+
+	sequence := &blobSequence{keys: keys}
+	got, err := io.ReadAll(sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequence.Close()
+	if want := strings.Join(pieces, ""); string(got) != want {
+		t.Errorf("read %d bytes, want the %d bytes of the pieces joined", len(got), len(want))
+	}
+	if counting.most != 1 || counting.open != 0 {
+		t.Errorf("%d blobs open at most and %d left open, want 1 and 0", counting.most, counting.open)
+	}
+
+	// A missing piece fails the read
+	missing := &blobSequence{keys: []string{keys[0], ".test-sequence-missing"}}
+	if _, err := io.ReadAll(missing); err == nil {
+		t.Error("reading a sequence with a missing blob succeeded")
+	}
+	missing.Close()
+	if counting.open != 0 {
+		t.Errorf("%d blobs left open after a failed read", counting.open)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Tags and metadata, so teams can sort build artifacts and logs. An upload
+// can carry tags (?tags=, X-Tags or a tags form field, comma-separated) and
+// key/value metadata (X-Meta-<Name> headers or meta[<name>] form fields).
+// They're kept in tables of their own, returned as tags and metadata with
+// the file's info and in listings, and listings can be narrowed by them:
+// ?tag=nightly,arm64 keeps files with every tag given and ?meta.branch=main
+// files whose metadata has that value.
+
+const (
+	maxFileTags          = 20
+	maxFileMetadata      = 32
+	maxMetadataValueSize = 1024
+)
+
+var (
+	tagPattern          = regexp.MustCompile(`^[a-z0-9][a-z0-9._:/-]{0,63}$`)
+	metadataNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+// FileTag is one tag of a file.
+type FileTag struct {
+	ID     uint   `gorm:"primaryKey"`
+	FileID uint   `gorm:"not null;uniqueIndex:idx_file_tags_file_tag,priority:1"`
+	Tag    string `gorm:"not null;uniqueIndex:idx_file_tags_file_tag,priority:2;index"`
+}
+
+// FileMetadata is one metadata entry of a file.
+type FileMetadata struct {
+	ID     uint   `gorm:"primaryKey"`
+	FileID uint   `gorm:"not null;uniqueIndex:idx_file_metadata_file_name,priority:1"`
+	Name   string `gorm:"not null;uniqueIndex:idx_file_metadata_file_name,priority:2;index:idx_file_metadata_name_value,priority:1"`
+	Value  string `gorm:"not null;size:1024;index:idx_file_metadata_name_value,priority:2"`
+}
+
+// fileLabels are the tags and metadata sent with an upload.
+type fileLabels struct {
+	tags     []string
+	metadata map[string]string
+}
+
+// requestLabels reads the tags and metadata sent with an upload, looking in
+// form fields through fields when the body has them.
+func requestLabels(c *fiber.Ctx, fields map[string]string) (*fileLabels, error) {
+	tagsValue := c.Query("tags")
+	if tagsValue == "" {
+		tagsValue = c.Get("X-Tags")
+	}
+	if tagsValue == "" {
+		tagsValue = fields["tags"]
+	}
+
+	// Headers win over form fields, as for the other options
+	metadata := make(map[string]string)
+	for field, value := range fields {
+		if name, ok := strings.CutPrefix(field, "meta["); ok && strings.HasSuffix(name, "]") {
+			metadata[strings.ToLower(strings.TrimSuffix(name, "]"))] = value
+		}
+	}
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		if name, ok := cutPrefixFold(string(key), "X-Meta-"); ok {
+			metadata[strings.ToLower(name)] = string(value)
+		}
+	})
+	return parseFileLabels(tagsValue, metadata)
+}
+
+// parseFileLabels checks comma-separated tags and metadata entries, tags
+// being lowercased and duplicates dropped.
+func parseFileLabels(tagsValue string, metadata map[string]string) (*fileLabels, error) {
+	labels := &fileLabels{metadata: metadata}
+	seen := make(map[string]bool)
+	for _, tag := range splitList(strings.ToLower(tagsValue)) {
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("Invalid tag '%s' (letters, digits and . _ : / -, up to 64 characters)", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			labels.tags = append(labels.tags, tag)
+		}
+	}
+	if len(labels.tags) > maxFileTags {
+		return nil, fmt.Errorf("A file can have at most %d tags", maxFileTags)
+	}
+
+	if len(metadata) > maxFileMetadata {
+		return nil, fmt.Errorf("A file can have at most %d metadata entries", maxFileMetadata)
+	}
+	for name, value := range metadata {
+		if !metadataNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("Invalid metadata name '%s' (letters, digits, _ and -, up to 64 characters)", name)
+		}
+		if len(value) > maxMetadataValueSize {
+			return nil, fmt.Errorf("Metadata '%s' is longer than %d bytes", name, maxMetadataValueSize)
+		}
+	}
+	return labels, nil
+}
+
+// cutPrefixFold is strings.CutPrefix ignoring case.
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// saveFileLabels stores labels for the file fileRecord, in tx, and shows
+// them on it.
+func saveFileLabels(tx *gorm.DB, fileRecord *FileRecord, labels *fileLabels) error {
+	if labels == nil {
+		return nil
+	}
+	for _, tag := range labels.tags {
+		if err := tx.Create(&FileTag{FileID: fileRecord.ID, Tag: tag}).Error; err != nil {
+			return err
+		}
+	}
+	for name, value := range labels.metadata {
+		if err := tx.Create(&FileMetadata{FileID: fileRecord.ID, Name: name, Value: value}).Error; err != nil {
+			return err
+		}
+	}
+	fileRecord.Tags = labels.tags
+	if len(labels.metadata) > 0 {
+		fileRecord.Metadata = labels.metadata
+	}
+	return nil
+}
+
+// attachFileLabels fills in the tags and metadata of records.
+func attachFileLabels(records []FileRecord) {
+	if len(records) == 0 {
+		return
+	}
+	ids := make([]uint, len(records))
+	byID := make(map[uint]*FileRecord, len(records))
+	for i := range records {
+		ids[i] = records[i].ID
+		byID[records[i].ID] = &records[i]
+	}
+
+	var tags []FileTag
+	db.Where("file_id IN ?", ids).Order("id").Find(&tags)
+	for _, tag := range tags {
+		byID[tag.FileID].Tags = append(byID[tag.FileID].Tags, tag.Tag)
+	}
+
+	var metadata []FileMetadata
+	db.Where("file_id IN ?", ids).Find(&metadata)
+	for _, entry := range metadata {
+		record := byID[entry.FileID]
+		if record.Metadata == nil {
+			record.Metadata = make(map[string]string)
+		}
+		record.Metadata[entry.Name] = entry.Value
+	}
+}
+
+// deleteFileLabels drops the tags and metadata of a file that's gone.
+func deleteFileLabels(tx *gorm.DB, fileID uint) error {
+	if err := tx.Where("file_id = ?", fileID).Delete(&FileTag{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("file_id = ?", fileID).Delete(&DownloadEvent{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("file_id = ?", fileID).Delete(&FileMetadata{}).Error
+}
+
+// filterFileLabels applies the ?tag= and ?meta.<name>= listing filters.
+func filterFileLabels(c *fiber.Ctx, query *gorm.DB) *gorm.DB {
+	for _, tag := range splitList(strings.ToLower(c.Query("tag"))) {
+		query = query.Where("id IN (?)", db.Model(&FileTag{}).Select("file_id").Where("tag = ?", tag))
+	}
+
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		if name, ok := strings.CutPrefix(string(key), "meta."); ok && name != "" {
+			query = query.Where("id IN (?)", db.Model(&FileMetadata{}).Select("file_id").
+				Where("name = ? AND value = ?", strings.ToLower(name), string(value)))
+		}
+	})
+	return query
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth throttling: MAX_DOWNLOAD_RATE and MAX_UPLOAD_RATE cap each
+// transfer, and MAX_TOTAL_DOWNLOAD_RATE and MAX_TOTAL_UPLOAD_RATE cap all of
+// them together, so one fast client can't take the whole link. Rates are
+// sizes per second such as 10MB/s; 0 means no limit. Transfers are paced by
+// token buckets as the data is copied, and the kernel's flow control slows
+// the other end down to match.
+
+// throttleChunk is the most a throttled transfer moves between waits, which
+// keeps the pace smooth.
+const throttleChunk = 32 * 1024
+
+var (
+	downloadRate int64
+	uploadRate   int64
+	// Shared by every transfer in that direction; nil when uncapped
+	totalDownloadLimiter *rateLimiter
+	totalUploadLimiter   *rateLimiter
+)
+
+// loadThrottleConfig reads MAX_DOWNLOAD_RATE, MAX_UPLOAD_RATE,
+// MAX_TOTAL_DOWNLOAD_RATE and MAX_TOTAL_UPLOAD_RATE.
+func loadThrottleConfig() {
+	downloadRate = parseRateSetting("MAX_DOWNLOAD_RATE")
+	uploadRate = parseRateSetting("MAX_UPLOAD_RATE")
+	totalDownloadLimiter, totalUploadLimiter = nil, nil
+	if rate := parseRateSetting("MAX_TOTAL_DOWNLOAD_RATE"); rate > 0 {
+		totalDownloadLimiter = newRateLimiter(rate)
+	}
+	if rate := parseRateSetting("MAX_TOTAL_UPLOAD_RATE"); rate > 0 {
+		totalUploadLimiter = newRateLimiter(rate)
+	}
+}
+
+// parseRateSetting reads a rate such as 10MB/s (or just 10MB) in bytes per
+// second.
+func parseRateSetting(key string) int64 {
+	value := getEnv(key, "0")
+	rate, err := parseSize(strings.TrimSuffix(strings.TrimSpace(strings.ToLower(value)), "/s"))
+	if err != nil || rate < 0 {
+		log.Printf("Invalid %s value '%s', using default 0 (unlimited)", key, value)
+		return 0
+	}
+	return rate
+}
+
+// rateLimiter is a token bucket holding up to a tenth of a second of data.
+// Callers may overdraw it and then sleep off the debt, so concurrent
+// transfers sharing one bucket get a fair share of its rate between them.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	burst := float64(max(rate/10, throttleChunk))
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller
+// must wait before sending them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttle paces one transfer against every limit that applies to it. A nil
+// throttle doesn't limit anything.
+type throttle []*rateLimiter
+
+// downloadThrottle returns the limits for a new download.
+func downloadThrottle() throttle {
+	return newThrottle(downloadRate, totalDownloadLimiter)
+}
+
+// uploadThrottle returns the limits for a new upload.
+func uploadThrottle() throttle {
+	return newThrottle(uploadRate, totalUploadLimiter)
+}
+
+func newThrottle(rate int64, total *rateLimiter) throttle {
+	var t throttle
+	if rate > 0 {
+		t = append(t, newRateLimiter(rate))
+	}
+	if total != nil {
+		t = append(t, total)
+	}
+	return t
+}
+
+// wait blocks until n bytes may be sent.
+func (t throttle) wait(n int) {
+	var delay time.Duration
+	for _, limiter := range t {
+		delay = max(delay, limiter.reserve(n))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// reader paces reads from r.
+func (t throttle) reader(r io.Reader) io.Reader {
+	if len(t) == 0 {
+		return r
+	}
+	return &throttledReader{r: r, throttle: t}
+}
+
+// writer paces writes to w.
+func (t throttle) writer(w io.Writer) io.Writer {
+	if len(t) == 0 {
+		return w
+	}
+	return &throttledWriter{w: w, throttle: t}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	throttle throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.throttle.wait(n)
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	w        io.Writer
+	throttle throttle
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		w.throttle.wait(len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // decoders register themselves
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	_ "golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails of image uploads: /t/:id?w=320 scales the image down in
+// process and caches the result in storage next to the original, under the
+// original's key plus the width, so it goes when the blob does. Widths are
+// rounded up to a fixed set to bound how many versions of a file are kept.
+// Thumbnails of files encrypted at rest are made on each request instead of
+// being stored in the clear.
+
+var thumbnailWidths = []int{64, 128, 256, 320, 480, 640, 800, 1024}
+
+const (
+	thumbnailDefaultWidth = 320
+	// Refuse to decode images bigger than this, so a small file that expands
+	// to gigabytes of pixels can't exhaust memory
+	thumbnailMaxPixels = 50_000_000
+)
+
+var (
+	thumbnailsEnabled bool
+	// Scaling is CPU bound; run no more at once than there are CPUs
+	thumbnailSlots = make(chan struct{}, runtime.NumCPU())
+)
+
+// loadThumbnailConfig reads THUMBNAILS_ENABLED.
+func loadThumbnailConfig() {
+	thumbnailsEnabled = getEnv("THUMBNAILS_ENABLED", "true") == "true"
+}
+
+func setupThumbnailRoutes(app *fiber.App) {
+	app.Get("/t/:id", handleThumbnail)
+}
+
+// thumbnailWidth rounds a requested width up to the next cached size.
+func thumbnailWidth(requested int) int {
+	for _, width := range thumbnailWidths {
+		if requested <= width {
+			return width
+		}
+	}
+	return thumbnailWidths[len(thumbnailWidths)-1]
+}
+
+func thumbnailKey(blobKey string, width int) string {
+	return fmt.Sprintf("%s.thumb%d", blobKey, width)
+}
+
+// deleteThumbnails removes the cached thumbnails of the blob under key.
+func deleteThumbnails(key string) {
+	for _, width := range thumbnailWidths {
+		fileStorage.Delete(thumbnailKey(key, width))
+	}
+}
+
+// thumbnailable reports whether a thumbnail can be made of a file.
+func thumbnailable(fileRecord *FileRecord) bool {
+	switch strings.TrimSpace(strings.SplitN(fileRecord.MimeType, ";", 2)[0]) {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp":
+		return true
+	}
+	return false
+}
+
+// makeThumbnail scales the image in src to width pixels wide (never up) and
+// encodes it as JPEG, or PNG when it has transparency.
+func makeThumbnail(src io.ReadSeeker, width int) ([]byte, error) {
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+
+	img, err := decodeImage(src)
+	if err != nil {
+		return nil, err
+	}
+	scaled := fitImage(img, width, 0)
+
+	var out bytes.Buffer
+	if scaled.Opaque() {
+		err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&out, scaled)
+	}
+	return out.Bytes(), err
+}
+
+// decodeImage decodes the image in src, refusing ones too large to handle.
+// For animated GIFs this is the first frame.
+func decodeImage(src io.ReadSeeker) (image.Image, error) {
+	config, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > thumbnailMaxPixels {
+		return nil, fmt.Errorf("image is %dx%d, too large to process", config.Width, config.Height)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(src)
+	return img, err
+}
+
+// fitImage scales img down to fit within width x height, keeping its aspect
+// ratio; a dimension of 0 is unconstrained. Images are never scaled up.
+func fitImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	scale := 1.0
+	if width > 0 && width < bounds.Dx() {
+		scale = float64(width) / float64(bounds.Dx())
+	}
+	if height > 0 && height < bounds.Dy() {
+		scale = min(scale, float64(height)/float64(bounds.Dy()))
+	}
+	width = max(1, int(float64(bounds.Dx())*scale+0.5))
+	height = max(1, int(float64(bounds.Dy())*scale+0.5))
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	if scale == 1 {
+		draw.Draw(scaled, scaled.Bounds(), img, bounds.Min, draw.Src)
+	} else {
+		xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	}
+	return scaled
+}
+
+// handleThumbnail is GET /t/:id?w=320. Password-protected files need the
+// password unless the request comes from their owner or an admin.
+func handleThumbnail(c *fiber.Ctx) error {
+	if !thumbnailsEnabled {
+		return c.Status(404).SendString("Thumbnails are disabled")
+	}
+	id := c.Params("id")
+	fileRecord, err := lookupDownload(c, strings.TrimSuffix(id, filepath.Ext(id)))
+	if fileRecord == nil {
+		return err
+	}
+	if !thumbnailable(fileRecord) {
+		return c.Status(415).SendString("No thumbnail for this file type")
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 && fileRecord.Downloads >= limit {
+		return c.Status(410).SendString(fmt.Sprintf("File has reached maximum download limit (%d)", limit))
+	}
+	if !ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+		if ok, _ := checkFilePassword(c, fileRecord); !ok {
+			return c.Status(401).SendString("Password required")
+		}
+	}
+
+	width := thumbnailWidth(c.QueryInt("w", thumbnailDefaultWidth))
+	key := thumbnailKey(fileRecord.FilePath, width)
+	cache := fileRecord.EncryptionNonce == ""
+
+	var thumbnail []byte
+	if cache {
+		if cached, err := fileStorage.Open(key); err == nil {
+			thumbnail, err = io.ReadAll(cached)
+			cached.Close()
+			if err != nil {
+				thumbnail = nil
+			}
+		}
+	}
+	if thumbnail == nil {
+		reader, err := openFileRecord(fileRecord)
+		if err != nil {
+			requestLog(c).Error("Failed to open file", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+			return c.Status(500).SendString("Failed to open file")
+		}
+		thumbnail, err = makeThumbnail(reader, width)
+		reader.Close()
+		if err != nil {
+			requestLog(c).Warn("Failed to make thumbnail", "file_id", fileRecord.UniqueID, "error", err)
+			return c.Status(415).SendString("Could not make a thumbnail of this image")
+		}
+		if cache {
+			if err := fileStorage.Save(key, bytes.NewReader(thumbnail), int64(len(thumbnail))); err != nil {
+				log.Printf("Failed to cache thumbnail %s: %v", key, err)
+			}
+		}
+	}
+
+	c.Set("Content-Type", http.DetectContentType(thumbnail))
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set("Cache-Control", "private, max-age=3600")
+	return c.Send(thumbnail)
+}
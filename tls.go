@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HTTPS without a reverse proxy. Either TLS_CERT and TLS_KEY name a
+// certificate and key on disk, or AUTO_TLS lists the domains to obtain
+// certificates for from Let's Encrypt. In both cases a plain HTTP listener on
+// HTTP_PORT redirects to HTTPS (and answers ACME challenges in AUTO_TLS
+// mode).
+
+var (
+	tlsCertFile  string
+	tlsKeyFile   string
+	autoTLSHosts []string
+	autoTLSCache string
+	autoTLSEmail string
+	httpPort     string
+)
+
+// loadTLSConfig reads TLS_CERT, TLS_KEY, AUTO_TLS, AUTO_TLS_CACHE,
+// AUTO_TLS_EMAIL and HTTP_PORT.
+func loadTLSConfig() {
+	tlsCertFile = getEnv("TLS_CERT", "")
+	tlsKeyFile = getEnv("TLS_KEY", "")
+	autoTLSHosts = splitList(getEnv("AUTO_TLS", ""))
+	autoTLSCache = getEnv("AUTO_TLS_CACHE", "./certs")
+	autoTLSEmail = getEnv("AUTO_TLS_EMAIL", "")
+
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatal("TLS_CERT and TLS_KEY must be set together")
+	}
+	if tlsCertFile != "" && len(autoTLSHosts) > 0 {
+		log.Fatal("Set either TLS_CERT/TLS_KEY or AUTO_TLS, not both")
+	}
+
+	// Let's Encrypt validates domains over port 80, so AUTO_TLS needs the
+	// HTTP listener unless it is explicitly turned off
+	defaultHTTPPort := ""
+	if len(autoTLSHosts) > 0 {
+		defaultHTTPPort = "80"
+	}
+	httpPort = getEnv("HTTP_PORT", defaultHTTPPort)
+	if httpPort == "off" {
+		httpPort = ""
+	}
+}
+
+func tlsEnabled() bool {
+	return tlsCertFile != "" || len(autoTLSHosts) > 0
+}
+
+// listen serves app on port, or the socket set by LISTEN, over HTTPS when
+// TLS is configured.
+func listen(app *fiber.App, port string) error {
+	if !tlsEnabled() {
+		if customListener() {
+			ln, err := openListener(port)
+			if err != nil {
+				return err
+			}
+			return app.Listener(ln)
+		}
+		// Listen rather than Listener, which can't prefork
+		return app.Listen(":" + port)
+	}
+
+	var tlsConfig *tls.Config
+	var challengeHandler func(http.Handler) http.Handler
+	if len(autoTLSHosts) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(autoTLSHosts...),
+			Cache:      autocert.DirCache(autoTLSCache),
+			Email:      autoTLSEmail,
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: manager.GetCertificate,
+			// fasthttp only speaks HTTP/1.1, so h2 must not be negotiated
+			NextProtos: []string{"http/1.1", acme.ALPNProto},
+		}
+		challengeHandler = manager.HTTPHandler
+		log.Printf("Automatic HTTPS for %s (certificates cached in %s)", strings.Join(autoTLSHosts, ", "), autoTLSCache)
+	} else {
+		cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		log.Printf("HTTPS enabled with certificate %s", tlsCertFile)
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	if httpPort != "" {
+		go serveHTTPRedirect(port, challengeHandler)
+	}
+
+	ln, err := openListener(port)
+	if err != nil {
+		return err
+	}
+	return app.Listener(tls.NewListener(ln, tlsConfig))
+}
+
+// serveHTTPRedirect answers plain HTTP on HTTP_PORT with a permanent
+// redirect to the same URL over HTTPS. wrap, when set, lets autocert answer
+// ACME HTTP-01 challenges first.
+func serveHTTPRedirect(httpsPort string, wrap func(http.Handler) http.Handler) {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+
+	log.Printf("Redirecting HTTP on port %s to HTTPS", httpPort)
+	if err := http.ListenAndServe(":"+httpPort, handler); err != nil {
+		log.Printf("HTTP redirect listener failed: %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Torrents of large files. /api/files/:id/torrent describes a file as a
+// single-file .torrent whose web seed (BEP 19) is the file's download link,
+// so BitTorrent clients can always fetch from this server and share what
+// they have with each other, taking load off it. ?format=magnet gives the
+// same as a magnet link. Piece hashes are cached in storage next to the
+// original, like thumbnails, so a file is only read through once.
+
+const (
+	torrentMinPieceLength = 256 << 10
+	torrentMaxPieceLength = 16 << 20
+	torrentTargetPieces   = 1500
+)
+
+var (
+	torrentsEnabled bool
+	torrentMinSize  int64
+	torrentTrackers []string
+	// Hashing reads the whole file; don't let many requests do it at once
+	torrentSlots = make(chan struct{}, 2)
+)
+
+// loadTorrentConfig reads TORRENTS_ENABLED, TORRENT_MIN_SIZE and
+// TORRENT_TRACKERS.
+func loadTorrentConfig() {
+	torrentsEnabled = getEnv("TORRENTS_ENABLED", "true") == "true"
+	if !torrentsEnabled {
+		return
+	}
+	minSizeStr := getEnv("TORRENT_MIN_SIZE", "50MB")
+	var err error
+	torrentMinSize, err = parseSize(minSizeStr)
+	if err != nil || torrentMinSize < 0 {
+		log.Printf("Invalid TORRENT_MIN_SIZE value '%s', using default 50MB", minSizeStr)
+		torrentMinSize = 50 * 1024 * 1024
+	}
+	for _, tracker := range splitList(getEnv("TORRENT_TRACKERS", "")) {
+		if u, err := url.Parse(tracker); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Printf("Invalid tracker '%s' in TORRENT_TRACKERS, ignoring it", tracker)
+			continue
+		}
+		torrentTrackers = append(torrentTrackers, tracker)
+	}
+}
+
+// torrentPieceLength picks a power of two between 256 KiB and 16 MiB that
+// keeps a file to about 1500 pieces.
+func torrentPieceLength(size int64) int64 {
+	length := int64(torrentMinPieceLength)
+	for size/length > torrentTargetPieces && length < torrentMaxPieceLength {
+		length *= 2
+	}
+	return length
+}
+
+func torrentPiecesKey(blobKey string) string {
+	return blobKey + ".pieces"
+}
+
+// deleteTorrentPieces removes the cached piece hashes of the blob under key.
+func deleteTorrentPieces(key string) {
+	fileStorage.Delete(torrentPiecesKey(key))
+}
+
+// torrentPieces returns the concatenated SHA-1 hashes of the file's pieces,
+// from the cache when they've been worked out before. Files encrypted at
+// rest are hashed on each request instead, like their thumbnails.
+func torrentPieces(fileRecord *FileRecord, pieceLength int64) ([]byte, error) {
+	key := torrentPiecesKey(fileRecord.FilePath)
+	pieceCount := (fileRecord.FileSize + pieceLength - 1) / pieceLength
+	cache := fileRecord.EncryptionNonce == ""
+
+	if cache {
+		if cached, err := fileStorage.Open(key); err == nil {
+			pieces, err := io.ReadAll(cached)
+			cached.Close()
+			if err == nil && int64(len(pieces)) == pieceCount*sha1.Size {
+				return pieces, nil
+			}
+		}
+	}
+
+	torrentSlots <- struct{}{}
+	defer func() { <-torrentSlots }()
+
+	reader, err := openFileRecord(fileRecord)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	pieces := make([]byte, 0, pieceCount*sha1.Size)
+	buf := make([]byte, pieceLength)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			pieces = append(pieces, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if int64(len(pieces)) != pieceCount*sha1.Size {
+		return nil, fmt.Errorf("read %d pieces of %d", len(pieces)/sha1.Size, pieceCount)
+	}
+
+	if cache {
+		if err := fileStorage.Save(key, bytes.NewReader(pieces), int64(len(pieces))); err != nil {
+			log.Printf("Failed to cache torrent pieces %s: %v", key, err)
+		}
+	}
+	return pieces, nil
+}
+
+// handleFileTorrent is GET /api/files/:id/torrent, or ?format=magnet for a
+// magnet link. Looking one up doesn't count as a download; the web seed's
+// requests do, so files with a download limit or a password aren't offered.
+func handleFileTorrent(c *fiber.Ctx) error {
+	if !torrentsEnabled {
+		return c.Status(404).SendString("Torrents are disabled")
+	}
+	format := c.Query("format", "torrent")
+	if format != "torrent" && format != "magnet" {
+		return c.Status(400).SendString(fmt.Sprintf("Invalid format '%s'", format))
+	}
+
+	id := c.Params("id")
+	fileRecord, err := lookupDownload(c, strings.TrimSuffix(id, filepath.Ext(id)))
+	if fileRecord == nil {
+		return err
+	}
+	if fileRecord.FileSize < torrentMinSize {
+		return c.Status(422).SendString(fmt.Sprintf("Torrents are only made of files of %s or more", formatBytes(torrentMinSize)))
+	}
+	if fileRecord.downloadLimit() > 0 {
+		return c.Status(409).SendString("Files with a download limit can't be shared as torrents")
+	}
+	if fileRecord.PasswordHash != "" {
+		return c.Status(409).SendString("Password-protected files can't be shared as torrents")
+	}
+
+	pieceLength := torrentPieceLength(fileRecord.FileSize)
+	pieces, err := torrentPieces(fileRecord, pieceLength)
+	if err != nil {
+		requestLog(c).Error("Failed to hash file for torrent", "file_id", fileRecord.UniqueID, "key", fileRecord.FilePath, "error", err)
+		return c.Status(500).SendString("Failed to read file")
+	}
+
+	name := fileRecord.OriginalName
+	if name == "" {
+		name = fileRecord.UniqueID + fileRecord.Extension
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"length":       fileRecord.FileSize,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+	var encodedInfo bytes.Buffer
+	bencode(&encodedInfo, info)
+	infoHash := sha1.Sum(encodedInfo.Bytes())
+	webSeed := forwardSignature(c, getBaseURL(c)+"/d/"+fileRecord.UniqueID+fileRecord.Extension, fileRecord)
+
+	if format == "magnet" {
+		params := []string{
+			"xt=urn:btih:" + hex.EncodeToString(infoHash[:]),
+			"dn=" + url.QueryEscape(name),
+			"xl=" + strconv.FormatInt(fileRecord.FileSize, 10),
+		}
+		for _, tracker := range torrentTrackers {
+			params = append(params, "tr="+url.QueryEscape(tracker))
+		}
+		torrentURL := forwardSignature(c, getBaseURL(c)+c.Path(), fileRecord)
+		params = append(params, "ws="+url.QueryEscape(webSeed), "xs="+url.QueryEscape(torrentURL))
+		return c.SendString("magnet:?" + strings.Join(params, "&"))
+	}
+
+	torrent := map[string]interface{}{
+		"info":          bencodeRaw(encodedInfo.Bytes()),
+		"url-list":      []interface{}{webSeed},
+		"created by":    "bashupload",
+		"creation date": fileRecord.UploadedAt.Unix(),
+	}
+	if len(torrentTrackers) > 0 {
+		torrent["announce"] = torrentTrackers[0]
+		tiers := make([]interface{}, 0, len(torrentTrackers))
+		for _, tracker := range torrentTrackers {
+			tiers = append(tiers, []interface{}{tracker})
+		}
+		torrent["announce-list"] = tiers
+	}
+	var out bytes.Buffer
+	bencode(&out, torrent)
+
+	c.Set("Content-Type", "application/x-bittorrent")
+	c.Set("Content-Disposition", contentDisposition("attachment", name+".torrent"))
+	c.Set("X-Torrent-Info-Hash", hex.EncodeToString(infoHash[:]))
+	return c.Send(out.Bytes())
+}
+
+// bencodeRaw is a value that is already bencoded.
+type bencodeRaw []byte
+
+// bencode writes v in BitTorrent's encoding. It knows the types torrents
+// are built from: strings, byte strings, integers, lists and dictionaries,
+// whose keys it sorts.
+func bencode(w *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case bencodeRaw:
+		w.Write(v)
+	case string:
+		fmt.Fprintf(w, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(w, "%d:", len(v))
+		w.Write(v)
+	case int:
+		fmt.Fprintf(w, "i%de", v)
+	case int64:
+		fmt.Fprintf(w, "i%de", v)
+	case []interface{}:
+		w.WriteByte('l')
+		for _, item := range v {
+			bencode(w, item)
+		}
+		w.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		w.WriteByte('d')
+		for _, key := range keys {
+			bencode(w, key)
+			bencode(w, v[key])
+		}
+		w.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// The trash: expired, used-up and deleted files are soft-deleted first and
+// only purged, blob and all, once TRASH_RETENTION has passed, so an admin can
+// restore a file removed by mistake or by a cleanup bug. Trashed files are
+// invisible everywhere else; their slug is freed straight away, and given
+// back on restore unless another file took it meanwhile. A TRASH_RETENTION
+// of 0 removes files immediately.
+
+var trashRetention time.Duration
+
+// loadTrashConfig reads TRASH_RETENTION.
+func loadTrashConfig() {
+	retentionStr := getEnv("TRASH_RETENTION", "24h")
+	var err error
+	trashRetention, err = parseDuration(retentionStr)
+	if err != nil || trashRetention < 0 {
+		log.Printf("Invalid TRASH_RETENTION value '%s', using default 24 hours", retentionStr)
+		trashRetention = 24 * time.Hour
+	}
+}
+
+// removeFile takes a file out of service, into the trash or, with the trash
+// off, for good. reason is kept with it, e.g. "expired" or "admin".
+func removeFile(fileRecord *FileRecord, reason string) error {
+	var err error
+	if trashRetention <= 0 {
+		err = purgeFile(fileRecord)
+	} else {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			deletedSlug := ""
+			if fileRecord.Slug != nil {
+				deletedSlug = *fileRecord.Slug
+			}
+			err := tx.Model(fileRecord).Updates(map[string]interface{}{
+				"delete_reason": reason,
+				"deleted_slug":  deletedSlug,
+				"slug":          nil,
+			}).Error
+			if err != nil {
+				return err
+			}
+			result := tx.Delete(fileRecord)
+			if result.Error == nil && result.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			return result.Error
+		})
+	}
+	if err == nil {
+		recordFileRemoved(fileRecord)
+	}
+	return err
+}
+
+// purgeFile removes a file and its blob for good. Only the caller that
+// deletes the row releases the blob, so replicas purging the same file at
+// once drop one reference between them; a blob left behind by a failed
+// delete is found by reconciliation.
+func purgeFile(fileRecord *FileRecord) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := deleteFileLabels(tx, fileRecord.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", fileRecord.ID).Delete(&Alias{}).Error; err != nil {
+			return err
+		}
+		result := tx.Unscoped().Delete(fileRecord)
+		if result.Error == nil && result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return result.Error
+	})
+	if err != nil {
+		return err
+	}
+	return releaseBlob(fileRecord.FilePath)
+}
+
+// purgeTrash removes files that have been in the trash past TRASH_RETENTION.
+func purgeTrash() {
+	var trashed []FileRecord
+	db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-trashRetention)).Find(&trashed)
+
+	purged := 0
+	for i := range trashed {
+		if err := purgeFile(&trashed[i]); err != nil {
+			log.Printf("Failed to purge %s: %v", trashed[i].FilePath, err)
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Purged %d files from the trash", purged)
+	}
+}
+
+// findTrashed loads a file in the trash by its ID.
+func findTrashed(id string, fileRecord *FileRecord) error {
+	return db.Unscoped().Where("unique_id = ? AND deleted_at IS NOT NULL", id).First(fileRecord).Error
+}
+
+// handleAdminListTrash lists the files in the trash, with the filters,
+// sorting and paging of listFiles.
+func handleAdminListTrash(c *fiber.Ctx) error {
+	return listFiles(c, db.Unscoped().Model(&FileRecord{}).Where("deleted_at IS NOT NULL"), 500)
+}
+
+// handleAdminRestoreFile takes a file back out of the trash. A file that had
+// expired gets a new expiry, {"expires": "7D"} or ?expires=7D or else the
+// default, and one that had used up its downloads starts counting again.
+// Its slug comes back if no other file has taken it.
+func handleAdminRestoreFile(c *fiber.Ctx) error {
+	var req struct {
+		Expires string `json:"expires" form:"expires"`
+	}
+	c.BodyParser(&req)
+	if req.Expires == "" {
+		req.Expires = c.Query("expires")
+	}
+
+	var fileRecord FileRecord
+	if err := findTrashed(c.Params("id"), &fileRecord); err != nil {
+		return apiError(c, 404, "File not found in the trash")
+	}
+
+	updates := map[string]interface{}{
+		"deleted_at":    nil,
+		"delete_reason": "",
+		"deleted_slug":  "",
+	}
+	if req.Expires != "" {
+		duration, err := parseDuration(req.Expires)
+		if err != nil || duration < 0 {
+			return apiError(c, 400, fmt.Sprintf("Invalid expiration '%s'", req.Expires))
+		}
+		var expiresAt *time.Time
+		if duration > 0 {
+			t := time.Now().Add(duration)
+			expiresAt = &t
+		}
+		updates["expires_at"] = expiresAt
+	} else if fileRecord.ExpiresAt != nil && time.Now().After(*fileRecord.ExpiresAt) {
+		updates["expires_at"] = computeExpiry(fileRecord.FileSize)
+	}
+	if limit := fileRecord.downloadLimit(); limit > 0 && fileRecord.Downloads >= limit {
+		updates["downloads"] = 0
+	}
+
+	// The slug may have gone to another file, or go to one between the check
+	// and the update
+	slug := fileRecord.DeletedSlug
+	if slug != "" {
+		if _, err := resolveSlug(slug); err == nil {
+			updates["slug"] = slug
+		}
+	}
+	err := db.Unscoped().Model(&fileRecord).Updates(updates).Error
+	if updates["slug"] != nil && isSlugConflict(err, &FileRecord{Slug: &slug}) {
+		delete(updates, "slug")
+		err = db.Unscoped().Model(&fileRecord).Updates(updates).Error
+	}
+	if err != nil {
+		return apiError(c, 500, "Failed to restore file")
+	}
+	db.First(&fileRecord, fileRecord.ID)
+	log.Printf("Admin restored file %s (%s)", fileRecord.UniqueID, fileRecord.OriginalName)
+	response := fiber.Map{
+		"success": true,
+		"data":    fileRecord,
+	}
+	if slug != "" && updates["slug"] == nil {
+		response["message"] = fmt.Sprintf("Restored without its slug '%s', which is no longer free", slug)
+	}
+	return c.JSON(response)
+}
+
+// handleAdminPurgeFile removes a file in the trash for good.
+func handleAdminPurgeFile(c *fiber.Ctx) error {
+	var fileRecord FileRecord
+	if err := findTrashed(c.Params("id"), &fileRecord); err != nil {
+		return apiError(c, 404, "File not found in the trash")
+	}
+	if err := purgeFile(&fileRecord); err != nil {
+		log.Printf("Failed to purge %s: %v", fileRecord.FilePath, err)
+		return apiError(c, 500, "Failed to purge file")
+	}
+	log.Printf("Admin purged file %s (%s)", fileRecord.UniqueID, fileRecord.OriginalName)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "File purged",
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRestoreGivesSlugBack(t *testing.T) {
+	saved := trashRetention
+	trashRetention = time.Hour
+	defer func() { trashRetention = saved }()
+
+	app := fiber.New()
+	app.Post("/api/admin/trash/:id/restore", handleAdminRestoreFile)
+	restore := func(fileRecord *FileRecord) (FileRecord, string) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("POST", "/api/admin/trash/"+fileRecord.UniqueID+"/restore", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Data    FileRecord `json:"data"`
+			Message string     `json:"message"`
+		}
+		if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&body) != nil {
+			t.Fatalf("restore answered %d", resp.StatusCode)
+		}
+		return body.Data, body.Message
+	}
+	trashWithSlug := func() (*FileRecord, string) {
+		t.Helper()
+		fileRecord := newTestFile(t, 4, 0)
+		slug := "restore-" + generateUniqueID()[:8]
+		fileRecord.Slug = &slug
+		db.Model(fileRecord).Update("slug", slug)
+		if err := removeFile(fileRecord, "admin"); err != nil {
+			t.Fatal(err)
+		}
+		return fileRecord, slug
+	}
+
+	fileRecord, slug := trashWithSlug()
+	restored, message := restore(fileRecord)
+	if restored.Slug == nil || *restored.Slug != slug || message != "" {
+		t.Errorf("free slug: restored with %v and message %q, want %s back", restored.Slug, message, slug)
+	}
+	purgeFile(fileRecord)
+
+	// Another file took the slug while this one was in the trash
+	fileRecord, slug = trashWithSlug()
+	taker := newTestFile(t, 4, 0)
+	db.Model(taker).Update("slug", slug)
+	defer purgeFile(taker)
+	restored, message = restore(fileRecord)
+	if restored.Slug != nil || message == "" {
+		t.Errorf("taken slug: restored with %v and message %q, want no slug and a message", restored.Slug, message)
+	}
+	if restored.DeletedAt.Valid || restored.DeletedSlug != "" {
+		t.Errorf("taken slug: file still marked as trashed")
+	}
+	purgeFile(fileRecord)
+}
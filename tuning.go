@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Server tuning for big instances. PREFORK=true runs one server process per
+// CPU, sharing the port through SO_REUSEPORT; every process is a replica of
+// its own, so it needs MULTI_INSTANCE and a shared database, and SFTP and
+// gRPC are served by the parent. HTTP_CONCURRENCY caps the connections a
+// process serves at once, HTTP_READ_BUFFER_SIZE bounds request headers and
+// HTTP_WRITE_BUFFER_SIZE sets how much of a response is buffered per write.
+//
+// Plain blobs on local disk are sent with sendfile(2), ranges and limited
+// downloads included, so the bytes go from the page cache to the socket
+// without passing through the process.
+
+var (
+	prefork         bool
+	httpConcurrency int
+	readBufferSize  int
+	writeBufferSize int
+)
+
+// loadHTTPConfig reads PREFORK, HTTP_CONCURRENCY, HTTP_READ_BUFFER_SIZE and
+// HTTP_WRITE_BUFFER_SIZE. It runs after loadClusterConfig and loadTLSConfig.
+func loadHTTPConfig() {
+	prefork = getEnv("PREFORK", "false") == "true"
+	if prefork {
+		if !multiInstance {
+			log.Fatal("PREFORK runs a replica per CPU: set MULTI_INSTANCE=true and a shared DB_DRIVER")
+		}
+		if tlsEnabled() {
+			log.Fatal("PREFORK can't serve HTTPS; terminate TLS at a reverse proxy")
+		}
+		if !fiber.IsChild() {
+			log.Printf("Prefork: serving with %d processes", runtime.GOMAXPROCS(0))
+		}
+	}
+
+	concurrencyStr := getEnv("HTTP_CONCURRENCY", strconv.Itoa(fiber.DefaultConcurrency))
+	var err error
+	httpConcurrency, err = strconv.Atoi(concurrencyStr)
+	if err != nil || httpConcurrency <= 0 {
+		log.Printf("Invalid HTTP_CONCURRENCY value '%s', using default %d", concurrencyStr, fiber.DefaultConcurrency)
+		httpConcurrency = fiber.DefaultConcurrency
+	}
+
+	readBufferSize = loadBufferSize("HTTP_READ_BUFFER_SIZE", "4KB", 4*1024)
+	writeBufferSize = loadBufferSize("HTTP_WRITE_BUFFER_SIZE", "32KB", 32*1024)
+}
+
+// loadBufferSize reads a per-connection buffer size, between 1 KB and 1 MB.
+func loadBufferSize(name, fallback string, fallbackBytes int) int {
+	value := getEnv(name, fallback)
+	size, err := parseSize(value)
+	if err != nil || size < 1024 || size > 1024*1024 {
+		log.Printf("Invalid %s value '%s', using default %s", name, value, fallback)
+		return fallbackBytes
+	}
+	return int(size)
+}
+
+// sendLocalFile sends the inclusive span start-end of a plain blob on local
+// disk with sendfile, finishing claim once it's sent. It reports false when
+// the blob can't be opened, with claim untouched.
+func sendLocalFile(c *fiber.Ctx, path string, start, end int64, claim *downloadClaim) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, nil
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		return false, nil
+	}
+	length := end - start + 1
+	return true, c.SendStream(&sendfileReader{
+		file:   file,
+		body:   io.LimitedReader{R: file, N: length},
+		length: length,
+		claim:  claim,
+	}, int(length))
+}
+
+// sendfileReader is a response body fasthttp copies with sendfile: writing
+// it to the connection's buffered writer hands the *io.LimitedReader over an
+// *os.File to the TCP connection's ReadFrom, which the kernel serves. Any
+// wrapper in between would fall back to copying through user space.
+type sendfileReader struct {
+	file   *os.File
+	body   io.LimitedReader
+	length int64
+	claim  *downloadClaim
+}
+
+func (r *sendfileReader) Read(p []byte) (int, error) {
+	return r.body.Read(p)
+}
+
+func (r *sendfileReader) WriteTo(w io.Writer) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(&r.body)
+	}
+	return io.Copy(w, &r.body)
+}
+
+func (r *sendfileReader) Close() error {
+	r.claim.finish(r.length-r.body.N, r.length)
+	return r.file.Close()
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tus 1.0.0 resumable uploads (https://tus.io/protocols/resumable-upload).
+// Supported extensions: creation and termination.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	// maxTusParts bounds the parts one upload can have to store and join;
+	// the PATCH that would take the last one has to finish the upload
+	maxTusParts = maxTotalChunks
+)
+
+// TusUpload tracks a tus upload. Each PATCH is kept in the storage backend as
+// a part of its own, so with several instances any of them can take the next
+// one, until Offset reaches Length. The parts are then joined into a regular
+// FileRecord and UniqueID is set.
+type TusUpload struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	UploadID  string    `json:"upload_id" gorm:"unique;not null"`
+	Filename  string    `json:"filename" gorm:"not null"`
+	MimeType  string    `json:"mime_type"`
+	Length    int64     `json:"length" gorm:"not null"`
+	Offset    int64     `json:"offset" gorm:"default:0"`
+	Parts     string    `json:"-"` // comma-separated part names, in order
+	UniqueID  string    `json:"unique_id"`
+	IPAddress string    `json:"-"`
+	UserID    *uint     `json:"-"`
+	APIKeyID  *uint     `json:"-"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
+}
+
+// tusLocks turns away a second PATCH to the same upload on this instance
+// at once. Across instances, the offset check when recording a part does.
+var tusLocks sync.Map
+
+// tusPartKey is the storage key of one part of an upload.
+func tusPartKey(uploadID, part string) string {
+	return ".tus/" + uploadID + "." + part
+}
+
+func (u *TusUpload) partKeys() []string {
+	var keys []string
+	for _, part := range splitList(u.Parts) {
+		keys = append(keys, tusPartKey(u.UploadID, part))
+	}
+	return keys
+}
+
+// removeTusUpload deletes an upload together with its stored parts.
+func removeTusUpload(upload *TusUpload) {
+	for _, key := range upload.partKeys() {
+		fileStorage.Delete(key)
+	}
+	db.Delete(upload)
+	tusLocks.Delete(upload.UploadID)
+}
+
+// dropLegacyTusUploads removes unfinished uploads begun while their data was
+// kept in a single local file. Their clients get a 404 and start over.
+func dropLegacyTusUploads() {
+	var uploads []TusUpload
+	db.Where("unique_id = '' OR unique_id IS NULL").Where("parts = '' OR parts IS NULL").Find(&uploads)
+	dropped := 0
+	for i := range uploads {
+		os.Remove(filepath.Join(uploadDir, ".tus", uploads[i].UploadID))
+		if uploads[i].Offset > 0 {
+			db.Delete(&uploads[i])
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("Dropped %d unfinished tus uploads from before parts were kept in storage", dropped)
+	}
+}
+
+func setupTusRoutes(api fiber.Router, auth fiber.Handler) {
+	tus := api.Group("/tus", tusHeaders, auth)
+	tus.Options("/", handleTusOptions)
+	tus.Post("/", handleTusCreate)
+	tus.Head("/:id", handleTusHead)
+	tus.Patch("/:id", handleTusPatch)
+	tus.Delete("/:id", handleTusDelete)
+}
+
+// tusHeaders sets the headers every tus response carries and rejects clients
+// speaking another protocol version.
+func tusHeaders(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Cache-Control", "no-store")
+
+	if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return c.Status(412).SendString("Unsupported tus version")
+	}
+	return c.Next()
+}
+
+func handleTusOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.FormatInt(maxUpload, 10))
+	return c.SendStatus(204)
+}
+
+func handleTusCreate(c *fiber.Ctx) error {
+	if c.Get("Upload-Defer-Length") != "" {
+		return c.Status(400).SendString("Upload-Defer-Length is not supported")
+	}
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return c.Status(400).SendString("Upload-Length must be a positive integer")
+	}
+	if length > maxUpload {
+		return c.Status(413).SendString(fmt.Sprintf("File too large. Maximum size is %s", formatBytes(maxUpload)))
+	}
+	if quotaErr := checkUploadQuota(c.IP(), length); quotaErr != nil {
+		return c.Status(quotaErr.status).SendString(quotaErr.message)
+	}
+
+	metadata := parseTusMetadata(c.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	mimeType := metadata["filetype"]
+	if mimeType == "" {
+		mimeType = metadata["type"]
+	}
+	if err := checkFileType(sanitizeFilename(filename), mimeType); err != nil {
+		return c.Status(415).SendString(err.Error())
+	}
+
+	upload := TusUpload{
+		UploadID:  generateUniqueID(),
+		Filename:  sanitizeFilename(filename),
+		MimeType:  mimeType,
+		Length:    length,
+		IPAddress: storedIP(c.IP()),
+		UserID:    currentUserID(c),
+		APIKeyID:  currentAPIKeyID(c),
+	}
+
+	if result := db.Create(&upload); result.Error != nil {
+		return c.Status(500).SendString("Failed to create upload")
+	}
+
+	// Keep the client on the API version it created the upload under
+	prefix, _, _ := splitAPIPath(c.Path())
+	c.Set("Location", fmt.Sprintf("%s%s/tus/%s", getBaseURL(c), prefix, upload.UploadID))
+	c.Set("Upload-Offset", "0")
+	return c.SendStatus(201)
+}
+
+func handleTusHead(c *fiber.Ctx) error {
+	var upload TusUpload
+	if result := db.Where("upload_id = ?", c.Params("id")).First(&upload); result.Error != nil {
+		return c.SendStatus(404)
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.UniqueID != "" {
+		if link := tusDownloadURL(c, &upload); link != "" {
+			c.Set("Upload-Download-URL", link)
+		}
+	}
+	return c.SendStatus(200)
+}
+
+func handleTusPatch(c *fiber.Ctx) error {
+	if c.Get("Content-Type") != "application/offset+octet-stream" {
+		return c.Status(415).SendString("Content-Type must be application/offset+octet-stream")
+	}
+
+	uploadID := c.Params("id")
+	lock, _ := tusLocks.LoadOrStore(uploadID, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	if !mu.TryLock() {
+		return c.Status(423).SendString("Upload is locked by another request")
+	}
+	defer mu.Unlock()
+
+	var upload TusUpload
+	if result := db.Where("upload_id = ?", uploadID).First(&upload); result.Error != nil {
+		return c.SendStatus(404)
+	}
+	if upload.UniqueID != "" {
+		return c.Status(409).SendString("Upload is already complete")
+	}
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		return c.Status(409).SendString("Upload-Offset does not match the current offset")
+	}
+
+	// Every byte arrived but finishing failed: try again
+	remaining := upload.Length - upload.Offset
+	if remaining == 0 {
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		return completeTusUpload(c, &upload)
+	}
+
+	lastPart := len(splitList(upload.Parts)) >= maxTusParts-1
+
+	// Hold off while too many uploads are in flight or the disk is full
+	ticket, refusal := admitUpload(remaining)
+	if refusal != nil {
+		return refuseUpload(c, refusal)
+	}
+	defer ticket.release()
+
+	// Keep whatever arrived even if the client disconnects midway, so it can
+	// resume from the new offset
+	stagedPath := newStagingPath()
+	f, err := os.Create(stagedPath)
+	if err != nil {
+		return c.Status(500).SendString("Failed to store upload data")
+	}
+	written, copyErr := io.Copy(f, io.LimitReader(uploadThrottle().reader(c.Context().RequestBodyStream()), remaining))
+	if closeErr := f.Close(); closeErr != nil {
+		written, copyErr = 0, closeErr
+	}
+	if written == 0 {
+		os.Remove(stagedPath)
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		if copyErr != nil {
+			return c.Status(500).SendString("Failed to store upload data")
+		}
+		return c.SendStatus(204)
+	}
+	if lastPart && written < remaining {
+		os.Remove(stagedPath)
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		return c.Status(413).SendString(fmt.Sprintf("Upload has %d parts; send the remaining %d bytes in one PATCH", maxTusParts-1, remaining))
+	}
+
+	part := strconv.FormatInt(upload.Offset, 10) + "-" + generateUniqueID()[:8]
+	if err := persistStaged(tusPartKey(uploadID, part), stagedPath, written); err != nil {
+		requestLog(c).Error("Failed to store tus upload data", "upload_id", uploadID, "error", err)
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		return c.Status(500).SendString("Failed to store upload data")
+	}
+
+	// Record the part only if no other request moved the offset meanwhile,
+	// e.g. one sent to another instance
+	parts := upload.Parts
+	if parts != "" {
+		parts += ","
+	}
+	parts += part
+	result := db.Model(&TusUpload{}).
+		Where("id = ?", upload.ID).
+		Where(map[string]interface{}{"offset": upload.Offset}).
+		Updates(map[string]interface{}{"offset": upload.Offset + written, "parts": parts})
+	if result.Error != nil || result.RowsAffected == 0 {
+		fileStorage.Delete(tusPartKey(uploadID, part))
+		db.Where("upload_id = ?", uploadID).First(&upload)
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		if result.Error != nil {
+			return c.Status(500).SendString("Failed to store upload data")
+		}
+		return c.Status(409).SendString("Upload-Offset does not match the current offset")
+	}
+	upload.Offset += written
+	upload.Parts = parts
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+	if copyErr != nil {
+		return c.Status(500).SendString("Failed to store upload data")
+	}
+
+	if upload.Offset == upload.Length {
+		return completeTusUpload(c, &upload)
+	}
+	return c.SendStatus(204)
+}
+
+// completeTusUpload answers the PATCH that brought an upload to its full
+// length, finishing it.
+func completeTusUpload(c *fiber.Ctx, upload *TusUpload) error {
+	deleteToken, err := finishTusUpload(c, upload)
+	var typeErr *fileTypeError
+	if errors.As(err, &typeErr) {
+		removeTusUpload(upload)
+		return c.Status(415).SendString(typeErr.Error())
+	}
+	if err != nil {
+		requestLog(c).Error("Failed to finish tus upload", "upload_id", upload.UploadID, "error", err)
+		return c.Status(500).SendString("Failed to save file")
+	}
+	c.Set("Upload-Download-URL", tusDownloadURL(c, upload))
+	c.Set("Upload-Delete-Token", deleteToken)
+	return c.SendStatus(204)
+}
+
+// finishTusUpload hands a fully received upload over to storage and registers
+// it as a regular file, returning its deletion token.
+func finishTusUpload(c *fiber.Ctx, upload *TusUpload) (string, error) {
+	// Join the parts into one staged file so it is hashed (and encrypted at
+	// rest) like any other upload
+	partKeys := upload.partKeys()
+	parts := &blobSequence{keys: partKeys}
+	defer parts.Close()
+	stagedPath := newStagingPath()
+	staged, err := saveStream(stagedPath, parts)
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
+
+	if err := checkMimeType(staged.MimeType); err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
+
+	uniqueID := newFileID()
+	ext := filepath.Ext(upload.Filename)
+	if ext == "" {
+		ext = ".bin" // Default extension for files without extension
+	}
+	storageKey := newStorageKey(ext)
+
+	storageKey, nonce, err := storeBlob(storageKey, staged)
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
+
+	deleteToken, deleteTokenHash := newDeleteToken()
+	fileRecord := FileRecord{
+		UniqueID:         uniqueID,
+		OriginalName:     upload.Filename,
+		FilePath:         storageKey,
+		IPFSCID:          blobCID(storageKey),
+		Compression:      staged.Compression,
+		CompressedSize:   staged.CompressedSize,
+		FileSize:         upload.Length,
+		SHA256:           staged.Digest.SHA256,
+		MD5:              staged.Digest.MD5,
+		EncryptionNonce:  nonce,
+		MimeType:         staged.MimeType,
+		DeclaredMimeType: upload.MimeType,
+		Extension:        ext,
+		DeleteToken:      deleteTokenHash,
+		ScanStatus:       initialScanStatus(),
+		Moderation:       initialModeration(),
+		HoldReason:       initialHoldReason(),
+		IPAddress:        storedIP(c.IP()),
+		UserID:           upload.UserID,
+		APIKeyID:         upload.APIKeyID,
+		ExpiresAt:        computeExpiry(staged.Size),
+	}
+
+	if err := createFileRecord(db, &fileRecord); err != nil {
+		// Clean up file if database save fails
+		releaseBlob(storageKey)
+		return "", err
+	}
+	queueScan(fileRecord)
+	logUpload(c, &fileRecord)
+	sendWebhook(c, webhookUploaded, &fileRecord, "")
+
+	// The parts go only now, so an upload that failed to finish can be
+	// finished on a retry
+	for _, key := range partKeys {
+		fileStorage.Delete(key)
+	}
+	upload.UniqueID, upload.Parts = fileRecord.UniqueID, ""
+	db.Model(upload).Updates(map[string]interface{}{"unique_id": fileRecord.UniqueID, "parts": ""})
+	return deleteToken, nil
+}
+
+func handleTusDelete(c *fiber.Ctx) error {
+	var upload TusUpload
+	if result := db.Where("upload_id = ?", c.Params("id")).First(&upload); result.Error != nil {
+		return c.SendStatus(404)
+	}
+
+	removeTusUpload(&upload)
+	return c.SendStatus(204)
+}
+
+// tusDownloadURL returns the download link of a completed upload, signed
+// when links must be, or "" once its file is gone.
+func tusDownloadURL(c *fiber.Ctx, upload *TusUpload) string {
+	var fileRecord FileRecord
+	if err := db.Where("unique_id = ?", upload.UniqueID).First(&fileRecord).Error; err != nil {
+		return ""
+	}
+	return signLink(getBaseURL(c)+fileRecord.downloadPath(), &fileRecord)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs, where the value may be omitted.
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+		value := ""
+		if len(parts) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestTusPartLimit(t *testing.T) {
+	app := fiber.New(fiber.Config{StreamRequestBody: true})
+	app.Patch("/api/tus/:id", handleTusPatch)
+
+	// Parts stand in for PATCHes already received; none is ever read
+	names := make([]string, maxTusParts-2)
+	for i := range names {
+		names[i] = "0-test"
+	}
+	upload := TusUpload{
+		UploadID: generateUniqueID(),
+		Filename: "parts.bin",
+		Length:   20,
+		Offset:   10,
+		Parts:    strings.Join(names, ","),
+	}
+	if err := db.Create(&upload).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer removeTusUpload(&upload)
+
+	patch := func(offset, body string) (int, string) {
+		req := httptest.NewRequest("PATCH", "/api/tus/"+upload.UploadID, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", offset)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Upload-Offset")
+	}
+
+	// One part short of the limit, a partial PATCH still goes in
+	if status, offset := patch("10", "12345"); status != 204 || offset != "15" {
+		t.Fatalf("PATCH below the limit: got %d at offset %s, want 204 at 15", status, offset)
+	}
+
+	// The last part has to finish the upload
+	if status, offset := patch("15", "123"); status != 413 || offset != "15" {
+		t.Fatalf("partial last PATCH: got %d at offset %s, want 413 at 15", status, offset)
+	}
+	db.First(&upload, upload.ID)
+	if upload.Offset != 15 || len(upload.partKeys()) != maxTusParts-1 {
+		t.Errorf("refused PATCH was recorded: offset %d with %d parts", upload.Offset, len(upload.partKeys()))
+	}
+}
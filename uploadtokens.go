@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Upload tokens, for web apps and browser extensions that upload straight
+// from the client. Their backend, holding an API key (or a signed-in user),
+// asks POST /api/token for a token that lasts minutes rather than forever,
+// carries only the upload scope (read too, if asked for) and can be bound to
+// the page's origin, and hands it to the browser in place of the key. The
+// token goes wherever an API key does, or as "Authorization: Bearer ut_...",
+// and its uploads belong to whoever it was issued to, though the token
+// can't manage them (see ownsUpload). Tokens are signed with
+// SIGNED_URL_SECRET rather than stored, so they can't be revoked one by one:
+// revoking the key that issued them does that. Without the secret set none
+// are issued, as they'd stop working on restart and on other replicas.
+
+const (
+	uploadTokenPrefix     = "ut_"
+	defaultUploadTokenTTL = 10 * time.Minute
+	maxUploadTokenTTL     = 24 * time.Hour
+)
+
+// uploadTokenClaims is what an upload token says about itself.
+type uploadTokenClaims struct {
+	KeyID   uint   `json:"k,omitempty"` // issuing API key; 0 with UserID 0 for API_KEY
+	UserID  uint   `json:"u,omitempty"` // issuing user
+	Expires int64  `json:"e"`
+	Scopes  string `json:"s"`
+	Origin  string `json:"o,omitempty"` // the only Origin it's accepted from
+}
+
+func uploadTokenSignature(payload string) string {
+	mac := hmac.New(sha256.New, signedURLSecret)
+	fmt.Fprintf(mac, "upload-token:%s", payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func issueUploadToken(claims uploadTokenClaims) string {
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return uploadTokenPrefix + payload + "." + uploadTokenSignature(payload)
+}
+
+// parseUploadToken checks an upload token's signature and expiry.
+func parseUploadToken(token string) (*uploadTokenClaims, bool) {
+	payload, signature, ok := strings.Cut(strings.TrimPrefix(token, uploadTokenPrefix), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(uploadTokenSignature(payload))) {
+		return nil, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, false
+	}
+	var claims uploadTokenClaims
+	if json.Unmarshal(data, &claims) != nil || time.Now().Unix() >= claims.Expires {
+		return nil, false
+	}
+	return &claims, true
+}
+
+// uploadTokenKey resolves an upload token sent with the request to the key
+// it stands for: the issuing key cut down to the token's scopes, or for a
+// user's token a key-less stand-in with the user signed in. It returns nil
+// when the token is invalid, expired, from another origin or its issuer is
+// gone.
+func uploadTokenKey(c *fiber.Ctx, token string) *APIKey {
+	claims, ok := parseUploadToken(token)
+	if !ok || (claims.Origin != "" && c.Get(fiber.HeaderOrigin) != claims.Origin) {
+		return nil
+	}
+	c.Locals("upload_token", true)
+
+	scopes := strings.Split(claims.Scopes, ",")
+	switch {
+	case claims.UserID != 0:
+		var user User
+		if !accountsEnabled() || db.First(&user, claims.UserID).Error != nil {
+			return nil
+		}
+		c.Locals("user", &user)
+		return &APIKey{Label: "upload token", Scopes: claims.Scopes}
+	case claims.KeyID != 0:
+		var issuer APIKey
+		if db.First(&issuer, claims.KeyID).Error != nil || !issuer.active() {
+			return nil
+		}
+		key := issuer
+		key.Scopes = strings.Join(intersectScopes(scopes, issuer.Scopes), ",")
+		return &key
+	default:
+		if apiKey == "" {
+			return nil
+		}
+		return &APIKey{Label: "upload token", Scopes: strings.Join(intersectScopes(scopes, legacyAPIKey.Scopes), ",")}
+	}
+}
+
+// intersectScopes is the scopes of wanted found in have (comma-separated).
+func intersectScopes(wanted []string, have string) []string {
+	held := strings.Split(have, ",")
+	var scopes []string
+	for _, scope := range wanted {
+		if containsString(held, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// handleIssueUploadToken is POST /api/token: {"expires_in": "10m",
+// "scopes": ["upload"], "origin": "https://app.example.com"}, all optional.
+// It takes an API key with the upload scope, or a signed-in user; not
+// another upload token.
+func handleIssueUploadToken(c *fiber.Ctx) error {
+	if !signedURLSecretIsSet {
+		return apiError(c, 404, "Upload tokens are not enabled on this server")
+	}
+	var req struct {
+		ExpiresIn string   `json:"expires_in" form:"expires_in"`
+		Scopes    []string `json:"scopes" form:"scopes"`
+		Origin    string   `json:"origin" form:"origin"`
+	}
+	if err := c.BodyParser(&req); err != nil && len(c.Body()) > 0 {
+		return apiError(c, 400, "Invalid request body")
+	}
+
+	// Nothing in front of this route need have looked at the key yet, so
+	// the token is checked for here, invalid ones included
+	var claims uploadTokenClaims
+	available := scopeUpload + "," + scopeRead
+	key := requestAPIKey(c)
+	if strings.HasPrefix(providedAPIKey(c), uploadTokenPrefix) {
+		return apiError(c, 403, "Upload tokens can't issue more upload tokens")
+	}
+	if key != nil {
+		if !key.hasScope(scopeUpload) {
+			return apiError(c, 403, "API key lacks the 'upload' scope")
+		}
+		claims.KeyID = key.ID
+		available = key.Scopes
+	} else if user := currentUser(c); user != nil {
+		claims.UserID = user.ID
+	} else {
+		return apiError(c, 401, "Upload tokens are issued to API keys and signed-in users")
+	}
+
+	ttl := defaultUploadTokenTTL
+	if req.ExpiresIn != "" {
+		var err error
+		ttl, err = parseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 || ttl > maxUploadTokenTTL {
+			return apiError(c, 400, fmt.Sprintf("Invalid expires_in '%s': up to %s", req.ExpiresIn, formatDuration(maxUploadTokenTTL)))
+		}
+	}
+	claims.Expires = time.Now().Add(ttl).Unix()
+
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{scopeUpload}
+	}
+	for _, scope := range req.Scopes {
+		if scope != scopeUpload && scope != scopeRead {
+			return apiError(c, 400, fmt.Sprintf("Invalid scope '%s': upload tokens can have upload and read", scope))
+		}
+	}
+	scopes := intersectScopes(req.Scopes, available)
+	if len(scopes) != len(req.Scopes) {
+		return apiError(c, 403, "An upload token can't have scopes its issuer lacks")
+	}
+	claims.Scopes = strings.Join(scopes, ",")
+
+	if req.Origin != "" {
+		origin, err := normalizeOrigin(req.Origin)
+		if err != nil || origin == "*" {
+			return apiError(c, 400, fmt.Sprintf("Invalid origin '%s': expected e.g. https://app.example.com", req.Origin))
+		}
+		claims.Origin = origin
+	}
+
+	requestLog(c).Info("Upload token issued", "key_id", claims.KeyID, "user_id", claims.UserID, "scopes", claims.Scopes, "origin", claims.Origin)
+	return c.Status(201).JSON(fiber.Map{
+		"success":    true,
+		"token":      issueUploadToken(claims),
+		"expires_at": time.Unix(claims.Expires, 0).UTC(),
+		"scopes":     scopes,
+		"origin":     claims.Origin,
+	})
+}
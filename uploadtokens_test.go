@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// withUploadTokens turns upload tokens on, with a known secret, and API keys
+// on for the rest of the test.
+func withUploadTokens(t *testing.T) {
+	t.Helper()
+	savedSecret, savedSet, savedRequired := signedURLSecret, signedURLSecretIsSet, apiKeyRequired
+	signedURLSecret, signedURLSecretIsSet, apiKeyRequired = []byte("test token secret"), true, true
+	t.Cleanup(func() {
+		signedURLSecret, signedURLSecretIsSet, apiKeyRequired = savedSecret, savedSet, savedRequired
+	})
+}
+
+func TestParseUploadToken(t *testing.T) {
+	withUploadTokens(t)
+	valid := uploadTokenClaims{KeyID: 7, Expires: time.Now().Add(time.Minute).Unix(), Scopes: scopeUpload}
+	token := issueUploadToken(valid)
+	payload, signature, _ := strings.Cut(strings.TrimPrefix(token, uploadTokenPrefix), ".")
+
+	forged := func() string {
+		signedURLSecret = []byte("someone else's secret")
+		defer func() { signedURLSecret = []byte("test token secret") }()
+		return issueUploadToken(valid)
+	}()
+	widened := valid
+	widened.Scopes = scopeUpload + "," + scopeRead
+	widenedPayload, _, _ := strings.Cut(strings.TrimPrefix(issueUploadToken(widened), uploadTokenPrefix), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{"valid", token, true},
+		{"expired", issueUploadToken(uploadTokenClaims{KeyID: 7, Expires: time.Now().Add(-time.Second).Unix(), Scopes: scopeUpload}), false},
+		{"forged signature", forged, false},
+		{"claims changed", uploadTokenPrefix + widenedPayload + "." + signature, false},
+		{"signature cut short", uploadTokenPrefix + payload + "." + signature[:len(signature)-1], false},
+		{"no signature", uploadTokenPrefix + payload, false},
+		{"not base64", uploadTokenPrefix + "!!." + uploadTokenSignature("!!"), false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, ok := parseUploadToken(tt.token)
+			if ok != tt.want {
+				t.Fatalf("parseUploadToken ok = %v, want %v", ok, tt.want)
+			}
+			if ok && (claims.KeyID != valid.KeyID || claims.Scopes != valid.Scopes) {
+				t.Errorf("claims = %+v, want %+v", *claims, valid)
+			}
+		})
+	}
+}
+
+func TestUploadTokenRoutes(t *testing.T) {
+	withUploadTokens(t)
+	issuer := APIKey{Label: "token issuer", KeyHash: hashAPIKey(apiKeyPrefix + "token-issuer"), Scopes: scopeUpload + "," + scopeRead}
+	if err := db.Create(&issuer).Error; err != nil {
+		t.Fatal(err)
+	}
+	uploadOnly := issueUploadToken(uploadTokenClaims{KeyID: issuer.ID, Expires: time.Now().Add(time.Minute).Unix(), Scopes: scopeUpload})
+	bound := issueUploadToken(uploadTokenClaims{KeyID: issuer.ID, Expires: time.Now().Add(time.Minute).Unix(), Scopes: scopeUpload, Origin: "https://app.example.com"})
+	expired := issueUploadToken(uploadTokenClaims{KeyID: issuer.ID, Expires: time.Now().Add(-time.Minute).Unix(), Scopes: scopeUpload})
+
+	app := fiber.New()
+	ok := func(c *fiber.Ctx) error { return c.SendString("ok") }
+	app.Post("/api/upload", requireAPIKey(scopeUpload), ok)
+	app.Get("/api/files", requireAPIKey(scopeRead), ok)
+	app.Post("/api/token", handleIssueUploadToken) // as setupAPIRoutes has it
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		origin     string
+		wantStatus int
+	}{
+		{"upload", "POST", "/api/upload", uploadOnly, "", 200},
+		{"read without the read scope", "GET", "/api/files", uploadOnly, "", 403},
+		{"issuing another token", "POST", "/api/token", uploadOnly, "", 403},
+		{"expired token issuing another", "POST", "/api/token", expired, "", 403},
+		{"the issuing key", "POST", "/api/token", apiKeyPrefix + "token-issuer", "", 201},
+		{"expired", "POST", "/api/upload", expired, "", 401},
+		{"from its origin", "POST", "/api/upload", bound, "https://app.example.com", 200},
+		{"from another origin", "POST", "/api/upload", bound, "https://evil.example.com", 401},
+		{"without an origin", "POST", "/api/upload", bound, "", 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if strings.HasPrefix(tt.token, uploadTokenPrefix) {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			} else {
+				req.Header.Set("X-API-Key", tt.token)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	// Revoking the issuing key takes its tokens with it
+	db.Model(&issuer).Update("revoked", true)
+	req := httptest.NewRequest("POST", "/api/upload", nil)
+	req.Header.Set("Authorization", "Bearer "+uploadOnly)
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != 401 {
+		t.Errorf("token of a revoked key: status %v (err %v), want 401", resp.StatusCode, err)
+	}
+}
+
+func TestUploadTokenDoesNotOwnIssuerFiles(t *testing.T) {
+	withUploadTokens(t)
+	savedRequired := signedURLsRequired
+	signedURLsRequired = true
+	defer func() { signedURLsRequired = savedRequired }()
+
+	const secret = apiKeyPrefix + "file-owner"
+	issuer := APIKey{Label: "file owner", KeyHash: hashAPIKey(secret), Scopes: scopeUpload + "," + scopeRead}
+	if err := db.Create(&issuer).Error; err != nil {
+		t.Fatal(err)
+	}
+	fileRecord := newTestFile(t, 4, 5)
+	db.Model(fileRecord).Update("api_key_id", issuer.ID)
+	token := issueUploadToken(uploadTokenClaims{KeyID: issuer.ID, Expires: time.Now().Add(time.Minute).Unix(), Scopes: scopeUpload + "," + scopeRead})
+
+	app := fiber.New()
+	app.Post("/api/files/:id/sign", requireAPIKey(scopeUpload), handleSignFile)
+	app.Get("/api/files/:id/downloads", requireAPIKey(scopeRead), handleFileDownloads)
+	app.Get("/d/:filename", handleFileDownload)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		keyCheck bool // try the issuing key too; a download would use one up
+	}{
+		{"sign", "POST", "/api/files/" + fileRecord.UniqueID + "/sign", true},
+		{"download log", "GET", "/api/files/" + fileRecord.UniqueID + "/downloads", true},
+		{"unsigned download", "GET", "/d/" + fileRecord.UniqueID + ".bin", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != 403 {
+				t.Errorf("%s %s with an upload token = %d, want 403", tt.method, tt.path, resp.StatusCode)
+			}
+
+			// The issuing key itself owns the file
+			if !tt.keyCheck {
+				return
+			}
+			req = httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("X-API-Key", secret)
+			if resp, err = app.Test(req); err != nil || resp.StatusCode != 200 {
+				t.Errorf("%s %s with the issuing key = %d (err %v), want 200", tt.method, tt.path, resp.StatusCode, err)
+			}
+		})
+	}
+}
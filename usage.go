@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Usage accounting per API key, user and uploader IP. Every upload and
+// download adds to an hourly counter row per subject, so usage over any
+// window is a sum over a few rows instead of a scan of the files table.
+// Downloads and the bandwidth they use are charged to whoever uploaded the
+// file.
+
+const (
+	usageByKey  = "key"
+	usageByUser = "user"
+	usageByIP   = "ip"
+)
+
+var allUsageSubjects = []string{usageByKey, usageByUser, usageByIP}
+
+// usageRetention is how long hourly usage rows are kept (0 = forever).
+var usageRetention time.Duration
+
+// UsageStat is one subject's traffic during one hour.
+type UsageStat struct {
+	ID            uint      `json:"-" gorm:"primaryKey"`
+	SubjectType   string    `json:"subject_type" gorm:"size:8;not null;uniqueIndex:idx_usage_subject_hour,priority:1"`
+	Subject       string    `json:"subject" gorm:"size:64;not null;uniqueIndex:idx_usage_subject_hour,priority:2"`
+	Hour          time.Time `json:"hour" gorm:"not null;uniqueIndex:idx_usage_subject_hour,priority:3;index"`
+	Uploads       int64     `json:"uploads"`
+	BytesUploaded int64     `json:"bytes_uploaded"`
+	Downloads     int64     `json:"downloads"`
+	BytesServed   int64     `json:"bytes_served"`
+}
+
+// loadUsageConfig reads USAGE_RETENTION (default 90 days).
+func loadUsageConfig() {
+	retentionStr := getEnv("USAGE_RETENTION", "90D")
+	var err error
+	usageRetention, err = parseDuration(retentionStr)
+	if err != nil {
+		log.Printf("Invalid USAGE_RETENTION value '%s', using default 90 days", retentionStr)
+		usageRetention = 90 * 24 * time.Hour
+	}
+}
+
+// usageSubjects returns the subjects a file's traffic is charged to.
+func usageSubjects(fileRecord *FileRecord) [][2]string {
+	var subjects [][2]string
+	if fileRecord.IPAddress != "" { // scrubbed, see METADATA_RETENTION
+		subjects = append(subjects, [2]string{usageByIP, fileRecord.IPAddress})
+	}
+	if fileRecord.APIKeyID != nil {
+		subjects = append(subjects, [2]string{usageByKey, strconv.FormatUint(uint64(*fileRecord.APIKeyID), 10)})
+	}
+	if fileRecord.UserID != nil {
+		subjects = append(subjects, [2]string{usageByUser, strconv.FormatUint(uint64(*fileRecord.UserID), 10)})
+	}
+	return subjects
+}
+
+// addUsage adds to the current hour's counters of everyone fileRecord's
+// traffic is charged to.
+func addUsage(fileRecord *FileRecord, counters UsageStat) {
+	addDailyStat(DailyStat{
+		Uploads:       counters.Uploads,
+		BytesUploaded: counters.BytesUploaded,
+		Downloads:     counters.Downloads,
+		BytesServed:   counters.BytesServed,
+	})
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	for _, subject := range usageSubjects(fileRecord) {
+		row := UsageStat{SubjectType: subject[0], Subject: subject[1], Hour: hour}
+		if err := db.Where(row).FirstOrCreate(&row).Error; err != nil {
+			// Lost the race to create the row, which now exists
+			if err = db.Where(UsageStat{SubjectType: subject[0], Subject: subject[1], Hour: hour}).First(&row).Error; err != nil {
+				log.Printf("Failed to record usage for %s %s: %v", subject[0], subject[1], err)
+				continue
+			}
+		}
+		db.Model(&row).UpdateColumns(map[string]interface{}{
+			"uploads":        gorm.Expr("uploads + ?", counters.Uploads),
+			"bytes_uploaded": gorm.Expr("bytes_uploaded + ?", counters.BytesUploaded),
+			"downloads":      gorm.Expr("downloads + ?", counters.Downloads),
+			"bytes_served":   gorm.Expr("bytes_served + ?", counters.BytesServed),
+		})
+	}
+}
+
+func recordUploadUsage(fileRecord *FileRecord) {
+	addUsage(fileRecord, UsageStat{Uploads: 1, BytesUploaded: fileRecord.FileSize})
+}
+
+// recordDownloadUsage charges bytes served from fileRecord, counting a
+// download when the response started at the first byte.
+func recordDownloadUsage(fileRecord *FileRecord, bytes int64, countsAsDownload bool) {
+	counters := UsageStat{BytesServed: bytes}
+	if countsAsDownload {
+		counters.Downloads = 1
+	}
+	addUsage(fileRecord, counters)
+}
+
+// pruneUsage drops usage rows older than USAGE_RETENTION.
+func pruneUsage() {
+	if usageRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().UTC().Add(-usageRetention)
+	if result := db.Where("hour < ?", cutoff).Delete(&UsageStat{}); result.RowsAffected > 0 {
+		log.Printf("Pruned %d hourly usage rows older than %s", result.RowsAffected, formatDuration(usageRetention))
+	}
+}
+
+// usageEntry is one subject's usage over the requested window.
+type usageEntry struct {
+	SubjectType   string `json:"subject_type"`
+	Subject       string `json:"subject"`
+	Uploads       int64  `json:"uploads"`
+	BytesUploaded int64  `json:"bytes_uploaded"`
+	Downloads     int64  `json:"downloads"`
+	BytesServed   int64  `json:"bytes_served"`
+	FilesAlive    int64  `json:"files_alive"`
+	BytesAlive    int64  `json:"bytes_alive"`
+}
+
+// ownUsageSubjects returns the subjects the request may see the usage of
+// when it isn't from an admin: its own key, user and IP.
+func ownUsageSubjects(c *fiber.Ctx) map[string]string {
+	own := map[string]string{usageByIP: storedIP(c.IP())}
+	if key := requestAPIKey(c); key != nil && key.ID != 0 {
+		own[usageByKey] = strconv.FormatUint(uint64(key.ID), 10)
+	}
+	if user := currentUser(c); user != nil {
+		own[usageByUser] = strconv.FormatUint(uint64(user.ID), 10)
+	}
+	return own
+}
+
+// collectUsage sums the usage of subjects of type subjectType since since
+// (nil for all time). An empty subject lists the heaviest users, up to limit.
+func collectUsage(subjectType, subject string, since *time.Time, limit int) []usageEntry {
+	query := db.Model(&UsageStat{}).
+		Select("subject_type, subject, SUM(uploads) AS uploads, SUM(bytes_uploaded) AS bytes_uploaded, "+
+			"SUM(downloads) AS downloads, SUM(bytes_served) AS bytes_served").
+		Where("subject_type = ?", subjectType).
+		Group("subject_type, subject")
+	if subject != "" {
+		query = query.Where("subject = ?", subject)
+	}
+	if since != nil {
+		query = query.Where("hour >= ?", *since)
+	}
+
+	var entries []usageEntry
+	query.Order("SUM(bytes_uploaded) + SUM(bytes_served) desc").Limit(limit).Scan(&entries)
+	if subject != "" && len(entries) == 0 {
+		// No traffic in the window, but there may still be files
+		entries = []usageEntry{{SubjectType: subjectType, Subject: subject}}
+	}
+
+	// Files alive are current, whatever the window
+	column := map[string]string{usageByKey: "api_key_id", usageByUser: "user_id", usageByIP: "ip_address"}[subjectType]
+	for i := range entries {
+		db.Model(&FileRecord{}).
+			Select("COUNT(*), COALESCE(SUM(file_size), 0)").
+			Where(column+" = ?", entries[i].Subject).
+			Row().Scan(&entries[i].FilesAlive, &entries[i].BytesAlive)
+	}
+	return entries
+}
+
+// usageBreakdown answers the usage part of GET /api/stats. window is a
+// duration such as 24h or 7D ("all" or empty for all time) and by a list of
+// subject types. Admins see every subject, anyone else only their own.
+func usageBreakdown(c *fiber.Ctx) (fiber.Map, error) {
+	window := c.Query("window", "all")
+	var since *time.Time
+	if window != "all" {
+		duration, err := parseDuration(window)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("Invalid window '%s'", window)
+		}
+		start := time.Now().UTC().Add(-duration).Truncate(time.Hour)
+		since = &start
+	}
+
+	subjectTypes := allUsageSubjects
+	if by := c.Query("by"); by != "" {
+		subjectTypes = splitList(strings.ToLower(by))
+		for _, subjectType := range subjectTypes {
+			if !containsString(allUsageSubjects, subjectType) {
+				return nil, fmt.Errorf("Invalid by '%s' (expected %s)", subjectType, strings.Join(allUsageSubjects, ", "))
+			}
+		}
+	}
+
+	admin := hasValidAdminKey(c)
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+	own := ownUsageSubjects(c)
+
+	usage := make([]usageEntry, 0)
+	for _, subjectType := range subjectTypes {
+		if admin {
+			usage = append(usage, collectUsage(subjectType, "", since, limit)...)
+		} else if subject, ok := own[subjectType]; ok {
+			usage = append(usage, collectUsage(subjectType, subject, since, 1)...)
+		}
+	}
+
+	return fiber.Map{
+		"window": window,
+		"since":  since,
+		"usage":  usage,
+	}, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Webhooks. When WEBHOOK_URL is set, file events are POSTed to it as JSON in
+// the background, signed with WEBHOOK_SECRET so the receiver can check they
+// came from this server. Failed deliveries are retried with exponential
+// backoff; a receiver that stays down loses events rather than stalling
+// uploads.
+
+const (
+	webhookUploaded   = "file.uploaded"
+	webhookDownloaded = "file.downloaded"
+	webhookExpired    = "file.expired"
+	webhookDeleted    = "file.deleted"
+
+	webhookQueueSize = 256
+	webhookWorkers   = 4
+	webhookTimeout   = 10 * time.Second
+)
+
+var allWebhookEvents = []string{webhookUploaded, webhookDownloaded, webhookExpired, webhookDeleted}
+
+var (
+	webhookURL     string
+	webhookSecret  string
+	webhookEvents  map[string]bool
+	webhookRetries int
+	webhookQueue   chan webhookDelivery
+	webhookClient  = &http.Client{Timeout: webhookTimeout}
+)
+
+// webhookPayload is the JSON body of a webhook request.
+type webhookPayload struct {
+	ID          string      `json:"id"`
+	Event       string      `json:"event"`
+	Timestamp   time.Time   `json:"timestamp"`
+	Reason      string      `json:"reason,omitempty"` // why a file expired or who deleted it
+	RequestID   string      `json:"request_id,omitempty"`
+	DownloadURL string      `json:"download_url,omitempty"`
+	File        *FileRecord `json:"file"`
+}
+
+type webhookDelivery struct {
+	id    string
+	event string
+	body  []byte
+}
+
+// loadWebhookConfig reads WEBHOOK_URL, WEBHOOK_SECRET, WEBHOOK_EVENTS and
+// WEBHOOK_MAX_RETRIES and starts the delivery workers.
+func loadWebhookConfig() {
+	webhookURL = getEnv("WEBHOOK_URL", "")
+	if webhookURL == "" {
+		return
+	}
+	if !strings.HasPrefix(webhookURL, "http://") && !strings.HasPrefix(webhookURL, "https://") {
+		log.Printf("Invalid WEBHOOK_URL value '%s', webhooks disabled", webhookURL)
+		webhookURL = ""
+		return
+	}
+	webhookSecret = getEnv("WEBHOOK_SECRET", "")
+	if webhookSecret == "" {
+		log.Printf("WEBHOOK_SECRET is not set, webhook requests will not be signed")
+	}
+
+	webhookEvents = make(map[string]bool)
+	for _, event := range splitList(getEnv("WEBHOOK_EVENTS", strings.Join(allWebhookEvents, ","))) {
+		if !containsString(allWebhookEvents, event) {
+			log.Printf("Unknown webhook event '%s' in WEBHOOK_EVENTS, ignoring it", event)
+			continue
+		}
+		webhookEvents[event] = true
+	}
+
+	retriesStr := getEnv("WEBHOOK_MAX_RETRIES", "5")
+	var err error
+	webhookRetries, err = strconv.Atoi(retriesStr)
+	if err != nil || webhookRetries < 0 {
+		log.Printf("Invalid WEBHOOK_MAX_RETRIES value '%s', using default 5", retriesStr)
+		webhookRetries = 5
+	}
+
+	webhookQueue = make(chan webhookDelivery, webhookQueueSize)
+	for i := 0; i < webhookWorkers; i++ {
+		go deliverWebhooks()
+	}
+
+	events := make([]string, 0, len(webhookEvents))
+	for _, event := range allWebhookEvents {
+		if webhookEvents[event] {
+			events = append(events, event)
+		}
+	}
+	log.Printf("Webhooks enabled: %s (%s)", webhookURL, strings.Join(events, ", "))
+}
+
+// sendWebhook queues event for fileRecord, and posts it to Slack and Discord
+// when they're set up. c is the request that caused it, or nil for
+// background events such as expiry cleanup.
+func sendWebhook(c *fiber.Ctx, event string, fileRecord *FileRecord, reason string) {
+	notifyChat(c, event, fileRecord, reason)
+	if webhookURL == "" || !webhookEvents[event] {
+		return
+	}
+
+	payload := webhookPayload{
+		ID:        utils.UUIDv4(),
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Reason:    reason,
+		File:      fileRecord,
+	}
+	if c != nil {
+		payload.RequestID, _ = c.Locals("request_id").(string)
+		payload.DownloadURL = signLink(getBaseURL(c)+fileRecord.downloadPath(), fileRecord)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook %s: %v", event, err)
+		return
+	}
+
+	select {
+	case webhookQueue <- webhookDelivery{id: payload.ID, event: event, body: body}:
+	default:
+		slog.Warn("Webhook queue full, dropping event", "event", event, "file_id", fileRecord.UniqueID)
+	}
+}
+
+func deliverWebhooks() {
+	for delivery := range webhookQueue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			retry, err := postWebhook(delivery)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= webhookRetries {
+				slog.Error("Webhook delivery failed", "event", delivery.event, "delivery_id", delivery.id,
+					"attempts", attempt+1, "error", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// postWebhook makes one delivery attempt. It reports whether a failure is
+// worth retrying: network errors, 429 and 5xx are, other 4xx answers are not.
+func postWebhook(delivery webhookDelivery) (bool, error) {
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bashupload-webhook/1.0")
+	req.Header.Set("X-Bashupload-Event", delivery.event)
+	req.Header.Set("X-Bashupload-Delivery", delivery.id)
+	if webhookSecret != "" {
+		req.Header.Set("X-Bashupload-Signature", "sha256="+signWebhook(delivery.body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == 429 || resp.StatusCode >= 500
+	return retry, fmt.Errorf("receiver answered %s", resp.Status)
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body under WEBHOOK_SECRET.
+func signWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
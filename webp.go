@@ -0,0 +1,610 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// Lossless WebP (VP8L) encoding, for image transforms asking for
+// format=webp: Go's image packages only decode WebP. The encoder keeps to
+// the parts of the format that pay off most for screenshots and graphics,
+// the subtract-green and predictor transforms, LZ77 backward references and
+// a single set of canonical Huffman codes for the whole image, and leaves
+// out color caches, cross-color transforms and palettes.
+
+const (
+	webpMaxDimension = 1 << 14
+	// Predictor modes are chosen per 16x16 tile
+	webpPredictorBits = 4
+	webpMaxLength     = 4096
+	webpMaxDistance   = 1<<20 - 120
+	webpHashChain     = 16
+)
+
+// Predictor modes the encoder picks from, as numbered by the format
+const (
+	webpPredictLeft       = 1
+	webpPredictTop        = 2
+	webpPredictSelect     = 11
+	webpPredictClampedAdd = 12
+)
+
+var webpPredictorModes = []int{webpPredictLeft, webpPredictTop, webpPredictSelect, webpPredictClampedAdd}
+
+// Order the code length code lengths are stored in
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// encodeWebP writes img to w as a lossless WebP image.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > webpMaxDimension || height > webpMaxDimension {
+		return errors.New("webp: image must be between 1x1 and 16384x16384 pixels")
+	}
+
+	// WebP stores straight, not premultiplied, alpha
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	pix := make([]uint32, width*height)
+	alphaUsed := false
+	for i := range pix {
+		p := nrgba.Pix[4*i : 4*i+4]
+		pix[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		alphaUsed = alphaUsed || p[3] != 0xff
+	}
+
+	bw := &webpBitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alphaUsed {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// Subtract green, then predict each pixel from its neighbours; the
+	// decoder undoes them in reverse
+	for i, argb := range pix {
+		green := (argb >> 8) & 0xff
+		red := (argb>>16 - green) & 0xff
+		blue := (argb - green) & 0xff
+		pix[i] = argb&0xff00ff00 | red<<16 | blue
+	}
+	bw.write(1, 1)
+	bw.write(2, 2)
+
+	residuals, modes := webpPredict(pix, width, height)
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(webpPredictorBits-2, 3)
+	webpWriteImage(bw, modes, webpTiles(width), false)
+	bw.write(0, 1)
+
+	webpWriteImage(bw, residuals, width, true)
+	data := bw.bytes()
+
+	padded := len(data) + len(data)%2
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+padded))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(data) < padded {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func webpTiles(size int) int {
+	return (size + 1<<webpPredictorBits - 1) >> webpPredictorBits
+}
+
+// webpPredict applies the predictor transform: every tile gets the mode
+// leaving the smallest residuals. It returns the residuals and the image of
+// modes, one pixel per tile with the mode in green.
+func webpPredict(pix []uint32, width, height int) ([]uint32, []uint32) {
+	tilesX, tilesY := webpTiles(width), webpTiles(height)
+	modes := make([]uint32, tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			best, bestCost := webpPredictLeft, -1
+			for _, mode := range webpPredictorModes {
+				cost := 0
+				for y := ty << webpPredictorBits; y < min(height, (ty+1)<<webpPredictorBits); y++ {
+					for x := tx << webpPredictorBits; x < min(width, (tx+1)<<webpPredictorBits); x++ {
+						cost += webpResidualCost(webpSub(pix[y*width+x], webpPrediction(pix, width, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesX+tx] = uint32(best) << 8
+		}
+	}
+
+	residuals := make([]uint32, len(pix))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mode := int(modes[(y>>webpPredictorBits)*tilesX+x>>webpPredictorBits] >> 8)
+			residuals[y*width+x] = webpSub(pix[y*width+x], webpPrediction(pix, width, x, y, mode))
+		}
+	}
+	return residuals, modes
+}
+
+// webpPrediction is what the decoder predicts for the pixel at x, y: opaque
+// black for the first pixel, the left neighbour along the top row, the top
+// one down the left column, and mode elsewhere.
+func webpPrediction(pix []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return pix[i-1]
+	case x == 0:
+		return pix[i-width]
+	}
+	left, top, topLeft := pix[i-1], pix[i-width], pix[i-width-1]
+	switch mode {
+	case webpPredictLeft:
+		return left
+	case webpPredictTop:
+		return top
+	case webpPredictSelect:
+		// Whichever of left and top is closer to the gradient's estimate
+		leftDistance, topDistance := 0, 0
+		for shift := 0; shift < 32; shift += 8 {
+			l, t, tl := int(left>>shift&0xff), int(top>>shift&0xff), int(topLeft>>shift&0xff)
+			leftDistance += abs(tl - t)
+			topDistance += abs(tl - l)
+		}
+		if leftDistance < topDistance {
+			return left
+		}
+		return top
+	case webpPredictClampedAdd:
+		var out uint32
+		for shift := 0; shift < 32; shift += 8 {
+			v := int(left>>shift&0xff) + int(top>>shift&0xff) - int(topLeft>>shift&0xff)
+			out |= uint32(min(max(v, 0), 255)) << shift
+		}
+		return out
+	}
+	return left
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// webpSub subtracts b from a channel by channel, modulo 256.
+func webpSub(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		out |= ((a>>shift - b>>shift) & 0xff) << shift
+	}
+	return out
+}
+
+// webpResidualCost estimates how costly a residual is to code: how far its
+// channels are from zero.
+func webpResidualCost(residual uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		cost += abs(int(int8(residual >> shift)))
+	}
+	return cost
+}
+
+// webpToken is a literal pixel or, when length > 0, a backward reference.
+type webpToken struct {
+	argb     uint32
+	length   int
+	distance int // distance code, see webpDistanceCode
+}
+
+// webpWriteImage writes an entropy-coded image: the main image when
+// topLevel, or one of a transform's.
+func webpWriteImage(bw *webpBitWriter, pix []uint32, width int, topLevel bool) {
+	bw.write(0, 1) // no color cache
+	if topLevel {
+		bw.write(0, 1) // one set of codes for the whole image
+	}
+
+	tokens := webpBackwardReferences(pix, width)
+	green := make([]uint32, 256+24)
+	red := make([]uint32, 256)
+	blue := make([]uint32, 256)
+	alpha := make([]uint32, 256)
+	distance := make([]uint32, 40)
+	for _, token := range tokens {
+		if token.length > 0 {
+			code, _, _ := webpPrefix(token.length)
+			green[256+code]++
+			code, _, _ = webpPrefix(token.distance)
+			distance[code]++
+			continue
+		}
+		green[token.argb>>8&0xff]++
+		red[token.argb>>16&0xff]++
+		blue[token.argb&0xff]++
+		alpha[token.argb>>24]++
+	}
+
+	greenCode := webpWritePrefixCode(bw, green)
+	redCode := webpWritePrefixCode(bw, red)
+	blueCode := webpWritePrefixCode(bw, blue)
+	alphaCode := webpWritePrefixCode(bw, alpha)
+	distanceCode := webpWritePrefixCode(bw, distance)
+
+	for _, token := range tokens {
+		if token.length > 0 {
+			code, extraBits, extra := webpPrefix(token.length)
+			greenCode.write(bw, 256+code)
+			bw.write(extra, extraBits)
+			code, extraBits, extra = webpPrefix(token.distance)
+			distanceCode.write(bw, code)
+			bw.write(extra, extraBits)
+			continue
+		}
+		greenCode.write(bw, int(token.argb>>8&0xff))
+		redCode.write(bw, int(token.argb>>16&0xff))
+		blueCode.write(bw, int(token.argb&0xff))
+		alphaCode.write(bw, int(token.argb>>24))
+	}
+}
+
+// webpBackwardReferences turns pixels into literals and LZ77 backward
+// references, greedily taking the longest match among the pixel above and
+// recent pixels with the same hash.
+func webpBackwardReferences(pix []uint32, width int) []webpToken {
+	const hashBits = 16
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, len(pix))
+	hash := func(i int) uint32 {
+		return (pix[i]*0x1e35a7bd ^ pix[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < len(pix) {
+			h := hash(i)
+			chain[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	matchLength := func(i, candidate int) int {
+		n := 0
+		for i+n < len(pix) && n < webpMaxLength && pix[candidate+n] == pix[i+n] {
+			n++
+		}
+		return n
+	}
+
+	tokens := make([]webpToken, 0, len(pix)/2)
+	for i := 0; i < len(pix); {
+		bestLength, bestDistance := 0, 0
+		if i >= width {
+			bestLength, bestDistance = matchLength(i, i-width), width
+		}
+		if i+1 < len(pix) {
+			candidate := int(head[hash(i)])
+			for tries := 0; candidate >= 0 && tries < webpHashChain && i-candidate <= webpMaxDistance; tries++ {
+				if n := matchLength(i, candidate); n > bestLength {
+					bestLength, bestDistance = n, i-candidate
+				}
+				candidate = int(chain[candidate])
+			}
+		}
+
+		if bestLength < 3 {
+			tokens = append(tokens, webpToken{argb: pix[i]})
+			insert(i)
+			i++
+			continue
+		}
+		tokens = append(tokens, webpToken{length: bestLength, distance: webpDistanceCode(bestDistance, width)})
+		for end := i + bestLength; i < end; i++ {
+			insert(i)
+		}
+	}
+	return tokens
+}
+
+// webpDistanceCode maps a distance in pixels to the format's distance code:
+// short codes stand for nearby pixels in two dimensions, and larger ones
+// for the distance plus 120.
+func webpDistanceCode(distance, width int) int {
+	switch distance {
+	case width:
+		return 1
+	case 1:
+		return 2
+	}
+	return distance + 120
+}
+
+// webpPrefix splits a length or distance code value into its prefix code
+// and extra bits.
+func webpPrefix(value int) (int, uint, uint32) {
+	v := value - 1
+	if v < 4 {
+		return v, 0, 0
+	}
+	high := bits.Len(uint(v)) - 1
+	second := (v >> (high - 1)) & 1
+	return 2*high + second, uint(high - 1), uint32(v & (1<<(high-1) - 1))
+}
+
+// webpPrefixCode is a Huffman code ready for writing.
+type webpPrefixCode struct {
+	codes   []uint32 // bit-reversed, to be written least significant bit first
+	lengths []uint8  // bits written per symbol
+}
+
+func (p *webpPrefixCode) write(bw *webpBitWriter, symbol int) {
+	bw.write(p.codes[symbol], uint(p.lengths[symbol]))
+}
+
+// webpWritePrefixCode builds the Huffman code for the symbol counts and
+// writes it: as a simple code when at most two symbols below 256 are used,
+// otherwise as code lengths, themselves Huffman coded.
+func webpWritePrefixCode(bw *webpBitWriter, counts []uint32) *webpPrefixCode {
+	var used []int
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+	code := &webpPrefixCode{codes: make([]uint32, len(counts)), lengths: make([]uint8, len(counts))}
+
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.write(uint32(used[1]), 8)
+			code.codes[used[1]], code.lengths[used[0]], code.lengths[used[1]] = 1, 1, 1
+		}
+		return code
+	}
+
+	lengths := webpHuffmanLengths(counts, 15)
+	webpCanonicalCodes(lengths, code)
+	bw.write(0, 1)
+	webpWriteCodeLengths(bw, lengths)
+	return code
+}
+
+// webpWriteCodeLengths writes the code lengths of a Huffman code,
+// run-length encoded and coded with a Huffman code of their own.
+func webpWriteCodeLengths(bw *webpBitWriter, lengths []uint8) {
+	type token struct {
+		symbol, extra int
+	}
+	var tokens []token
+	for i := 0; i < len(lengths); {
+		length := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == length {
+			run++
+		}
+		i += run
+		if length == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				tokens = append(tokens, token{18, n - 11})
+				run -= n
+			}
+			if run >= 3 {
+				tokens = append(tokens, token{17, run - 3})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, token{int(length), 0})
+			run--
+			for run >= 3 {
+				n := min(run, 6)
+				tokens = append(tokens, token{16, n - 3})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{int(length), 0})
+		}
+	}
+
+	counts := make([]uint32, 19)
+	for _, t := range tokens {
+		counts[t.symbol]++
+	}
+	lengthLengths := webpHuffmanLengths(counts, 7)
+	lengthCode := &webpPrefixCode{codes: make([]uint32, 19), lengths: make([]uint8, 19)}
+	webpCanonicalCodes(lengthLengths, lengthCode)
+
+	n := len(webpCodeLengthOrder)
+	for n > 4 && lengthLengths[webpCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	bw.write(uint32(n-4), 4)
+	for _, symbol := range webpCodeLengthOrder[:n] {
+		bw.write(uint32(lengthLengths[symbol]), 3)
+	}
+	bw.write(0, 1) // lengths for the whole alphabet follow
+
+	extraBits := map[int]uint{16: 2, 17: 3, 18: 7}
+	for _, t := range tokens {
+		lengthCode.write(bw, t.symbol)
+		if n, ok := extraBits[t.symbol]; ok {
+			bw.write(uint32(t.extra), n)
+		}
+	}
+}
+
+// webpHuffmanLengths returns Huffman code lengths for the symbol counts, no
+// longer than maxLength. Unused symbols get 0, and a lone used symbol 1.
+func webpHuffmanLengths(counts []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(counts))
+	weights := make([]uint32, len(counts))
+	used := 0
+	for symbol, count := range counts {
+		if count > 0 {
+			weights[symbol] = count
+			used++
+		}
+	}
+	if used == 0 {
+		return lengths
+	}
+	if used == 1 {
+		for symbol, count := range counts {
+			if count > 0 {
+				lengths[symbol] = 1
+			}
+		}
+		return lengths
+	}
+
+	// Flatten the counts until the tree is shallow enough
+	for floor := uint32(1); ; floor *= 2 {
+		if webpHuffmanTree(weights, lengths) <= maxLength {
+			return lengths
+		}
+		for symbol, weight := range weights {
+			if weight > 0 && weight < floor {
+				weights[symbol] = floor
+			}
+		}
+	}
+}
+
+// webpHuffmanTree fills in the depth of each weighted symbol in a Huffman
+// tree and returns the deepest.
+func webpHuffmanTree(weights []uint32, depths []uint8) int {
+	type node struct {
+		weight uint64
+		symbol int // -1 for inner nodes
+		left   int
+		right  int
+	}
+	var nodes []node
+	for symbol, weight := range weights {
+		if weight > 0 {
+			nodes = append(nodes, node{weight: uint64(weight), symbol: symbol})
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	// Two queues: the sorted leaves, and inner nodes, which come out sorted
+	leafCount := len(nodes)
+	leaves, inner := 0, leafCount
+	pick := func() int {
+		if leaves < leafCount && (inner >= len(nodes) || nodes[leaves].weight <= nodes[inner].weight) {
+			leaves++
+			return leaves - 1
+		}
+		inner++
+		return inner - 1
+	}
+	for i := 0; i < leafCount-1; i++ {
+		a := pick()
+		b := pick()
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+	}
+
+	deepest := 0
+	var walk func(i, depth int)
+	walk = func(i, depth int) {
+		if nodes[i].symbol >= 0 {
+			depths[nodes[i].symbol] = uint8(depth)
+			deepest = max(deepest, depth)
+			return
+		}
+		walk(nodes[i].left, depth+1)
+		walk(nodes[i].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+	return deepest
+}
+
+// webpCanonicalCodes assigns canonical codes for the lengths to code. A lone
+// symbol is written with no bits at all, as decoders expect.
+func webpCanonicalCodes(lengths []uint8, code *webpPrefixCode) {
+	var countPerLength [16]uint32
+	used := 0
+	for _, length := range lengths {
+		if length > 0 {
+			countPerLength[length]++
+			used++
+		}
+	}
+	var next [16]uint32
+	for length, c := 1, uint32(0); length < 16; length++ {
+		c = (c + countPerLength[length-1]) << 1
+		next[length] = c
+	}
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		if used == 1 {
+			code.codes[symbol], code.lengths[symbol] = 0, 0
+			continue
+		}
+		c := next[length]
+		next[length]++
+		code.codes[symbol] = bits.Reverse32(c) >> (32 - uint(length))
+		code.lengths[symbol] = length
+	}
+}
+
+// webpBitWriter packs bits least significant first.
+type webpBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nBits uint
+}
+
+func (b *webpBitWriter) write(value uint32, n uint) {
+	b.acc |= uint64(value&(1<<n-1)) << b.nBits
+	b.nBits += n
+	for b.nBits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nBits -= 8
+	}
+}
+
+func (b *webpBitWriter) bytes() []byte {
+	if b.nBits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nBits = 0, 0
+	}
+	return b.buf
+}
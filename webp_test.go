@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	fill := func(w, h int, pixel func(x, y int) color.NRGBA) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.SetNRGBA(x, y, pixel(x, y))
+			}
+		}
+		return img
+	}
+	solid := func(c color.NRGBA) func(x, y int) color.NRGBA {
+		return func(int, int) color.NRGBA { return c }
+	}
+	gradient := func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 7), uint8(y * 3), uint8(x + y), 0xff}
+	}
+	noise := func(int, int) color.NRGBA {
+		return color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff}
+	}
+	noisyAlpha := func(int, int) color.NRGBA {
+		return color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))}
+	}
+	stripes := func(x, y int) color.NRGBA {
+		if (x/4)%2 == 0 {
+			return color.NRGBA{0x20, 0x40, 0x80, 0xff}
+		}
+		return color.NRGBA{0xff, 0xff, 0xff, 0x80}
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"1x1", fill(1, 1, solid(color.NRGBA{0x12, 0x34, 0x56, 0xff}))},
+		{"solid", fill(64, 64, solid(color.NRGBA{0xff, 0x00, 0x00, 0xff}))},
+		{"solid transparent", fill(40, 30, solid(color.NRGBA{0, 0, 0, 0}))},
+		{"solid translucent", fill(33, 17, solid(color.NRGBA{0x10, 0x80, 0xf0, 0x40}))},
+		{"gradient", fill(100, 60, gradient)},
+		{"odd size gradient", fill(17, 33, gradient)},
+		{"wide", fill(600, 3, gradient)},
+		{"tall", fill(2, 500, gradient)},
+		{"noise", fill(48, 48, noise)},
+		{"noise with alpha", fill(31, 29, noisyAlpha)},
+		{"stripes with alpha", fill(257, 65, stripes)},
+		{"large repetitive", fill(512, 384, stripes)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := encodeWebP(&out, tt.img); err != nil {
+				t.Fatalf("encodeWebP: %v", err)
+			}
+			decoded, err := webp.Decode(&out)
+			if err != nil {
+				t.Fatalf("decoding the output: %v", err)
+			}
+			if decoded.Bounds() != tt.img.Bounds() {
+				t.Fatalf("decoded bounds %v, want %v", decoded.Bounds(), tt.img.Bounds())
+			}
+			bounds := tt.img.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					want := tt.img.NRGBAAt(x, y)
+					got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+					if want.A == 0 {
+						// Fully transparent pixels have no color to keep
+						got.R, got.G, got.B, want.R, want.G, want.B = 0, 0, 0, 0, 0, 0
+					}
+					if got != want {
+						t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeWebPOffsetBounds(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 20, 26, 36))
+	for y := 20; y < 36; y++ {
+		for x := 10; x < 26; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	var out bytes.Buffer
+	if err := encodeWebP(&out, img); err != nil {
+		t.Fatalf("encodeWebP: %v", err)
+	}
+	decoded, err := webp.Decode(&out)
+	if err != nil {
+		t.Fatalf("decoding the output: %v", err)
+	}
+	if got := decoded.Bounds(); got != image.Rect(0, 0, 16, 16) {
+		t.Fatalf("decoded bounds %v, want 16x16 at the origin", got)
+	}
+	if got, want := color.NRGBAModel.Convert(decoded.At(3, 4)), (color.NRGBA{13, 24, 0x80, 0xff}); got != want {
+		t.Errorf("pixel (3, 4) = %v, want %v", got, want)
+	}
+}
+
+func TestEncodeWebPRefusesBadSizes(t *testing.T) {
+	for _, rect := range []image.Rectangle{
+		image.Rect(0, 0, 0, 10),
+		image.Rect(0, 0, webpMaxDimension+1, 1),
+	} {
+		if err := encodeWebP(&bytes.Buffer{}, image.NewNRGBA(rect)); err == nil {
+			t.Errorf("encodeWebP accepted a %dx%d image", rect.Dx(), rect.Dy())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// On-the-fly zips. GET /zip?ids=a,b,c sends several uploads as one zip,
+// streamed like a bundle's, so whoever was given a handful of links can grab
+// them all at once. Every file has to be available: one that is missing,
+// expired, used up or blocked fails the whole request rather than leaving a
+// hole in the archive. Each file counts one download.
+
+const maxZipFiles = 100
+
+// handleZipDownload is GET /zip?ids=a,b,c. IDs may carry the link's
+// extension or be slugs. ?password= (or X-File-Password) opens the
+// password-protected files among them.
+func handleZipDownload(c *fiber.Ctx) error {
+	var ids []string
+	for _, id := range splitList(c.Query("ids")) {
+		id = strings.TrimSuffix(id, filepath.Ext(id))
+		if !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return c.Status(400).SendString("Give the files to zip with ?ids=a,b,c")
+	}
+	if len(ids) > maxZipFiles {
+		return c.Status(400).SendString(fmt.Sprintf("At most %d files can be zipped at once", maxZipFiles))
+	}
+
+	files := make([]FileRecord, 0, len(ids))
+	for _, id := range ids {
+		var fileRecord FileRecord
+		if err := findFile(id, &fileRecord); err != nil {
+			return c.Status(404).SendString(fmt.Sprintf("File %s not found", id))
+		}
+		// A signature covers a single file, so only the owner can zip files
+		// that need one
+		if signedURLsRequired && !ownsUpload(c, fileRecord.UserID, fileRecord.APIKeyID) {
+			return c.Status(403).SendString(fmt.Sprintf("File %s needs a signed link; download it on its own", id))
+		}
+		if fileRecord.ExpiresAt != nil && time.Now().After(*fileRecord.ExpiresAt) {
+			return c.Status(404).SendString(fmt.Sprintf("File %s has expired", id))
+		}
+		if _, err := statBlob(fileRecord.FilePath); err != nil {
+			return c.Status(404).SendString(fmt.Sprintf("File %s not found on disk", id))
+		}
+		if refused, err := refuseUnscanned(c, &fileRecord); refused {
+			return err
+		}
+		if refused, err := refuseHeld(c, &fileRecord); refused {
+			return err
+		}
+		if refused, err := refuseUnreleased(c, &fileRecord); refused {
+			return err
+		}
+		if ok, password := checkFilePassword(c, &fileRecord); !ok {
+			if password != "" {
+				audit(c, auditAuthFailure, fileRecord.UniqueID, "file password")
+				return c.Status(401).SendString(fmt.Sprintf("Wrong password for file %s", id))
+			}
+			return c.Status(401).SendString(fmt.Sprintf("File %s is password-protected; pass ?password= or the X-File-Password header", id))
+		}
+		files = append(files, fileRecord)
+	}
+
+	// Claim every download before sending anything, giving them all back if
+	// one of the files has been used up meanwhile
+	claims := make([]*downloadClaim, 0, len(files))
+	for i := range files {
+		claim := claimDownload(&files[i], c.IP())
+		if claim == nil {
+			refundClaims(claims)
+			return c.Status(410).SendString(fmt.Sprintf("File %s has reached its download limit", files[i].UniqueID))
+		}
+		claim.by(c.IP(), c.Get("User-Agent"))
+		claims = append(claims, claim)
+	}
+	for i := range files {
+		recordDownloadUsage(&files[i], files[i].FileSize, true)
+		audit(c, auditDownload, files[i].UniqueID, "zip")
+		sendWebhook(c, webhookDownloaded, &files[i], "")
+	}
+	requestLog(c).Info("Files downloaded as zip", "files", len(files))
+
+	streamZip(c, "bashupload-files.zip", files, claims, "Zip download")
+	return nil
+}